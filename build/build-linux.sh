@@ -3,6 +3,10 @@
 set -o nounset
 set -o errexit
 
+VERSION=${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}
+COMMIT=${COMMIT:-$(git rev-parse --short HEAD 2>/dev/null || true)}
+LDFLAGS="-X main.version=${VERSION} -X main.commit=${COMMIT}"
+
 echo "Building Linux 64bit:"
-GOOS=linux GOARCH=amd64 go build -o bin/tarpon cmd/tarpon/main.go
+GOOS=linux GOARCH=amd64 go build -ldflags "${LDFLAGS}" -o bin/tarpon ./cmd/tarpon
 echo "Done"
\ No newline at end of file
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/montrosesoftware/tarpon/pkg/bench"
+)
+
+func main() {
+	cfg := bench.DefaultConfig()
+	flag.StringVar(&cfg.URL, "url", cfg.URL, "base URL of the server")
+	flag.StringVar(&cfg.Token, "token", os.Getenv("TARPON_ADMIN_TOKEN"), "admin token, TARPON_ADMIN_TOKEN by default")
+	flag.IntVar(&cfg.Rooms, "rooms", cfg.Rooms, "number of rooms")
+	flag.IntVar(&cfg.Peers, "peers", cfg.Peers, "number of peers in every room")
+	flag.StringVar(&cfg.Pattern, "pattern", cfg.Pattern, "traffic pattern, "+bench.Broadcast+" or "+bench.Direct)
+	flag.Float64Var(&cfg.Rate, "rate", cfg.Rate, "messages sent by every peer per second, as many as possible when 0")
+	flag.DurationVar(&cfg.Duration, "duration", cfg.Duration, "how long peers send messages")
+	flag.IntVar(&cfg.Messages, "messages", cfg.Messages, "number of messages sent by every peer, unlimited when 0")
+	flag.IntVar(&cfg.PayloadSize, "payload-size", cfg.PayloadSize, "size of padding in payloads in bytes")
+	flag.DurationVar(&cfg.Grace, "grace", cfg.Grace, "how long to wait for deliveries after peers stop sending")
+	inProcess := flag.Bool("in-process", false, "load an in-process server instead of the one at the URL")
+	flag.Parse()
+
+	if *inProcess {
+		ts := bench.NewLocalServer()
+		defer ts.Close()
+		cfg.URL = ts.URL
+	}
+
+	if err := run(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "tarpon-bench: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run loads the server until the load ends or it's interrupted, and prints the report.
+func run(cfg bench.Config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	fmt.Fprintf(os.Stderr, "loading %s with %d rooms of %d peers...\n", cfg.URL, cfg.Rooms, cfg.Peers)
+	report, err := bench.Run(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/client"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+)
+
+// defaultURL is the URL of the admin API of a server running locally with the default config
+const defaultURL = "http://localhost:5000"
+
+// roomsCommand lists, creates or deletes rooms or lists their connected peers
+// with the admin API.
+func roomsCommand(args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("rooms: missing command, want list, presence, node, create or delete")
+	}
+
+	cmd, args := args[0], args[1:]
+	flags := flag.NewFlagSet("rooms "+cmd, flag.ExitOnError)
+	newClient := adminFlags(flags, bufio.NewReader(in))
+	switch cmd {
+	case "list":
+		flags.Usage = usageFunc(flags, "rooms list [flags]", "List rooms with numbers of registered and connected peers.")
+		if err := parseArgs(flags, args, 0); err != nil {
+			return err
+		}
+		c, err := newClient()
+		if err != nil {
+			return err
+		}
+		rooms, err := c.ListRooms(context.Background())
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "UID\tPEERS\tONLINE")
+		for _, r := range rooms {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", r.UID, r.Peers, r.Online)
+		}
+		return w.Flush()
+
+	case "presence":
+		flags.Usage = usageFunc(flags, "rooms presence [flags] <uid>", "List peers connected to a room through any instance of the server.")
+		if err := parseArgs(flags, args, 1); err != nil {
+			return err
+		}
+		c, err := newClient()
+		if err != nil {
+			return err
+		}
+		peers, err := c.Presence(context.Background(), flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		for _, uid := range peers {
+			fmt.Fprintln(out, uid)
+		}
+		return nil
+
+	case "node":
+		flags.Usage = usageFunc(flags, "rooms node [flags] <uid>", "Print the ID and URL of the instance of the server owning a room.")
+		if err := parseArgs(flags, args, 1); err != nil {
+			return err
+		}
+		c, err := newClient()
+		if err != nil {
+			return err
+		}
+		node, err := c.Node(context.Background(), flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s %s\n", node.Node, node.URL)
+		return nil
+
+	case "create":
+		flags.Usage = usageFunc(flags, "rooms create [flags] <uid>", "Create a room. Flags override the server's defaults in the room.")
+		historyCount := flags.Int("history-count", 0, "number of messages kept in the room's history")
+		historyAge := flags.Duration("history-age", 0, "how long messages are kept in the room's history")
+		writeWait := flags.Duration("write-wait", 0, "timeout of writes to peers' connections")
+		pongWait := flags.Duration("pong-wait", 0, "how long to wait for a pong from peers")
+		pingPeriod := flags.Duration("ping-period", 0, "how often peers are pinged, less than pong-wait")
+		maxMessageSize := flags.Int("max-message-size", 0, "maximum size of peers' messages in bytes")
+		messagesBufSize := flags.Int("messages-buf-size", 0, "number of messages buffered for every peer")
+		messageRate := flags.Int("message-rate", 0, "number of messages a peer may send per second")
+		messageBurst := flags.Int("message-burst", 0, "number of messages a peer may send at once")
+		maxRateStrikes := flags.Int("max-rate-strikes", 0, "number of rate limited messages after which a peer is disconnected")
+		if err := parseArgs(flags, args, 1); err != nil {
+			return err
+		}
+
+		req := server.CreateRoomReq{UID: flags.Arg(0)}
+		if isSet(flags, "history-count") || isSet(flags, "history-age") {
+			req.History = &server.HistoryLimitsReq{MaxCount: *historyCount, MaxAge: int(historyAge.Seconds())}
+		}
+		conn := server.ConnectionReq{
+			WriteWait:       int(writeWait.Seconds()),
+			PongWait:        int(pongWait.Seconds()),
+			PingPeriod:      int(pingPeriod.Seconds()),
+			MaxMessageSize:  *maxMessageSize,
+			MessagesBufSize: *messagesBufSize,
+			MessageRate:     *messageRate,
+			MessageBurst:    *messageBurst,
+			MaxRateStrikes:  *maxRateStrikes,
+		}
+		if conn != (server.ConnectionReq{}) {
+			req.Connection = &conn
+		}
+		c, err := newClient()
+		if err != nil {
+			return err
+		}
+		if err := c.CreateRoom(context.Background(), req); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "room %s created\n", req.UID)
+		return nil
+
+	case "delete":
+		flags.Usage = usageFunc(flags, "rooms delete [flags] <uid>", "Delete a room and disconnect its peers.")
+		if err := parseArgs(flags, args, 1); err != nil {
+			return err
+		}
+		c, err := newClient()
+		if err != nil {
+			return err
+		}
+		if err := c.DeleteRoom(context.Background(), flags.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "room %s deleted\n", flags.Arg(0))
+		return nil
+	}
+	return fmt.Errorf("rooms: unknown command %q, want list, presence, node, create or delete", cmd)
+}
+
+// peerSecretEnv is the variable which the secret of a registered peer is read
+// from, unless it's read from stdin.
+const peerSecretEnv = "TARPON_PEER_SECRET"
+
+// peersCommand registers peers with the admin API. Secrets aren't arguments, so
+// that they don't show up in process lists and shell history.
+func peersCommand(args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 || args[0] != "register" {
+		return errors.New("peers: missing or unknown command, want register")
+	}
+
+	stdin := bufio.NewReader(in)
+	flags := flag.NewFlagSet("peers register", flag.ExitOnError)
+	newClient := adminFlags(flags, stdin)
+	flags.Usage = usageFunc(flags, "peers register [flags] <room> <uid>",
+		"Register a peer in a room, creating the room if needed. Registering a peer again replaces its secret.\n"+
+			"The secret is read from "+peerSecretEnv+", or from the first line of stdin when it's not set,\n"+
+			"which is the line after the admin token with --token-stdin.")
+	role := flags.String("role", "", "role of the peer, host or none")
+	ttl := flags.Duration("ttl", 0, "how long the secret is valid for, it doesn't expire by default")
+	if err := parseArgs(flags, args[1:], 2); err != nil {
+		return err
+	}
+	// the token comes first on stdin
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	secret, err := readSecret(stdin)
+	if err != nil {
+		return err
+	}
+
+	room := flags.Arg(0)
+	req := server.RegisterPeerReq{UID: flags.Arg(1), Secret: secret, Role: *role}
+	if *ttl > 0 {
+		req.ExpiresAt = time.Now().Add(*ttl).UTC()
+	}
+	created, err := c.RegisterPeer(context.Background(), room, req)
+	if err != nil {
+		return err
+	}
+	if created {
+		fmt.Fprintf(out, "peer %s registered in room %s\n", req.UID, room)
+	} else {
+		fmt.Fprintf(out, "peer %s updated in room %s\n", req.UID, room)
+	}
+	return nil
+}
+
+// readSecret returns the secret set in the environment, or the next line read from stdin.
+func readSecret(stdin *bufio.Reader) (string, error) {
+	if secret := os.Getenv(peerSecretEnv); secret != "" {
+		return secret, nil
+	}
+	secret, err := readLine(stdin)
+	if err != nil {
+		return "", fmt.Errorf("peers register: reading secret failed: %w", err)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("peers register: missing secret, set %s or write it to stdin", peerSecretEnv)
+	}
+	return secret, nil
+}
+
+// readLine returns the next line read from stdin, without surrounding spaces.
+func readLine(stdin *bufio.Reader) (string, error) {
+	line, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// adminTokenEnv is the variable which the admin token is read from, unless it's
+// read from stdin.
+const adminTokenEnv = "TARPON_ADMIN_TOKEN"
+
+// adminFlags adds flags of the admin API's URL, which defaults to TARPON_URL, and
+// of reading the admin token from stdin, and returns a function creating the client
+// once the flags are parsed. Like secrets of peers, the token isn't an argument, so
+// that it doesn't show up in process lists and shell history.
+func adminFlags(flags *flag.FlagSet, stdin *bufio.Reader) func() (*client.Client, error) {
+	url := flags.String("url", "", "base URL of the server, TARPON_URL or "+defaultURL+" by default")
+	tokenStdin := flags.Bool("token-stdin", false, "read the admin token from the first line of stdin instead of "+adminTokenEnv)
+	return func() (*client.Client, error) {
+		token := os.Getenv(adminTokenEnv)
+		if *tokenStdin {
+			var err error
+			if token, err = readLine(stdin); err != nil {
+				return nil, fmt.Errorf("reading admin token failed: %w", err)
+			}
+			if token == "" {
+				return nil, errors.New("missing admin token on stdin")
+			}
+		}
+		return client.New(withDefault(*url, os.Getenv("TARPON_URL"), defaultURL), token), nil
+	}
+}
+
+// parseArgs parses the flags and checks the number of remaining arguments.
+func parseArgs(flags *flag.FlagSet, args []string, n int) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != n {
+		return usageError(flags, fmt.Sprintf("want %d arguments, got %d", n, flags.NArg()))
+	}
+	return nil
+}
+
+// isSet reports whether the flag was given on the command line.
+func isSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// withDefault returns the first value which is not empty.
+func withDefault(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
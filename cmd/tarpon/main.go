@@ -1,29 +1,147 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 
-	"github.com/montrosesoftware/tarpon/pkg/agent"
-	"github.com/montrosesoftware/tarpon/pkg/broker"
 	"github.com/montrosesoftware/tarpon/pkg/config"
-	"github.com/montrosesoftware/tarpon/pkg/instrumentation"
-	"github.com/montrosesoftware/tarpon/pkg/logging"
-	"github.com/montrosesoftware/tarpon/pkg/messaging"
-	"github.com/montrosesoftware/tarpon/pkg/server"
 )
 
+// Build information, set with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = ""
+)
+
+const usage = `Usage: tarpon <command> [arguments]
+
+Commands:
+  serve                                 run the server, the default command
+  config print                          print the config read from the file and environment
+  config validate                       check the config and exit
+  rooms list                            list rooms with numbers of registered and connected peers
+  rooms presence <uid>                  list peers connected to a room
+  rooms node <uid>                      print the instance of the server owning a room
+  rooms create <uid>                    create a room
+  rooms delete <uid>                    delete a room and disconnect its peers
+  peers register <room> <uid>           register a peer in a room with the secret from stdin
+  version                               print the version
+
+Run 'tarpon <command> -h' for flags of the command.
+`
+
 func main() {
-	log.Printf("starting tarpon...")
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "tarpon: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command given in the arguments, reading its input from in and
+// writing its output to out.
+func run(args []string, in io.Reader, out io.Writer) error {
+	// flags without a command run the server, as before there were commands
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help") {
+		return serve(args)
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "serve":
+		return serve(args)
+	case "config":
+		return configCommand(args, out)
+	case "rooms":
+		return roomsCommand(args, in, out)
+	case "peers":
+		return peersCommand(args, in, out)
+	case "version":
+		info := serverBuildInfo()
+		fmt.Fprintf(out, "tarpon %s", info.Version)
+		if info.Commit != "" {
+			fmt.Fprintf(out, " (%s)", info.Commit)
+		}
+		fmt.Fprintf(out, " %s\n", info.GoVersion)
+		return nil
+	case "help", "-h", "--help":
+		fmt.Fprint(out, usage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// configCommand prints or validates the config.
+func configCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("config: missing command, want print or validate")
+	}
+
+	cmd, args := args[0], args[1:]
+	flags := flag.NewFlagSet("config "+cmd, flag.ExitOnError)
+	configPath := configFlag(flags)
+	switch cmd {
+	case "print":
+		flags.Usage = usageFunc(flags, "config print [flags]", "Print the config read from the file and environment.")
+	case "validate":
+		flags.Usage = usageFunc(flags, "config validate [flags]", "Check the config and exit.")
+	default:
+		return fmt.Errorf("config: unknown command %q, want print or validate", cmd)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected arguments")
+	}
+
+	path := configFilePath(*configPath)
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	if cmd == "validate" {
+		if path == "" {
+			path = "environment"
+		}
+		fmt.Fprintf(out, "config from %s is valid\n", path)
+		return nil
+	}
+	dump, err := config.Dump(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(out, dump)
+	return nil
+}
 
-	config := config.ParseConfig()
-	logger := logging.NewLogrusLogger(&config.Logging)
-	store := messaging.NewRoomStore()
-	broker := broker.NewBroker(logger)
-	server := server.NewRoomServer(store, agent.PeerHandler(broker, logger), logger)
+// configFlag adds the flag of the config file's path.
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", "", "path to the YAML config file, "+config.DefaultFilename+" in the working directory by default")
+}
 
-	instrumentation := instrumentation.NewPrometheusInstrumentation()
-	server.EnableMetrics(instrumentation.MetricsHandler())
+// configFilePath returns the path given in the flag, or the default one.
+func configFilePath(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	return config.DefaultPath()
+}
 
-	server.Listen(config.Server.Host, config.Server.Port)
+// usageFunc returns the usage of the command with flags.
+func usageFunc(flags *flag.FlagSet, synopsis string, description string) func() {
+	return func() {
+		fmt.Fprintf(flags.Output(), "Usage: tarpon %s\n\n%s\n\nFlags:\n", synopsis, description)
+		flags.PrintDefaults()
+	}
+}
 
+// usageError prints the usage of the command and returns an error with the message.
+func usageError(flags *flag.FlagSet, msg string) error {
+	flags.Usage()
+	return fmt.Errorf("%s: %s", flags.Name(), msg)
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/presence"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+)
+
+type StubPresence struct{}
+
+func (StubPresence) Online(room string) ([]string, error) {
+	return []string{"peer-1"}, nil
+}
+
+type StubRouter struct{}
+
+func (StubRouter) Route(room string) (presence.Node, bool) {
+	return presence.Node{ID: "node-1", URL: "http://node-1:5000"}, true
+}
+
+func (StubRouter) Agreed() bool {
+	return true
+}
+
+func TestAdminCommands(t *testing.T) {
+	s := server.NewRoomServer(messaging.NewRoomStore(), func(messaging.Peer, string, *websocket.Conn, *http.Request) {}, logging.NoopLogger{})
+	s.EnableAdminAuth("admin-token")
+	s.EnablePresence(StubPresence{})
+	s.EnableRouting(StubRouter{}, false)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	os.Setenv("TARPON_ADMIN_TOKEN", "admin-token")
+	defer os.Unsetenv("TARPON_ADMIN_TOKEN")
+	admin := []string{"--url", ts.URL}
+
+	cases := []struct {
+		args  []string
+		input string
+		want  string
+	}{
+		{append([]string{"rooms", "create"}, append(admin, "room-1")...), "", "room room-1 created\n"},
+		{append([]string{"peers", "register"}, append(admin, "room-1", "peer-1")...), "0123456789-0123456789-0123456789\n", "peer peer-1 registered in room room-1\n"},
+		{append([]string{"rooms", "list"}, admin...), "", "UID     PEERS  ONLINE\nroom-1  1      1\n"},
+		{append([]string{"rooms", "presence"}, append(admin, "room-1")...), "", "peer-1\n"},
+		{append([]string{"rooms", "node"}, append(admin, "room-1")...), "", "node-1 http://node-1:5000\n"},
+		{append([]string{"rooms", "delete"}, append(admin, "room-1")...), "", "room room-1 deleted\n"},
+		{append([]string{"rooms", "list"}, admin...), "", "UID  PEERS  ONLINE\n"},
+	}
+	for _, c := range cases {
+		out := &bytes.Buffer{}
+		if err := run(c.args, strings.NewReader(c.input), out); err != nil {
+			t.Fatalf("%v failed: %v", c.args, err)
+		}
+		if out.String() != c.want {
+			t.Errorf("%v printed %q, want %q", c.args, out.String(), c.want)
+		}
+	}
+
+	if err := run(append([]string{"rooms", "delete"}, append(admin, "room-1")...), nil, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got error %v deleting missing room, want not found", err)
+	}
+}
+
+func TestRegisterPeerReadsSecret(t *testing.T) {
+	store := messaging.NewRoomStore()
+	s := server.NewRoomServer(store, func(messaging.Peer, string, *websocket.Conn, *http.Request) {}, logging.NoopLogger{})
+	s.EnableAdminAuth("admin-token")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	os.Setenv("TARPON_ADMIN_TOKEN", "admin-token")
+	defer os.Unsetenv("TARPON_ADMIN_TOKEN")
+	args := []string{"peers", "register", "--url", ts.URL, "room-1"}
+
+	if err := run(append(args, "peer-1"), strings.NewReader("stdin-0123456789-0123456789\n"), &bytes.Buffer{}); err != nil {
+		t.Fatalf("could not register peer with secret from stdin: %v", err)
+	}
+	os.Setenv("TARPON_PEER_SECRET", "env-0123456789-0123456789")
+	err := run(append(args, "peer-2"), strings.NewReader("ignored-0123456789-0123456789\n"), &bytes.Buffer{})
+	os.Unsetenv("TARPON_PEER_SECRET")
+	if err != nil {
+		t.Fatalf("could not register peer with secret from environment: %v", err)
+	}
+
+	for secret, want := range map[string]string{"stdin-0123456789-0123456789": "peer-1", "env-0123456789-0123456789": "peer-2"} {
+		if p, err := store.JoinRoom("room-1", secret); err != nil || p.UID != want {
+			t.Errorf("joined as %q with error %v using secret %q, want %s", p.UID, err, secret, want)
+		}
+	}
+
+	if err := run(append(args, "peer-3"), strings.NewReader(""), &bytes.Buffer{}); err == nil {
+		t.Errorf("registered peer without a secret")
+	}
+	if err := run(append(args, "peer-3", "secret-0123456789-0123456789"), strings.NewReader(""), &bytes.Buffer{}); err == nil {
+		t.Errorf("registered peer with the secret in arguments")
+	}
+}
+
+func TestAdminTokenFromStdin(t *testing.T) {
+	store := messaging.NewRoomStore()
+	s := server.NewRoomServer(store, func(messaging.Peer, string, *websocket.Conn, *http.Request) {}, logging.NoopLogger{})
+	s.EnableAdminAuth("admin-token")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// the token comes before the peer's secret
+	args := []string{"peers", "register", "--url", ts.URL, "--token-stdin", "room-1", "peer-1"}
+	if err := run(args, strings.NewReader("admin-token\nstdin-0123456789-0123456789\n"), &bytes.Buffer{}); err != nil {
+		t.Fatalf("could not register peer with token from stdin: %v", err)
+	}
+	if p, err := store.JoinRoom("room-1", "stdin-0123456789-0123456789"); err != nil || p.UID != "peer-1" {
+		t.Errorf("joined as %q with error %v, want peer-1", p.UID, err)
+	}
+
+	cases := map[string]string{
+		"missing token": "",
+		"wrong token":   "other-token\n",
+	}
+	for name, input := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := run([]string{"rooms", "list", "--url", ts.URL, "--token-stdin"}, strings.NewReader(input), &bytes.Buffer{}); err == nil {
+				t.Errorf("listed rooms with token %q", input)
+			}
+		})
+	}
+}
+
+func TestUnknownCommands(t *testing.T) {
+	for _, args := range [][]string{{"rooms"}, {"rooms", "rename"}, {"peers", "remove"}, {"config", "edit"}} {
+		if err := run(args, nil, &bytes.Buffer{}); err == nil {
+			t.Errorf("%v succeeded, want an error", args)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/config"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+)
+
+// reloadCheckInterval is how often the config file is checked for changes
+const reloadCheckInterval = 5 * time.Second
+
+// reloader reloads the config on SIGHUP or when the config file changes, and
+// applies the settings which can be changed without dropping connections. Invalid
+// configs are not applied.
+type reloader struct {
+	path    string
+	current config.Config
+	modTime time.Time
+	apply   func(cfg config.Config)
+	logger  logging.Logger
+}
+
+func newReloader(path string, cfg config.Config, apply func(cfg config.Config), l logging.Logger) *reloader {
+	r := &reloader{path: path, current: cfg, apply: apply, logger: l}
+	r.changed()
+	return r
+}
+
+func (r *reloader) run() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	ticker := time.NewTicker(reloadCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-signals:
+			r.logger.Info("received SIGHUP, reloading config")
+			r.changed()
+			r.reload()
+		case <-ticker.C:
+			if r.changed() {
+				r.logger.Info("config file changed, reloading config", logging.Fields{"path": r.path})
+				r.reload()
+			}
+		}
+	}
+}
+
+// changed reports whether the config file was modified since the last check
+func (r *reloader) changed() bool {
+	if r.path == "" {
+		return false
+	}
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(r.modTime) {
+		return false
+	}
+	r.modTime = info.ModTime()
+	return true
+}
+
+func (r *reloader) reload() {
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		r.logger.Error("config not reloaded", logging.Fields{"error": err})
+		return
+	}
+	if config.RequiresRestart(r.current, cfg) {
+		r.logger.Warn("only log level, client limits, allowed origins and webhooks are reloaded, other changes require a restart")
+	}
+	r.apply(cfg)
+	r.current = cfg
+	r.logger.Info("config reloaded")
+}
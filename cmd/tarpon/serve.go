@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/agent"
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/clientip"
+	"github.com/montrosesoftware/tarpon/pkg/config"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/history"
+	"github.com/montrosesoftware/tarpon/pkg/instrumentation"
+	"github.com/montrosesoftware/tarpon/pkg/interceptor"
+	"github.com/montrosesoftware/tarpon/pkg/kv"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/moderation"
+	"github.com/montrosesoftware/tarpon/pkg/presence"
+	"github.com/montrosesoftware/tarpon/pkg/ratelimit"
+	"github.com/montrosesoftware/tarpon/pkg/ring"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
+	"github.com/montrosesoftware/tarpon/pkg/webhook"
+)
+
+// serve runs the server until it's shut down by a signal.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := configFlag(flags)
+	flags.Usage = usageFunc(flags, "serve [flags]", "Run the server.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected arguments")
+	}
+
+	log.Printf("starting tarpon %s...", version)
+	path := configFilePath(*configPath)
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	dump, err := config.Dump(cfg)
+	if err != nil {
+		return fmt.Errorf("error while printing config: %w", err)
+	}
+	log.Printf("tarpon config:\n%s\n", dump)
+
+	logger := logging.NewLogrusLogger(&cfg.Logging)
+	shared, err := newSharedStore(&cfg.Store)
+	if err != nil {
+		return fmt.Errorf("error connecting to the store: %w", err)
+	}
+	store := newRoomStore(shared, cfg.Store.KeyPrefix, logger)
+	messages := history.NewStore(history.Limits{MaxCount: cfg.History.MaxCount, MaxAge: cfg.History.MaxAge})
+	backend := broker.NewBroker(logger)
+	var broker broker.Broker = history.NewBroker(backend, messages, cfg.History.Replay)
+	chain, err := newInterceptors(&cfg.Interceptors)
+	if err != nil {
+		return fmt.Errorf("error reading interceptors: %w", err)
+	}
+	if len(chain) > 0 {
+		broker = interceptor.NewBroker(broker, chain)
+	}
+	var auditSink audit.Sink = audit.NoopSink{}
+	if cfg.Audit.Output != "" {
+		auditLog, err := audit.Open(cfg.Audit.Output, logger)
+		if err != nil {
+			return fmt.Errorf("error opening audit log: %w", err)
+		}
+		defer auditLog.Close()
+		auditSink = auditLog
+	}
+	// the dispatcher runs even without URLs, so that they can be added by reloading the config
+	dispatcher := webhook.NewDispatcher(&cfg.Webhooks, logger)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	var sink events.Sink = dispatcher
+
+	moderator := moderation.NewModerator(broker, store, auditSink, logger)
+	broker = moderator
+	registry, err := newRegistry(shared, &cfg.Cluster, cfg.Store.KeyPrefix, sink, logger)
+	if err != nil {
+		return fmt.Errorf("error joining cluster: %w", err)
+	}
+	defer registry.Stop()
+	presenceBroker := presence.NewBroker(broker, registry, logger)
+	presenceBroker.Start()
+	defer presenceBroker.Stop()
+	broker = presenceBroker
+	var tracer tracing.Tracer = tracing.NoopTracer{}
+	if cfg.Tracing.Endpoint != "" {
+		exporter, err := newExporter(&cfg.Tracing, registry.NodeID())
+		if err != nil {
+			return fmt.Errorf("error configuring tracing: %w", err)
+		}
+		provider := tracing.NewProvider(exporter, cfg.Tracing.FlushInterval, cfg.Tracing.SampleRatio, logger)
+		provider.Start()
+		defer provider.Stop()
+		tracer = provider
+		broker = tracing.NewBroker(broker, tracer)
+	}
+
+	options := agent.NewRoomOptions(agent.NewOptions(&cfg.Websocket), store)
+	options.SetReplay(cfg.History.Replay)
+	server := server.NewRoomServer(store, agent.PeerHandler(broker, store, sink, auditSink, tracer, options, logger), logger)
+	server.SetWebsocketBuffers(cfg.Websocket.ReadBufferSize, cfg.Websocket.WriteBufferSize)
+	server.EnableConnectionOverrides(options)
+	server.EnableEvents(sink)
+	server.EnableHistory(messages)
+	server.EnableModeration(moderator)
+	server.EnablePresence(registry)
+	if cfg.Cluster.RoutingOn() {
+		router := newRouter(&cfg.Cluster, registry, logger)
+		if err := router.Start(); err != nil {
+			return fmt.Errorf("error reading cluster nodes: %w", err)
+		}
+		defer router.Stop()
+		server.EnableRouting(router, cfg.Cluster.Routing == config.RoutingRedirect)
+	}
+	server.EnableAudit(auditSink)
+	server.EnableTracing(tracer)
+	if perIP, perRoom := newJoinLimiters(&cfg.JoinProtection); perIP != nil || perRoom != nil {
+		server.EnableJoinProtection(perIP, perRoom)
+	}
+	if len(cfg.Server.TrustedProxies) > 0 {
+		resolver, err := clientip.NewResolver(cfg.Server.TrustedProxies)
+		if err != nil {
+			return fmt.Errorf("error reading trusted proxies: %w", err)
+		}
+		server.EnableClientIPResolver(resolver)
+	}
+	// limiters with zero limits don't limit clients until they are set by reloading the config
+	requests := ratelimit.NewBuckets(cfg.ClientLimits.RequestRate, cfg.ClientLimits.RequestBurst)
+	connections := ratelimit.NewConcurrencyLimit(cfg.ClientLimits.MaxConnections)
+	server.EnableClientLimits(requests, connections)
+	server.SetAllowedOrigins(cfg.Server.AllowedOrigins)
+	if cfg.Admin.Token != "" {
+		server.EnableAdminAuth(cfg.Admin.Token)
+		server.EnableServerMessages(broker, cfg.Admin.SenderName)
+	}
+	if cfg.Server.HTTPTransport {
+		server.EnableHTTPTransport(agent.StreamHandler(broker, store, sink, options, logger), agent.MessageHandler(broker, store, tracer, options, logger))
+	}
+
+	instrumentation := instrumentation.NewPrometheusInstrumentation()
+	server.EnableMetrics(instrumentation.MetricsHandler())
+
+	server.SetBuildInfo(serverBuildInfo())
+	server.AddHealthCheck("store", store)
+	server.AddHealthCheck("broker", backend)
+	go shutdownOnSignal(server, cfg.Server.DrainTimeout, cfg.Server.ShutdownTimeout)
+
+	reloader := newReloader(path, cfg, func(cfg config.Config) {
+		if err := logger.SetLevel(cfg.Logging.Level); err != nil {
+			logger.Error("can't change log level", logging.Fields{"error": err})
+		}
+		requests.SetLimit(cfg.ClientLimits.RequestRate, cfg.ClientLimits.RequestBurst)
+		connections.SetMax(cfg.ClientLimits.MaxConnections)
+		server.SetAllowedOrigins(cfg.Server.AllowedOrigins)
+		dispatcher.SetTargets(cfg.Webhooks.URLs, cfg.Webhooks.Secret)
+	}, logger)
+	go reloader.run()
+
+	server.Listen(cfg.Server.Host, cfg.Server.Port)
+	return nil
+}
+
+func serverBuildInfo() server.BuildInfo {
+	return server.BuildInfo{Version: version, Commit: commit, GoVersion: runtime.Version()}
+}
+
+// shutdownOnSignal shuts the server down gracefully on SIGINT or SIGTERM.
+func shutdownOnSignal(s *server.RoomServer, drain time.Duration, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("received %v, shutting down...", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx, drain); err != nil {
+		log.Printf("error during shutdown: %v", err)
+	}
+}
+
+// roomStore is kept in memory or shared by instances of the server
+type roomStore interface {
+	server.RoomStore
+	server.HealthChecker
+	moderation.PeerStore
+	agent.KeyDirectory
+	agent.ConnectionStore
+}
+
+// newSharedStore connects to the store shared by instances of the server, or
+// returns nil when there's none configured.
+func newSharedStore(cfg *config.Store) (kv.Store, error) {
+	if cfg.RedisAddress == "" {
+		return nil, nil
+	}
+	o := kv.RedisOptions{
+		Address:  cfg.RedisAddress,
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDB,
+		Timeout:  cfg.Timeout,
+		PoolSize: cfg.PoolSize,
+	}
+	if cfg.RedisTLS || cfg.RedisCAFile != "" {
+		o.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if cfg.RedisCAFile != "" {
+		data, err := ioutil.ReadFile(cfg.RedisCAFile)
+		if err != nil {
+			return nil, err
+		}
+		o.TLS.RootCAs = x509.NewCertPool()
+		if !o.TLS.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.RedisCAFile)
+		}
+	}
+	return kv.NewRedis(o), nil
+}
+
+// newRoomStore creates the store of rooms, in the shared store when there's one.
+func newRoomStore(shared kv.Store, prefix string, l logging.Logger) roomStore {
+	if shared == nil {
+		return messaging.NewRoomStore()
+	}
+	return messaging.NewSharedRoomStore(shared, prefix, l)
+}
+
+// newExporter creates the exporter of spans, reporting the resource of the
+// instance with the node ID
+func newExporter(cfg *config.Tracing, nodeID string) (*tracing.OTLPExporter, error) {
+	attrs, err := cfg.Resource()
+	if err != nil {
+		return nil, err
+	}
+	headers, err := cfg.ExportHeaders()
+	if err != nil {
+		return nil, err
+	}
+	resource := tracing.NewResource(cfg.ServiceName, version, nodeID, attrs)
+	exporter := tracing.NewOTLPExporter(cfg.Endpoint, resource, cfg.Timeout)
+	exporter.SetHeaders(headers)
+	return exporter, nil
+}
+
+// newRegistry joins the cluster of instances sharing the store. Without a shared
+// store, the instance is the only node of its own cluster.
+func newRegistry(shared kv.Store, cfg *config.Cluster, prefix string, e events.Sink, l logging.Logger) (*presence.Registry, error) {
+	if shared == nil {
+		shared = kv.NewMemoryStore()
+	}
+	o := presence.DefaultOptions(cfg.NodeID)
+	if o.NodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error reading host name, set the node id: %w", err)
+		}
+		o.NodeID = hostname
+	}
+	o.URL = cfg.AdvertiseURL
+	o.Heartbeat = cfg.Heartbeat
+	o.Lease = cfg.Lease
+	o.Prefix = prefix
+	r := presence.NewRegistry(shared, o, e, l)
+	return r, r.Start()
+}
+
+// newInterceptors builds the chain of built-in interceptors enabled in the config.
+// Custom interceptors can be appended to it.
+func newInterceptors(cfg *config.Interceptors) (interceptor.Chain, error) {
+	var chain interceptor.Chain
+
+	if cfg.MaxPayloadSize > 0 {
+		chain = append(chain, interceptor.MaxPayloadSize(cfg.MaxPayloadSize))
+	}
+	if cfg.SchemaFile != "" {
+		data, err := ioutil.ReadFile(cfg.SchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading schema file: %w", err)
+		}
+		schema, err := interceptor.ParseSchema(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing schema file: %w", err)
+		}
+		chain = append(chain, interceptor.ValidateSchema(schema))
+	}
+	if cfg.RequireSealed {
+		chain = append(chain, interceptor.RequireSealed())
+	}
+	if len(cfg.Keywords) > 0 {
+		chain = append(chain, interceptor.KeywordFilter(cfg.Keywords, cfg.MaskKeywords))
+	}
+
+	return chain, nil
+}
+
+// newJoinLimiters creates lockouts of IP addresses and rooms enabled in the config.
+func newJoinLimiters(cfg *config.JoinProtection) (perIP server.FailureLimiter, perRoom server.RoomLimiter) {
+	if cfg.IPThreshold > 0 {
+		perIP = ratelimit.NewLockout("join_ip", cfg.IPThreshold, cfg.Backoff, cfg.MaxLockout, cfg.Window)
+	}
+	if cfg.RoomThreshold > 0 {
+		perRoom = ratelimit.NewLockout("join_room", cfg.RoomThreshold, cfg.Backoff, cfg.MaxLockout, cfg.Window)
+	}
+	return perIP, perRoom
+}
+
+// newRouter routes rooms to the nodes listed in the config, or to live nodes of
+// the cluster when there are none.
+func newRouter(cfg *config.Cluster, r *presence.Registry, l logging.Logger) *ring.Router {
+	if len(cfg.Nodes) > 0 {
+		return ring.NewRouter(ring.StaticMembers(cfg.Nodes), cfg.AdvertiseURL, cfg.Heartbeat, l)
+	}
+	return ring.NewRouter(r, r.NodeID(), cfg.Heartbeat, l)
+}
@@ -7,6 +7,7 @@ require (
 	github.com/ilyakaznacheev/cleanenv v1.2.5
 	github.com/prometheus/client_golang v1.11.1
 	github.com/sirupsen/logrus v1.7.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	gopkg.in/yaml.v2 v2.4.0
 	logur.dev/adapter/logrus v0.5.0
 	logur.dev/logur v0.17.0
@@ -1,48 +1,108 @@
 package agent
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/montrosesoftware/tarpon/pkg/audit"
 	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/events"
 	"github.com/montrosesoftware/tarpon/pkg/logging"
 	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/ratelimit"
 	"github.com/montrosesoftware/tarpon/pkg/server"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
 )
 
 const (
-	writeWait       = 15 * time.Second
-	pongWait        = 60 * time.Second
-	pingPeriod      = (pongWait * 9) / 10
-	maxMessageSize  = 32768
-	messagesBufSize = 64
+	strikesWindow = 10 * time.Second
+	closeKicked   = 4000
 )
 
+var errRateLimitExceeded = errors.New("message rate limit exceeded")
+
+// PeerDirectory looks up peers registered in rooms.
+type PeerDirectory interface {
+	GetPeer(room string, uid string) (messaging.Peer, bool)
+}
+
+// KeyDirectory is implemented by peer directories which keep public keys of peers.
+// Peers joining rooms get the keys of peers registered in them.
+type KeyDirectory interface {
+	PublicKeys(room string) map[string]string
+}
+
 // Agent handles websocket communication between peers and the broker.
 type Agent struct {
 	peer      messaging.Peer
 	room      string
 	conn      *websocket.Conn
 	broker    broker.Broker
+	directory PeerDirectory
+	events    events.Sink
 	writeChan chan messaging.Message
 	stopChan  chan struct{}
+	closeChan chan struct{}
+	closeOnce sync.Once
+	goingAway int32
+	limiter   *ratelimit.Bucket
+	strikes   int
+	struckAt  time.Time
+	audit     audit.Sink
+	source    audit.Source
+	tracer    tracing.Tracer
+	options   Options
 	logger    logging.Logger
 }
 
-func New(p messaging.Peer, r string, b broker.Broker, l logging.Logger) *Agent {
-	return &Agent{peer: p, room: r, broker: b, writeChan: make(chan messaging.Message, messagesBufSize), stopChan: make(chan struct{}), logger: l}
+func New(p messaging.Peer, r string, b broker.Broker, d PeerDirectory, e events.Sink, o Options, l logging.Logger) *Agent {
+	return &Agent{
+		peer:      p,
+		room:      r,
+		broker:    b,
+		directory: d,
+		events:    e,
+		writeChan: make(chan messaging.Message, o.MessagesBufSize),
+		stopChan:  make(chan struct{}),
+		closeChan: make(chan struct{}),
+		limiter:   ratelimit.NewBucket(float64(o.MessageRate), o.MessageBurst),
+		audit:     audit.NoopSink{},
+		tracer:    tracing.NoopTracer{},
+		options:   o,
+		logger:    l,
+	}
 }
 
-func PeerHandler(b broker.Broker, l logging.Logger) server.PeerHandlerFunc {
-	return func(p messaging.Peer, room string, conn *websocket.Conn) {
-		agent := New(p, room, b, l)
+// PeerHandler starts agents of peers joining rooms, with the options of their room.
+func PeerHandler(b broker.Broker, d PeerDirectory, e events.Sink, au audit.Sink, t tracing.Tracer, o *RoomOptions, l logging.Logger) server.PeerHandlerFunc {
+	return func(p messaging.Peer, room string, conn *websocket.Conn, r *http.Request) {
+		agent := New(p, room, b, d, e, o.Get(room), l)
+		agent.EnableAudit(au, audit.SourceFrom(r.Context()))
+		agent.EnableTracing(t)
 		agent.Start(conn)
+		agent.Wait()
 	}
 }
 
+// EnableAudit makes the agent record security-relevant events of the session
+// started by the source.
+func (a *Agent) EnableAudit(s audit.Sink, src audit.Source) {
+	a.audit = s
+	a.source = src
+}
+
+// EnableTracing makes the agent record spans of messages sent and received by the peer.
+func (a *Agent) EnableTracing(t tracing.Tracer) {
+	a.tracer = t
+}
+
 func (a *Agent) Write(m messaging.Message) {
 	a.logMessage("adding message to the write channel...", m)
 	select {
@@ -71,40 +131,80 @@ func (a *Agent) Start(c *websocket.Conn) {
 	a.logger.Info("agent started", logging.Fields{"room": a.room, "peer": a.peer.UID})
 }
 
+// Wait blocks until the agent stops reading messages from the peer.
+func (a *Agent) Wait() {
+	<-a.stopChan
+}
+
 func (a *Agent) ID() string {
 	return a.peer.UID
 }
 
+// Close disconnects the peer, e.g. when it's kicked out of the room.
+func (a *Agent) Close() {
+	a.closeOnce.Do(func() {
+		close(a.closeChan)
+	})
+}
+
+// CloseGoingAway disconnects the peer when the server shuts down.
+func (a *Agent) CloseGoingAway() {
+	atomic.StoreInt32(&a.goingAway, 1)
+	a.Close()
+}
+
 func (a *Agent) sendControlMessage(msgFactory func(a string) (*messaging.Message, error)) {
-	msg, err := msgFactory(a.ID())
+	sendControl(a.broker, a.room, a.ID(), msgFactory, a.logger)
+}
+
+// peerConnected announces the peer with its public key
+func (a *Agent) peerConnected(uid string) (*messaging.Message, error) {
+	return messaging.NewPeerConnectedWithKey(uid, a.peer.PublicKey)
+}
+
+// sendKeyDirectory sends the peer public keys of peers in the room, unless nobody
+// registered one
+func (a *Agent) sendKeyDirectory() {
+	if msg := keyDirectory(a.directory, a.room, a.peer.UID, a.logger); msg != nil {
+		a.Write(*msg)
+	}
+}
+
+// sendError notifies the peer that its message with the given id was rejected.
+func (a *Agent) sendError(id string, code string, text string) {
+	msg, err := messaging.NewError(a.ID(), id, code, text)
 	if err != nil {
-		a.logger.Error("failed to create control message", logging.Fields{"room": a.room, "peer": a.peer.UID, "error": err})
-	} else {
-		a.broker.Send(a.room, *msg)
+		a.logger.Error("failed to create error message", logging.Fields{"room": a.room, "peer": a.peer.UID, "error": err})
+		return
 	}
+	a.Write(*msg)
 }
 
 // readPump handles messages coming from the peer
 func (a *Agent) readPump() {
-	a.sendControlMessage(messaging.NewPeerConnected)
+	a.sendKeyDirectory()
+	a.sendControlMessage(a.peerConnected)
 	a.broker.Register(a.room, a)
+	a.events.Notify(events.New(events.PeerConnected, a.room, a.peer.UID))
 
 	defer func() {
 		a.broker.Unregister(a.room, a)
 		a.sendControlMessage(messaging.NewPeerDisconnected)
+		a.events.Notify(events.New(events.PeerDisconnected, a.room, a.peer.UID))
 
 		close(a.stopChan)
 		a.logger.Debug("agent read pump stopped", logging.Fields{"room": a.room, "peer": a.peer.UID})
 	}()
 
-	a.conn.SetReadLimit(maxMessageSize)
-	if err := a.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+	// frames may be larger than messages, which are checked after reading
+	a.conn.SetReadLimit(2 * int64(a.options.MaxMessageSize))
+	if err := a.conn.SetReadDeadline(time.Now().Add(a.options.PongWait)); err != nil {
 		a.logger.Error("error setting read deadline on socket", logging.Fields{"room": a.room, "peer": a.peer.UID, "error": err})
 		return
 	}
 	a.conn.SetPongHandler(func(string) error {
 		a.logger.Debug("received pong from peer", logging.Fields{"room": a.room, "peer": a.peer.UID})
-		return a.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return a.conn.SetReadDeadline(time.Now().Add(a.options.PongWait))
 	})
 
 	for {
@@ -114,13 +214,16 @@ func (a *Agent) readPump() {
 			break
 		}
 		a.logger.Debug("received data from peer", logging.Fields{"room": a.room, "peer": a.peer.UID})
-		a.handleClientMessage(r)
+		if err := a.handleClientMessage(r); err != nil {
+			a.logger.Warn("disconnecting peer", logging.Fields{"room": a.room, "peer": a.peer.UID, "error": err})
+			break
+		}
 	}
 }
 
 // writePump handles messages coming from the broker
 func (a *Agent) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(a.options.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		a.logger.Debug("closing websocket", logging.Fields{"room": a.room, "peer": a.peer.UID})
@@ -138,17 +241,12 @@ func (a *Agent) writePump() {
 				return
 			}
 
-			if err := a.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				a.logger.Error("error setting write deadline for message", logging.Fields{"room": a.room, "peer": a.peer.UID})
-			}
-			a.logMessage("sending message to peer", m)
-			err := a.conn.WriteJSON(m)
-			if err != nil {
+			if err := a.writeMessage(m); err != nil {
 				a.logWSError(err)
 				return
 			}
 		case <-ticker.C:
-			if err := a.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+			if err := a.conn.SetWriteDeadline(time.Now().Add(a.options.WriteWait)); err != nil {
 				a.logger.Error("error setting write deadline for ping", logging.Fields{"room": a.room, "peer": a.peer.UID})
 			}
 			a.logger.Debug("sending ping to peer", logging.Fields{"room": a.room, "peer": a.peer.UID})
@@ -156,6 +254,19 @@ func (a *Agent) writePump() {
 				a.logWSError(err)
 				return
 			}
+		case <-a.closeChan:
+			a.logger.Info("closing agent", logging.Fields{"room": a.room, "peer": a.peer.UID})
+			if err := a.conn.SetWriteDeadline(time.Now().Add(a.options.WriteWait)); err != nil {
+				a.logger.Error("error setting write deadline for close message", logging.Fields{"room": a.room, "peer": a.peer.UID})
+			}
+			msg := websocket.FormatCloseMessage(closeKicked, "removed from the room")
+			if atomic.LoadInt32(&a.goingAway) == 1 {
+				msg = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+			}
+			if err := a.conn.WriteMessage(websocket.CloseMessage, msg); err != nil {
+				a.logWSError(err)
+			}
+			return
 		case <-a.stopChan:
 			a.logger.Debug("agent write pump received stop signal", logging.Fields{"room": a.room, "peer": a.peer.UID})
 			return
@@ -163,28 +274,55 @@ func (a *Agent) writePump() {
 	}
 }
 
-type ClientMessage struct {
-	To      string          `json:"to"`
-	Payload json.RawMessage `json:"payload"`
+// writeMessage sends the message to the peer, recording a span in the message's trace
+func (a *Agent) writeMessage(m messaging.Message) error {
+	parent, _ := tracing.ParseTraceContext(m.Trace, m.TraceState)
+	span := a.tracer.StartSpan(parent, "Agent.writePump")
+	defer span.End()
+	span.SetAttribute("room", a.room)
+	span.SetAttribute("peer", a.peer.UID)
+
+	if err := a.conn.SetWriteDeadline(time.Now().Add(a.options.WriteWait)); err != nil {
+		a.logger.Error("error setting write deadline for message", logging.Fields{"room": a.room, "peer": a.peer.UID})
+	}
+	a.logMessage("sending message to peer", m)
+	err := a.conn.WriteJSON(m)
+	span.SetError(err)
+	return err
 }
 
-func (a *Agent) handleClientMessage(r io.Reader) {
-	var msgReq ClientMessage
+// handleClientMessage forwards a message read from the peer to the broker.
+// Rejected messages are reported back to the peer with an error frame. An error
+// is returned only when the peer should be disconnected.
+func (a *Agent) handleClientMessage(r io.Reader) error {
+	if !a.limiter.Allow() {
+		// strikes are counted in a window, so that peers steadily sending faster
+		// than the limit are disconnected too, not only those flooding the server
+		if now := time.Now(); now.Sub(a.struckAt) > strikesWindow {
+			a.strikes = 0
+			a.struckAt = now
+		}
+		a.strikes++
+		a.logger.Warn("message rate limit exceeded, dropping message", logging.Fields{"room": a.room, "peer": a.peer.UID, "strikes": a.strikes})
+		if a.strikes >= a.options.MaxRateStrikes {
+			e := audit.New(audit.RateLimitDisconnect, a.room, a.peer.UID, a.source)
+			e.Reason = errRateLimitExceeded.Error()
+			a.audit.Record(e)
+			return errRateLimitExceeded
+		}
+		a.sendError("", messaging.ErrCodeRateLimited, "too many messages")
+		return nil
+	}
 
-	if err := json.NewDecoder(r).Decode(&msgReq); err != nil {
-		a.logger.Error("error decoding message:", logging.Fields{"room": a.room, "peer": a.peer.UID, "error": err})
-		return
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(a.options.MaxMessageSize)+1))
+	if err != nil {
+		a.logger.Error("error reading message:", logging.Fields{"room": a.room, "peer": a.peer.UID, "error": err})
+		return nil
 	}
-	if msgReq.Payload == nil || bytes.Equal(msgReq.Payload, []byte("null")) {
-		a.logger.Debug("no payload, dropping message", logging.Fields{"room": a.room, "peer": a.peer.UID})
-		return
+	if rejection := deliver(a.broker, a.directory, a.tracer, "Agent.handleClientMessage", a.options.MaxMessageSize, a.room, a.peer.UID, a.source, data, a.logger); rejection != nil {
+		a.sendError(rejection.ID, rejection.Code, rejection.Reason)
 	}
-	a.logMessage("received message from peer", msgReq)
-	a.broker.Send(a.room, messaging.Message{
-		From:    a.peer.UID,
-		To:      msgReq.To,
-		Payload: msgReq.Payload,
-	})
+	return nil
 }
 
 func (a *Agent) logMessage(t string, o interface{}) {
@@ -3,6 +3,7 @@ package agent_test
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -13,16 +14,33 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/montrosesoftware/tarpon/pkg/agent"
+	"github.com/montrosesoftware/tarpon/pkg/audit"
 	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/interceptor"
 	"github.com/montrosesoftware/tarpon/pkg/logging"
 	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/server"
 )
 
 var (
-	myRoomUID = "room-123"
-	myPeer    = "peer-abc"
+	myRoomUID   = "room-123"
+	myPeer      = "peer-abc"
+	otherPeer   = "another-peer"
+	offlinePeer = "offline-peer"
+
+	forbiddenPayload = `"forbidden"`
 )
 
+type StubDirectory struct{}
+
+func (StubDirectory) GetPeer(room string, uid string) (messaging.Peer, bool) {
+	if room == myRoomUID && (uid == myPeer || uid == otherPeer || uid == offlinePeer) {
+		return messaging.Peer{UID: uid}, true
+	}
+	return messaging.Peer{}, false
+}
+
 func newMockHandler(agent *agent.Agent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		upgrader := websocket.Upgrader{}
@@ -41,13 +59,20 @@ type SpyBroker struct {
 	mutex       sync.Mutex
 }
 
-func (b *SpyBroker) Send(room string, m messaging.Message) {
+func (b *SpyBroker) Send(room string, m messaging.Message) error {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
+	if m.To == offlinePeer {
+		return broker.ErrRecipientOffline
+	}
+	if string(m.Payload) == forbiddenPayload {
+		return interceptor.Reject(interceptor.ErrCodeForbiddenContent, "forbidden")
+	}
 	if room == myRoomUID {
 		b.messages = append(b.messages, m)
 	}
+	return nil
 }
 
 func (b *SpyBroker) Register(room string, s broker.Subscriber) {
@@ -97,7 +122,7 @@ func (b *SpyBroker) assertNoSubscriber(t *testing.T) {
 
 func TestSubsciptionToBroker(t *testing.T) {
 	broker := &SpyBroker{}
-	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, logging.NoopLogger{})
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
 	s := httptest.NewServer(newMockHandler(agent))
 	defer s.Close()
 
@@ -117,7 +142,7 @@ func TestSubsciptionToBroker(t *testing.T) {
 
 func TestSendMessageToBroker(t *testing.T) {
 	broker := &SpyBroker{}
-	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, logging.NoopLogger{})
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
 	s := httptest.NewServer(newMockHandler(agent))
 	defer s.Close()
 
@@ -152,11 +177,33 @@ func TestSendMessageToBroker(t *testing.T) {
 	broker.assertMessages(t, append(ctrlMessages, messages...))
 }
 
+func TestMessagesCarrySourceOfSession(t *testing.T) {
+	broker := &SpyBroker{}
+	src := audit.Source{RemoteIP: "192.0.2.1", UserAgent: "Mozilla/5.0", RequestID: "request-1"}
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
+	agent.EnableAudit(audit.NoopSink{}, src)
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+	if err := ws.WriteJSON(generateMessage(0)); err != nil {
+		t.Fatalf("error writing to WS: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	if n := len(broker.messages); n != 2 || broker.messages[1].Source != src {
+		t.Errorf("got messages %+v, want the message from %+v", broker.messages, src)
+	}
+}
+
 // this test times out when writing to agent blocks
 func TestWriteMessageToPeerNeverBlocks(t *testing.T) {
 	broker := &SpyBroker{}
 	// this agent doesn't start, so is not processing messages sent to the peer, causing the buffer to get full
-	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, logging.NoopLogger{})
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
 
 	for i := 0; i < 1000; i++ {
 		agent.Write(generateMessage(i))
@@ -165,7 +212,7 @@ func TestWriteMessageToPeerNeverBlocks(t *testing.T) {
 
 func TestWriteControlMessages(t *testing.T) {
 	broker := &SpyBroker{}
-	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, logging.NoopLogger{})
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
 	s := httptest.NewServer(newMockHandler(agent))
 	defer s.Close()
 
@@ -192,9 +239,84 @@ func TestWriteControlMessages(t *testing.T) {
 	broker.assertMessages(t, messages)
 }
 
+type StubKeyDirectory struct {
+	StubDirectory
+}
+
+func (StubKeyDirectory) PublicKeys(room string) map[string]string {
+	return map[string]string{otherPeer: "other-key"}
+}
+
+func TestPublicKeysAreSentToPeers(t *testing.T) {
+	broker := &SpyBroker{}
+	peer := messaging.Peer{UID: myPeer, PublicKey: "my-key"}
+	agent := agent.New(peer, myRoomUID, broker, StubKeyDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+
+	var got struct {
+		Payload struct {
+			Type string            `json:"type"`
+			Keys map[string]string `json:"keys"`
+		} `json:"payload"`
+	}
+	if err := ws.ReadJSON(&got); err != nil {
+		t.Fatalf("error reading key directory: %v", err)
+	}
+	if got.Payload.Type != "key_directory" || got.Payload.Keys[otherPeer] != "other-key" {
+		t.Errorf("got %+v, want key directory with key of %s", got.Payload, otherPeer)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	want, err := messaging.NewPeerConnectedWithKey(myPeer, "my-key")
+	if err != nil {
+		t.Fatalf("error creating control message: %v", err)
+	}
+	broker.assertMessages(t, []messaging.Message{*want})
+}
+
+type SpySink struct {
+	events []events.Event
+	mutex  sync.Mutex
+}
+
+func (s *SpySink) Notify(e events.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, e)
+}
+
+func TestNotifyLifecycleEvents(t *testing.T) {
+	sink := &SpySink{}
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, &SpyBroker{}, StubDirectory{}, sink, agent.DefaultOptions(), logging.NoopLogger{})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	ws.Close()
+
+	// wait for a server to process peers connection
+	time.Sleep(time.Millisecond * 100)
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	want := []events.Type{events.PeerConnected, events.PeerDisconnected}
+	if len(sink.events) != len(want) {
+		t.Fatalf("got events %v, but want %v", sink.events, want)
+	}
+	for i, e := range sink.events {
+		if e.Type != want[i] || e.Room != myRoomUID || e.Peer != myPeer {
+			t.Errorf("at index %d got event %+v, but want %q of %q in %q", i, e, want[i], myPeer, myRoomUID)
+		}
+	}
+}
+
 func TestWriteMessageToPeer(t *testing.T) {
 	broker := &SpyBroker{}
-	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, logging.NoopLogger{})
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
 	s := httptest.NewServer(newMockHandler(agent))
 	defer s.Close()
 
@@ -230,6 +352,299 @@ func TestWriteMessageToPeer(t *testing.T) {
 	agent.Write(generateMessage(0))
 }
 
+func TestRejectedMessagesAreReportedToPeer(t *testing.T) {
+	broker := &SpyBroker{}
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+
+	if err := ws.WriteJSON(messaging.Message{ID: "msg-1", To: otherPeer}); err != nil {
+		t.Fatalf("error writing empty payload message to WS: %v", err)
+	}
+	writeIncorrectJSON(t, ws)
+	tooLarge := `{"payload":"` + strings.Repeat("a", 40000) + `"}`
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(tooLarge)); err != nil {
+		t.Fatalf("error writing too large message to WS: %v", err)
+	}
+
+	assertErrorFrame(t, ws, "msg-1", messaging.ErrCodeEmptyPayload)
+	assertErrorFrame(t, ws, "", messaging.ErrCodeDecode)
+	assertErrorFrame(t, ws, "", messaging.ErrCodeTooLarge)
+}
+
+func TestOptionsLimitConnection(t *testing.T) {
+	options := agent.DefaultOptions()
+	options.PongWait = 200 * time.Millisecond
+	options.PingPeriod = 100 * time.Millisecond
+	options.MaxMessageSize = 64
+	broker := &SpyBroker{}
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, options, logging.NoopLogger{})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+
+	tooLarge := `{"payload":"` + strings.Repeat("a", 64) + `"}`
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(tooLarge)); err != nil {
+		t.Fatalf("error writing too large message to WS: %v", err)
+	}
+	assertErrorFrame(t, ws, "", messaging.ErrCodeTooLarge)
+
+	// the peer stops reading, so pings are not answered and the agent disconnects it
+	time.Sleep(500 * time.Millisecond)
+	broker.assertNoSubscriber(t)
+}
+
+func TestRoomOptions(t *testing.T) {
+	store := messaging.NewRoomStore()
+	store.CreateRoom(myRoomUID)
+	options := agent.NewRoomOptions(agent.DefaultOptions(), store)
+
+	options.SetReplay(50)
+
+	if err := options.CheckOverrides(server.ConnectionReq{PongWait: 10}); err == nil {
+		t.Errorf("pong wait shorter than the default ping period should be rejected")
+	}
+	if err := options.CheckOverrides(server.ConnectionReq{MessagesBufSize: 50}); err == nil {
+		t.Errorf("buffer which can't hold the replayed messages should be rejected")
+	}
+	req := server.ConnectionReq{PongWait: 10, PingPeriod: 5, MaxMessageSize: 1024}
+	if err := options.CheckOverrides(req); err != nil {
+		t.Fatalf("could not check overrides: %v", err)
+	}
+	options.SetOverrides(myRoomUID, req)
+
+	want := agent.DefaultOptions()
+	want.PongWait = 10 * time.Second
+	want.PingPeriod = 5 * time.Second
+	want.MaxMessageSize = 1024
+	if got := options.Get(myRoomUID); got != want {
+		t.Errorf("got options %+v, want %+v", got, want)
+	}
+	if got := options.Get("another-room"); got != agent.DefaultOptions() {
+		t.Errorf("got options %+v of another room, want defaults", got)
+	}
+
+	// overrides are kept with the room, so they're removed together with it
+	store.DeleteRoom(myRoomUID)
+	store.CreateRoom(myRoomUID)
+	if got := options.Get(myRoomUID); got != agent.DefaultOptions() {
+		t.Errorf("got options %+v of a room created again, want defaults", got)
+	}
+}
+
+func TestRateLimitedMessagesAreReportedToPeer(t *testing.T) {
+	broker := &SpyBroker{}
+	o := agent.DefaultOptions()
+	o.MessageRate = 1
+	o.MessageBurst = 5
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, o, logging.NoopLogger{})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := ws.WriteJSON(generateMessage(i)); err != nil {
+			t.Fatalf("error writing to WS: %v", err)
+		}
+	}
+
+	assertErrorFrame(t, ws, "", messaging.ErrCodeRateLimited)
+}
+
+type SpyAudit struct {
+	events []audit.Event
+	mutex  sync.Mutex
+}
+
+func (a *SpyAudit) Record(e audit.Event) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.events = append(a.events, e)
+}
+
+func TestFloodingPeerIsDisconnected(t *testing.T) {
+	broker := &SpyBroker{}
+	spy := &SpyAudit{}
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
+	agent.EnableAudit(spy, audit.Source{RequestID: "req-1"})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := ws.WriteJSON(generateMessage(i)); err != nil {
+			break
+		}
+	}
+
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second * 1))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Errorf("connection is still open, but the flooding peer should be disconnected")
+			}
+			break
+		}
+	}
+
+	spy.mutex.Lock()
+	defer spy.mutex.Unlock()
+	if len(spy.events) != 1 || spy.events[0].Type != audit.RateLimitDisconnect || spy.events[0].RequestID != "req-1" {
+		t.Errorf("got audit events %+v, want one rate limit disconnect of request req-1", spy.events)
+	}
+}
+
+func TestPeerAboveRateIsDisconnected(t *testing.T) {
+	broker := &SpyBroker{}
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+
+	// every round has a few allowed messages followed by rate limited ones
+	for i := 0; i < 200; i++ {
+		if err := ws.WriteJSON(generateMessage(i)); err != nil {
+			t.Fatalf("error writing to WS: %v", err)
+		}
+	}
+	closed := false
+	for round := 0; round < 10 && !closed; round++ {
+		for i := 0; i < 12; i++ {
+			if err := ws.WriteJSON(generateMessage(i)); err != nil {
+				closed = true
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second * 1))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Errorf("connection is still open, but the peer sending above the rate should be disconnected")
+			}
+			break
+		}
+	}
+}
+
+func TestClosedAgentDisconnectsPeer(t *testing.T) {
+	cases := map[string]struct {
+		close    func(a *agent.Agent)
+		wantCode int
+	}{
+		"when the peer is removed from the room": {
+			close:    func(a *agent.Agent) { a.Close() },
+			wantCode: 4000,
+		},
+		"when the server shuts down": {
+			close:    func(a *agent.Agent) { a.CloseGoingAway() },
+			wantCode: websocket.CloseGoingAway,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			broker := &SpyBroker{}
+			agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
+			s := httptest.NewServer(newMockHandler(agent))
+			defer s.Close()
+
+			ws := openWS(t, s)
+			defer ws.Close()
+			// wait for the server to register the agent
+			time.Sleep(time.Millisecond * 100)
+
+			tt.close(agent)
+
+			_ = ws.SetReadDeadline(time.Now().Add(time.Second * 1))
+			for {
+				_, _, err := ws.ReadMessage()
+				if err == nil {
+					continue
+				}
+				if !websocket.IsCloseError(err, tt.wantCode) {
+					t.Errorf("got error %v, but want close frame with code %d", err, tt.wantCode)
+				}
+				break
+			}
+			// wait until server cleans up
+			time.Sleep(time.Millisecond * 100)
+			broker.assertNoSubscriber(t)
+		})
+	}
+}
+
+func TestInvalidRecipientsAreReportedToPeer(t *testing.T) {
+	broker := &SpyBroker{}
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+
+	payload := json.RawMessage(`"my message"`)
+	if err := ws.WriteJSON(messaging.Message{ID: "msg-1", To: "unknown-peer", Payload: payload}); err != nil {
+		t.Fatalf("error writing to WS: %v", err)
+	}
+	if err := ws.WriteJSON(messaging.Message{ID: "msg-2", To: offlinePeer, Payload: payload}); err != nil {
+		t.Fatalf("error writing to WS: %v", err)
+	}
+
+	assertErrorFrame(t, ws, "msg-1", messaging.ErrCodeUnknownRecipient)
+	assertErrorFrame(t, ws, "msg-2", messaging.ErrCodeOfflineRecipient)
+}
+
+func TestInterceptorRejectionsAreReportedToPeer(t *testing.T) {
+	broker := &SpyBroker{}
+	agent := agent.New(messaging.Peer{UID: myPeer}, myRoomUID, broker, StubDirectory{}, events.NoopSink{}, agent.DefaultOptions(), logging.NoopLogger{})
+	s := httptest.NewServer(newMockHandler(agent))
+	defer s.Close()
+
+	ws := openWS(t, s)
+	defer ws.Close()
+
+	if err := ws.WriteJSON(messaging.Message{ID: "msg-1", Payload: json.RawMessage(forbiddenPayload)}); err != nil {
+		t.Fatalf("error writing to WS: %v", err)
+	}
+
+	assertErrorFrame(t, ws, "msg-1", interceptor.ErrCodeForbiddenContent)
+}
+
+func assertErrorFrame(t *testing.T, ws *websocket.Conn, id string, code string) {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second * 1))
+	var msg messaging.Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("error reading from WS: %v", err)
+	}
+	var payload struct {
+		Type string `json:"type"`
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		t.Fatalf("error decoding error frame payload: %v", err)
+	}
+	if msg.From != messaging.ServerUID || msg.To != myPeer || msg.ID != id {
+		t.Errorf("got error frame %+v, but wanted one from %q to %q with id %q", msg, messaging.ServerUID, myPeer, id)
+	}
+	if payload.Type != "error" || payload.Code != code {
+		t.Errorf("got error payload %+v, but wanted code %q", payload, code)
+	}
+}
+
 func assertSameMessages(t *testing.T, got []messaging.Message, want []messaging.Message) {
 	t.Helper()
 	if len(got) != len(want) {
@@ -262,7 +677,7 @@ func writeIncorrectJSON(t *testing.T, conn *websocket.Conn) {
 
 func writeMessageWithoutPayload(t *testing.T, conn *websocket.Conn) {
 	t.Helper()
-	if err := conn.WriteJSON(messaging.Message{To: "another-peer"}); err != nil {
+	if err := conn.WriteJSON(messaging.Message{To: otherPeer}); err != nil {
 		t.Errorf("error writing empty payload message to WS: %v", err)
 	}
 }
@@ -270,7 +685,7 @@ func writeMessageWithoutPayload(t *testing.T, conn *websocket.Conn) {
 func generateMessage(i int) messaging.Message {
 	var to string
 	if i%2 == 0 {
-		to = "another-peer"
+		to = otherPeer
 	}
 	return messaging.Message{
 		From:    myPeer, // this is ignored by the agent when sent as a client message, but we use it for assertions
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
+)
+
+// ClientMessage is a message sent by a peer. Trace is an optional traceparent of
+// the client's span, which becomes the parent of the message's spans, and
+// TraceState the optional tracestate of the client's trace.
+type ClientMessage struct {
+	ID         string          `json:"id,omitempty"`
+	To         string          `json:"to"`
+	Payload    json.RawMessage `json:"payload"`
+	Trace      string          `json:"trace,omitempty"`
+	TraceState string          `json:"tracestate,omitempty"`
+}
+
+// deliver decodes a message sent by the peer and hands it to the broker. It returns
+// a rejection when the message was not delivered, regardless of the transport
+// the message came from. Delivery is recorded as the named span.
+func deliver(b broker.Broker, d PeerDirectory, t tracing.Tracer, name string, maxSize int, room string, peer string, src audit.Source, data []byte, l logging.Logger) *messaging.Rejection {
+	if len(data) > maxSize {
+		l.Warn("message too large, dropping message", logging.Fields{"room": room, "peer": peer})
+		return &messaging.Rejection{Code: messaging.ErrCodeTooLarge, Reason: "message exceeds maximum size"}
+	}
+
+	var msgReq ClientMessage
+	if err := json.Unmarshal(data, &msgReq); err != nil {
+		l.Error("error decoding message:", logging.Fields{"room": room, "peer": peer, "error": err})
+		return &messaging.Rejection{Code: messaging.ErrCodeDecode, Reason: "message is not valid JSON"}
+	}
+
+	parent, _ := tracing.ParseTraceContext(msgReq.Trace, msgReq.TraceState)
+	span := t.StartSpan(parent, name)
+	defer span.End()
+	span.SetAttribute("room", room)
+	span.SetAttribute("peer", peer)
+	rejection := validate(d, room, peer, msgReq, l)
+	if rejection == nil {
+		rejection = send(b, room, peer, src, msgReq, span.Context(), l)
+	}
+	if rejection != nil {
+		span.SetError(rejection)
+	}
+	return rejection
+}
+
+// validate returns a rejection when the decoded message can't be delivered
+func validate(d PeerDirectory, room string, peer string, msgReq ClientMessage, l logging.Logger) *messaging.Rejection {
+	if msgReq.Payload == nil || bytes.Equal(msgReq.Payload, []byte("null")) {
+		l.Debug("no payload, dropping message", logging.Fields{"room": room, "peer": peer})
+		return &messaging.Rejection{ID: msgReq.ID, Code: messaging.ErrCodeEmptyPayload, Reason: "message has no payload"}
+	}
+	// messages to the server are commands, which are validated by the broker
+	if msgReq.To != "" && msgReq.To != messaging.ServerUID {
+		if _, ok := d.GetPeer(room, msgReq.To); !ok {
+			l.Debug("unknown recipient, dropping message", logging.Fields{"room": room, "peer": peer, "to": msgReq.To})
+			return &messaging.Rejection{ID: msgReq.ID, Code: messaging.ErrCodeUnknownRecipient, Reason: "recipient is not registered in the room"}
+		}
+	}
+	return nil
+}
+
+// send hands the validated message to the broker and returns a rejection when it
+// was not delivered
+func send(b broker.Broker, room string, peer string, src audit.Source, msgReq ClientMessage, trace tracing.SpanContext, l logging.Logger) *messaging.Rejection {
+	err := b.Send(room, messaging.Message{
+		ID:         msgReq.ID,
+		From:       peer,
+		To:         msgReq.To,
+		Payload:    msgReq.Payload,
+		Trace:      trace.Traceparent(),
+		TraceState: trace.TraceState,
+		Source:     src,
+	})
+	var rejection *messaging.Rejection
+	switch {
+	case err == broker.ErrRecipientOffline:
+		l.Debug("recipient offline, message not delivered", logging.Fields{"room": room, "peer": peer, "to": msgReq.To})
+		return &messaging.Rejection{ID: msgReq.ID, Code: messaging.ErrCodeOfflineRecipient, Reason: "recipient is not connected"}
+	case errors.As(err, &rejection):
+		l.Debug("message rejected", logging.Fields{"room": room, "peer": peer, "error": err})
+		return &messaging.Rejection{ID: msgReq.ID, Code: rejection.Code, Reason: rejection.Reason}
+	case err != nil:
+		l.Error("error sending message", logging.Fields{"room": room, "peer": peer, "error": err})
+	}
+	return nil
+}
+
+func sendControl(b broker.Broker, room string, peer string, msgFactory func(a string) (*messaging.Message, error), l logging.Logger) {
+	msg, err := msgFactory(peer)
+	if err != nil {
+		l.Error("failed to create control message", logging.Fields{"room": room, "peer": peer, "error": err})
+	} else if err := b.Send(room, *msg); err != nil {
+		l.Error("failed to send control message", logging.Fields{"room": room, "peer": peer, "error": err})
+	}
+}
+
+// keyDirectory creates the message with public keys of peers in the room for the
+// peer joining it. It returns nil when the directory doesn't keep keys or nobody
+// registered one.
+func keyDirectory(d PeerDirectory, room string, peer string, l logging.Logger) *messaging.Message {
+	kd, ok := d.(KeyDirectory)
+	if !ok {
+		return nil
+	}
+	keys := kd.PublicKeys(room)
+	if len(keys) == 0 {
+		return nil
+	}
+	msg, err := messaging.NewKeyDirectory(peer, keys)
+	if err != nil {
+		l.Error("failed to create key directory", logging.Fields{"room": room, "peer": peer, "error": err})
+		return nil
+	}
+	return msg
+}
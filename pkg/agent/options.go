@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/config"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+)
+
+// Options are timeouts and limits of peers' connections. PingPeriod must be less
+// than PongWait, so that pongs arrive before the read deadline. Peers sending
+// more than MessageRate messages per second, in bursts of MessageBurst, have them
+// rejected and are disconnected after MaxRateStrikes rejections.
+type Options struct {
+	WriteWait       time.Duration
+	PongWait        time.Duration
+	PingPeriod      time.Duration
+	MaxMessageSize  int
+	MessagesBufSize int
+	MessageRate     int
+	MessageBurst    int
+	MaxRateStrikes  int
+}
+
+// DefaultOptions returns the options of the default config.
+func DefaultOptions() Options {
+	cfg := config.Defaults()
+	return NewOptions(&cfg.Websocket)
+}
+
+// NewOptions returns the options set in the validated config.
+func NewOptions(cfg *config.Websocket) Options {
+	return Options{
+		WriteWait:       cfg.WriteWait,
+		PongWait:        cfg.PongWait,
+		PingPeriod:      cfg.PingPeriod,
+		MaxMessageSize:  cfg.MaxMessageSize,
+		MessagesBufSize: cfg.MessagesBufSize,
+		MessageRate:     cfg.MessageRate,
+		MessageBurst:    cfg.MessageBurst,
+		MaxRateStrikes:  cfg.MaxRateStrikes,
+	}
+}
+
+// override returns the options with the fields set in the overrides replacing ours
+func (o Options) override(c messaging.ConnectionOverrides) Options {
+	if c.WriteWait > 0 {
+		o.WriteWait = time.Duration(c.WriteWait) * time.Second
+	}
+	if c.PongWait > 0 {
+		o.PongWait = time.Duration(c.PongWait) * time.Second
+	}
+	if c.PingPeriod > 0 {
+		o.PingPeriod = time.Duration(c.PingPeriod) * time.Second
+	}
+	if c.MaxMessageSize > 0 {
+		o.MaxMessageSize = c.MaxMessageSize
+	}
+	if c.MessagesBufSize > 0 {
+		o.MessagesBufSize = c.MessagesBufSize
+	}
+	if c.MessageRate > 0 {
+		o.MessageRate = c.MessageRate
+	}
+	if c.MessageBurst > 0 {
+		o.MessageBurst = c.MessageBurst
+	}
+	if c.MaxRateStrikes > 0 {
+		o.MaxRateStrikes = c.MaxRateStrikes
+	}
+	return o
+}
+
+// ConnectionStore keeps overrides of connection options with rooms, e.g. the room
+// store, so that instances of the server sharing rooms share their overrides too
+// and they're removed together with rooms.
+type ConnectionStore interface {
+	SetConnectionOverrides(room string, o messaging.ConnectionOverrides) bool
+	ConnectionOverrides(room string) messaging.ConnectionOverrides
+}
+
+// RoomOptions returns options of connections in every room, which are the defaults
+// unless overridden when the room was created. RoomOptions is safe for concurrent use.
+type RoomOptions struct {
+	defaults Options
+	store    ConnectionStore
+	replay   int
+}
+
+func NewRoomOptions(defaults Options, s ConnectionStore) *RoomOptions {
+	return &RoomOptions{defaults: defaults, store: s}
+}
+
+// Get returns options of connections in the room.
+func (r *RoomOptions) Get(room string) Options {
+	return r.defaults.override(r.store.ConnectionOverrides(room))
+}
+
+// SetReplay sets the number of messages replayed from history to peers joining
+// rooms, which their buffers of messages have to hold.
+func (r *RoomOptions) SetReplay(n int) {
+	r.replay = n
+}
+
+// CheckOverrides returns an error when the request would override the defaults
+// with invalid options.
+func (r *RoomOptions) CheckOverrides(req server.ConnectionReq) error {
+	o := r.defaults.override(messaging.ConnectionOverrides(req))
+	if o.PingPeriod >= o.PongWait {
+		return errors.New("connection.ping_period: must be less than pong_wait")
+	}
+	// the buffer holds the key directory too, which peers get before the replay
+	if o.MessagesBufSize <= r.replay {
+		return fmt.Errorf("connection.messages_buf_size: must be more than the %d messages replayed from history", r.replay)
+	}
+	return nil
+}
+
+// SetOverrides overrides options of connections in the room with the checked request.
+func (r *RoomOptions) SetOverrides(room string, req server.ConnectionReq) {
+	r.store.SetConnectionOverrides(room, messaging.ConnectionOverrides(req))
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/ratelimit"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
+)
+
+// Stream delivers messages from the broker to a peer over Server-Sent Events.
+// Together with messages sent by the peer over HTTP, it's an alternative to
+// websockets for clients behind proxies blocking them.
+type Stream struct {
+	peer      messaging.Peer
+	room      string
+	broker    broker.Broker
+	directory PeerDirectory
+	events    events.Sink
+	writeChan chan messaging.Message
+	closeChan chan struct{}
+	closeOnce sync.Once
+	options   Options
+	logger    logging.Logger
+}
+
+func NewStream(p messaging.Peer, r string, b broker.Broker, d PeerDirectory, e events.Sink, o Options, l logging.Logger) *Stream {
+	return &Stream{
+		peer:      p,
+		room:      r,
+		broker:    b,
+		directory: d,
+		events:    e,
+		writeChan: make(chan messaging.Message, o.MessagesBufSize),
+		closeChan: make(chan struct{}),
+		options:   o,
+		logger:    l,
+	}
+}
+
+func StreamHandler(b broker.Broker, d PeerDirectory, e events.Sink, o *RoomOptions, l logging.Logger) server.StreamHandlerFunc {
+	return func(p messaging.Peer, room string, w http.ResponseWriter, r *http.Request) {
+		NewStream(p, room, b, d, e, o.Get(room), l).Serve(w, r)
+	}
+}
+
+// MessageHandler delivers messages sent by peers over HTTP. Every peer's messages
+// are rate limited like the ones sent over websockets.
+func MessageHandler(b broker.Broker, d PeerDirectory, t tracing.Tracer, o *RoomOptions, l logging.Logger) server.MessageHandlerFunc {
+	// rooms may override the limit, so peers are limited by buckets of their room's limit
+	limiters := make(map[[2]int]*ratelimit.Buckets)
+	var mutex sync.Mutex
+	limiter := func(o Options) *ratelimit.Buckets {
+		mutex.Lock()
+		defer mutex.Unlock()
+		limit := [2]int{o.MessageRate, o.MessageBurst}
+		if limiters[limit] == nil {
+			limiters[limit] = ratelimit.NewBuckets(float64(o.MessageRate), o.MessageBurst)
+		}
+		return limiters[limit]
+	}
+
+	return func(p messaging.Peer, room string, r *http.Request) *messaging.Rejection {
+		options := o.Get(room)
+		if !limiter(options).Allow(room + "/" + p.UID) {
+			l.Warn("message rate limit exceeded, dropping message", logging.Fields{"room": room, "peer": p.UID})
+			return &messaging.Rejection{Code: messaging.ErrCodeRateLimited, Reason: "too many messages"}
+		}
+
+		maxSize := options.MaxMessageSize
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxSize)+1))
+		if err != nil {
+			l.Error("error reading message:", logging.Fields{"room": room, "peer": p.UID, "error": err})
+			return &messaging.Rejection{Code: messaging.ErrCodeDecode, Reason: "message could not be read"}
+		}
+		return deliver(b, d, t, "MessageHandler", maxSize, room, p.UID, audit.SourceFrom(r.Context()), data, l)
+	}
+}
+
+func (s *Stream) ID() string {
+	return s.peer.UID
+}
+
+func (s *Stream) Write(m messaging.Message) {
+	select {
+	case s.writeChan <- m:
+	default:
+		s.logger.Warn("message dropped, stream write channel buffer is full", logging.Fields{"room": s.room, "peer": s.peer.UID, "buffer_length": len(s.writeChan)})
+	}
+}
+
+// Close ends the stream, e.g. when the peer is kicked out of the room.
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+}
+
+// Serve streams messages to the peer until the request is done.
+func (s *Stream) Serve(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.logger.Error("response writer does not support streaming", logging.Fields{"room": s.room, "peer": s.peer.UID})
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if msg := keyDirectory(s.directory, s.room, s.peer.UID, s.logger); msg != nil {
+		s.Write(*msg)
+	}
+	sendControl(s.broker, s.room, s.peer.UID, func(uid string) (*messaging.Message, error) {
+		return messaging.NewPeerConnectedWithKey(uid, s.peer.PublicKey)
+	}, s.logger)
+	s.broker.Register(s.room, s)
+	s.events.Notify(events.New(events.PeerConnected, s.room, s.peer.UID))
+	s.logger.Info("stream started", logging.Fields{"room": s.room, "peer": s.peer.UID})
+
+	defer func() {
+		s.broker.Unregister(s.room, s)
+		sendControl(s.broker, s.room, s.peer.UID, messaging.NewPeerDisconnected, s.logger)
+		s.events.Notify(events.New(events.PeerDisconnected, s.room, s.peer.UID))
+		s.logger.Info("stream closed", logging.Fields{"room": s.room, "peer": s.peer.UID})
+	}()
+
+	ticker := time.NewTicker(s.options.PingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m := <-s.writeChan:
+			data, err := json.Marshal(m)
+			if err != nil {
+				s.logger.Error("can't marshal message to json", logging.Fields{"room": s.room, "peer": s.peer.UID, "error": err})
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				s.logger.Info("stream write failed", logging.Fields{"room": s.room, "peer": s.peer.UID, "error": err})
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				s.logger.Info("stream write failed", logging.Fields{"room": s.room, "peer": s.peer.UID, "error": err})
+				return
+			}
+			flusher.Flush()
+		case <-s.closeChan:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
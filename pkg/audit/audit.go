@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/clientip"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+)
+
+// SchemaVersion is the version of the event schema. It changes only when fields
+// are removed or change their meaning.
+const SchemaVersion = 1
+
+// Types of audited events.
+const (
+	RoomCreated         = "room_created"
+	RoomDeleted         = "room_deleted"
+	PeerRegistered      = "peer_registered"
+	PeerJoined          = "peer_joined"
+	JoinFailed          = "join_failed"
+	AdminAuthFailed     = "admin_auth_failed"
+	PeerKicked          = "peer_kicked"
+	PeerMuted           = "peer_muted"
+	PeerUnmuted         = "peer_unmuted"
+	PeerBanned          = "peer_banned"
+	SecretRotated       = "secret_rotated"
+	SecretRevoked       = "secret_revoked"
+	RateLimitDisconnect = "rate_limit_disconnect"
+)
+
+// RequestIDHeader carries the correlation id of a request. It's generated when
+// the client doesn't send one and is returned in the response.
+const RequestIDHeader = "X-Request-ID"
+
+const (
+	maxRequestIDLength = 64
+	maxUserAgentLength = 256
+)
+
+// Source identifies the client a request came from. RequestID correlates all
+// events caused by the request, including the ones of the session it started.
+type Source struct {
+	RemoteIP  string
+	UserAgent string
+	RequestID string
+}
+
+// NewSource creates the source of the request. RemoteIP is the address the request
+// came from, which is a proxy's address when the client is behind it.
+func NewSource(r *http.Request) Source {
+	ip := clientip.RemoteIP(r)
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = newRequestID()
+	}
+	return Source{RemoteIP: ip, UserAgent: ua, RequestID: id}
+}
+
+type sourceKey struct{}
+
+// WithSource returns a copy of the context carrying the source.
+func WithSource(ctx context.Context, src Source) context.Context {
+	return context.WithValue(ctx, sourceKey{}, src)
+}
+
+// SourceFrom returns the source carried by the context, if any.
+func SourceFrom(ctx context.Context) Source {
+	src, _ := ctx.Value(sourceKey{}).(Source)
+	return src
+}
+
+// Event is a security-relevant event. Actor is who caused the event, when it's
+// not the client itself, e.g. "admin" or the UID of a host.
+type Event struct {
+	Version   int       `json:"v"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Room      string    `json:"room,omitempty"`
+	Peer      string    `json:"peer,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	RemoteIP  string    `json:"remote_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func New(t string, room string, peer string, src Source) Event {
+	return Event{
+		Version:   SchemaVersion,
+		Time:      time.Now().UTC(),
+		Type:      t,
+		Room:      room,
+		Peer:      peer,
+		RemoteIP:  src.RemoteIP,
+		UserAgent: src.UserAgent,
+		RequestID: src.RequestID,
+	}
+}
+
+// Sink records audit events.
+type Sink interface {
+	Record(e Event)
+}
+
+// NoopSink drops all events.
+type NoopSink struct{}
+
+func (NoopSink) Record(Event) {}
+
+// Log writes events as JSON lines, separately from operational logs.
+type Log struct {
+	w      io.Writer
+	closer io.Closer
+	mutex  sync.Mutex
+	logger logging.Logger
+}
+
+func NewLog(w io.Writer, l logging.Logger) *Log {
+	return &Log{w: w, logger: l}
+}
+
+// Open creates a log writing to stdout when output is "stdout", or appending to
+// the file at the output path otherwise.
+func Open(output string, l logging.Logger) (*Log, error) {
+	if output == "stdout" {
+		return NewLog(os.Stdout, l), nil
+	}
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log := NewLog(f, l)
+	log.closer = f
+	return log, nil
+}
+
+func (a *Log) Record(e Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		a.logger.Error("can't marshal audit event to json", logging.Fields{"type": e.Type, "error": err})
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.w.Write(line); err != nil {
+		a.logger.Error("audit event write failed", logging.Fields{"type": e.Type, "error": err})
+	}
+}
+
+// Close closes the file the log writes to.
+func (a *Log) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
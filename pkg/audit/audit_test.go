@@ -0,0 +1,73 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+)
+
+func TestLogWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	log := audit.NewLog(&buf, logging.NoopLogger{})
+	src := audit.Source{RemoteIP: "10.0.0.1", UserAgent: "test", RequestID: "req-1"}
+
+	log.Record(audit.New(audit.JoinFailed, "room-123", "", src))
+	log.Record(audit.New(audit.PeerJoined, "room-123", "peer-abc", src))
+
+	var got []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("could not decode line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d lines, want 2", len(got))
+	}
+	want := map[string]interface{}{
+		"v":          float64(audit.SchemaVersion),
+		"type":       audit.PeerJoined,
+		"room":       "room-123",
+		"peer":       "peer-abc",
+		"remote_ip":  "10.0.0.1",
+		"user_agent": "test",
+		"request_id": "req-1",
+	}
+	for k, v := range want {
+		if got[1][k] != v {
+			t.Errorf("got %q = %v, want %v", k, got[1][k], v)
+		}
+	}
+	if _, ok := got[0]["peer"]; ok {
+		t.Errorf("empty fields should be omitted, got %v", got[0])
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	r, err := http.NewRequest("GET", "/rooms/room-123/ws", nil)
+	if err != nil {
+		t.Fatalf("could not instantiate request: %v", err)
+	}
+	r.RemoteAddr = "192.0.2.1:54321"
+	r.Header.Set("User-Agent", "test-agent")
+
+	src := audit.NewSource(r)
+	if src.RemoteIP != "192.0.2.1" || src.UserAgent != "test-agent" {
+		t.Errorf("got source %+v", src)
+	}
+	if len(src.RequestID) != 16 {
+		t.Errorf("got request id %q, want a generated one", src.RequestID)
+	}
+
+	r.Header.Set(audit.RequestIDHeader, "from-proxy")
+	if src := audit.NewSource(r); src.RequestID != "from-proxy" {
+		t.Errorf("got request id %q, want the one sent by the client", src.RequestID)
+	}
+}
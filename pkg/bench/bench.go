@@ -0,0 +1,393 @@
+// Package bench load tests a tarpon server. It creates rooms with peers, drives
+// their traffic and measures how much of it is delivered and how fast.
+package bench
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/client"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+)
+
+// Traffic patterns.
+const (
+	// Broadcast makes every peer broadcast to the room
+	Broadcast = "broadcast"
+	// Direct makes every peer send messages to random peers in the room
+	Direct = "direct"
+)
+
+// Config describes the load. Every peer sends Rate messages per second, or as
+// many as it can when Rate is zero, for Duration or until it sent Messages, when
+// it's set. Delivery of messages is awaited for Grace after sending stops.
+type Config struct {
+	URL         string
+	Token       string
+	Rooms       int
+	Peers       int
+	Pattern     string
+	Rate        float64
+	Duration    time.Duration
+	Messages    int
+	PayloadSize int
+	Grace       time.Duration
+}
+
+// DefaultConfig returns a config of a short load of a local server.
+func DefaultConfig() Config {
+	return Config{
+		URL:         "http://localhost:5000",
+		Rooms:       10,
+		Peers:       5,
+		Pattern:     Broadcast,
+		Rate:        10,
+		Duration:    10 * time.Second,
+		PayloadSize: 256,
+		Grace:       time.Second,
+	}
+}
+
+// Validate returns an error describing the first invalid setting.
+func (c *Config) Validate() error {
+	switch {
+	case c.Rooms < 1:
+		return errors.New("rooms: must be positive")
+	case c.Peers < 2:
+		return errors.New("peers: must be at least 2")
+	case c.Pattern != Broadcast && c.Pattern != Direct:
+		return fmt.Errorf("pattern: must be %s or %s", Broadcast, Direct)
+	case c.Rate < 0:
+		return errors.New("rate: must not be negative")
+	case c.Duration <= 0 && c.Messages <= 0:
+		return errors.New("duration or messages: must be positive")
+	case c.PayloadSize < 0:
+		return errors.New("payload_size: must not be negative")
+	}
+	return nil
+}
+
+// Report summarizes a run. Rejected counts messages the server rejected, e.g.
+// because the sender exceeded its rate limit. Expected counts deliveries of sent
+// messages which were not rejected to their recipients, Dropped those which didn't
+// happen. Latency percentiles are of delivered messages.
+type Report struct {
+	Rooms              int
+	Peers              int
+	ConnectionFailures int
+	Reconnects         int64
+	Sent               int64
+	Rejected           int64
+	Expected           int64
+	Received           int64
+	Dropped            int64
+	Elapsed            time.Duration
+	Throughput         float64
+	LatencyP50         time.Duration
+	LatencyP90         time.Duration
+	LatencyP99         time.Duration
+	LatencyMax         time.Duration
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "rooms:               %d\n", r.Rooms)
+	fmt.Fprintf(&b, "peers:               %d\n", r.Peers)
+	fmt.Fprintf(&b, "connection failures: %d\n", r.ConnectionFailures)
+	fmt.Fprintf(&b, "reconnects:          %d\n", r.Reconnects)
+	fmt.Fprintf(&b, "sent:                %d\n", r.Sent)
+	fmt.Fprintf(&b, "rejected:            %d\n", r.Rejected)
+	fmt.Fprintf(&b, "received:            %d of %d, %d dropped\n", r.Received, r.Expected, r.Dropped)
+	fmt.Fprintf(&b, "elapsed:             %v\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "throughput:          %.1f msg/s\n", r.Throughput)
+	fmt.Fprintf(&b, "latency:             p50 %v, p90 %v, p99 %v, max %v\n", r.LatencyP50, r.LatencyP90, r.LatencyP99, r.LatencyMax)
+	return b.String()
+}
+
+// payload carries the time the message was sent at, padded to the configured size
+type payload struct {
+	Sent    int64  `json:"sent"`
+	Padding string `json:"padding,omitempty"`
+}
+
+// recorder collects deliveries of messages to all peers
+type recorder struct {
+	latencies  []time.Duration
+	mutex      sync.Mutex
+	received   int64
+	rejected   int64
+	reconnects int64
+}
+
+func (r *recorder) record(latency time.Duration) {
+	atomic.AddInt64(&r.received, 1)
+	r.mutex.Lock()
+	r.latencies = append(r.latencies, latency)
+	r.mutex.Unlock()
+}
+
+// peer is a handler of a connected peer's messages. Rejected counts rejections of
+// messages the peer sent.
+type peer struct {
+	uid      string
+	recorder *recorder
+	rejected int64
+}
+
+func (p *peer) HandleMessage(m messaging.Message) {
+	if m.From == p.uid {
+		return
+	}
+	var pl payload
+	if err := json.Unmarshal(m.Payload, &pl); err != nil || pl.Sent == 0 {
+		return
+	}
+	p.recorder.record(time.Since(time.Unix(0, pl.Sent)))
+}
+
+func (p *peer) HandleEvent(e client.Event) {
+	switch e.Type {
+	case client.EventError:
+		atomic.AddInt64(&p.recorder.rejected, 1)
+		atomic.AddInt64(&p.rejected, 1)
+	case client.Reconnected:
+		atomic.AddInt64(&p.recorder.reconnects, 1)
+	}
+}
+
+type room struct {
+	uid      string
+	peers    []string
+	conns    []*client.Conn
+	handlers []*peer
+}
+
+// Run creates the rooms, connects their peers, drives the traffic and removes the
+// rooms. Peers which fail to connect are counted and don't take part in the run.
+func Run(ctx context.Context, cfg Config) (Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return Report{}, err
+	}
+	c := client.New(cfg.URL, cfg.Token)
+	rec := &recorder{}
+	report := Report{Rooms: cfg.Rooms, Peers: cfg.Rooms * cfg.Peers}
+
+	rooms, err := setUp(ctx, c, cfg)
+	defer tearDown(c, rooms)
+	if err != nil {
+		return Report{}, err
+	}
+	for _, r := range rooms {
+		for i, uid := range r.peers {
+			handler := &peer{uid: uid, recorder: rec}
+			conn, err := c.Connect(ctx, r.uid, secret(r.uid, uid), handler, client.DefaultConnOptions())
+			if err != nil {
+				report.ConnectionFailures++
+				continue
+			}
+			r.conns[i] = conn
+			r.handlers[i] = handler
+		}
+	}
+	// peers are announced to rooms before they start sending
+	time.Sleep(100 * time.Millisecond)
+
+	pad := strings.Repeat("x", cfg.PayloadSize)
+	var sent int64
+	sentBy := make(map[*peer]int64)
+	var sentMutex sync.Mutex
+	var wg sync.WaitGroup
+	runCtx := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	start := time.Now()
+	for _, r := range rooms {
+		for i, conn := range r.conns {
+			if conn == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(r *room, from int, conn *client.Conn) {
+				defer wg.Done()
+				n := drive(runCtx, cfg, r.recipients(from), conn, pad)
+				atomic.AddInt64(&sent, n)
+				sentMutex.Lock()
+				sentBy[r.handlers[from]] = n
+				sentMutex.Unlock()
+			}(r, i, conn)
+		}
+	}
+	wg.Wait()
+	sending := time.Since(start)
+
+	time.Sleep(cfg.Grace)
+	var expected int64
+	for _, r := range rooms {
+		expected += r.expected(cfg.Pattern, sentBy)
+		r.close()
+	}
+
+	report.Sent = sent
+	report.Expected = expected
+	report.Received = atomic.LoadInt64(&rec.received)
+	report.Rejected = atomic.LoadInt64(&rec.rejected)
+	report.Reconnects = atomic.LoadInt64(&rec.reconnects)
+	if report.Expected > report.Received {
+		report.Dropped = report.Expected - report.Received
+	}
+	report.Elapsed = sending
+	if sending > 0 {
+		report.Throughput = float64(report.Received) / sending.Seconds()
+	}
+	rec.mutex.Lock()
+	report.LatencyP50, report.LatencyP90, report.LatencyP99, report.LatencyMax = percentiles(rec.latencies)
+	rec.mutex.Unlock()
+	return report, nil
+}
+
+// drive sends messages of the peer until the context is done or the peer sent all
+// its messages, and returns the number of sent messages. Broadcasts are sent to
+// the recipients, direct messages to one of them at random. Peers without
+// recipients send no direct messages.
+func drive(ctx context.Context, cfg Config, recipients []string, conn *client.Conn, pad string) (sent int64) {
+	if cfg.Pattern == Direct && len(recipients) == 0 {
+		return 0
+	}
+	var tick <-chan time.Time
+	if cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for cfg.Messages <= 0 || sent < int64(cfg.Messages) {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return sent
+			}
+		} else if ctx.Err() != nil {
+			return sent
+		}
+
+		to := ""
+		if cfg.Pattern == Direct {
+			to = recipients[mrand.Intn(len(recipients))]
+		}
+		if err := conn.Send(to, payload{Sent: time.Now().UnixNano(), Padding: pad}); err != nil {
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// setUp creates the rooms and registers their peers
+func setUp(ctx context.Context, c *client.Client, cfg Config) ([]*room, error) {
+	run := randomHex(4)
+	rooms := make([]*room, 0, cfg.Rooms)
+	for i := 0; i < cfg.Rooms; i++ {
+		r := &room{uid: fmt.Sprintf("bench-%s-%d", run, i), conns: make([]*client.Conn, cfg.Peers), handlers: make([]*peer, cfg.Peers)}
+		if err := c.CreateRoom(ctx, server.CreateRoomReq{UID: r.uid}); err != nil {
+			return rooms, fmt.Errorf("error creating room %s: %w", r.uid, err)
+		}
+		rooms = append(rooms, r)
+		for j := 0; j < cfg.Peers; j++ {
+			uid := fmt.Sprintf("peer-%d", j)
+			if _, err := c.RegisterPeer(ctx, r.uid, server.RegisterPeerReq{UID: uid, Secret: secret(r.uid, uid)}); err != nil {
+				return rooms, fmt.Errorf("error registering peer %s in room %s: %w", uid, r.uid, err)
+			}
+			r.peers = append(r.peers, uid)
+		}
+	}
+	return rooms, nil
+}
+
+// tearDown disconnects the peers and deletes the rooms
+func tearDown(c *client.Client, rooms []*room) {
+	for _, r := range rooms {
+		r.close()
+		// servers without the delete endpoint keep the rooms until restarted
+		_ = c.DeleteRoom(context.Background(), r.uid)
+	}
+}
+
+// recipients returns connected peers other than the sender
+func (r *room) recipients(from int) []string {
+	uids := make([]string, 0, len(r.peers))
+	for i, c := range r.conns {
+		if c != nil && i != from {
+			uids = append(uids, r.peers[i])
+		}
+	}
+	return uids
+}
+
+// expected returns deliveries of messages sent by peers of the room which were not
+// rejected. Every message of a peer has the same number of recipients, so that
+// rejections, which don't always tell which message was rejected, are matched with
+// deliveries.
+func (r *room) expected(pattern string, sentBy map[*peer]int64) int64 {
+	var expected int64
+	for i, h := range r.handlers {
+		if h == nil {
+			continue
+		}
+		deliveries := int64(1)
+		if pattern == Broadcast {
+			deliveries = int64(len(r.recipients(i)))
+		}
+		if accepted := sentBy[h] - atomic.LoadInt64(&h.rejected); accepted > 0 {
+			expected += accepted * deliveries
+		}
+	}
+	return expected
+}
+
+func (r *room) close() {
+	for i, c := range r.conns {
+		if c != nil {
+			c.Close()
+			r.conns[i] = nil
+		}
+	}
+}
+
+// secret derives the peer's secret, which is long enough to be accepted by the server
+func secret(room string, uid string) string {
+	return "bench-secret-" + room + "-" + uid
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func percentiles(latencies []time.Duration) (p50 time.Duration, p90 time.Duration, p99 time.Duration, max time.Duration) {
+	if len(latencies) == 0 {
+		return 0, 0, 0, 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	return at(0.5), at(0.9), at(0.99), latencies[len(latencies)-1]
+}
@@ -0,0 +1,123 @@
+package bench_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/agent"
+	"github.com/montrosesoftware/tarpon/pkg/bench"
+)
+
+func TestRun(t *testing.T) {
+	ts := bench.NewLocalServer()
+	defer ts.Close()
+
+	for _, pattern := range []string{bench.Broadcast, bench.Direct} {
+		t.Run(pattern, func(t *testing.T) {
+			cfg := bench.DefaultConfig()
+			cfg.URL = ts.URL
+			cfg.Rooms = 2
+			cfg.Peers = 3
+			cfg.Pattern = pattern
+			cfg.Rate = 50
+			cfg.Duration = 0
+			cfg.Messages = 5
+			cfg.Grace = 100 * time.Millisecond
+
+			report, err := bench.Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if report.ConnectionFailures != 0 || report.Sent != 30 {
+				t.Errorf("got report\n%v\nwant all 6 peers sending 5 messages", report)
+			}
+			if report.Received != report.Expected || report.Dropped != 0 || report.LatencyMax == 0 {
+				t.Errorf("got report\n%v\nwant all messages delivered", report)
+			}
+		})
+	}
+}
+
+func TestRunRejectedMessagesAreNotDropped(t *testing.T) {
+	o := agent.DefaultOptions()
+	o.MessageRate = 1
+	o.MessageBurst = 2
+	o.MaxRateStrikes = 1000
+	ts := bench.NewLocalServerWithOptions(o)
+	defer ts.Close()
+
+	for _, pattern := range []string{bench.Broadcast, bench.Direct} {
+		t.Run(pattern, func(t *testing.T) {
+			cfg := bench.DefaultConfig()
+			cfg.URL = ts.URL
+			cfg.Rooms = 1
+			cfg.Peers = 3
+			cfg.Pattern = pattern
+			cfg.Rate = 0
+			cfg.Duration = 0
+			cfg.Messages = 10
+			cfg.Grace = 100 * time.Millisecond
+
+			report, err := bench.Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if report.Rejected == 0 {
+				t.Fatalf("got report\n%v\nwant messages over the rate limit rejected", report)
+			}
+			if report.Received != report.Expected || report.Dropped != 0 {
+				t.Errorf("got report\n%v\nwant rejected messages not counted as dropped", report)
+			}
+		})
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	cases := map[string]func(c *bench.Config){
+		"no rooms":         func(c *bench.Config) { c.Rooms = 0 },
+		"single peer":      func(c *bench.Config) { c.Peers = 1 },
+		"unknown pattern":  func(c *bench.Config) { c.Pattern = "multicast" },
+		"no duration":      func(c *bench.Config) { c.Duration = 0 },
+		"negative payload": func(c *bench.Config) { c.PayloadSize = -1 },
+	}
+	for name, change := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := bench.DefaultConfig()
+			change(&cfg)
+			if _, err := bench.Run(context.Background(), cfg); err == nil {
+				t.Errorf("run with invalid config succeeded")
+			}
+		})
+	}
+}
+
+func benchmarkPattern(b *testing.B, pattern string) {
+	ts := bench.NewLocalServer()
+	defer ts.Close()
+
+	cfg := bench.DefaultConfig()
+	cfg.URL = ts.URL
+	cfg.Pattern = pattern
+	cfg.Rate = 50
+	cfg.Duration = 0
+	cfg.Messages = b.N/(cfg.Rooms*cfg.Peers) + 1
+	cfg.Grace = 200 * time.Millisecond
+
+	b.ResetTimer()
+	report, err := bench.Run(context.Background(), cfg)
+	b.StopTimer()
+	if err != nil {
+		b.Fatalf("run failed: %v", err)
+	}
+	b.ReportMetric(float64(report.LatencyP99.Microseconds()), "p99-µs")
+	b.ReportMetric(float64(report.Dropped), "dropped")
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	benchmarkPattern(b, bench.Broadcast)
+}
+
+func BenchmarkDirect(b *testing.B) {
+	benchmarkPattern(b, bench.Direct)
+}
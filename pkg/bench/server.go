@@ -0,0 +1,32 @@
+package bench
+
+import (
+	"net/http/httptest"
+
+	"github.com/montrosesoftware/tarpon/pkg/agent"
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
+)
+
+// NewLocalServer starts an in-process server with the in-memory store and broker
+// and default connection options, e.g. to run the load in Go benchmarks. Its URL
+// is the URL of the load's config. The server must be closed.
+func NewLocalServer() *httptest.Server {
+	return NewLocalServerWithOptions(agent.DefaultOptions())
+}
+
+// NewLocalServerWithOptions starts an in-process server like NewLocalServer, with
+// the connection options, e.g. to load a server with lower rate limits.
+func NewLocalServerWithOptions(o agent.Options) *httptest.Server {
+	l := logging.NoopLogger{}
+	store := messaging.NewRoomStore()
+	b := broker.NewBroker(l)
+	options := agent.NewRoomOptions(o, store)
+	s := server.NewRoomServer(store, agent.PeerHandler(b, store, events.NoopSink{}, audit.NoopSink{}, tracing.NoopTracer{}, options, l), l)
+	return httptest.NewServer(s)
+}
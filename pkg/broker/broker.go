@@ -1,90 +1,159 @@
 package broker
 
 import (
+	"errors"
+	"hash/fnv"
 	"sync"
 
 	"github.com/montrosesoftware/tarpon/pkg/logging"
 	"github.com/montrosesoftware/tarpon/pkg/messaging"
 )
 
+const shardsCount = 64
+
+// ErrRecipientOffline is returned when a direct message could not be delivered
+// because its recipient has no subscriber registered in the room.
+var ErrRecipientOffline = errors.New("recipient offline")
+
 type Subscriber interface {
 	Write(m messaging.Message)
 	ID() string
 }
 
 type Broker interface {
-	Send(room string, message messaging.Message)
+	Send(room string, message messaging.Message) error
 	Register(room string, s Subscriber)
 	Unregister(room string, s Subscriber) bool
 }
 
+// InMemoryBroker delivers messages to subscribers registered in the same process.
+// Rooms are spread over shards, each guarded by its own lock, so that traffic in
+// one room does not contend with other rooms.
 type InMemoryBroker struct {
-	subscribers map[string][]Subscriber
-	mutex       sync.RWMutex
-	logger      logging.Logger
+	shards [shardsCount]shard
+	logger logging.Logger
 }
 
-func NewBroker(l logging.Logger) *InMemoryBroker {
-	return &InMemoryBroker{subscribers: make(map[string][]Subscriber), logger: l}
+type shard struct {
+	rooms map[string]*roomSubscribers
+	mutex sync.RWMutex
 }
 
-func (b *InMemoryBroker) Send(room string, message messaging.Message) {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+// roomSubscribers indexes subscribers of a single room by their ID. Slices are
+// never modified in place, so they can be read after the shard lock is released.
+type roomSubscribers struct {
+	all  []Subscriber
+	byID map[string][]Subscriber
+}
 
-	if message.IsBroadcast() {
-		b.broadcast(message, b.subscribers[room])
-	} else {
-		b.sendDirect(message, b.subscribers[room])
+func NewBroker(l logging.Logger) *InMemoryBroker {
+	b := &InMemoryBroker{logger: l}
+	for i := range b.shards {
+		b.shards[i].rooms = make(map[string]*roomSubscribers)
 	}
+	return b
+}
+
+// CheckHealth always succeeds, the broker has no backplane which could fail.
+func (b *InMemoryBroker) CheckHealth() error {
+	return nil
 }
 
-func (b *InMemoryBroker) Register(room string, s Subscriber) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+func (b *InMemoryBroker) Send(room string, message messaging.Message) error {
+	s := b.shard(room)
 
-	b.subscribers[room] = append(b.subscribers[room], s)
-	b.logger.Info("subscriber registered", logging.Fields{"room": room, "subscriber": s.ID(), "subscribers_count": len(b.subscribers[room])})
+	s.mutex.RLock()
+	var subscribers []Subscriber
+	if rs := s.rooms[room]; rs != nil {
+		if message.IsBroadcast() {
+			subscribers = rs.all
+		} else {
+			subscribers = rs.byID[message.To]
+		}
+	}
+	s.mutex.RUnlock()
+
+	if len(subscribers) == 0 && !message.IsBroadcast() {
+		return ErrRecipientOffline
+	}
+	for _, subscriber := range subscribers {
+		subscriber.Write(message)
+	}
+	return nil
 }
 
-func (b *InMemoryBroker) Unregister(room string, s Subscriber) bool {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+func (b *InMemoryBroker) Register(room string, sub Subscriber) {
+	s := b.shard(room)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	roomSubs := b.subscribers[room]
-	for i, subscriber := range roomSubs {
-		if subscriber == s {
-			if len(roomSubs) == 1 {
-				delete(b.subscribers, room)
+	rs := s.rooms[room]
+	if rs == nil {
+		rs = &roomSubscribers{byID: make(map[string][]Subscriber)}
+		s.rooms[room] = rs
+	}
+	rs.all = appendCopy(rs.all, sub)
+	rs.byID[sub.ID()] = appendCopy(rs.byID[sub.ID()], sub)
+	b.logger.Info("subscriber registered", logging.Fields{"room": room, "subscriber": sub.ID(), "subscribers_count": len(rs.all)})
+}
+
+func (b *InMemoryBroker) Unregister(room string, sub Subscriber) bool {
+	s := b.shard(room)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rs := s.rooms[room]
+	if rs != nil {
+		if all, ok := removeCopy(rs.all, sub); ok {
+			rs.all = all
+			if byID, _ := removeCopy(rs.byID[sub.ID()], sub); len(byID) == 0 {
+				delete(rs.byID, sub.ID())
 			} else {
-				roomSubs[i] = roomSubs[len(roomSubs)-1]
-				b.subscribers[room] = roomSubs[:len(roomSubs)-1]
+				rs.byID[sub.ID()] = byID
+			}
+			if len(rs.all) == 0 {
+				delete(s.rooms, room)
 			}
-			b.logger.Info("subscriber unregistered", logging.Fields{"room": room, "subscriber": s.ID(), "subscribers_count": len(b.subscribers[room])})
+			b.logger.Info("subscriber unregistered", logging.Fields{"room": room, "subscriber": sub.ID(), "subscribers_count": len(rs.all)})
 			return true
 		}
 	}
-	b.logger.Warn("tried to unregister subscriber, but it seems not registered", logging.Fields{"room": room, "subscriber": s.ID()})
+	b.logger.Warn("tried to unregister subscriber, but it seems not registered", logging.Fields{"room": room, "subscriber": sub.ID()})
 	return false
 }
 
 func (b *InMemoryBroker) RoomsCount() int {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+	count := 0
+	for i := range b.shards {
+		s := &b.shards[i]
+		s.mutex.RLock()
+		count += len(s.rooms)
+		s.mutex.RUnlock()
+	}
+	return count
+}
 
-	return len(b.subscribers)
+func (b *InMemoryBroker) shard(room string) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(room))
+	return &b.shards[h.Sum32()%shardsCount]
 }
 
-func (b *InMemoryBroker) broadcast(message messaging.Message, subscribers []Subscriber) {
-	for _, subscriber := range subscribers {
-		subscriber.Write(message)
-	}
+// appendCopy returns a new slice with s appended to subscribers
+func appendCopy(subscribers []Subscriber, s Subscriber) []Subscriber {
+	result := make([]Subscriber, len(subscribers), len(subscribers)+1)
+	copy(result, subscribers)
+	return append(result, s)
 }
 
-func (b *InMemoryBroker) sendDirect(message messaging.Message, subscribers []Subscriber) {
-	for _, subscriber := range subscribers {
-		if subscriber.ID() == message.To {
-			subscriber.Write(message)
+// removeCopy returns a new slice without the first occurrence of s and reports whether s was found
+func removeCopy(subscribers []Subscriber, s Subscriber) ([]Subscriber, bool) {
+	for i, subscriber := range subscribers {
+		if subscriber == s {
+			result := make([]Subscriber, 0, len(subscribers)-1)
+			result = append(result, subscribers[:i]...)
+			return append(result, subscribers[i+1:]...), true
 		}
 	}
+	return subscribers, false
 }
@@ -1,8 +1,11 @@
 package broker_test
 
 import (
+	"fmt"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/montrosesoftware/tarpon/pkg/broker"
@@ -40,6 +43,13 @@ func (s *SpySubscriber) assertMessages(t *testing.T, ms []messaging.Message) {
 	}
 }
 
+func assertSent(t *testing.T, b broker.Broker, room string, m messaging.Message) {
+	t.Helper()
+	if err := b.Send(room, m); err != nil {
+		t.Errorf("could not send message %v: %v", m, err)
+	}
+}
+
 func TestRegistration(t *testing.T) {
 	broker := broker.NewBroker(logging.NoopLogger{})
 	subscriber := &SpySubscriber{id: peer1}
@@ -97,33 +107,49 @@ func TestSendingMessages(t *testing.T) {
 	broker.Register(room2, subscriber33)
 
 	m1 := messaging.Message{To: subscriber1.id}
-	broker.Send(room1, m1)
+	assertSent(t, broker, room1, m1)
 	subscriber1.assertMessages(t, []messaging.Message{m1})
 	subscriber2.assertMessages(t, nil)
 	subscriber3.assertMessages(t, nil)
 	subscriber33.assertMessages(t, nil)
 
 	m2 := messaging.Message{To: ""} // broadcast message
-	broker.Send(room1, m2)
+	assertSent(t, broker, room1, m2)
 	subscriber1.assertMessages(t, []messaging.Message{m1, m2})
 	subscriber2.assertMessages(t, []messaging.Message{m2})
 	subscriber3.assertMessages(t, nil)
 	subscriber33.assertMessages(t, nil)
 
 	m3 := messaging.Message{To: subscriber3.id}
-	broker.Send(room2, m3)
+	assertSent(t, broker, room2, m3)
 	subscriber1.assertMessages(t, []messaging.Message{m1, m2})
 	subscriber2.assertMessages(t, []messaging.Message{m2})
 	subscriber3.assertMessages(t, []messaging.Message{m3})
 	subscriber33.assertMessages(t, []messaging.Message{m3})
 
-	broker.Send("invalid room", m3)
+	if err := broker.Send("invalid room", m3); err == nil {
+		t.Errorf("sending to invalid room succeeded, but it shouldn't")
+	}
 	subscriber1.assertMessages(t, []messaging.Message{m1, m2})
 	subscriber2.assertMessages(t, []messaging.Message{m2})
 	subscriber3.assertMessages(t, []messaging.Message{m3})
 	subscriber33.assertMessages(t, []messaging.Message{m3})
 }
 
+func TestSendingToOfflineRecipient(t *testing.T) {
+	b := broker.NewBroker(logging.NoopLogger{})
+	subscriber1 := &SpySubscriber{id: peer1}
+	b.Register(room1, subscriber1)
+
+	if err := b.Send(room1, messaging.Message{To: peer2}); err != broker.ErrRecipientOffline {
+		t.Errorf("got %v when sending to offline peer, but wanted %v", err, broker.ErrRecipientOffline)
+	}
+	if err := b.Send(room2, messaging.Message{To: ""}); err != nil {
+		t.Errorf("got %v when broadcasting to empty room, but wanted no error", err)
+	}
+	subscriber1.assertMessages(t, nil)
+}
+
 func TestConcurrentSends(t *testing.T) {
 	broker := broker.NewBroker(logging.NoopLogger{})
 	subscriber1 := &SpySubscriber{id: peer1}
@@ -138,7 +164,7 @@ func TestConcurrentSends(t *testing.T) {
 	go func() {
 		m := messaging.Message{To: subscriber1.id}
 		for i := 0; i < 1000; i++ {
-			broker.Send(room1, m)
+			assertSent(t, broker, room1, m)
 		}
 		wg.Done()
 	}()
@@ -146,7 +172,7 @@ func TestConcurrentSends(t *testing.T) {
 	go func() {
 		m := messaging.Message{To: ""}
 		for i := 0; i < 1000; i++ {
-			broker.Send(room1, m)
+			assertSent(t, broker, room1, m)
 		}
 		wg.Done()
 	}()
@@ -161,3 +187,92 @@ func TestConcurrentSends(t *testing.T) {
 		t.Errorf("subscriber 2 received %d messages, but wanted 1000", len(subscriber1.messages))
 	}
 }
+
+type countingSubscriber struct {
+	id    string
+	count int64
+}
+
+func (s *countingSubscriber) ID() string {
+	return s.id
+}
+
+func (s *countingSubscriber) Write(m messaging.Message) {
+	atomic.AddInt64(&s.count, 1)
+}
+
+func newPopulatedBroker(rooms int, peers int) *broker.InMemoryBroker {
+	b := broker.NewBroker(logging.NoopLogger{})
+	for r := 0; r < rooms; r++ {
+		for p := 0; p < peers; p++ {
+			b.Register(benchRoom(r), &countingSubscriber{id: benchPeer(p)})
+		}
+	}
+	return b
+}
+
+func benchRoom(i int) string {
+	return "room-" + strconv.Itoa(i)
+}
+
+func benchPeer(i int) string {
+	return "peer-" + strconv.Itoa(i)
+}
+
+func BenchmarkSendDirect(b *testing.B) {
+	for _, size := range []struct{ rooms, peers int }{{10, 10}, {1000, 10}, {10000, 10}, {100, 1000}} {
+		b.Run(fmt.Sprintf("%d_rooms_%d_peers", size.rooms, size.peers), func(b *testing.B) {
+			broker := newPopulatedBroker(size.rooms, size.peers)
+			var seq int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(atomic.AddInt64(&seq, 1))
+					m := messaging.Message{To: benchPeer(i % size.peers)}
+					if err := broker.Send(benchRoom(i%size.rooms), m); err != nil {
+						b.Errorf("could not send message: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, size := range []struct{ rooms, peers int }{{1000, 10}, {10, 1000}} {
+		b.Run(fmt.Sprintf("%d_rooms_%d_peers", size.rooms, size.peers), func(b *testing.B) {
+			broker := newPopulatedBroker(size.rooms, size.peers)
+			var seq int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(atomic.AddInt64(&seq, 1))
+					if err := broker.Send(benchRoom(i%size.rooms), messaging.Message{}); err != nil {
+						b.Errorf("could not send message: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkRegisterWhileSending(b *testing.B) {
+	broker := newPopulatedBroker(1000, 10)
+	var seq int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(atomic.AddInt64(&seq, 1))
+			room := benchRoom(i % 1000)
+			if i%10 == 0 {
+				s := &countingSubscriber{id: "churn"}
+				broker.Register(room, s)
+				broker.Unregister(room, s)
+				continue
+			}
+			if err := broker.Send(room, messaging.Message{To: benchPeer(i % 10)}); err != nil {
+				b.Errorf("could not send message: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+// Package client is a Go client of tarpon. Client calls the admin API to manage
+// rooms and peers, Conn connects peers to rooms with websockets.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+)
+
+// defaultTimeout limits how long a single request to the API may take
+const defaultTimeout = 10 * time.Second
+
+// Error is returned when the server responds with an unexpected status. Message
+// is the body of the response, which describes what was wrong with the request.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client calls the admin API of the server at the base URL, e.g. http://localhost:5000,
+// authorizing requests with the admin token, unless it's empty.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func New(baseURL string, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// CreateRoom creates the room. It returns an Error with http.StatusConflict when
+// the room already exists.
+func (c *Client) CreateRoom(ctx context.Context, req server.CreateRoomReq) error {
+	return c.do(ctx, http.MethodPost, "/rooms", req, nil, http.StatusCreated)
+}
+
+// ListRooms returns all rooms, ordered by UID.
+func (c *Client) ListRooms(ctx context.Context) ([]messaging.RoomInfo, error) {
+	var res server.ListRoomsRes
+	if err := c.do(ctx, http.MethodGet, "/rooms", nil, &res, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return res.Rooms, nil
+}
+
+// Presence returns UIDs of peers connected to the room through any instance of
+// the server.
+func (c *Client) Presence(ctx context.Context, room string) ([]string, error) {
+	var res server.PresenceRes
+	if err := c.do(ctx, http.MethodGet, "/rooms/"+url.PathEscape(room)+"/presence", nil, &res, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return res.Peers, nil
+}
+
+// Node returns the instance of the server owning the room, where its peers should
+// connect, when the server routes rooms.
+func (c *Client) Node(ctx context.Context, room string) (server.NodeRes, error) {
+	var res server.NodeRes
+	err := c.do(ctx, http.MethodGet, "/rooms/"+url.PathEscape(room)+"/node", nil, &res, http.StatusOK)
+	return res, err
+}
+
+// DeleteRoom deletes the room and disconnects its peers. It returns an Error with
+// http.StatusNotFound when the room doesn't exist.
+func (c *Client) DeleteRoom(ctx context.Context, room string) error {
+	return c.do(ctx, http.MethodDelete, "/rooms/"+url.PathEscape(room), nil, nil, http.StatusNoContent)
+}
+
+// RegisterPeer registers the peer in the room, creating the room if needed. It
+// reports whether the peer is new, registering it again replaces its secret.
+func (c *Client) RegisterPeer(ctx context.Context, room string, req server.RegisterPeerReq) (bool, error) {
+	err := c.do(ctx, http.MethodPost, "/rooms/"+url.PathEscape(room)+"/peers", req, nil, http.StatusCreated)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// do sends the request with the JSON encoded body and decodes the response into
+// res, unless it's nil. Statuses other than want are returned as Error.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, res interface{}, want int) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if res != nil {
+		return json.NewDecoder(resp.Body).Decode(res)
+	}
+	return nil
+}
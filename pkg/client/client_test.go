@@ -0,0 +1,83 @@
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/montrosesoftware/tarpon/pkg/client"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+)
+
+const (
+	adminToken = "admin-token"
+	mySecret   = "0123456789-0123456789-0123456789"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	store := messaging.NewRoomStore()
+	s := server.NewRoomServer(store, func(messaging.Peer, string, *websocket.Conn, *http.Request) {}, logging.NoopLogger{})
+	s.EnableAdminAuth(adminToken)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestManageRooms(t *testing.T) {
+	ts := newServer(t)
+	c := client.New(ts.URL, adminToken)
+	ctx := context.Background()
+
+	if err := c.CreateRoom(ctx, server.CreateRoomReq{UID: "room-1"}); err != nil {
+		t.Fatalf("could not create room: %v", err)
+	}
+	assertStatus(t, c.CreateRoom(ctx, server.CreateRoomReq{UID: "room-1"}), http.StatusConflict)
+
+	created, err := c.RegisterPeer(ctx, "room-2", server.RegisterPeerReq{UID: "peer-1", Secret: mySecret})
+	if err != nil || !created {
+		t.Fatalf("got created %v and error %v, want new peer", created, err)
+	}
+	created, err = c.RegisterPeer(ctx, "room-2", server.RegisterPeerReq{UID: "peer-1", Secret: mySecret})
+	if err != nil || created {
+		t.Fatalf("got created %v and error %v, want registered peer", created, err)
+	}
+
+	rooms, err := c.ListRooms(ctx)
+	if err != nil {
+		t.Fatalf("could not list rooms: %v", err)
+	}
+	want := []messaging.RoomInfo{{UID: "room-1"}, {UID: "room-2", Peers: 1}}
+	if !reflect.DeepEqual(rooms, want) {
+		t.Errorf("got rooms %v, want %v", rooms, want)
+	}
+
+	if err := c.DeleteRoom(ctx, "room-1"); err != nil {
+		t.Errorf("could not delete room: %v", err)
+	}
+	assertStatus(t, c.DeleteRoom(ctx, "room-1"), http.StatusNotFound)
+}
+
+func TestInvalidToken(t *testing.T) {
+	ts := newServer(t)
+	c := client.New(ts.URL, "wrong-token")
+
+	_, err := c.ListRooms(context.Background())
+	assertStatus(t, err, http.StatusUnauthorized)
+}
+
+func assertStatus(t *testing.T, err error, want int) {
+	t.Helper()
+	e, ok := err.(*client.Error)
+	if !ok {
+		t.Fatalf("got error %v, want status %d", err, want)
+	}
+	if e.StatusCode != want {
+		t.Errorf("got status %d, want %d", e.StatusCode, want)
+	}
+}
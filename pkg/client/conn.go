@@ -0,0 +1,577 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/montrosesoftware/tarpon/pkg/e2e"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+// CloseKicked is the close code of connections closed by the server because the
+// peer was removed from the room. Such connections are not reconnected.
+const CloseKicked = 4000
+
+var (
+	ErrNotConnected   = errors.New("not connected")
+	ErrConnectionLost = errors.New("connection lost before response")
+	ErrClosed         = errors.New("connection closed")
+	ErrNoPublicKey    = errors.New("recipient has no public key to seal the message with")
+)
+
+// Types of control events sent by the server, and of Reconnected, which the
+// connection sends to its handler once it's connected again.
+const (
+	PeerConnected    = "peer_connected"
+	PeerDisconnected = "peer_disconnected"
+	PeerKicked       = "peer_kicked"
+	PeerMuted        = "peer_muted"
+	PeerUnmuted      = "peer_unmuted"
+	PeerBanned       = "peer_banned"
+	EventError       = "error"
+	KeyDirectory     = "key_directory"
+	Reconnected      = "reconnected"
+)
+
+// Event is a control message from the server. Peer is the peer the event is
+// about, with its PublicKey when it has one. Errors of rejected messages have the
+// ID of the message, a Code and a Message instead. Key directories have Keys of
+// peers in the room, by UID.
+type Event struct {
+	Type      string            `json:"type"`
+	Peer      string            `json:"peer,omitempty"`
+	PublicKey string            `json:"public_key,omitempty"`
+	ID        string            `json:"-"`
+	Code      string            `json:"code,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Keys      map[string]string `json:"keys,omitempty"`
+}
+
+// RejectionError is returned by Request when the server rejects the request.
+type RejectionError struct {
+	Code    string
+	Message string
+}
+
+func (e *RejectionError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Handler receives messages from other peers and control events. Its methods are
+// called from a single goroutine, in order of arrival, so they must not block, e.g.
+// by waiting for a Request. Responses to requests are not passed to the handler.
+type Handler interface {
+	HandleMessage(m messaging.Message)
+	HandleEvent(e Event)
+}
+
+// ConnOptions are timeouts of the connection and delays of reconnecting, which
+// grow from MinBackoff to MaxBackoff. MaxRetries limits reconnection attempts
+// after the connection is lost, there's no limit when it's zero. With Keys, the
+// peer's key pair, direct messages are sealed for their recipients and sealed
+// messages are opened before they reach the handler, direct messages from peers
+// which aren't sealed are dropped. Zero timeouts, delays and
+// Logger are taken from DefaultConnOptions.
+type ConnOptions struct {
+	WriteWait  time.Duration
+	PongWait   time.Duration
+	PingPeriod time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	MaxRetries int
+	Keys       *e2e.KeyPair
+	Logger     logging.Logger
+}
+
+// DefaultConnOptions returns options matching the server's defaults.
+func DefaultConnOptions() ConnOptions {
+	return ConnOptions{
+		WriteWait:  15 * time.Second,
+		PongWait:   60 * time.Second,
+		PingPeriod: 54 * time.Second,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		Logger:     logging.NoopLogger{},
+	}
+}
+
+// withDefaults fills zero options from DefaultConnOptions
+func (o ConnOptions) withDefaults() ConnOptions {
+	d := DefaultConnOptions()
+	if o.WriteWait == 0 {
+		o.WriteWait = d.WriteWait
+	}
+	if o.PongWait == 0 {
+		o.PongWait = d.PongWait
+	}
+	if o.PingPeriod == 0 {
+		o.PingPeriod = d.PingPeriod
+	}
+	if o.MinBackoff == 0 {
+		o.MinBackoff = d.MinBackoff
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = d.MaxBackoff
+	}
+	if o.Logger == nil {
+		o.Logger = d.Logger
+	}
+	return o
+}
+
+type response struct {
+	message messaging.Message
+	err     error
+}
+
+type pendingRequest struct {
+	to       string
+	response chan response
+}
+
+// Conn is a peer's websocket connection to a room. It answers the server's pings,
+// pings the server to detect lost connections and reconnects with backoff until
+// it's closed. Conn is safe for concurrent use.
+type Conn struct {
+	url       string
+	dialer    websocket.Dialer
+	handler   Handler
+	options   ConnOptions
+	ws        *websocket.Conn
+	wsMutex   sync.Mutex
+	pending   map[string]pendingRequest
+	pendMutex sync.Mutex
+	peerKeys  map[string]e2e.PublicKey
+	keysMutex sync.RWMutex
+	idPrefix  string
+	nextID    uint64
+	closeChan chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+	logger    logging.Logger
+}
+
+// Connect joins the room with the peer's secret. It fails when the first attempt
+// to connect fails, later attempts are retried with backoff.
+func (c *Client) Connect(ctx context.Context, room string, secret string, h Handler, o ConnOptions) (*Conn, error) {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	u = websocketURL(u)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/rooms/" + url.PathEscape(room) + "/ws"
+	o = o.withDefaults()
+
+	conn := &Conn{
+		url:       u.String(),
+		dialer:    websocket.Dialer{HandshakeTimeout: o.WriteWait, Subprotocols: []string{"tarpon", "access_token", secret}},
+		handler:   h,
+		options:   o,
+		pending:   make(map[string]pendingRequest),
+		peerKeys:  make(map[string]e2e.PublicKey),
+		idPrefix:  strconv.FormatUint(rand.Uint64(), 36),
+		closeChan: make(chan struct{}),
+		done:      make(chan struct{}),
+		logger:    o.Logger.WithFields(logging.Fields{"room": room}),
+	}
+	ws, err := conn.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go conn.run(ws)
+	return conn, nil
+}
+
+// Send sends the payload, encoded as JSON, to the peer, or broadcasts it to the
+// room when to is empty.
+func (c *Conn) Send(to string, payload interface{}) error {
+	return c.send("", to, payload)
+}
+
+// Reply answers the message with the payload, so that the sender can match the
+// response with its request.
+func (c *Conn) Reply(m messaging.Message, payload interface{}) error {
+	return c.send(m.ID, m.From, payload)
+}
+
+// Request sends the payload to the peer and waits for its reply, a message from
+// the peer with the same ID, until the context is done.
+func (c *Conn) Request(ctx context.Context, to string, payload interface{}) (messaging.Message, error) {
+	id := c.idPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&c.nextID, 1), 10)
+	ch := make(chan response, 1)
+	c.pendMutex.Lock()
+	c.pending[id] = pendingRequest{to: to, response: ch}
+	c.pendMutex.Unlock()
+	defer func() {
+		c.pendMutex.Lock()
+		delete(c.pending, id)
+		c.pendMutex.Unlock()
+	}()
+
+	if err := c.send(id, to, payload); err != nil {
+		return messaging.Message{}, err
+	}
+	select {
+	case r := <-ch:
+		return r.message, r.err
+	case <-ctx.Done():
+		return messaging.Message{}, ctx.Err()
+	}
+}
+
+// Close disconnects from the room and waits until the connection stops.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		c.wsMutex.Lock()
+		if c.ws != nil {
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			if err := c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.options.WriteWait)); err != nil {
+				c.logger.Debug("error sending close message", logging.Fields{"error": err})
+			}
+			c.ws.Close()
+		}
+		c.wsMutex.Unlock()
+	})
+	<-c.done
+	return nil
+}
+
+// PeerKey returns the public key of the peer distributed by the server, e.g. to
+// compare its fingerprint with the one the peer reports out-of-band.
+func (c *Conn) PeerKey(uid string) (e2e.PublicKey, bool) {
+	c.keysMutex.RLock()
+	defer c.keysMutex.RUnlock()
+	k, ok := c.peerKeys[uid]
+	return k, ok
+}
+
+// Done is closed when the connection stops, because it was closed, the peer was
+// removed from the room or reconnecting failed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection stopped, or nil when it was closed or is still running.
+func (c *Conn) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *Conn) send(id string, to string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if c.options.Keys != nil && to != "" && to != messaging.ServerUID {
+		key, ok := c.PeerKey(to)
+		if !ok {
+			return ErrNoPublicKey
+		}
+		if data, err = e2e.Seal(data, key, c.options.Keys); err != nil {
+			return err
+		}
+	}
+	msg := struct {
+		ID      string          `json:"id,omitempty"`
+		To      string          `json:"to"`
+		Payload json.RawMessage `json:"payload"`
+	}{ID: id, To: to, Payload: data}
+
+	c.wsMutex.Lock()
+	defer c.wsMutex.Unlock()
+	if c.ws == nil {
+		return ErrNotConnected
+	}
+	if err := c.ws.SetWriteDeadline(time.Now().Add(c.options.WriteWait)); err != nil {
+		return err
+	}
+	return c.ws.WriteJSON(msg)
+}
+
+// maxRedirects limits redirects to instances of the server owning the room
+const maxRedirects = 3
+
+// dial connects to the room, following redirects to the instance owning it. Every
+// attempt starts at the URL of the client, as the owner may change. Errors of
+// rejected handshakes are returned as Error
+func (c *Conn) dial(ctx context.Context) (*websocket.Conn, error) {
+	target := c.url
+	for redirects := 0; ; redirects++ {
+		ws, resp, err := c.dialer.DialContext(ctx, target, nil)
+		if err != websocket.ErrBadHandshake || resp == nil {
+			return ws, err
+		}
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		location, lerr := resp.Location()
+		if resp.StatusCode != http.StatusTemporaryRedirect || lerr != nil || redirects == maxRedirects {
+			return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+		}
+		c.logger.Debug("redirected to owner of the room", logging.Fields{"location": location.Host})
+		target = websocketURL(location).String()
+	}
+}
+
+// websocketURL returns the URL with the websocket scheme matching its HTTP scheme
+func websocketURL(u *url.URL) *url.URL {
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	return u
+}
+
+// run reads from the connection and reconnects when it's lost, until it's closed
+// or reconnecting fails
+func (c *Conn) run(ws *websocket.Conn) {
+	defer close(c.done)
+	for {
+		err := c.serve(ws)
+		c.failPending(ErrConnectionLost)
+		if c.isClosed() {
+			return
+		}
+		if websocket.IsCloseError(err, CloseKicked) {
+			c.logger.Info("removed from the room", logging.Fields{"error": err})
+			c.err = err
+			return
+		}
+		c.logger.Warn("connection lost, reconnecting", logging.Fields{"error": err})
+
+		ws, err = c.reconnect()
+		if err != nil {
+			if err != ErrClosed {
+				c.err = err
+			}
+			return
+		}
+		c.handler.HandleEvent(Event{Type: Reconnected})
+	}
+}
+
+// serve reads messages from the connection and pings the server until reading fails
+func (c *Conn) serve(ws *websocket.Conn) error {
+	c.wsMutex.Lock()
+	if c.isClosed() {
+		c.wsMutex.Unlock()
+		ws.Close()
+		return ErrClosed
+	}
+	c.ws = ws
+	c.wsMutex.Unlock()
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		c.wsMutex.Lock()
+		c.ws = nil
+		c.wsMutex.Unlock()
+		ws.Close()
+	}()
+
+	extendDeadline := func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(c.options.PongWait))
+	}
+	if err := extendDeadline(""); err != nil {
+		return err
+	}
+	ws.SetPongHandler(extendDeadline)
+	ws.SetPingHandler(func(data string) error {
+		if err := extendDeadline(data); err != nil {
+			return err
+		}
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.options.WriteWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	go c.ping(ws, stop)
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if err := extendDeadline(""); err != nil {
+			return err
+		}
+		var m messaging.Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			c.logger.Warn("received invalid message", logging.Fields{"error": err})
+			continue
+		}
+		c.dispatch(m)
+	}
+}
+
+func (c *Conn) ping(ws *websocket.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(c.options.PingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.options.WriteWait)); err != nil {
+				c.logger.Debug("error sending ping", logging.Fields{"error": err})
+				ws.Close()
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// dispatch passes the message to the request waiting for it, or to the handler
+func (c *Conn) dispatch(m messaging.Message) {
+	var event Event
+	if m.From == messaging.ServerUID && json.Unmarshal(m.Payload, &event) == nil && event.Type != "" {
+		event.ID = m.ID
+		if event.Type == EventError && c.respond(m, &RejectionError{Code: event.Code, Message: event.Message}) {
+			return
+		}
+		c.updateKeys(event)
+		c.handler.HandleEvent(event)
+		return
+	}
+	if c.options.Keys != nil && !m.IsBroadcast() && m.From != messaging.ServerUID && !e2e.IsSealed(m.Payload) {
+		c.logger.Warn("dropping direct message which isn't sealed", logging.Fields{"peer": m.From})
+		return
+	}
+	if c.options.Keys != nil && e2e.IsSealed(m.Payload) {
+		key, _ := c.PeerKey(m.From)
+		opened, err := e2e.Open(m.Payload, key, c.options.Keys)
+		if err != nil {
+			c.logger.Warn("dropping sealed message which can't be opened", logging.Fields{"peer": m.From, "error": err})
+			return
+		}
+		m.Payload = opened
+	}
+	if c.respond(m, nil) {
+		return
+	}
+	c.handler.HandleMessage(m)
+}
+
+// updateKeys remembers public keys of peers distributed by the server
+func (c *Conn) updateKeys(e Event) {
+	keys := e.Keys
+	if e.Type == PeerConnected && e.PublicKey != "" {
+		keys = map[string]string{e.Peer: e.PublicKey}
+	}
+	c.keysMutex.Lock()
+	defer c.keysMutex.Unlock()
+	for uid, s := range keys {
+		k, err := e2e.ParsePublicKey(s)
+		if err != nil {
+			c.logger.Warn("ignoring invalid public key", logging.Fields{"peer": uid})
+			continue
+		}
+		c.peerKeys[uid] = k
+	}
+}
+
+// respond completes the request the message answers and reports whether there was one
+func (c *Conn) respond(m messaging.Message, err error) bool {
+	if m.ID == "" {
+		return false
+	}
+	c.pendMutex.Lock()
+	defer c.pendMutex.Unlock()
+	req, ok := c.pending[m.ID]
+	if !ok || (err == nil && m.From != req.to) {
+		return false
+	}
+	delete(c.pending, m.ID)
+	req.response <- response{message: m, err: err}
+	return true
+}
+
+func (c *Conn) failPending(err error) {
+	c.pendMutex.Lock()
+	defer c.pendMutex.Unlock()
+	for id, req := range c.pending {
+		req.response <- response{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// reconnect dials the room with growing delays until it succeeds, the connection
+// is closed, the handshake is rejected or the retries are exhausted
+func (c *Conn) reconnect() (*websocket.Conn, error) {
+	for attempt := 0; c.options.MaxRetries == 0 || attempt < c.options.MaxRetries; attempt++ {
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-c.closeChan:
+			return nil, ErrClosed
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-c.closeChan:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		ws, err := c.dial(ctx)
+		cancel()
+		if err == nil {
+			c.logger.Info("reconnected", logging.Fields{"attempt": attempt + 1})
+			return ws, nil
+		}
+		if c.isClosed() {
+			return nil, ErrClosed
+		}
+		if e, ok := err.(*Error); ok && (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusNotFound) {
+			return nil, err
+		}
+		c.logger.Debug("reconnecting failed", logging.Fields{"attempt": attempt + 1, "error": err})
+	}
+	return nil, fmt.Errorf("reconnecting failed after %d attempts", c.options.MaxRetries)
+}
+
+// backoff returns a random delay of the attempt between half and all of the
+// exponentially growing backoff
+func (c *Conn) backoff(attempt int) time.Duration {
+	d := c.options.MinBackoff
+	for i := 0; i < attempt && d < c.options.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.options.MaxBackoff {
+		d = c.options.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (c *Conn) isClosed() bool {
+	select {
+	case <-c.closeChan:
+		return true
+	default:
+		return false
+	}
+}
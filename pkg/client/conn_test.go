@@ -0,0 +1,352 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/montrosesoftware/tarpon/pkg/agent"
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/client"
+	"github.com/montrosesoftware/tarpon/pkg/e2e"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/server"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
+)
+
+const (
+	myRoom    = "room-123"
+	myPeer    = "peer-a"
+	otherPeer = "peer-b"
+)
+
+// SpyHandler records events and replies to requests with their payloads
+type SpyHandler struct {
+	conn     *client.Conn
+	messages []messaging.Message
+	events   []client.Event
+	mutex    sync.Mutex
+}
+
+func (h *SpyHandler) HandleMessage(m messaging.Message) {
+	h.mutex.Lock()
+	h.messages = append(h.messages, m)
+	conn := h.conn
+	h.mutex.Unlock()
+	if conn != nil && m.ID != "" {
+		_ = conn.Reply(m, m.Payload)
+	}
+}
+
+func (h *SpyHandler) HandleEvent(e client.Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.events = append(h.events, e)
+}
+
+func (h *SpyHandler) replyWith(conn *client.Conn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.conn = conn
+}
+
+func (h *SpyHandler) received() []messaging.Message {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]messaging.Message(nil), h.messages...)
+}
+
+func (h *SpyHandler) eventTypes() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var types []string
+	for _, e := range h.events {
+		types = append(types, e.Type+" "+e.Peer)
+	}
+	return types
+}
+
+func newRoomServer(t *testing.T) (*httptest.Server, *client.Client) {
+	t.Helper()
+	l := logging.NoopLogger{}
+	store := messaging.NewRoomStore()
+	b := broker.NewBroker(l)
+	s := server.NewRoomServer(store, agent.PeerHandler(b, store, events.NoopSink{}, audit.NoopSink{}, tracing.NoopTracer{}, agent.NewRoomOptions(agent.DefaultOptions(), store), l), l)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	c := client.New(ts.URL, "")
+	for _, uid := range []string{myPeer, otherPeer, "offline"} {
+		if _, err := c.RegisterPeer(context.Background(), myRoom, server.RegisterPeerReq{UID: uid, Secret: uid + "-" + mySecret}); err != nil {
+			t.Fatalf("could not register peer: %v", err)
+		}
+	}
+	return ts, c
+}
+
+func connect(t *testing.T, c *client.Client, uid string, h client.Handler) *client.Conn {
+	t.Helper()
+	conn, err := c.Connect(context.Background(), myRoom, uid+"-"+mySecret, h, client.DefaultConnOptions())
+	if err != nil {
+		t.Fatalf("could not connect %s: %v", uid, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestRequestResponse(t *testing.T) {
+	_, c := newRoomServer(t)
+	handler := &SpyHandler{}
+	conn := connect(t, c, myPeer, handler)
+	other := &SpyHandler{}
+	otherConn := connect(t, c, otherPeer, other)
+	other.replyWith(otherConn)
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err := conn.Request(ctx, otherPeer, "hello")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if res.From != otherPeer || string(res.Payload) != `"hello"` {
+		t.Errorf("got response %+v, want hello from %s", res, otherPeer)
+	}
+
+	_, err = conn.Request(ctx, "offline", "hello")
+	if e, ok := err.(*client.RejectionError); !ok || e.Code != messaging.ErrCodeOfflineRecipient {
+		t.Errorf("got error %v, want %s", err, messaging.ErrCodeOfflineRecipient)
+	}
+
+	if err := conn.Send("", json.RawMessage(`{"text":"hi"}`)); err != nil {
+		t.Fatalf("could not broadcast: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, m := range handler.received() {
+		if m.ID != "" {
+			t.Errorf("response %+v was passed to the handler", m)
+		}
+	}
+	if got := other.received(); len(got) != 2 || string(got[1].Payload) != `{"text":"hi"}` {
+		t.Errorf("got messages %v, want the request and the broadcast", got)
+	}
+	if got := handler.eventTypes(); len(got) != 1 || got[0] != client.PeerConnected+" "+otherPeer {
+		t.Errorf("got events %v, want %s of %s", got, client.PeerConnected, otherPeer)
+	}
+
+	otherConn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if got := handler.eventTypes(); len(got) != 2 || got[1] != client.PeerDisconnected+" "+otherPeer {
+		t.Errorf("got events %v, want %s of %s", got, client.PeerDisconnected, otherPeer)
+	}
+}
+
+func TestConnectWithZeroOptions(t *testing.T) {
+	_, c := newRoomServer(t)
+	handler := &SpyHandler{}
+	connect(t, c, otherPeer, handler)
+
+	conn, err := c.Connect(context.Background(), myRoom, myPeer+"-"+mySecret, &SpyHandler{}, client.ConnOptions{})
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := conn.Send(otherPeer, "hello"); err != nil {
+		t.Fatalf("could not send: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := handler.received(); len(got) != 1 || string(got[0].Payload) != `"hello"` {
+		t.Errorf("got messages %v, want hello", got)
+	}
+}
+
+func TestConnectWithInvalidSecret(t *testing.T) {
+	_, c := newRoomServer(t)
+
+	_, err := c.Connect(context.Background(), myRoom, "invalid-"+mySecret, &SpyHandler{}, client.DefaultConnOptions())
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got error %v, want %d", err, http.StatusUnauthorized)
+	}
+}
+
+func TestConnectFollowsRedirects(t *testing.T) {
+	owner, _ := newRoomServer(t)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, owner.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer front.Close()
+
+	c := client.New(front.URL, "")
+	conn, err := c.Connect(context.Background(), myRoom, myPeer+"-"+mySecret, &SpyHandler{}, client.DefaultConnOptions())
+	if err != nil {
+		t.Fatalf("could not connect through redirect: %v", err)
+	}
+	conn.Close()
+
+	var loop *httptest.Server
+	loop = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, loop.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer loop.Close()
+	_, err = client.New(loop.URL, "").Connect(context.Background(), myRoom, myPeer+"-"+mySecret, &SpyHandler{}, client.DefaultConnOptions())
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("got error %v, want redirects to stop", err)
+	}
+}
+
+func TestSealedMessages(t *testing.T) {
+	_, c := newRoomServer(t)
+	keys := map[string]*e2e.KeyPair{}
+	for _, uid := range []string{"alice", "bob", "eve"} {
+		kp, err := e2e.GenerateKeyPair()
+		if err != nil {
+			t.Fatalf("could not generate key pair: %v", err)
+		}
+		keys[uid] = kp
+		req := server.RegisterPeerReq{UID: uid, Secret: uid + "-" + mySecret, PublicKey: kp.Public.String()}
+		if _, err := c.RegisterPeer(context.Background(), myRoom, req); err != nil {
+			t.Fatalf("could not register peer: %v", err)
+		}
+	}
+	connectWithKeys := func(uid string, h client.Handler, kp *e2e.KeyPair) *client.Conn {
+		o := client.DefaultConnOptions()
+		o.Keys = kp
+		conn, err := c.Connect(context.Background(), myRoom, uid+"-"+mySecret, h, o)
+		if err != nil {
+			t.Fatalf("could not connect %s: %v", uid, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	bob := &SpyHandler{}
+	bob.replyWith(connectWithKeys("bob", bob, keys["bob"]))
+	// eve has a registered key but doesn't use it, so she sees what the server routes
+	eve := &SpyHandler{}
+	eveConn := connectWithKeys("eve", eve, nil)
+	time.Sleep(100 * time.Millisecond)
+	alice := connectWithKeys("alice", &SpyHandler{}, keys["alice"])
+	time.Sleep(100 * time.Millisecond)
+
+	if k, ok := alice.PeerKey("bob"); !ok || k != keys["bob"].Public {
+		t.Errorf("got key %v of bob, want the one from the key directory", k)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err := alice.Request(ctx, "bob", "hello")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if string(res.Payload) != `"hello"` {
+		t.Errorf("got response %s, want hello opened", res.Payload)
+	}
+	if got := bob.received(); len(got) != 1 || string(got[0].Payload) != `"hello"` {
+		t.Errorf("got messages %v, want hello opened", got)
+	}
+
+	if err := alice.Send("eve", "secret"); err != nil {
+		t.Fatalf("could not send: %v", err)
+	}
+	if err := alice.Send("offline", "secret"); err != client.ErrNoPublicKey {
+		t.Errorf("got error %v sending to peer without key, want %v", err, client.ErrNoPublicKey)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := eve.received(); len(got) != 1 || !e2e.IsSealed(got[0].Payload) {
+		t.Errorf("got messages %v, want a sealed payload", got)
+	}
+
+	// only sealed messages are known to come from their senders
+	if err := eveConn.Send("bob", "forged"); err != nil {
+		t.Fatalf("could not send: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := bob.received(); len(got) != 1 {
+		t.Errorf("got messages %v, want the unsealed one dropped", got)
+	}
+}
+
+// StubRoom accepts websockets, dropping the first connection without closing it
+// and closing the second with the given code
+type StubRoom struct {
+	upgrader    websocket.Upgrader
+	connections int
+	closeCode   int
+	mutex       sync.Mutex
+}
+
+func (s *StubRoom) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	s.connections++
+	n := s.connections
+	s.mutex.Unlock()
+
+	switch {
+	case n == 1:
+		conn.Close()
+	case s.closeCode != 0:
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(s.closeCode, "removed from the room"))
+		conn.Close()
+	default:
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	cases := map[string]struct {
+		closeCode   int
+		wantStopped bool
+	}{
+		"reconnects when connection is lost": {},
+		"stops when removed from the room":   {closeCode: client.CloseKicked, wantStopped: true},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			room := &StubRoom{closeCode: tt.closeCode}
+			ts := httptest.NewServer(room)
+			defer ts.Close()
+			handler := &SpyHandler{}
+			o := client.DefaultConnOptions()
+			o.MinBackoff = 10 * time.Millisecond
+
+			conn, err := client.New(ts.URL, "").Connect(context.Background(), myRoom, mySecret, handler, o)
+			if err != nil {
+				t.Fatalf("could not connect: %v", err)
+			}
+			defer conn.Close()
+			time.Sleep(100 * time.Millisecond)
+
+			if got := handler.eventTypes(); len(got) != 1 || got[0] != client.Reconnected+" " {
+				t.Errorf("got events %v, want %s", got, client.Reconnected)
+			}
+			select {
+			case <-conn.Done():
+				if !tt.wantStopped {
+					t.Errorf("connection stopped: %v", conn.Err())
+				} else if !websocket.IsCloseError(conn.Err(), client.CloseKicked) {
+					t.Errorf("got error %v, want close %d", conn.Err(), client.CloseKicked)
+				}
+			default:
+				if tt.wantStopped {
+					t.Errorf("connection is still running")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver finds the IP address of the client which sent a request. Forwarded
+// and X-Forwarded-For headers are trusted only when set by trusted proxies.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver creates a resolver trusting proxies in the CIDRs, e.g. "10.0.0.0/8".
+// Single addresses are accepted too.
+func NewResolver(cidrs []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", c, err)
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+// ClientIP returns the address of the client. Addresses in forwarding headers are
+// read from the nearest one, skipping trusted proxies, so that clients can't
+// spoof them by sending the headers themselves.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	ip := RemoteIP(req)
+	if !r.isTrusted(ip) {
+		return ip
+	}
+
+	hops := forwardedFor(req.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (r *Resolver) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP returns the address the request came from, ignoring forwarding headers.
+func RemoteIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// forwardedFor returns addresses from the Forwarded header, or X-Forwarded-For
+// when there's none, ordered from the client to the nearest proxy.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("Forwarded") {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, kv[1])
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	return hops
+}
+
+// parseHop returns the IP address of a forwarding header entry like
+// 192.0.2.1, "192.0.2.1:4711" or "[2001:db8::1]:4711", or an empty string when
+// it's not an address, e.g. "unknown".
+func parseHop(hop string) string {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
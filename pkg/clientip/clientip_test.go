@@ -0,0 +1,75 @@
+package clientip_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/montrosesoftware/tarpon/pkg/clientip"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := map[string]struct {
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		"uses remote address without headers": {
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		"ignores headers sent by untrusted clients": {
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "192.0.2.1",
+		},
+		"uses X-Forwarded-For set by trusted proxy": {
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		"skips trusted proxies in X-Forwarded-For": {
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.1, 10.0.0.2"},
+			want:       "198.51.100.1",
+		},
+		"prefers Forwarded": {
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded":       `for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`,
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			want: "2001:db8::1",
+		},
+		"stops at unknown addresses": {
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": "for=unknown, for=10.0.0.2"},
+			want:       "10.0.0.2",
+		},
+	}
+	resolver, err := clientip.NewResolver([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatalf("could not create resolver: %v", err)
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatalf("could not instantiate request: %v", err)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			if got := resolver.ClientIP(r); got != tt.want {
+				t.Errorf("got client IP %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidTrustedProxies(t *testing.T) {
+	if _, err := clientip.NewResolver([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("got no error for invalid CIDR")
+	}
+}
@@ -1,18 +1,37 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 	"gopkg.in/yaml.v2"
 )
 
-const filename = "tarpon.yaml"
+// DefaultFilename is the name of the config file read from the working directory
+// when no path is given.
+const DefaultFilename = "tarpon.yaml"
 
 type Config struct {
-	Logging Logging
-	Server  Server
+	Logging        Logging
+	Server         Server
+	Webhooks       Webhooks
+	Interceptors   Interceptors
+	History        History
+	Admin          Admin
+	Audit          Audit
+	JoinProtection JoinProtection
+	ClientLimits   ClientLimits
+	Tracing        Tracing
+	Websocket      Websocket
+	Store          Store
+	Cluster        Cluster
 }
 
 type Logging struct {
@@ -22,30 +41,387 @@ type Logging struct {
 type Server struct {
 	Host string `yaml:"host" env:"TARPON_HOST" env-description:"Server host. All by default" env-default:""`
 	Port string `yaml:"port" env:"TARPON_PORT" env-description:"Server post." env-default:"5000"`
+
+	HTTPTransport  bool     `yaml:"http_transport" env:"TARPON_HTTP_TRANSPORT" env-description:"Allow peers to use Server-Sent Events and HTTP requests instead of websockets" env-default:"true"`
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TARPON_TRUSTED_PROXIES" env-description:"Comma separated CIDRs of proxies whose Forwarded and X-Forwarded-For headers are trusted"`
+	AllowedOrigins []string `yaml:"allowed_origins" env:"TARPON_ALLOWED_ORIGINS" env-description:"Comma separated origins, e.g. https://example.com, allowed to open websockets. All when empty"`
+
+	DrainTimeout    time.Duration `yaml:"drain_timeout" env:"TARPON_DRAIN_TIMEOUT" env-description:"How long the server reports not ready before it stops accepting connections on shutdown" env-default:"5s"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"TARPON_SHUTDOWN_TIMEOUT" env-description:"Maximum time of a graceful shutdown, including the drain" env-default:"30s"`
 }
 
-func ParseConfig() Config {
-	var cfg Config
+type Webhooks struct {
+	URLs         []string      `yaml:"urls" env:"TARPON_WEBHOOKS_URLS" env-description:"Comma separated URLs receiving webhooks. Webhooks are disabled when empty"`
+	Secret       string        `yaml:"secret" env:"TARPON_WEBHOOKS_SECRET" env-description:"Key used to sign webhooks with HMAC-SHA256"`
+	QueueSize    int           `yaml:"queue_size" env:"TARPON_WEBHOOKS_QUEUE_SIZE" env-description:"Maximum number of webhooks waiting for delivery" env-default:"1024"`
+	Workers      int           `yaml:"workers" env:"TARPON_WEBHOOKS_WORKERS" env-description:"Number of concurrent webhook deliveries" env-default:"4"`
+	MaxRetries   int           `yaml:"max_retries" env:"TARPON_WEBHOOKS_MAX_RETRIES" env-description:"Maximum number of retries of a failed webhook" env-default:"5"`
+	RetryBackoff time.Duration `yaml:"retry_backoff" env:"TARPON_WEBHOOKS_RETRY_BACKOFF" env-description:"Delay before the first retry, doubled with every next retry" env-default:"500ms"`
+	Timeout      time.Duration `yaml:"timeout" env:"TARPON_WEBHOOKS_TIMEOUT" env-description:"Timeout of a single webhook request" env-default:"5s"`
+}
+
+type Interceptors struct {
+	MaxPayloadSize int      `yaml:"max_payload_size" env:"TARPON_INTERCEPTORS_MAX_PAYLOAD_SIZE" env-description:"Maximum size of message payloads in bytes. Unlimited when 0" env-default:"0"`
+	SchemaFile     string   `yaml:"schema_file" env:"TARPON_INTERCEPTORS_SCHEMA_FILE" env-description:"Path to a JSON schema every message payload must match"`
+	Keywords       []string `yaml:"keywords" env:"TARPON_INTERCEPTORS_KEYWORDS" env-description:"Comma separated words not allowed in messages"`
+	MaskKeywords   bool     `yaml:"mask_keywords" env:"TARPON_INTERCEPTORS_MASK_KEYWORDS" env-description:"Mask forbidden words instead of rejecting messages" env-default:"false"`
+	RequireSealed  bool     `yaml:"require_sealed" env:"TARPON_INTERCEPTORS_REQUIRE_SEALED" env-description:"Reject direct messages between peers which are not sealed with end-to-end encryption" env-default:"false"`
+}
+
+type History struct {
+	MaxCount int           `yaml:"max_count" env:"TARPON_HISTORY_MAX_COUNT" env-description:"Default number of broadcast messages kept in a room's history. Disabled when 0" env-default:"0"`
+	MaxAge   time.Duration `yaml:"max_age" env:"TARPON_HISTORY_MAX_AGE" env-description:"Default age after which messages are removed from history. Never when 0" env-default:"1h"`
+	Replay   int           `yaml:"replay" env:"TARPON_HISTORY_REPLAY" env-description:"Number of most recent messages replayed to joining peers, less than websocket.messages_buf_size" env-default:"50"`
+}
+
+type Admin struct {
+	Token      string `yaml:"token" env:"TARPON_ADMIN_TOKEN" env-description:"Bearer token required to create rooms, register peers and send server messages. Server messages are disabled when empty"`
+	SenderName string `yaml:"sender_name" env:"TARPON_ADMIN_SENDER_NAME" env-description:"Default name of the server identity sending server messages, which come from tarpon:<name>, or tarpon when empty"`
+}
+
+type JoinProtection struct {
+	IPThreshold   int           `yaml:"ip_threshold" env:"TARPON_JOIN_PROTECTION_IP_THRESHOLD" env-description:"Failed attempts to join rooms after which an IP address is locked out. Disabled when 0" env-default:"10"`
+	RoomThreshold int           `yaml:"room_threshold" env:"TARPON_JOIN_PROTECTION_ROOM_THRESHOLD" env-description:"Failed attempts to join a room after which wrong secrets are rejected with 429. Disabled when 0" env-default:"100"`
+	Backoff       time.Duration `yaml:"backoff" env:"TARPON_JOIN_PROTECTION_BACKOFF" env-description:"First lockout, doubled with every next failed attempt" env-default:"1s"`
+	MaxLockout    time.Duration `yaml:"max_lockout" env:"TARPON_JOIN_PROTECTION_MAX_LOCKOUT" env-description:"Maximum lockout" env-default:"15m"`
+	Window        time.Duration `yaml:"window" env:"TARPON_JOIN_PROTECTION_WINDOW" env-description:"Time after which failed attempts are forgotten" env-default:"15m"`
+}
+
+type ClientLimits struct {
+	MaxConnections int     `yaml:"max_connections" env:"TARPON_CLIENT_LIMITS_MAX_CONNECTIONS" env-description:"Maximum number of concurrent connections of an IP address, including websockets. Unlimited when 0" env-default:"0"`
+	RequestRate    float64 `yaml:"request_rate" env:"TARPON_CLIENT_LIMITS_REQUEST_RATE" env-description:"Requests per second an IP address may send. Unlimited when 0" env-default:"0"`
+	RequestBurst   int     `yaml:"request_burst" env:"TARPON_CLIENT_LIMITS_REQUEST_BURST" env-description:"Requests an IP address may send at once" env-default:"200"`
+}
+
+type Audit struct {
+	Output string `yaml:"output" env:"TARPON_AUDIT_OUTPUT" env-description:"Where the audit log is written as JSON lines, stdout or a file path. Disabled when empty"`
+}
+
+type Websocket struct {
+	WriteWait       time.Duration `yaml:"write_wait" env:"TARPON_WEBSOCKET_WRITE_WAIT" env-description:"Time allowed to write a message to a peer" env-default:"15s"`
+	PongWait        time.Duration `yaml:"pong_wait" env:"TARPON_WEBSOCKET_PONG_WAIT" env-description:"Time allowed to read the next pong from a peer before it's disconnected" env-default:"60s"`
+	PingPeriod      time.Duration `yaml:"ping_period" env:"TARPON_WEBSOCKET_PING_PERIOD" env-description:"How often peers are pinged, must be less than pong wait" env-default:"54s"`
+	MaxMessageSize  int           `yaml:"max_message_size" env:"TARPON_WEBSOCKET_MAX_MESSAGE_SIZE" env-description:"Maximum size of a message sent by a peer in bytes" env-default:"32768"`
+	MessagesBufSize int           `yaml:"messages_buf_size" env:"TARPON_WEBSOCKET_MESSAGES_BUF_SIZE" env-description:"Number of messages buffered for a slow peer before they are dropped" env-default:"64"`
+	MessageRate     int           `yaml:"message_rate" env:"TARPON_WEBSOCKET_MESSAGE_RATE" env-description:"Number of messages a peer may send per second" env-default:"100"`
+	MessageBurst    int           `yaml:"message_burst" env:"TARPON_WEBSOCKET_MESSAGE_BURST" env-description:"Number of messages a peer may send at once" env-default:"200"`
+	MaxRateStrikes  int           `yaml:"max_rate_strikes" env:"TARPON_WEBSOCKET_MAX_RATE_STRIKES" env-description:"Number of messages rejected as rate limited within 10 seconds after which the peer is disconnected" env-default:"50"`
+	ReadBufferSize  int           `yaml:"read_buffer_size" env:"TARPON_WEBSOCKET_READ_BUFFER_SIZE" env-description:"Size of the websocket read buffer in bytes" env-default:"4096"`
+	WriteBufferSize int           `yaml:"write_buffer_size" env:"TARPON_WEBSOCKET_WRITE_BUFFER_SIZE" env-description:"Size of the websocket write buffer in bytes" env-default:"4096"`
+}
+
+// maxMessageSizeLimit is the upper bound of the maximum message size.
+const maxMessageSizeLimit = 1 << 20
+
+// Validate returns an error describing the first invalid setting.
+func (w *Websocket) Validate() error {
+	switch {
+	case w.WriteWait <= 0:
+		return errors.New("websocket.write_wait: must be positive")
+	case w.PongWait <= 0:
+		return errors.New("websocket.pong_wait: must be positive")
+	case w.PingPeriod <= 0 || w.PingPeriod >= w.PongWait:
+		return errors.New("websocket.ping_period: must be positive and less than pong_wait")
+	case w.MaxMessageSize <= 0 || w.MaxMessageSize > maxMessageSizeLimit:
+		return fmt.Errorf("websocket.max_message_size: must be between 1 and %d", maxMessageSizeLimit)
+	case w.MessagesBufSize <= 0:
+		return errors.New("websocket.messages_buf_size: must be positive")
+	case w.MessageRate <= 0 || w.MessageBurst <= 0 || w.MaxRateStrikes <= 0:
+		return errors.New("websocket.message_rate, websocket.message_burst, websocket.max_rate_strikes: must be positive")
+	case w.ReadBufferSize <= 0 || w.WriteBufferSize <= 0:
+		return errors.New("websocket.read_buffer_size, websocket.write_buffer_size: must be positive")
+	}
+	return nil
+}
+
+type Tracing struct {
+	Endpoint           string        `yaml:"endpoint" env:"TARPON_TRACING_ENDPOINT,OTEL_EXPORTER_OTLP_TRACES_ENDPOINT" env-description:"OTLP/HTTP traces URL of an OpenTelemetry collector, e.g. http://localhost:4318/v1/traces, or the collector's URL with OTEL_EXPORTER_OTLP_ENDPOINT. Tracing is disabled when empty"`
+	Headers            string        `yaml:"headers" env:"TARPON_TRACING_HEADERS,OTEL_EXPORTER_OTLP_TRACES_HEADERS,OTEL_EXPORTER_OTLP_HEADERS" env-description:"Comma separated key=value headers sent to the collector, with URL encoded values, e.g. authorization=Bearer%20token"`
+	ServiceName        string        `yaml:"service_name" env:"TARPON_TRACING_SERVICE_NAME,OTEL_SERVICE_NAME" env-description:"Service name reported with spans" env-default:"tarpon"`
+	ResourceAttributes string        `yaml:"resource_attributes" env:"TARPON_TRACING_RESOURCE_ATTRIBUTES,OTEL_RESOURCE_ATTRIBUTES" env-description:"Comma separated key=value attributes of the resource reported with spans, with URL encoded values, e.g. deployment.environment=production"`
+	FlushInterval      time.Duration `yaml:"flush_interval" env:"TARPON_TRACING_FLUSH_INTERVAL" env-description:"How often spans are exported" env-default:"5s"`
+	Timeout            time.Duration `yaml:"timeout" env:"TARPON_TRACING_TIMEOUT" env-description:"Timeout of a single export request" env-default:"10s"`
+	SampleRatio        float64       `yaml:"sample_ratio" env:"TARPON_TRACING_SAMPLE_RATIO,OTEL_TRACES_SAMPLER_ARG" env-description:"Ratio of new traces which are sampled, above 0 and at most 1. Traces continued from peers follow their sampled flag" env-default:"1"`
+}
+
+// otlpEndpointEnv is the URL of a collector, whose traces URL is under /v1/traces.
+// It's used when the traces URL isn't set.
+const otlpEndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
 
-	// Use standard log here because logger is not configured yet
+// ExportHeaders returns the headers sent to the collector.
+func (t *Tracing) ExportHeaders() (map[string]string, error) {
+	return parseKeyValues(t.Headers)
+}
+
+// Resource returns attributes of the resource reported with spans.
+func (t *Tracing) Resource() (map[string]string, error) {
+	return parseKeyValues(t.ResourceAttributes)
+}
+
+// parseKeyValues reads a list of key=value pairs with URL encoded values, as
+// OpenTelemetry environment variables do
+func parseKeyValues(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid pair %q", pair)
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %q: %w", key, err)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+type Store struct {
+	RedisAddress  string        `yaml:"redis_address" env:"TARPON_STORE_REDIS_ADDRESS" env-description:"host:port of a Redis server keeping rooms and peers shared by instances of the server. Rooms are kept in memory when empty"`
+	RedisUsername string        `yaml:"redis_username" env:"TARPON_STORE_REDIS_USERNAME" env-description:"User of the Redis server's access control list, the default user when empty"`
+	RedisPassword string        `yaml:"redis_password" env:"TARPON_STORE_REDIS_PASSWORD" env-description:"Password of the Redis server"`
+	RedisTLS      bool          `yaml:"redis_tls" env:"TARPON_STORE_REDIS_TLS" env-description:"Connect to the Redis server with TLS" env-default:"false"`
+	RedisCAFile   string        `yaml:"redis_ca_file" env:"TARPON_STORE_REDIS_CA_FILE" env-description:"PEM file with certificates of authorities which the Redis server's certificate is verified with, the system's when empty"`
+	RedisDB       int           `yaml:"redis_db" env:"TARPON_STORE_REDIS_DB" env-description:"Number of the Redis database" env-default:"0"`
+	KeyPrefix     string        `yaml:"key_prefix" env:"TARPON_STORE_KEY_PREFIX" env-description:"Prefix of keys kept in Redis, which separates deployments sharing a server" env-default:"tarpon:"`
+	Timeout       time.Duration `yaml:"timeout" env:"TARPON_STORE_TIMEOUT" env-description:"Timeout of connecting to Redis and of a single command" env-default:"5s"`
+	PoolSize      int           `yaml:"pool_size" env:"TARPON_STORE_POOL_SIZE" env-description:"Maximum number of connections to Redis open at once" env-default:"10"`
+}
+
+type Cluster struct {
+	NodeID       string        `yaml:"node_id" env:"TARPON_CLUSTER_NODE_ID" env-description:"Unique name of this instance among instances sharing the store, the host name when empty"`
+	Heartbeat    time.Duration `yaml:"heartbeat" env:"TARPON_CLUSTER_HEARTBEAT" env-description:"How often the instance renews its lease and checks which peers connected to other instances" env-default:"2s"`
+	Lease        time.Duration `yaml:"lease" env:"TARPON_CLUSTER_LEASE" env-description:"Time after which an instance which stopped renewing its lease is removed and its peers are reported as disconnected" env-default:"10s"`
+	AdvertiseURL string        `yaml:"advertise_url" env:"TARPON_CLUSTER_ADVERTISE_URL" env-description:"URL at which clients reach this instance, required by routing"`
+	Routing      string        `yaml:"routing" env:"TARPON_CLUSTER_ROUTING" env-description:"Routing of rooms to instances: off, hint to let clients ask for the instance owning a room once advertise_url is set, or redirect to also redirect joining peers, which browsers don't follow" env-default:"hint"`
+	Nodes        []string      `yaml:"nodes" env:"TARPON_CLUSTER_NODES" env-description:"Comma separated URLs of all instances routing rooms, live instances sharing the store when empty"`
+}
 
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		log.Printf("%s not found, reading config from environment", filename)
+// Load reads the config from the YAML file at the path and the environment, which
+// takes precedence, or from the environment only when the path is empty. It
+// returns an error when the config can't be read or is invalid.
+func Load(path string) (Config, error) {
+	var cfg Config
+	if path == "" {
 		if err := cleanenv.ReadEnv(&cfg); err != nil {
-			log.Fatalf("error reading config: %v", err)
+			return Config{}, fmt.Errorf("error reading config from environment: %w", err)
+		}
+	} else if err := cleanenv.ReadConfig(path, &cfg); err != nil {
+		return Config{}, fmt.Errorf("error reading config from %s: %w", path, err)
+	}
+	if base := os.Getenv(otlpEndpointEnv); cfg.Tracing.Endpoint == "" && base != "" {
+		cfg.Tracing.Endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Defaults returns the config with the default values of all settings, ignoring
+// the environment, e.g. for components used without a loaded config.
+func Defaults() Config {
+	var cfg Config
+	setDefaults(reflect.ValueOf(&cfg).Elem())
+	return cfg
+}
+
+// setDefaults sets fields of the struct to values of their env-default tags, as
+// cleanenv does. The tags are fixed, so values which can't be parsed are bugs.
+func setDefaults(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			setDefaults(f)
+			continue
+		}
+		def, ok := t.Field(i).Tag.Lookup("env-default")
+		if !ok {
+			continue
 		}
-	} else {
-		log.Printf("%s found, reading config from %s and environment", filename, filename)
-		if err := cleanenv.ReadConfig(filename, &cfg); err != nil {
-			log.Fatalf("error reading config: %v", err)
+		if err := parseDefault(f, def); err != nil {
+			panic(fmt.Sprintf("config: invalid default of %s.%s: %v", t.Name(), t.Field(i).Name, err))
 		}
 	}
+}
 
-	yaml, err := yaml.Marshal(&cfg)
+func parseDefault(f reflect.Value, def string) error {
+	if f.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(def)
+		f.SetInt(int64(d))
+		return err
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(def)
+	case reflect.Int:
+		n, err := strconv.Atoi(def)
+		f.SetInt(int64(n))
+		return err
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(def, 64)
+		f.SetFloat(x)
+		return err
+	case reflect.Bool:
+		b, err := strconv.ParseBool(def)
+		f.SetBool(b)
+		return err
+	case reflect.Slice:
+		if def != "" {
+			f.Set(reflect.ValueOf(strings.Split(def, ",")))
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// DefaultPath returns the path of the default config file, or an empty string
+// when there's no such file and the config is read from the environment only.
+func DefaultPath() string {
+	if _, err := os.Stat(DefaultFilename); err != nil {
+		return ""
+	}
+	return DefaultFilename
+}
+
+// Validate returns an error describing the first invalid setting.
+func (c *Config) Validate() error {
+	switch c.Logging.Level {
+	case "trace", "debug", "info", "warn", "warning", "error", "fatal", "panic":
+	default:
+		return fmt.Errorf("logging.level: unknown level %q", c.Logging.Level)
+	}
+	if c.ClientLimits.MaxConnections < 0 || c.ClientLimits.RequestRate < 0 || c.ClientLimits.RequestBurst < 0 {
+		return errors.New("client_limits: must not be negative")
+	}
+	if c.ClientLimits.RequestRate > 0 && c.ClientLimits.RequestBurst < 1 {
+		return errors.New("client_limits.request_burst: must be positive when request_rate is set")
+	}
+	if c.Tracing.SampleRatio <= 0 || c.Tracing.SampleRatio > 1 {
+		return errors.New("tracing.sample_ratio: must be above 0 and at most 1")
+	}
+	if _, err := c.Tracing.ExportHeaders(); err != nil {
+		return fmt.Errorf("tracing.headers: %w", err)
+	}
+	if _, err := c.Tracing.Resource(); err != nil {
+		return fmt.Errorf("tracing.resource_attributes: %w", err)
+	}
+	if c.Store.RedisAddress != "" && (c.Store.Timeout <= 0 || c.Store.PoolSize < 1 || c.Store.RedisDB < 0) {
+		return errors.New("store: timeout and pool_size must be positive and redis_db must not be negative")
+	}
+	if strings.Contains(c.Cluster.NodeID, "/") {
+		return errors.New("cluster.node_id: must not contain /")
+	}
+	if c.Cluster.Heartbeat <= 0 || c.Cluster.Lease <= c.Cluster.Heartbeat {
+		return errors.New("cluster.heartbeat: must be positive and less than lease")
+	}
+	if err := c.Cluster.validateRouting(); err != nil {
+		return err
+	}
+	// the buffer holds the key directory too, which peers get before the replay
+	if c.History.Replay < 0 || c.History.Replay >= c.Websocket.MessagesBufSize {
+		return errors.New("history.replay: must not be negative and must be less than websocket.messages_buf_size")
+	}
+	for _, u := range c.Webhooks.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("webhooks.urls: invalid URL %q", u)
+		}
+	}
+	return c.Websocket.Validate()
+}
+
+// Routing modes of rooms to instances of the server.
+const (
+	RoutingOff      = "off"
+	RoutingHint     = "hint"
+	RoutingRedirect = "redirect"
+)
+
+// RoutingOn reports whether rooms are routed. Hints, the default, are given only
+// when the instance advertises its URL, so that single instances need no URL.
+func (c *Cluster) RoutingOn() bool {
+	return c.Routing == RoutingRedirect || (c.Routing == RoutingHint && (c.AdvertiseURL != "" || len(c.Nodes) > 0))
+}
+
+func (c *Cluster) validateRouting() error {
+	switch c.Routing {
+	case RoutingOff, RoutingHint, RoutingRedirect:
+	default:
+		return fmt.Errorf("cluster.routing: unknown mode %q", c.Routing)
+	}
+	if !c.RoutingOn() {
+		return nil
+	}
+	if !isHTTPURL(c.AdvertiseURL) {
+		return errors.New("cluster.advertise_url: must be an http or https URL when routing is on")
+	}
+	if len(c.Nodes) == 0 {
+		return nil
+	}
+	advertised := false
+	for _, u := range c.Nodes {
+		if !isHTTPURL(u) {
+			return fmt.Errorf("cluster.nodes: invalid URL %q", u)
+		}
+		advertised = advertised || u == c.AdvertiseURL
+	}
+	if !advertised {
+		return errors.New("cluster.nodes: must include advertise_url")
+	}
+	return nil
+}
+
+func isHTTPURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// RequiresRestart reports whether the configs differ in settings which are not
+// reloaded at runtime. Log level, client limits, allowed origins and webhook URLs
+// and secret can be changed without a restart.
+func RequiresRestart(old Config, new Config) bool {
+	return !reflect.DeepEqual(withoutReloadable(old), withoutReloadable(new))
+}
+
+func withoutReloadable(c Config) Config {
+	c.Logging.Level = ""
+	c.ClientLimits = ClientLimits{}
+	c.Server.AllowedOrigins = nil
+	c.Webhooks.URLs = nil
+	c.Webhooks.Secret = ""
+	return c
+}
+
+// redactedValue replaces secrets in dumped configs
+const redactedValue = "<redacted>"
+
+// Dump returns the config in YAML, with secrets redacted, so that it can be logged.
+func Dump(cfg Config) (string, error) {
+	cfg = redacted(cfg)
+	out, err := yaml.Marshal(&cfg)
 	if err != nil {
-		log.Fatalf("error while printing config: %v", err)
+		return "", err
 	}
-	log.Printf("tarpon config:\n%s\n", string(yaml))
+	return string(out), nil
+}
 
-	return cfg
+func redacted(c Config) Config {
+	redact(&c.Admin.Token)
+	redact(&c.Webhooks.Secret)
+	redact(&c.Store.RedisPassword)
+	redact(&c.Tracing.Headers)
+	return c
+}
+
+// redact replaces the secret, unless it's empty, so that dumps tell whether it's set
+func redact(secret *string) {
+	if *secret != "" {
+		*secret = redactedValue
+	}
 }
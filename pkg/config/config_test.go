@@ -0,0 +1,177 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/config"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tarpon-config")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "tarpon.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, "logging:\n  level: debug\nwebsocket:\n  pong_wait: 30s\n  ping_period: 20s\n")
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if cfg.Logging.Level != "debug" || cfg.Websocket.PongWait != 30*time.Second {
+		t.Errorf("got %+v, want settings from the file", cfg)
+	}
+	if cfg.Websocket.WriteWait != 15*time.Second {
+		t.Errorf("got write wait %v, want the default", cfg.Websocket.WriteWait)
+	}
+	if cfg.Cluster.Routing != config.RoutingHint || cfg.Cluster.RoutingOn() {
+		t.Errorf("got routing %q on %v, want hints off until the URL is advertised", cfg.Cluster.Routing, cfg.Cluster.RoutingOn())
+	}
+}
+
+func setenv(t *testing.T, key string, value string) {
+	t.Helper()
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("could not set %s: %v", key, err)
+	}
+	t.Cleanup(func() { os.Unsetenv(key) })
+}
+
+func TestLoadOpenTelemetryEnvironment(t *testing.T) {
+	setenv(t, "OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	setenv(t, "OTEL_EXPORTER_OTLP_HEADERS", "authorization=Bearer%20secret,x-tenant=acme")
+	setenv(t, "OTEL_SERVICE_NAME", "chat")
+	setenv(t, "OTEL_RESOURCE_ATTRIBUTES", "deployment.environment=production")
+	setenv(t, "TARPON_TRACING_SAMPLE_RATIO", "0.5")
+	setenv(t, "OTEL_TRACES_SAMPLER_ARG", "0.1")
+
+	cfg, err := config.Load(writeConfig(t, "{}\n"))
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if cfg.Tracing.Endpoint != "http://collector:4318/v1/traces" || cfg.Tracing.ServiceName != "chat" {
+		t.Errorf("got endpoint %q of service %q, want them from OTEL_* variables", cfg.Tracing.Endpoint, cfg.Tracing.ServiceName)
+	}
+	if cfg.Tracing.SampleRatio != 0.5 {
+		t.Errorf("got sample ratio %v, want TARPON_TRACING_SAMPLE_RATIO to take precedence", cfg.Tracing.SampleRatio)
+	}
+	headers, err := cfg.Tracing.ExportHeaders()
+	if err != nil || !reflect.DeepEqual(headers, map[string]string{"authorization": "Bearer secret", "x-tenant": "acme"}) {
+		t.Errorf("got headers %v with error %v", headers, err)
+	}
+	resource, err := cfg.Tracing.Resource()
+	if err != nil || !reflect.DeepEqual(resource, map[string]string{"deployment.environment": "production"}) {
+		t.Errorf("got resource %v with error %v", resource, err)
+	}
+
+	// the traces URL takes precedence over the collector's URL
+	setenv(t, "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://traces:4318/custom")
+	cfg, err = config.Load(writeConfig(t, "{}\n"))
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if cfg.Tracing.Endpoint != "http://traces:4318/custom" {
+		t.Errorf("got endpoint %q, want the traces URL", cfg.Tracing.Endpoint)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, err := config.Load(writeConfig(t, "{}\n"))
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if got := config.Defaults(); !reflect.DeepEqual(got, cfg) {
+		t.Errorf("got defaults %+v, want %+v", got, cfg)
+	}
+}
+
+func TestLoadInvalidConfig(t *testing.T) {
+	cases := map[string]string{
+		"unknown log level":      "logging:\n  level: loud\n",
+		"ping after pong wait":   "websocket:\n  pong_wait: 10s\n  ping_period: 20s\n",
+		"negative client limit":  "clientlimits:\n  max_connections: -1\n",
+		"invalid webhook url":    "webhooks:\n  urls: [\"ftp://example.com\"]\n",
+		"negative redis db":      "store:\n  redis_address: localhost:6379\n  redis_db: -1\n",
+		"lease before heartbeat": "cluster:\n  heartbeat: 10s\n  lease: 5s\n",
+		"routing without url":    "cluster:\n  routing: redirect\n",
+		"nodes without url":      "cluster:\n  nodes: [\"http://a:5000\"]\n",
+		"nodes without this one": "cluster:\n  routing: hint\n  advertise_url: http://a:5000\n  nodes: [\"http://b:5000\"]\n",
+		"sample ratio above 1":   "tracing:\n  sample_ratio: 1.5\n",
+		"malformed headers":      "tracing:\n  headers: authorization\n",
+		"malformed resource":     "tracing:\n  resource_attributes: region=%zz\n",
+		"replay above buffer":    "history:\n  replay: 64\n",
+		"negative message rate":  "websocket:\n  message_rate: -1\n",
+		"malformed yaml":         "logging: [\n",
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := config.Load(writeConfig(t, content)); err == nil {
+				t.Errorf("loaded invalid config")
+			}
+		})
+	}
+
+	if _, err := config.Load("does-not-exist.yaml"); err == nil {
+		t.Errorf("loaded config from a missing file")
+	}
+}
+
+func TestRequiresRestart(t *testing.T) {
+	old, err := config.Load(writeConfig(t, "logging:\n  level: info\n"))
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	reloadable := old
+	reloadable.Logging.Level = "debug"
+	reloadable.ClientLimits.RequestRate = 1
+	reloadable.Webhooks.URLs = []string{"https://example.com/hooks"}
+	reloadable.Server.AllowedOrigins = []string{"https://example.com"}
+	if config.RequiresRestart(old, reloadable) {
+		t.Errorf("reloadable settings should not require a restart")
+	}
+
+	changed := old
+	changed.Server.Port = "6000"
+	if !config.RequiresRestart(old, changed) {
+		t.Errorf("changed port should require a restart")
+	}
+}
+
+func TestDumpRedactsSecrets(t *testing.T) {
+	cfg, err := config.Load(writeConfig(t, "admin:\n  token: admin-secret\nwebhooks:\n  secret: webhook-secret\nstore:\n  redis_password: redis-secret\ntracing:\n  headers: authorization=tracing-secret\n"))
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	dump, err := config.Dump(cfg)
+	if err != nil {
+		t.Fatalf("could not dump config: %v", err)
+	}
+	for _, secret := range []string{"admin-secret", "webhook-secret", "redis-secret", "tracing-secret"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("dump contains secret %q", secret)
+		}
+	}
+	if !strings.Contains(dump, "token: <redacted>") {
+		t.Errorf("dump doesn't tell the token is set:\n%s", dump)
+	}
+	if cfg.Admin.Token != "admin-secret" {
+		t.Errorf("dumping changed the config")
+	}
+}
@@ -0,0 +1,140 @@
+// Package e2e seals payloads of direct messages, so that only their recipients
+// can read them while the server still routes them. Peers register X25519 public
+// keys with the server, which distributes them to the room, and seal payloads
+// with NaCl box using their private key and the recipient's public key.
+//
+// The server can't read sealed payloads, but it could hand out keys of its own.
+// Peers which don't trust the server should compare key fingerprints out-of-band.
+package e2e
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// TypeSealed is the type of sealed payloads.
+const TypeSealed = "sealed"
+
+const (
+	keySize   = 32
+	nonceSize = 24
+)
+
+var (
+	ErrInvalidKey      = errors.New("public key must be 32 bytes encoded with base64")
+	ErrInvalidEnvelope = errors.New("payload is not a sealed envelope")
+	ErrCantOpen        = errors.New("sealed payload can't be opened with the keys")
+)
+
+// PublicKey is an X25519 public key.
+type PublicKey [keySize]byte
+
+// ParsePublicKey decodes the key from standard base64.
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != keySize {
+		return k, ErrInvalidKey
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// String returns the key in standard base64, as it's registered with the server.
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// Fingerprint returns a short hash of the key, which peers can compare out-of-band.
+func (k PublicKey) Fingerprint() string {
+	sum := sha256.Sum256(k[:])
+	return hex.EncodeToString(sum[:8])
+}
+
+// KeyPair is a peer's key pair. The private key never leaves the peer.
+type KeyPair struct {
+	Public  PublicKey
+	private [keySize]byte
+}
+
+// GenerateKeyPair creates a new key pair from a secure source of randomness.
+func GenerateKeyPair() (*KeyPair, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Public: *public, private: *private}, nil
+}
+
+// Envelope is a sealed payload. Both fields are encoded with standard base64.
+type Envelope struct {
+	Type  string `json:"type"`
+	Nonce string `json:"nonce"`
+	Box   string `json:"box"`
+}
+
+// Seal encrypts and authenticates the payload for the recipient and returns the
+// envelope as a payload.
+func Seal(payload []byte, to PublicKey, from *KeyPair) (json.RawMessage, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	public := [keySize]byte(to)
+	sealed := box.Seal(nil, payload, &nonce, &public, &from.private)
+	return json.Marshal(Envelope{
+		Type:  TypeSealed,
+		Nonce: base64.StdEncoding.EncodeToString(nonce[:]),
+		Box:   base64.StdEncoding.EncodeToString(sealed),
+	})
+}
+
+// Open decrypts the sealed payload sent by the peer with the public key.
+func Open(payload []byte, from PublicKey, to *KeyPair) ([]byte, error) {
+	e, err := parseEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+	if err != nil || len(nonce) != nonceSize {
+		return nil, ErrInvalidEnvelope
+	}
+	sealed, err := base64.StdEncoding.DecodeString(e.Box)
+	if err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	var n [nonceSize]byte
+	copy(n[:], nonce)
+	public := [keySize]byte(from)
+	opened, ok := box.Open(nil, sealed, &n, &public, &to.private)
+	if !ok {
+		return nil, ErrCantOpen
+	}
+	return opened, nil
+}
+
+// IsSealed reports whether the payload is a sealed envelope.
+func IsSealed(payload []byte) bool {
+	_, err := parseEnvelope(payload)
+	return err == nil
+}
+
+func parseEnvelope(payload []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(payload, &e); err != nil || e.Type != TypeSealed || e.Nonce == "" || e.Box == "" {
+		return Envelope{}, ErrInvalidEnvelope
+	}
+	return e, nil
+}
+
+// String returns the fingerprint of the key pair's public key, never the private key.
+func (k *KeyPair) String() string {
+	return fmt.Sprintf("KeyPair(%s)", k.Public.Fingerprint())
+}
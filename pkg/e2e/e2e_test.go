@@ -0,0 +1,59 @@
+package e2e_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/montrosesoftware/tarpon/pkg/e2e"
+)
+
+func newKeyPair(t *testing.T) *e2e.KeyPair {
+	t.Helper()
+	kp, err := e2e.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("could not generate key pair: %v", err)
+	}
+	return kp
+}
+
+func TestSealAndOpen(t *testing.T) {
+	alice, bob, eve := newKeyPair(t), newKeyPair(t), newKeyPair(t)
+	plain := []byte(`{"sdp":"v=0"}`)
+
+	sealed, err := e2e.Seal(plain, bob.Public, alice)
+	if err != nil {
+		t.Fatalf("could not seal payload: %v", err)
+	}
+	if !e2e.IsSealed(sealed) || bytes.Contains(sealed, []byte("sdp")) {
+		t.Errorf("got payload %s, want a sealed envelope", sealed)
+	}
+
+	opened, err := e2e.Open(sealed, alice.Public, bob)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Errorf("got %s and error %v, want %s", opened, err, plain)
+	}
+	if _, err := e2e.Open(sealed, alice.Public, eve); err != e2e.ErrCantOpen {
+		t.Errorf("got error %v opening with another key, want %v", err, e2e.ErrCantOpen)
+	}
+	if _, err := e2e.Open(sealed, eve.Public, bob); err != e2e.ErrCantOpen {
+		t.Errorf("got error %v opening as sent by another peer, want %v", err, e2e.ErrCantOpen)
+	}
+	if _, err := e2e.Open(plain, alice.Public, bob); err != e2e.ErrInvalidEnvelope {
+		t.Errorf("got error %v opening plain payload, want %v", err, e2e.ErrInvalidEnvelope)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	kp := newKeyPair(t)
+
+	parsed, err := e2e.ParsePublicKey(kp.Public.String())
+	if err != nil || parsed != kp.Public {
+		t.Errorf("got key %v and error %v, want %v", parsed, err, kp.Public)
+	}
+	for _, invalid := range []string{"", "not base64!", "c2hvcnQ=", strings.Repeat("A", 64)} {
+		if _, err := e2e.ParsePublicKey(invalid); err != e2e.ErrInvalidKey {
+			t.Errorf("got error %v parsing %q, want %v", err, invalid, e2e.ErrInvalidKey)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package events
+
+import "time"
+
+type Type string
+
+const (
+	PeerConnected    Type = "peer_connected"
+	PeerDisconnected Type = "peer_disconnected"
+	RoomCreated      Type = "room_created"
+	RoomEmpty        Type = "room_empty"
+	RoomDeleted      Type = "room_deleted"
+	PeerRegistered   Type = "peer_registered"
+)
+
+// Event describes a change in the lifecycle of a room or a peer.
+type Event struct {
+	Type Type      `json:"type"`
+	Room string    `json:"room"`
+	Peer string    `json:"peer,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+func New(t Type, room string, peer string) Event {
+	return Event{Type: t, Room: room, Peer: peer, Time: time.Now().UTC()}
+}
+
+// Sink receives lifecycle events. Notify must not block.
+type Sink interface {
+	Notify(e Event)
+}
+
+// NoopSink is a sink that discards every event.
+type NoopSink struct{}
+
+func (NoopSink) Notify(_ Event) {}
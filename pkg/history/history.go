@@ -0,0 +1,181 @@
+package history
+
+import (
+	"sync"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+// Limits bound the history of a room. History is disabled when MaxCount is 0,
+// messages never expire when MaxAge is 0.
+type Limits struct {
+	MaxCount int           `json:"max_count"`
+	MaxAge   time.Duration `json:"max_age"`
+}
+
+// Entry is a message stored in the history. Seq grows monotonically within a room
+// and is used as a pagination cursor.
+type Entry struct {
+	Seq     uint64            `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Message messaging.Message `json:"message"`
+}
+
+type roomHistory struct {
+	entries []Entry
+	limits  Limits
+	seq     uint64
+	mutex   sync.Mutex
+	// sending is held for reading while messages are delivered and for writing
+	// while subscribers are registered
+	sending sync.RWMutex
+}
+
+// Store keeps bounded histories of broadcast messages sent in rooms.
+type Store struct {
+	rooms    map[string]*roomHistory
+	defaults Limits
+	now      func() time.Time
+	mutex    sync.Mutex
+}
+
+func NewStore(defaults Limits) *Store {
+	return &Store{rooms: make(map[string]*roomHistory), defaults: defaults, now: time.Now}
+}
+
+// SetLimits overrides default limits of the room.
+func (s *Store) SetLimits(room string, limits Limits) {
+	h := s.room(room)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.limits = limits
+	h.prune(s.now())
+}
+
+// Messages returns up to limit entries with Seq greater than after, oldest first,
+// and reports whether there are more entries to read.
+func (s *Store) Messages(room string, after uint64, limit int) ([]Entry, bool) {
+	s.mutex.Lock()
+	h := s.rooms[room]
+	s.mutex.Unlock()
+	if h == nil {
+		return nil, false
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.prune(s.now())
+	var result []Entry
+	for i, e := range h.entries {
+		if e.Seq <= after {
+			continue
+		}
+		if len(result) == limit {
+			return result, true
+		}
+		result = append(result, h.entries[i])
+	}
+	return result, false
+}
+
+// Delete removes the room's history and its limits.
+func (s *Store) Delete(room string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.rooms, room)
+}
+
+func (s *Store) room(room string) *roomHistory {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	h := s.rooms[room]
+	if h == nil {
+		h = &roomHistory{limits: s.defaults}
+		s.rooms[room] = h
+	}
+	return h
+}
+
+// append assumes the room lock is held
+func (h *roomHistory) append(m messaging.Message, now time.Time) {
+	if h.limits.MaxCount == 0 {
+		return
+	}
+	h.seq++
+	h.entries = append(h.entries, Entry{Seq: h.seq, Time: now, Message: m})
+	h.prune(now)
+}
+
+// recent assumes the room lock is held
+func (h *roomHistory) recent(n int, now time.Time) []Entry {
+	h.prune(now)
+	if len(h.entries) <= n {
+		return h.entries
+	}
+	return h.entries[len(h.entries)-n:]
+}
+
+// prune drops entries exceeding limits and assumes the room lock is held
+func (h *roomHistory) prune(now time.Time) {
+	drop := 0
+	if len(h.entries) > h.limits.MaxCount {
+		drop = len(h.entries) - h.limits.MaxCount
+	}
+	if h.limits.MaxAge > 0 {
+		for drop < len(h.entries) && now.Sub(h.entries[drop].Time) > h.limits.MaxAge {
+			drop++
+		}
+	}
+	h.entries = h.entries[drop:]
+}
+
+// Broker records broadcast messages sent by peers in the store and replays the
+// most recent of them to subscribers joining a room.
+type Broker struct {
+	broker.Broker
+	store  *Store
+	replay int
+}
+
+// NewBroker creates a broker replaying up to replay messages to new subscribers.
+func NewBroker(b broker.Broker, s *Store, replay int) *Broker {
+	return &Broker{Broker: b, store: s, replay: replay}
+}
+
+func (b *Broker) Send(room string, message messaging.Message) error {
+	if !message.IsBroadcast() || messaging.IsServerUID(message.From) {
+		return b.Broker.Send(room, message)
+	}
+
+	// messages of the room are delivered concurrently, but not while a subscriber
+	// registers, so that it either gets a message replayed or delivered, but never
+	// both or none
+	h := b.store.room(room)
+	h.sending.RLock()
+	defer h.sending.RUnlock()
+
+	h.mutex.Lock()
+	h.append(message, b.store.now())
+	h.mutex.Unlock()
+	return b.Broker.Send(room, message)
+}
+
+func (b *Broker) Register(room string, s broker.Subscriber) {
+	h := b.store.room(room)
+	h.sending.Lock()
+	defer h.sending.Unlock()
+
+	h.mutex.Lock()
+	recent := append([]Entry(nil), h.recent(b.replay, b.store.now())...)
+	h.mutex.Unlock()
+	// buffers of subscribers hold the replay, which is checked with their options
+	for _, e := range recent {
+		s.Write(e.Message)
+	}
+	b.Broker.Register(room, s)
+}
@@ -0,0 +1,196 @@
+package history_test
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/history"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+var (
+	myRoom = "room-123"
+	myPeer = "peer-abc"
+)
+
+type SpySubscriber struct {
+	id       string
+	messages []messaging.Message
+	mutex    sync.Mutex
+}
+
+func (s *SpySubscriber) ID() string {
+	return s.id
+}
+
+func (s *SpySubscriber) Write(m messaging.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages = append(s.messages, m)
+}
+
+func TestReplayRecentBroadcasts(t *testing.T) {
+	store := history.NewStore(history.Limits{MaxCount: 3})
+	b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), store, 2)
+	sender := &SpySubscriber{id: myPeer}
+	b.Register(myRoom, sender)
+
+	for i := 0; i < 5; i++ {
+		send(t, b, newMessage(i, ""))
+	}
+	send(t, b, newMessage(5, myPeer)) // direct messages are not recorded
+	ctrl, err := messaging.NewPeerConnected("another-peer")
+	if err != nil {
+		t.Fatalf("error creating control message: %v", err)
+	}
+	send(t, b, *ctrl) // server messages are not recorded
+
+	late := &SpySubscriber{id: "late-peer"}
+	b.Register(myRoom, late)
+
+	assertMessageIDs(t, late.messages, []string{"3", "4"})
+	entries, _ := store.Messages(myRoom, 0, 10)
+	if len(entries) != 3 {
+		t.Errorf("got %d entries in history, want 3", len(entries))
+	}
+}
+
+func TestHistoryDisabledByDefault(t *testing.T) {
+	store := history.NewStore(history.Limits{})
+	b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), store, 10)
+
+	send(t, b, newMessage(0, ""))
+	store.SetLimits("another-room", history.Limits{MaxCount: 10})
+	if err := b.Send("another-room", newMessage(1, "")); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+
+	if entries, _ := store.Messages(myRoom, 0, 10); len(entries) != 0 {
+		t.Errorf("got %d entries, but history should be disabled", len(entries))
+	}
+	if entries, _ := store.Messages("another-room", 0, 10); len(entries) != 1 {
+		t.Errorf("got %d entries, but history should be enabled for the room", len(entries))
+	}
+}
+
+func TestExpireOldMessages(t *testing.T) {
+	store := history.NewStore(history.Limits{MaxCount: 10, MaxAge: 50 * time.Millisecond})
+	b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), store, 10)
+
+	send(t, b, newMessage(0, ""))
+	time.Sleep(100 * time.Millisecond)
+	send(t, b, newMessage(1, ""))
+
+	entries, _ := store.Messages(myRoom, 0, 10)
+	assertMessageIDs(t, messagesOf(entries), []string{"1"})
+}
+
+func TestPaginateMessages(t *testing.T) {
+	store := history.NewStore(history.Limits{MaxCount: 10})
+	b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), store, 0)
+	for i := 0; i < 5; i++ {
+		send(t, b, newMessage(i, ""))
+	}
+
+	page1, more := store.Messages(myRoom, 0, 2)
+	if !more {
+		t.Errorf("first page should report more messages")
+	}
+	assertMessageIDs(t, messagesOf(page1), []string{"0", "1"})
+
+	page2, more := store.Messages(myRoom, page1[len(page1)-1].Seq, 10)
+	if more {
+		t.Errorf("last page should not report more messages")
+	}
+	assertMessageIDs(t, messagesOf(page2), []string{"2", "3", "4"})
+}
+
+func TestDeleteHistory(t *testing.T) {
+	store := history.NewStore(history.Limits{MaxCount: 10})
+	b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), store, 10)
+	send(t, b, newMessage(0, ""))
+
+	store.Delete(myRoom)
+	if entries, _ := store.Messages(myRoom, 0, 10); len(entries) != 0 {
+		t.Errorf("got %d entries of deleted room", len(entries))
+	}
+	late := &SpySubscriber{id: "late-peer"}
+	b.Register(myRoom, late)
+	if len(late.messages) != 0 {
+		t.Errorf("replayed %d messages of deleted room", len(late.messages))
+	}
+}
+
+// BlockingSubscriber blocks delivery of the first message until it's released
+type BlockingSubscriber struct {
+	SpySubscriber
+	blocked chan struct{}
+	release chan struct{}
+	writes  int32
+}
+
+func (s *BlockingSubscriber) Write(m messaging.Message) {
+	if atomic.AddInt32(&s.writes, 1) == 1 {
+		close(s.blocked)
+		<-s.release
+	}
+	s.SpySubscriber.Write(m)
+}
+
+func TestBroadcastsAreNotSerialized(t *testing.T) {
+	store := history.NewStore(history.Limits{MaxCount: 10})
+	b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), store, 10)
+	slow := &BlockingSubscriber{SpySubscriber: SpySubscriber{id: "slow-peer"}, blocked: make(chan struct{}), release: make(chan struct{})}
+	b.Register(myRoom, slow)
+
+	go b.Send(myRoom, newMessage(0, ""))
+	<-slow.blocked
+	done := make(chan struct{})
+	go func() {
+		_ = b.Send(myRoom, newMessage(1, ""))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("broadcast waited for delivery of another broadcast")
+	}
+	close(slow.release)
+}
+
+func send(t *testing.T, b broker.Broker, m messaging.Message) {
+	t.Helper()
+	if err := b.Send(myRoom, m); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+}
+
+func newMessage(i int, to string) messaging.Message {
+	return messaging.Message{ID: strconv.Itoa(i), From: myPeer, To: to, Payload: json.RawMessage(`"hello"`)}
+}
+
+func messagesOf(entries []history.Entry) []messaging.Message {
+	var result []messaging.Message
+	for _, e := range entries {
+		result = append(result, e.Message)
+	}
+	return result
+}
+
+func assertMessageIDs(t *testing.T, got []messaging.Message, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages %v, want ids %v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i].ID != want[i] {
+			t.Errorf("at index %d got message %v, want id %q", i, got[i], want[i])
+		}
+	}
+}
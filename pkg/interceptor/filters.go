@@ -0,0 +1,172 @@
+package interceptor
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/montrosesoftware/tarpon/pkg/e2e"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+// Codes of rejections returned by built-in interceptors, in addition to messaging.ErrCodeTooLarge.
+const (
+	ErrCodeInvalidPayload   = "invalid_payload"
+	ErrCodeForbiddenContent = "forbidden_content"
+	ErrCodeNotSealed        = "not_sealed"
+)
+
+// MaxPayloadSize rejects messages with payloads larger than size bytes.
+func MaxPayloadSize(size int) Interceptor {
+	return Func(func(room string, m messaging.Message) ([]messaging.Message, error) {
+		if len(m.Payload) > size {
+			return nil, Reject(messaging.ErrCodeTooLarge, fmt.Sprint("payload exceeds ", size, " bytes"))
+		}
+		return []messaging.Message{m}, nil
+	})
+}
+
+// RequireSealed rejects direct messages between peers with payloads which are not
+// sealed for end-to-end encryption. Broadcasts and commands to the server pass.
+func RequireSealed() Interceptor {
+	return Func(func(room string, m messaging.Message) ([]messaging.Message, error) {
+		if !m.IsBroadcast() && m.To != messaging.ServerUID && !e2e.IsSealed(m.Payload) {
+			return nil, Reject(ErrCodeNotSealed, "direct messages must be sealed")
+		}
+		return []messaging.Message{m}, nil
+	})
+}
+
+// ValidateSchema rejects messages with payloads not matching the schema.
+func ValidateSchema(schema *Schema) Interceptor {
+	return Func(func(room string, m messaging.Message) ([]messaging.Message, error) {
+		var v interface{}
+		if err := json.Unmarshal(m.Payload, &v); err != nil {
+			return nil, Reject(ErrCodeInvalidPayload, "payload is not valid JSON")
+		}
+		if err := schema.Validate(v); err != nil {
+			return nil, Reject(ErrCodeInvalidPayload, err.Error())
+		}
+		return []messaging.Message{m}, nil
+	})
+}
+
+// KeywordFilter looks for keywords, matched as whole words regardless of case, in
+// all strings of the payload. Words are separated by anything other than letters,
+// digits and underscores of any script, and empty keywords are ignored. When mask
+// is true the keywords are replaced with asterisks, otherwise messages containing
+// them are rejected.
+func KeywordFilter(keywords []string, mask bool) Interceptor {
+	quoted := make([]string, 0, len(keywords))
+	for _, k := range keywords {
+		// e.g. a trailing comma in the list, which would match between any words
+		if k = strings.TrimSpace(k); k != "" {
+			quoted = append(quoted, regexp.QuoteMeta(k))
+		}
+	}
+	// the end of the keyword is matched, so that a longer keyword which isn't
+	// a whole word doesn't hide a shorter one which is
+	m := &matcher{re: regexp.MustCompile(`(?i)(` + strings.Join(quoted, "|") + `)(?:$|[^\p{L}\p{N}_])`)}
+
+	return Func(func(room string, msg messaging.Message) ([]messaging.Message, error) {
+		if len(quoted) == 0 {
+			return []messaging.Message{msg}, nil
+		}
+
+		var v interface{}
+		if err := json.Unmarshal(msg.Payload, &v); err != nil {
+			return nil, Reject(ErrCodeInvalidPayload, "payload is not valid JSON")
+		}
+		if !containsMatch(v, m) {
+			return []messaging.Message{msg}, nil
+		}
+		if !mask {
+			return nil, Reject(ErrCodeForbiddenContent, "message contains forbidden words")
+		}
+
+		payload, err := json.Marshal(maskStrings(v, m))
+		if err != nil {
+			return nil, err
+		}
+		msg.Payload = payload
+		return []messaging.Message{msg}, nil
+	})
+}
+
+// matcher finds keywords which are whole words. Go's regular expressions only
+// know ASCII word boundaries and can't look behind, so the start of the keyword
+// is checked separately.
+type matcher struct {
+	re *regexp.Regexp
+}
+
+// findAll returns the start and end of every keyword in s
+func (m *matcher) findAll(s string) [][2]int {
+	var found [][2]int
+	for i := 0; i < len(s); {
+		loc := m.re.FindStringSubmatchIndex(s[i:])
+		if loc == nil {
+			break
+		}
+		start, end := i+loc[2], i+loc[3]
+		if r, _ := utf8.DecodeLastRuneInString(s[:start]); start == 0 || !isWordRune(r) {
+			found = append(found, [2]int{start, end})
+			i = end
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(s[start:])
+		i = start + size
+	}
+	return found
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+func containsMatch(v interface{}, m *matcher) bool {
+	switch t := v.(type) {
+	case string:
+		return len(m.findAll(t)) > 0
+	case []interface{}:
+		for _, e := range t {
+			if containsMatch(e, m) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range t {
+			if containsMatch(e, m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func maskStrings(v interface{}, m *matcher) interface{} {
+	switch t := v.(type) {
+	case string:
+		var b strings.Builder
+		last := 0
+		for _, loc := range m.findAll(t) {
+			b.WriteString(t[last:loc[0]])
+			b.WriteString(strings.Repeat("*", utf8.RuneCountInString(t[loc[0]:loc[1]])))
+			last = loc[1]
+		}
+		b.WriteString(t[last:])
+		return b.String()
+	case []interface{}:
+		for i := range t {
+			t[i] = maskStrings(t[i], m)
+		}
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = maskStrings(t[k], m)
+		}
+	}
+	return v
+}
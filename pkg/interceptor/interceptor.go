@@ -0,0 +1,80 @@
+package interceptor
+
+import (
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+// Interceptor processes a message sent by a peer before it reaches the broker.
+// It returns the messages to send instead of the original one: the message itself,
+// possibly modified, several messages to fan it out, or none to drop it silently.
+// Returning an error rejects the message. Errors created with Reject are reported
+// to the sender with their code.
+type Interceptor interface {
+	Intercept(room string, m messaging.Message) ([]messaging.Message, error)
+}
+
+// Func is an adapter allowing ordinary functions to be used as interceptors.
+type Func func(room string, m messaging.Message) ([]messaging.Message, error)
+
+func (f Func) Intercept(room string, m messaging.Message) ([]messaging.Message, error) {
+	return f(room, m)
+}
+
+// Chain applies interceptors in order, every interceptor processing all messages
+// returned by the previous one.
+type Chain []Interceptor
+
+func (c Chain) Intercept(room string, m messaging.Message) ([]messaging.Message, error) {
+	messages := []messaging.Message{m}
+	for _, i := range c {
+		var next []messaging.Message
+		for _, msg := range messages {
+			result, err := i.Intercept(room, msg)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, result...)
+		}
+		messages = next
+	}
+	return messages, nil
+}
+
+// Reject returns an error rejecting the message, which is reported to the sender with the code.
+func Reject(code string, reason string) error {
+	return &messaging.Rejection{Code: code, Reason: reason}
+}
+
+// Broker passes messages sent by peers through an interceptor before handing
+// them to the underlying broker. Messages sent by the server or on its behalf are
+// not intercepted.
+type Broker struct {
+	broker.Broker
+	interceptor Interceptor
+}
+
+func NewBroker(b broker.Broker, i Interceptor) *Broker {
+	return &Broker{Broker: b, interceptor: i}
+}
+
+// Send returns the interceptor's error when the message is rejected, otherwise
+// the first error returned by the underlying broker.
+func (b *Broker) Send(room string, message messaging.Message) error {
+	if messaging.IsServerUID(message.From) {
+		return b.Broker.Send(room, message)
+	}
+
+	messages, err := b.interceptor.Intercept(room, message)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, m := range messages {
+		if err := b.Broker.Send(room, m); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
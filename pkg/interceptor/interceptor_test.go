@@ -0,0 +1,257 @@
+package interceptor_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/interceptor"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+var (
+	myRoom = "room-123"
+	myPeer = "peer-abc"
+)
+
+type SpyBroker struct {
+	broker.Broker
+	messages []messaging.Message
+}
+
+func (b *SpyBroker) Send(room string, m messaging.Message) error {
+	b.messages = append(b.messages, m)
+	return nil
+}
+
+func fanOut(recipients ...string) interceptor.Interceptor {
+	return interceptor.Func(func(room string, m messaging.Message) ([]messaging.Message, error) {
+		var result []messaging.Message
+		for _, r := range recipients {
+			m.To = r
+			result = append(result, m)
+		}
+		return result, nil
+	})
+}
+
+func TestChainAppliesInterceptorsToAllMessages(t *testing.T) {
+	var seen []string
+	spy := interceptor.Func(func(room string, m messaging.Message) ([]messaging.Message, error) {
+		seen = append(seen, m.To)
+		return []messaging.Message{m}, nil
+	})
+	spyBroker := &SpyBroker{}
+	b := interceptor.NewBroker(spyBroker, interceptor.Chain{fanOut("a", "b"), spy})
+
+	if err := b.Send(myRoom, newMessage(`"hello"`)); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+
+	if !reflect.DeepEqual(seen, []string{"a", "b"}) {
+		t.Errorf("second interceptor saw recipients %v, want [a b]", seen)
+	}
+	if len(spyBroker.messages) != 2 {
+		t.Errorf("got %d messages sent, want 2", len(spyBroker.messages))
+	}
+}
+
+func TestRejectedMessagesAreNotSent(t *testing.T) {
+	spyBroker := &SpyBroker{}
+	b := interceptor.NewBroker(spyBroker, interceptor.Chain{interceptor.MaxPayloadSize(5)})
+
+	err := b.Send(myRoom, newMessage(`"too long"`))
+
+	assertRejection(t, err, messaging.ErrCodeTooLarge)
+	if len(spyBroker.messages) != 0 {
+		t.Errorf("got %d messages sent, want none", len(spyBroker.messages))
+	}
+}
+
+func TestServerMessagesAreNotIntercepted(t *testing.T) {
+	spyBroker := &SpyBroker{}
+	b := interceptor.NewBroker(spyBroker, interceptor.Chain{interceptor.MaxPayloadSize(0)})
+
+	m, err := messaging.NewPeerConnected(myPeer)
+	if err != nil {
+		t.Fatalf("error creating control message: %v", err)
+	}
+	if err := b.Send(myRoom, *m); err != nil {
+		t.Errorf("could not send control message: %v", err)
+	}
+	if len(spyBroker.messages) != 1 {
+		t.Errorf("got %d messages sent, want 1", len(spyBroker.messages))
+	}
+}
+
+func TestKeywordFilter(t *testing.T) {
+	cases := map[string]struct {
+		payload     string
+		mask        bool
+		wantPayload string
+		wantCode    string
+	}{
+		"passes clean messages": {
+			payload:     `{"text":"hello there"}`,
+			wantPayload: `{"text":"hello there"}`,
+		},
+		"ignores keywords inside words": {
+			payload:     `{"text":"darnation"}`,
+			wantPayload: `{"text":"darnation"}`,
+		},
+		"rejects messages with keywords": {
+			payload:  `{"text":"well, DARN it"}`,
+			wantCode: interceptor.ErrCodeForbiddenContent,
+		},
+		"masks keywords in nested strings": {
+			payload:     `{"lines":["darn","ok"],"meta":{"title":"Heck"}}`,
+			mask:        true,
+			wantPayload: `{"lines":["****","ok"],"meta":{"title":"****"}}`,
+		},
+		"rejects messages with keywords in other scripts": {
+			payload:  `{"text":"to jest Żaba"}`,
+			wantCode: interceptor.ErrCodeForbiddenContent,
+		},
+		"ignores keywords inside words in other scripts": {
+			payload:     `{"text":"żabą, ężaba, żaba_1"}`,
+			wantPayload: `{"text":"żabą, ężaba, żaba_1"}`,
+		},
+		"masks adjacent keywords in other scripts": {
+			payload:     `{"text":"żaba żaba!darn"}`,
+			mask:        true,
+			wantPayload: `{"text":"**** ****!****"}`,
+		},
+		"ignores empty keywords": {
+			payload:     `{"text":"nothing to see"}`,
+			wantPayload: `{"text":"nothing to see"}`,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			// the empty keyword is left by a trailing comma in the list
+			filter := interceptor.KeywordFilter([]string{"darn", "heck", "żaba", " "}, tt.mask)
+
+			result, err := filter.Intercept(myRoom, newMessage(tt.payload))
+
+			if tt.wantCode != "" {
+				assertRejection(t, err, tt.wantCode)
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v, want none", err)
+			}
+			if len(result) != 1 {
+				t.Fatalf("got %d messages, want 1", len(result))
+			}
+			assertSameJSON(t, result[0].Payload, tt.wantPayload)
+		})
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema, err := interceptor.ParseSchema([]byte(`{
+		"type": "object",
+		"required": ["type"],
+		"properties": {
+			"type": {"enum": ["offer", "answer", "candidate", "chat"]},
+			"text": {"type": "string", "maxLength": 5}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("could not parse schema: %v", err)
+	}
+	validate := interceptor.ValidateSchema(schema)
+
+	if _, err := validate.Intercept(myRoom, newMessage(`{"type":"chat","text":"hi"}`)); err != nil {
+		t.Errorf("got error %v for a valid payload", err)
+	}
+	for _, payload := range []string{`"chat"`, `{"text":"hi"}`, `{"type":"bye"}`, `{"type":"chat","text":"too long"}`} {
+		_, err := validate.Intercept(myRoom, newMessage(payload))
+		assertRejection(t, err, interceptor.ErrCodeInvalidPayload)
+	}
+}
+
+func TestParseSchemaRejectsUnsupportedSchemas(t *testing.T) {
+	cases := map[string]string{
+		"unknown keyword":               `{"type": "string", "pattern": "^a"}`,
+		"unknown keyword of a property": `{"properties": {"kind": {"const": "chat"}}}`,
+		"unknown keyword of items":      `{"items": {"type": "string", "format": "email"}}`,
+		"unknown type":                  `{"type": "text"}`,
+		"unknown type of a property":    `{"properties": {"kind": {"type": "int"}}}`,
+		"combined schemas":              `{"oneOf": [{"type": "string"}, {"type": "number"}]}`,
+		"null property":                 `{"properties": {"kind": null}}`,
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := interceptor.ParseSchema([]byte(data)); err == nil {
+				t.Errorf("parsed schema %s, but want an error", data)
+			}
+		})
+	}
+
+	annotated := `{"$schema": "http://json-schema.org/draft-07/schema#", "title": "Message", "description": "A chat message", "type": "object"}`
+	if _, err := interceptor.ParseSchema([]byte(annotated)); err != nil {
+		t.Errorf("got error %v parsing schema with annotations", err)
+	}
+}
+
+func TestRequireSealed(t *testing.T) {
+	sealed := `{"type":"sealed","nonce":"bm9uY2U=","box":"Ym94"}`
+	cases := map[string]struct {
+		to       string
+		payload  string
+		wantCode string
+	}{
+		"passes sealed direct messages": {to: "peer-xyz", payload: sealed},
+		"rejects plain direct messages": {to: "peer-xyz", payload: `{"sdp":"v=0"}`, wantCode: interceptor.ErrCodeNotSealed},
+		"passes plain broadcasts":       {payload: `{"text":"hello"}`},
+		"passes commands to the server": {to: messaging.ServerUID, payload: `{"type":"kick","peer":"peer-xyz"}`},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := newMessage(tt.payload)
+			m.To = tt.to
+
+			result, err := interceptor.RequireSealed().Intercept(myRoom, m)
+
+			if tt.wantCode != "" {
+				assertRejection(t, err, tt.wantCode)
+				return
+			}
+			if err != nil || len(result) != 1 {
+				t.Errorf("got %v and error %v, want the message", result, err)
+			}
+		})
+	}
+}
+
+func newMessage(payload string) messaging.Message {
+	return messaging.Message{From: myPeer, Payload: json.RawMessage(payload)}
+}
+
+func assertRejection(t *testing.T, err error, code string) {
+	t.Helper()
+	var rejection *messaging.Rejection
+	if !errors.As(err, &rejection) {
+		t.Fatalf("got error %v, want rejection with code %q", err, code)
+	}
+	if rejection.Code != code {
+		t.Errorf("got rejection code %q, want %q", rejection.Code, code)
+	}
+}
+
+func assertSameJSON(t *testing.T, got json.RawMessage, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("could not decode %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("could not decode %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got payload %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+package interceptor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"unicode/utf8"
+)
+
+// Schema is a subset of JSON Schema sufficient to validate message payloads.
+// Supported keywords are type, properties, required, additionalProperties,
+// items, enum, minLength, maxLength, minimum and maximum. The annotations $schema,
+// title and description are allowed, but they don't affect validation.
+type Schema struct {
+	SchemaURI            string             `json:"$schema"`
+	Title                string             `json:"title"`
+	Description          string             `json:"description"`
+	Type                 string             `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+}
+
+// ParseSchema fails on keywords and types which aren't supported, so that payloads
+// aren't accepted by a schema which is less strict than it was meant to be.
+func ParseSchema(data []byte) (*Schema, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	var s Schema
+	if err := d.Decode(&s); err != nil {
+		return nil, err
+	}
+	if err := s.check("schema"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// check returns an error when the schema or its subschemas have unknown types
+func (s *Schema) check(path string) error {
+	if s.Type != "" && !knownTypes[s.Type] {
+		return fmt.Errorf("%s.type: unknown type %q", path, s.Type)
+	}
+	if s.Items != nil {
+		if err := s.Items.check(path + ".items"); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop := s.Properties[name]
+		if prop == nil {
+			return fmt.Errorf("%s.properties.%s: must be a schema", path, name)
+		}
+		if err := prop.check(path + ".properties." + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var knownTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// Validate checks a value decoded from JSON into an interface{} against the schema.
+func (s *Schema) Validate(v interface{}) error {
+	return s.validate("payload", v)
+}
+
+func (s *Schema) validate(path string, v interface{}) error {
+	if s.Type != "" && !hasType(v, s.Type) {
+		return fmt.Errorf("%s: must be of type %s", path, s.Type)
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: must be one of %v", path, s.Enum)
+		}
+	}
+
+	switch t := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(t)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: must be at least %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: must be at most %d characters", path, *s.MaxLength)
+		}
+	case float64:
+		if s.Minimum != nil && t < *s.Minimum {
+			return fmt.Errorf("%s: must be at least %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && t > *s.Maximum {
+			return fmt.Errorf("%s: must be at most %v", path, *s.Maximum)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, e := range t {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), e); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := t[name]; !ok {
+				return fmt.Errorf("%s.%s: is required", path, name)
+			}
+		}
+		for name, e := range t {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s.%s: is not allowed", path, name)
+				}
+				continue
+			}
+			if err := prop.validate(path+"."+name, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasType(v interface{}, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return false
+}
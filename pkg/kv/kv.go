@@ -0,0 +1,29 @@
+// Package kv provides a key-value store shared by instances of the server, with
+// sets and hashes whose single operations are atomic. Redis is the shared store,
+// MemoryStore stands in for it in a single process and in tests.
+package kv
+
+// Store is a key-value store of sets and hashes of strings. Reads of missing keys
+// behave like reads of empty sets and hashes.
+type Store interface {
+	// SAdd adds the member to the set and reports whether it wasn't there.
+	SAdd(key string, member string) (bool, error)
+	// SRem removes the member from the set and reports whether it was there.
+	SRem(key string, member string) (bool, error)
+	SIsMember(key string, member string) (bool, error)
+	SMembers(key string) ([]string, error)
+	// HSet sets the field of the hash and reports whether the field is new.
+	HSet(key string, field string, value string) (bool, error)
+	// HGet returns the value of the field and whether the field exists.
+	HGet(key string, field string) (string, bool, error)
+	// HCompareAndSet sets the field of the hash to value, but only if it's set to
+	// old, and reports whether it did.
+	HCompareAndSet(key string, field string, old string, value string) (bool, error)
+	// HDel removes the field of the hash and reports whether it was there.
+	HDel(key string, field string) (bool, error)
+	HGetAll(key string) (map[string]string, error)
+	HLen(key string) (int, error)
+	Del(keys ...string) error
+	// CheckHealth reports whether the store is reachable.
+	CheckHealth() error
+}
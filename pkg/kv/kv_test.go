@@ -0,0 +1,106 @@
+package kv_test
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/montrosesoftware/tarpon/pkg/kv"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, kv.NewMemoryStore())
+}
+
+// TestRedis runs against the server at TARPON_TEST_REDIS_ADDRESS, when it's set,
+// and flushes its database 15.
+func TestRedis(t *testing.T) {
+	address := os.Getenv("TARPON_TEST_REDIS_ADDRESS")
+	if address == "" {
+		t.Skip("TARPON_TEST_REDIS_ADDRESS is not set")
+	}
+	o := kv.DefaultRedisOptions()
+	o.Address = address
+	o.DB = 15
+	r := kv.NewRedis(o)
+	defer r.Close()
+	if _, err := r.Do("FLUSHDB"); err != nil {
+		t.Fatalf("could not flush database: %v", err)
+	}
+	testStore(t, r)
+}
+
+func testStore(t *testing.T, s kv.Store) {
+	t.Helper()
+	if err := s.CheckHealth(); err != nil {
+		t.Fatalf("store is not healthy: %v", err)
+	}
+
+	steps := []struct {
+		name string
+		op   func() (bool, error)
+		want bool
+	}{
+		{"adding member", func() (bool, error) { return s.SAdd("set", "a") }, true},
+		{"adding member again", func() (bool, error) { return s.SAdd("set", "a") }, false},
+		{"adding another member", func() (bool, error) { return s.SAdd("set", "b") }, true},
+		{"checking member", func() (bool, error) { return s.SIsMember("set", "a") }, true},
+		{"checking missing member", func() (bool, error) { return s.SIsMember("set", "c") }, false},
+		{"removing missing member", func() (bool, error) { return s.SRem("set", "c") }, false},
+		{"setting field", func() (bool, error) { return s.HSet("hash", "f", "1") }, true},
+		{"overwriting field", func() (bool, error) { return s.HSet("hash", "f", "2") }, false},
+		{"setting empty field", func() (bool, error) { return s.HSet("hash", "g", "") }, true},
+		{"comparing and setting field", func() (bool, error) { return s.HCompareAndSet("hash", "f", "2", "3") }, true},
+		{"comparing and setting changed field", func() (bool, error) { return s.HCompareAndSet("hash", "f", "2", "4") }, false},
+		{"comparing and setting missing field", func() (bool, error) { return s.HCompareAndSet("hash", "missing", "", "1") }, false},
+		{"setting field back", func() (bool, error) { return s.HCompareAndSet("hash", "f", "3", "2") }, true},
+	}
+	for _, step := range steps {
+		got, err := step.op()
+		if err != nil {
+			t.Fatalf("error %s: %v", step.name, err)
+		}
+		if got != step.want {
+			t.Errorf("got %v %s, want %v", got, step.name, step.want)
+		}
+	}
+
+	members, err := s.SMembers("set")
+	sort.Strings(members)
+	if err != nil || !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Errorf("got members %v and error %v, want a and b", members, err)
+	}
+	if removed, err := s.SRem("set", "a"); err != nil || !removed {
+		t.Errorf("got %v and error %v removing member", removed, err)
+	}
+	if v, ok, err := s.HGet("hash", "f"); err != nil || !ok || v != "2" {
+		t.Errorf("got value %q, %v and error %v, want 2", v, ok, err)
+	}
+	if v, ok, err := s.HGet("hash", "missing"); err != nil || ok || v != "" {
+		t.Errorf("got value %q, %v and error %v of missing field", v, ok, err)
+	}
+	if n, err := s.HLen("hash"); err != nil || n != 2 {
+		t.Errorf("got length %d and error %v, want 2", n, err)
+	}
+	hash, err := s.HGetAll("hash")
+	if err != nil || !reflect.DeepEqual(hash, map[string]string{"f": "2", "g": ""}) {
+		t.Errorf("got hash %v and error %v", hash, err)
+	}
+	if removed, err := s.HDel("hash", "g"); err != nil || !removed {
+		t.Errorf("got %v and error %v removing field", removed, err)
+	}
+	if removed, err := s.HDel("hash", "g"); err != nil || removed {
+		t.Errorf("got %v and error %v removing missing field", removed, err)
+	}
+
+	if err := s.Del("set", "hash", "missing"); err != nil {
+		t.Fatalf("could not delete keys: %v", err)
+	}
+	if members, err := s.SMembers("set"); err != nil || len(members) != 0 {
+		t.Errorf("got members %v and error %v of deleted set", members, err)
+	}
+	if hash, err := s.HGetAll("hash"); err != nil || len(hash) != 0 {
+		t.Errorf("got hash %v and error %v of deleted hash", hash, err)
+	}
+}
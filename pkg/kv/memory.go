@@ -0,0 +1,156 @@
+package kv
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps sets and hashes in memory, so it's shared only by users in
+// the same process.
+type MemoryStore struct {
+	sets   map[string]map[string]struct{}
+	hashes map[string]map[string]string
+	mutex  sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sets:   make(map[string]map[string]struct{}),
+		hashes: make(map[string]map[string]string),
+	}
+}
+
+func (s *MemoryStore) SAdd(key string, member string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	set, ok := s.sets[key]
+	if !ok {
+		set = make(map[string]struct{})
+		s.sets[key] = set
+	}
+	if _, ok := set[member]; ok {
+		return false, nil
+	}
+	set[member] = struct{}{}
+	return true, nil
+}
+
+func (s *MemoryStore) SRem(key string, member string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	set := s.sets[key]
+	if _, ok := set[member]; !ok {
+		return false, nil
+	}
+	delete(set, member)
+	if len(set) == 0 {
+		delete(s.sets, key)
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) SIsMember(key string, member string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.sets[key][member]
+	return ok, nil
+}
+
+// SMembers returns members of the set, sorted.
+func (s *MemoryStore) SMembers(key string) ([]string, error) {
+	s.mutex.RLock()
+	members := make([]string, 0, len(s.sets[key]))
+	for m := range s.sets[key] {
+		members = append(members, m)
+	}
+	s.mutex.RUnlock()
+
+	sort.Strings(members)
+	return members, nil
+}
+
+func (s *MemoryStore) HSet(key string, field string, value string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash, ok := s.hashes[key]
+	if !ok {
+		hash = make(map[string]string)
+		s.hashes[key] = hash
+	}
+	_, exists := hash[field]
+	hash[field] = value
+	return !exists, nil
+}
+
+func (s *MemoryStore) HGet(key string, field string) (string, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	v, ok := s.hashes[key][field]
+	return v, ok, nil
+}
+
+func (s *MemoryStore) HCompareAndSet(key string, field string, old string, value string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash := s.hashes[key]
+	if v, ok := hash[field]; !ok || v != old {
+		return false, nil
+	}
+	hash[field] = value
+	return true, nil
+}
+
+func (s *MemoryStore) HDel(key string, field string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash := s.hashes[key]
+	if _, ok := hash[field]; !ok {
+		return false, nil
+	}
+	delete(hash, field)
+	if len(hash) == 0 {
+		delete(s.hashes, key)
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) HGetAll(key string) (map[string]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	hash := make(map[string]string, len(s.hashes[key]))
+	for f, v := range s.hashes[key] {
+		hash[f] = v
+	}
+	return hash, nil
+}
+
+func (s *MemoryStore) HLen(key string) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.hashes[key]), nil
+}
+
+func (s *MemoryStore) Del(keys ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, k := range keys {
+		delete(s.sets, k)
+		delete(s.hashes, k)
+	}
+	return nil
+}
+
+// CheckHealth always succeeds, the store has no backend which could fail.
+func (s *MemoryStore) CheckHealth() error {
+	return nil
+}
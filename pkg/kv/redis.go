@@ -0,0 +1,378 @@
+package kv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisOptions are the address of a Redis server, credentials of its database
+// and the timeout of dialing and of every command. Username is sent with the
+// password to servers with access control lists. Connections are encrypted
+// when TLS is set. PoolSize limits the number of connections open at once,
+// commands wait for one up to the timeout.
+type RedisOptions struct {
+	Address  string
+	Username string
+	Password string
+	DB       int
+	TLS      *tls.Config
+	Timeout  time.Duration
+	PoolSize int
+}
+
+// DefaultRedisOptions returns options of the database 0 of a local server.
+func DefaultRedisOptions() RedisOptions {
+	return RedisOptions{
+		Address:  "localhost:6379",
+		Timeout:  5 * time.Second,
+		PoolSize: 10,
+	}
+}
+
+// RedisError is an error reply of the server.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+var (
+	errUnexpectedReply = errors.New("redis: unexpected reply")
+	errPoolTimeout     = errors.New("redis: timed out waiting for a connection")
+)
+
+// Redis is a Store in a Redis server. It implements the subset of the protocol
+// the store needs and keeps a pool of connections, which are opened on demand.
+// It talks to a single server with RESP2, one command at a time on every
+// connection: it doesn't follow Sentinel or Cluster redirections.
+type Redis struct {
+	options RedisOptions
+	pool    chan *redisConn
+	// slots holds a token for every connection in use
+	slots chan struct{}
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedis(o RedisOptions) *Redis {
+	if o.PoolSize < 1 {
+		o.PoolSize = 1
+	}
+	return &Redis{options: o, pool: make(chan *redisConn, o.PoolSize), slots: make(chan struct{}, o.PoolSize)}
+}
+
+// Do sends the command and returns its reply, which is a string, an int64, a
+// []interface{} of replies or nil. Error replies are returned as RedisError.
+func (r *Redis) Do(args ...string) (interface{}, error) {
+	if err := r.acquire(); err != nil {
+		return nil, err
+	}
+	defer r.release()
+	c, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(r.options.Timeout, args)
+	if _, ok := err.(RedisError); err != nil && !ok {
+		// the connection may be left in the middle of a reply
+		c.conn.Close()
+		return nil, err
+	}
+	r.put(c)
+	return reply, err
+}
+
+// Close closes idle connections.
+func (r *Redis) Close() {
+	for {
+		select {
+		case c := <-r.pool:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// acquire waits up to the timeout until fewer than PoolSize connections are in use
+func (r *Redis) acquire() error {
+	select {
+	case r.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if r.options.Timeout <= 0 {
+		r.slots <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(r.options.Timeout)
+	defer timer.Stop()
+	select {
+	case r.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errPoolTimeout
+	}
+}
+
+func (r *Redis) release() {
+	<-r.slots
+}
+
+func (r *Redis) get() (*redisConn, error) {
+	select {
+	case c := <-r.pool:
+		return c, nil
+	default:
+		return r.dial()
+	}
+}
+
+func (r *Redis) put(c *redisConn) {
+	select {
+	case r.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (r *Redis) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: r.options.Timeout}
+	var conn net.Conn
+	var err error
+	if r.options.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.options.Address, r.options.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", r.options.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if r.options.Password != "" {
+		auth := []string{"AUTH", r.options.Password}
+		if r.options.Username != "" {
+			auth = []string{"AUTH", r.options.Username, r.options.Password}
+		}
+		if _, err := c.do(r.options.Timeout, auth); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.options.DB != 0 {
+		if _, err := c.do(r.options.Timeout, []string{"SELECT", strconv.Itoa(r.options.DB)}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) do(timeout time.Duration, args []string) (interface{}, error) {
+	if timeout > 0 {
+		if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := c.conn.Write(encodeCommand(args)); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+// encodeCommand encodes the command as an array of bulk strings
+func encodeCommand(args []string) []byte {
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b = append(b, "$"+strconv.Itoa(len(a))+"\r\n"...)
+		b = append(b, a...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errUnexpectedReply
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, errUnexpectedReply
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, errUnexpectedReply
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, errUnexpectedReply
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, errUnexpectedReply
+}
+
+func (r *Redis) SAdd(key string, member string) (bool, error) {
+	return r.doBool("SADD", key, member)
+}
+
+func (r *Redis) SRem(key string, member string) (bool, error) {
+	return r.doBool("SREM", key, member)
+}
+
+func (r *Redis) SIsMember(key string, member string) (bool, error) {
+	return r.doBool("SISMEMBER", key, member)
+}
+
+func (r *Redis) SMembers(key string) ([]string, error) {
+	return r.doStrings("SMEMBERS", key)
+}
+
+func (r *Redis) HSet(key string, field string, value string) (bool, error) {
+	return r.doBool("HSET", key, field, value)
+}
+
+func (r *Redis) HGet(key string, field string) (string, bool, error) {
+	reply, err := r.Do("HGET", key, field)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	v, ok := reply.(string)
+	if !ok {
+		return "", false, errUnexpectedReply
+	}
+	return v, true, nil
+}
+
+// compareAndSetScript sets the field only if it has the expected value. HGET of
+// a missing field is false in Lua, so it never equals the expected string.
+const compareAndSetScript = `if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+  redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+  return 1
+end
+return 0`
+
+// HCompareAndSet runs a script, so that the field is compared and set atomically.
+func (r *Redis) HCompareAndSet(key string, field string, old string, value string) (bool, error) {
+	return r.doBool("EVAL", compareAndSetScript, "1", key, field, old, value)
+}
+
+func (r *Redis) HDel(key string, field string) (bool, error) {
+	return r.doBool("HDEL", key, field)
+}
+
+func (r *Redis) HGetAll(key string) (map[string]string, error) {
+	values, err := r.doStrings("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, errUnexpectedReply
+	}
+	hash := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		hash[values[i]] = values[i+1]
+	}
+	return hash, nil
+}
+
+func (r *Redis) HLen(key string) (int, error) {
+	n, err := r.doInt("HLEN", key)
+	return int(n), err
+}
+
+func (r *Redis) Del(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := r.doInt(append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// CheckHealth pings the server.
+func (r *Redis) CheckHealth() error {
+	reply, err := r.Do("PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("redis: unexpected reply to ping: %v", reply)
+	}
+	return nil
+}
+
+func (r *Redis) doInt(args ...string) (int64, error) {
+	reply, err := r.Do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errUnexpectedReply
+	}
+	return n, nil
+}
+
+func (r *Redis) doBool(args ...string) (bool, error) {
+	n, err := r.doInt(args...)
+	return n > 0, err
+}
+
+func (r *Redis) doStrings(args ...string) ([]string, error) {
+	reply, err := r.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	replies, ok := reply.([]interface{})
+	if !ok && reply != nil {
+		return nil, errUnexpectedReply
+	}
+	values := make([]string, len(replies))
+	for i, v := range replies {
+		if values[i], ok = v.(string); !ok {
+			return nil, errUnexpectedReply
+		}
+	}
+	return values, nil
+}
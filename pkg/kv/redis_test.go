@@ -0,0 +1,356 @@
+package kv_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/kv"
+)
+
+// FakeRedis speaks the Redis protocol and serves commands of the store from a
+// MemoryStore. It records commands other than those of the store and counts
+// connections open at once.
+type FakeRedis struct {
+	listener net.Listener
+	store    *kv.MemoryStore
+	username string
+	password string
+	commands []string
+	open     int
+	maxOpen  int
+	mutex    sync.Mutex
+}
+
+func newFakeRedis(t *testing.T, password string) *FakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	return serveFakeRedis(t, l, "default", password)
+}
+
+// serveFakeRedis serves the user with the password on the listener
+func serveFakeRedis(t *testing.T, l net.Listener, username string, password string) *FakeRedis {
+	f := &FakeRedis{listener: l, store: kv.NewMemoryStore(), username: username, password: password}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *FakeRedis) serve(conn net.Conn) {
+	f.mutex.Lock()
+	f.open++
+	if f.open > f.maxOpen {
+		f.maxOpen = f.open
+	}
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		f.open--
+		f.mutex.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	authorized := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		if name == "AUTH" || name == "SELECT" {
+			f.mutex.Lock()
+			f.commands = append(f.commands, strings.Join(args, " "))
+			f.mutex.Unlock()
+		}
+		var reply string
+		switch {
+		case name == "AUTH" && f.authenticates(args[1:]):
+			authorized = true
+			reply = "+OK\r\n"
+		case name == "AUTH":
+			reply = "-WRONGPASS invalid password\r\n"
+		case !authorized:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = f.execute(name, args[1:])
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// authenticates checks the password, of the default user unless the user is given
+func (f *FakeRedis) authenticates(args []string) bool {
+	username := "default"
+	if len(args) == 2 {
+		username = args[0]
+	}
+	return username == f.username && args[len(args)-1] == f.password
+}
+
+func (f *FakeRedis) execute(name string, args []string) string {
+	s := f.store
+	switch name {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "SADD":
+		return boolReply(s.SAdd(args[0], args[1]))
+	case "SREM":
+		return boolReply(s.SRem(args[0], args[1]))
+	case "SISMEMBER":
+		return boolReply(s.SIsMember(args[0], args[1]))
+	case "SMEMBERS":
+		members, _ := s.SMembers(args[0])
+		return arrayReply(members)
+	case "HSET":
+		return boolReply(s.HSet(args[0], args[1], args[2]))
+	case "HGET":
+		v, ok, _ := s.HGet(args[0], args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulkReply(v)
+	case "EVAL":
+		// the only script is the one of HCompareAndSet
+		return boolReply(s.HCompareAndSet(args[2], args[3], args[4], args[5]))
+	case "HDEL":
+		return boolReply(s.HDel(args[0], args[1]))
+	case "HGETALL":
+		hash, _ := s.HGetAll(args[0])
+		var values []string
+		for k, v := range hash {
+			values = append(values, k, v)
+		}
+		return arrayReply(values)
+	case "HLEN":
+		n, _ := s.HLen(args[0])
+		return fmt.Sprintf(":%d\r\n", n)
+	case "DEL":
+		_ = s.Del(args...)
+		return fmt.Sprintf(":%d\r\n", len(args))
+	}
+	return "-ERR unknown command '" + name + "'\r\n"
+}
+
+func (f *FakeRedis) maxOpenConnections() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.maxOpen
+}
+
+func (f *FakeRedis) recorded() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' || n < 1 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func boolReply(ok bool, _ error) string {
+	if ok {
+		return ":1\r\n"
+	}
+	return ":0\r\n"
+}
+
+func bulkReply(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func arrayReply(values []string) string {
+	reply := "*" + strconv.Itoa(len(values)) + "\r\n"
+	for _, v := range values {
+		reply += bulkReply(v)
+	}
+	return reply
+}
+
+func newRedis(f *FakeRedis, password string) *kv.Redis {
+	o := kv.DefaultRedisOptions()
+	o.Address = f.listener.Addr().String()
+	o.Password = password
+	o.DB = 2
+	return kv.NewRedis(o)
+}
+
+func TestRedisProtocol(t *testing.T) {
+	f := newFakeRedis(t, "pass")
+	r := newRedis(f, "pass")
+	defer r.Close()
+
+	testStore(t, r)
+
+	// values are binary safe
+	value := "line\r\nwith \x00 and ünicode"
+	if _, err := r.HSet("hash", "f", value); err != nil {
+		t.Fatalf("could not set field: %v", err)
+	}
+	if got, _, err := r.HGet("hash", "f"); err != nil || got != value {
+		t.Errorf("got value %q and error %v, want %q", got, err, value)
+	}
+
+	_, err := r.Do("UNKNOWN")
+	if e, ok := err.(kv.RedisError); !ok || !strings.HasPrefix(string(e), "ERR unknown command") {
+		t.Errorf("got error %v, want the error reply", err)
+	}
+	// the connection is reused after error replies
+	if err := r.CheckHealth(); err != nil {
+		t.Errorf("ping after error reply failed: %v", err)
+	}
+	if got := f.recorded(); len(got) != 2 || got[0] != "AUTH pass" || got[1] != "SELECT 2" {
+		t.Errorf("got commands %v, want a single connection authenticated and selecting the database", got)
+	}
+}
+
+func TestRedisErrors(t *testing.T) {
+	f := newFakeRedis(t, "pass")
+
+	r := newRedis(f, "wrong")
+	defer r.Close()
+	if err := r.CheckHealth(); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("got error %v, want WRONGPASS", err)
+	}
+
+	f.listener.Close()
+	r = newRedis(f, "pass")
+	defer r.Close()
+	if _, err := r.SAdd("set", "a"); err == nil {
+		t.Errorf("command succeeded without a server")
+	}
+}
+
+func TestRedisWithTLSAndUser(t *testing.T) {
+	cert := newCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	f := serveFakeRedis(t, l, "tarpon", "pass")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	o := kv.DefaultRedisOptions()
+	o.Address = l.Addr().String()
+	o.Username = "tarpon"
+	o.Password = "pass"
+	o.TLS = &tls.Config{RootCAs: roots}
+	r := kv.NewRedis(o)
+	defer r.Close()
+
+	if err := r.CheckHealth(); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	if got := f.recorded(); len(got) != 1 || got[0] != "AUTH tarpon pass" {
+		t.Errorf("got commands %v, want the user authenticated", got)
+	}
+}
+
+func TestRedisLimitsOpenConnections(t *testing.T) {
+	f := newFakeRedis(t, "")
+	o := kv.DefaultRedisOptions()
+	o.Address = f.listener.Addr().String()
+	o.PoolSize = 2
+	r := kv.NewRedis(o)
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := r.SAdd("set", strconv.Itoa(i)); err != nil {
+				t.Errorf("could not add member: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := f.maxOpenConnections(); got > 2 {
+		t.Errorf("got %d connections open at once, want at most 2", got)
+	}
+	if members, _ := r.SMembers("set"); len(members) != 20 {
+		t.Errorf("got %d members, want 20", len(members))
+	}
+}
+
+// newCertificate creates a self-signed certificate of 127.0.0.1
+func newCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
@@ -1,6 +1,8 @@
 package logging
 
 import (
+	"errors"
+
 	"github.com/montrosesoftware/tarpon/pkg/config"
 	"github.com/sirupsen/logrus"
 	logrusadapter "logur.dev/adapter/logrus"
@@ -9,6 +11,8 @@ import (
 
 type LogurLogger struct {
 	logur.Logger
+	// logrus is the logger whose level can be changed, if any
+	logrus *logrus.Logger
 }
 
 func NewLogurLogger(logger logur.Logger) *LogurLogger {
@@ -26,11 +30,27 @@ func NewLogrusLogger(config *config.Logging) *LogurLogger {
 		logger.SetLevel(level)
 	}
 
-	return NewLogurLogger(logrusadapter.New(logger))
+	l := NewLogurLogger(logrusadapter.New(logger))
+	l.logrus = logger
+	return l
+}
+
+// SetLevel changes the log level of the logger and all loggers derived from it
+// with WithFields. It fails when the logger doesn't wrap a logrus logger.
+func (l *LogurLogger) SetLevel(level string) error {
+	if l.logrus == nil {
+		return errors.New("log level can't be changed")
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	l.logrus.SetLevel(parsed)
+	return nil
 }
 
 func (l *LogurLogger) WithFields(fields map[string]interface{}) Logger {
-	return &LogurLogger{Logger: logur.WithFields(l.Logger, fields)}
+	return &LogurLogger{Logger: logur.WithFields(l.Logger, fields), logrus: l.logrus}
 }
 
 func (l *LogurLogger) IsDebug() bool {
@@ -2,32 +2,149 @@ package messaging
 
 import (
 	"encoding/json"
+	"strings"
+
+	"github.com/montrosesoftware/tarpon/pkg/audit"
 )
 
 const (
 	ServerUID        = "tarpon"
 	ctrlDisconnected = "peer_disconnected"
 	ctrlConnected    = "peer_connected"
+	ctrlError        = "error"
+	ctrlKicked       = "peer_kicked"
+	ctrlMuted        = "peer_muted"
+	ctrlUnmuted      = "peer_unmuted"
+	ctrlBanned       = "peer_banned"
+	ctrlKeyDirectory = "key_directory"
+)
+
+// Error codes sent to a peer when its message is rejected by the server.
+const (
+	ErrCodeDecode           = "decode_error"
+	ErrCodeEmptyPayload     = "empty_payload"
+	ErrCodeUnknownRecipient = "unknown_recipient"
+	ErrCodeOfflineRecipient = "recipient_offline"
+	ErrCodeTooLarge         = "too_large"
+	ErrCodeRateLimited      = "rate_limited"
 )
 
+// Message is delivered to peers by brokers. Trace is the context of the span which
+// sent the message, in the W3C traceparent format, when tracing is enabled, and
+// TraceState is the state of its trace in the tracestate format. Source
+// is the request of the session the peer sent the message through, which brokers
+// audit commands with. It isn't delivered to peers.
 type Message struct {
-	From    string          `json:"from"`
-	To      string          `json:"to"`
-	Payload json.RawMessage `json:"payload"`
+	ID         string          `json:"id,omitempty"`
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Payload    json.RawMessage `json:"payload"`
+	Trace      string          `json:"trace,omitempty"`
+	TraceState string          `json:"tracestate,omitempty"`
+	Source     audit.Source    `json:"-"`
 }
 
 func (m *Message) IsBroadcast() bool {
 	return m.To == ""
 }
 
+// ServerIdentity returns the UID messages sent by the server on behalf of the
+// named service come from, e.g. "tarpon:recorder". It's ServerUID when name is empty.
+func ServerIdentity(name string) string {
+	if name == "" {
+		return ServerUID
+	}
+	return ServerUID + ":" + name
+}
+
+// IsServerUID reports whether the uid identifies the server or a service sending
+// messages through it. Such UIDs can't be used by peers.
+func IsServerUID(uid string) bool {
+	return uid == ServerUID || strings.HasPrefix(uid, ServerUID+":")
+}
+
+// Rejection describes why a message sent by a peer was not delivered. ID is the
+// id of the rejected message, if it is known.
+type Rejection struct {
+	ID     string
+	Code   string
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return r.Code + ": " + r.Reason
+}
+
 type controlPayload struct {
-	Type string `json:"type"`
-	Peer string `json:"peer"`
+	Type      string `json:"type"`
+	Peer      string `json:"peer"`
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+type keyDirectoryPayload struct {
+	Type string            `json:"type"`
+	Keys map[string]string `json:"keys"`
+}
+
+type errorPayload struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 func NewPeerDisconnected(peerUID string) (*Message, error) {
+	return newControlMessage(ctrlDisconnected, peerUID)
+}
+
+func NewPeerConnected(peerUID string) (*Message, error) {
+	return newControlMessage(ctrlConnected, peerUID)
+}
+
+// NewPeerConnectedWithKey announces the peer together with its public key, so
+// that peers can seal messages to it. The key is omitted when it's empty.
+func NewPeerConnectedWithKey(peerUID string, publicKey string) (*Message, error) {
+	m, err := newControlMessage(ctrlConnected, peerUID)
+	if err != nil || publicKey == "" {
+		return m, err
+	}
+	m.Payload, err = json.Marshal(controlPayload{Type: ctrlConnected, Peer: peerUID, PublicKey: publicKey})
+	return m, err
+}
+
+// NewKeyDirectory creates a message sent to the peer which joined the room with
+// public keys of peers registered in it, by UID.
+func NewKeyDirectory(peerUID string, keys map[string]string) (*Message, error) {
+	jsonPayload, err := json.Marshal(keyDirectoryPayload{Type: ctrlKeyDirectory, Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		From:    ServerUID,
+		To:      peerUID,
+		Payload: jsonPayload,
+	}, nil
+}
+
+func NewPeerKicked(peerUID string) (*Message, error) {
+	return newControlMessage(ctrlKicked, peerUID)
+}
+
+func NewPeerMuted(peerUID string) (*Message, error) {
+	return newControlMessage(ctrlMuted, peerUID)
+}
+
+func NewPeerUnmuted(peerUID string) (*Message, error) {
+	return newControlMessage(ctrlUnmuted, peerUID)
+}
+
+func NewPeerBanned(peerUID string) (*Message, error) {
+	return newControlMessage(ctrlBanned, peerUID)
+}
+
+func newControlMessage(t string, peerUID string) (*Message, error) {
 	payload := controlPayload{
-		Type: ctrlDisconnected,
+		Type: t,
 		Peer: peerUID,
 	}
 
@@ -43,10 +160,13 @@ func NewPeerDisconnected(peerUID string) (*Message, error) {
 	}, nil
 }
 
-func NewPeerConnected(peerUID string) (*Message, error) {
-	payload := controlPayload{
-		Type: ctrlConnected,
-		Peer: peerUID,
+// NewError creates an error frame addressed to the peer whose message was
+// rejected. id is the id of the rejected message, if it is known.
+func NewError(peerUID string, id string, code string, text string) (*Message, error) {
+	payload := errorPayload{
+		Type:    ctrlError,
+		Code:    code,
+		Message: text,
 	}
 
 	jsonPayload, err := json.Marshal(payload)
@@ -55,8 +175,9 @@ func NewPeerConnected(peerUID string) (*Message, error) {
 	}
 
 	return &Message{
+		ID:      id,
 		From:    ServerUID,
-		To:      "",
+		To:      peerUID,
 		Payload: jsonPayload,
 	}, nil
 }
@@ -1,6 +1,26 @@
 package messaging
 
+import "time"
+
+// RoleHost is the role of peers allowed to moderate the room.
+const RoleHost = "host"
+
+// Peer is registered in a room and joins it with its secret. The secret doesn't
+// expire when ExpiresAt is zero. PublicKey is the peer's key for end-to-end
+// encryption, distributed to other peers in the room, if it has one.
 type Peer struct {
-	UID    string
-	Secret string
+	UID       string
+	Secret    string
+	Role      string
+	ExpiresAt time.Time
+	PublicKey string
+}
+
+func (p Peer) IsHost() bool {
+	return p.Role == RoleHost
+}
+
+// Expired reports whether the peer's secret is expired at the time t.
+func (p Peer) Expired(t time.Time) bool {
+	return !p.ExpiresAt.IsZero() && !t.Before(p.ExpiresAt)
 }
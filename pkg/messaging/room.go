@@ -1,25 +1,101 @@
 package messaging
 
 import (
+	"crypto/sha256"
 	"sync"
+	"time"
 )
 
+// RoomInfo summarizes a room for listings. Peers counts registered peers, Online
+// those connected, when the server tracks presence.
+type RoomInfo struct {
+	UID    string `json:"uid"`
+	Peers  int    `json:"peers"`
+	Online int    `json:"online,omitempty"`
+}
+
+// ConnectionOverrides override timeouts and limits of peers' connections in a
+// room. Timeouts are in seconds, fields left zero keep their defaults.
+type ConnectionOverrides struct {
+	WriteWait       int `json:"write_wait,omitempty"`
+	PongWait        int `json:"pong_wait,omitempty"`
+	PingPeriod      int `json:"ping_period,omitempty"`
+	MaxMessageSize  int `json:"max_message_size,omitempty"`
+	MessagesBufSize int `json:"messages_buf_size,omitempty"`
+	MessageRate     int `json:"message_rate,omitempty"`
+	MessageBurst    int `json:"message_burst,omitempty"`
+	MaxRateStrikes  int `json:"max_rate_strikes,omitempty"`
+}
+
+// Room holds peers registered to it, indexed both by UID and by secret, so that
+// lookups and joins don't depend on the number of peers.
 type Room struct {
-	peers []Peer
-	mutex sync.RWMutex
+	peers      map[string]Peer
+	bySecret   map[[sha256.Size]byte]string
+	connection ConnectionOverrides
+	mutex      sync.RWMutex
 }
 
-func (r *Room) RegisterPeer(peer Peer) bool {
+// RegisterPeer registers the peer, or replaces the registered one, and reports
+// whether it wasn't registered before. It fails with ErrSecretInUse when another
+// peer of the room has the same secret.
+func (r *Room) RegisterPeer(peer Peer) (bool, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	for i, p := range r.peers {
-		if p.UID == peer.UID {
-			r.peers[i] = peer
-			return false
-		}
+	if r.peers == nil {
+		r.peers = make(map[string]Peer)
+		r.bySecret = make(map[[sha256.Size]byte]string)
+	}
+	if r.secretInUse(peer.Secret, peer.UID) {
+		return false, ErrSecretInUse
+	}
+
+	old, exists := r.peers[peer.UID]
+	if exists {
+		r.unindex(old)
+	}
+	r.peers[peer.UID] = peer
+	r.bySecret[secretKey(peer.Secret)] = peer.UID
+	return !exists, nil
+}
+
+// RotateSecret replaces the secret of the registered peer, so that the old one
+// can't be used to join the room anymore. It reports whether the peer is registered
+// and fails with ErrSecretInUse when another peer of the room has the secret.
+func (r *Room) RotateSecret(uid string, secret string, expiresAt time.Time) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	p, ok := r.peers[uid]
+	if !ok {
+		return false, nil
+	}
+	if r.secretInUse(secret, uid) {
+		return true, ErrSecretInUse
 	}
-	r.peers = append(r.peers, peer)
+	r.unindex(p)
+	p.Secret = secret
+	p.ExpiresAt = expiresAt
+	r.peers[uid] = p
+	r.bySecret[secretKey(secret)] = uid
+	return true, nil
+}
+
+// RevokeSecret keeps the peer registered, but it can't join the room until its
+// secret is rotated.
+func (r *Room) RevokeSecret(uid string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	p, ok := r.peers[uid]
+	if !ok {
+		return false
+	}
+	r.unindex(p)
+	p.Secret = ""
+	p.ExpiresAt = time.Time{}
+	r.peers[uid] = p
 	return true
 }
 
@@ -27,12 +103,50 @@ func (r *Room) GetPeer(uid string) (Peer, bool) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for _, p := range r.peers {
-		if p.UID == uid {
-			return p, true
+	p, ok := r.peers[uid]
+	return p, ok
+}
+
+// RemovePeer unregisters the peer, so that it can't join the room anymore.
+func (r *Room) RemovePeer(uid string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	p, ok := r.peers[uid]
+	if !ok {
+		return false
+	}
+	r.unindex(p)
+	delete(r.peers, uid)
+	return true
+}
+
+// PublicKeys returns public keys of peers which registered them, by UID.
+func (r *Room) PublicKeys() map[string]string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	keys := make(map[string]string)
+	for uid, p := range r.peers {
+		if p.PublicKey != "" {
+			keys[uid] = p.PublicKey
 		}
 	}
-	return Peer{}, false
+	return keys
+}
+
+func (r *Room) SetConnectionOverrides(o ConnectionOverrides) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.connection = o
+}
+
+func (r *Room) ConnectionOverrides() ConnectionOverrides {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.connection
 }
 
 func (r *Room) PeersCount() int {
@@ -42,14 +156,39 @@ func (r *Room) PeersCount() int {
 	return len(r.peers)
 }
 
+// Join returns the peer with the secret, unless the secret is revoked or expired.
 func (r *Room) Join(secret string) (Peer, error) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for _, p := range r.peers {
-		if p.Secret == secret {
+	if uid, ok := r.bySecret[secretKey(secret)]; ok {
+		if p, ok := r.peers[uid]; ok && p.Secret != "" && p.Secret == secret && !p.Expired(time.Now()) {
 			return p, nil
 		}
 	}
 	return Peer{}, ErrUnauthorized
 }
+
+// secretInUse reports whether a peer other than uid has the secret and assumes
+// the lock is held
+func (r *Room) secretInUse(secret string, uid string) bool {
+	if secret == "" {
+		return false
+	}
+	owner, ok := r.bySecret[secretKey(secret)]
+	return ok && owner != uid
+}
+
+// unindex removes the peer's secret from the index and assumes the lock is held
+func (r *Room) unindex(p Peer) {
+	key := secretKey(p.Secret)
+	if r.bySecret[key] == p.UID {
+		delete(r.bySecret, key)
+	}
+}
+
+// secretKey hashes the secret, so that the index doesn't keep secrets as map keys
+// and lookups don't leak secret prefixes through timing.
+func secretKey(secret string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(secret))
+}
@@ -2,12 +2,17 @@ package messaging
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 )
 
 var (
 	ErrRoomNotFound = errors.New("room not found")
 	ErrUnauthorized = errors.New("not authorized")
+	// ErrSecretInUse is returned when a peer would get the secret of another
+	// peer of the room, so that joining with it wouldn't tell them apart.
+	ErrSecretInUse = errors.New("secret used by another peer")
 )
 
 type MemoryRoomStore struct {
@@ -21,6 +26,11 @@ func NewRoomStore() *MemoryRoomStore {
 	return &s
 }
 
+// CheckHealth always succeeds, the store has no backend which could fail.
+func (s *MemoryRoomStore) CheckHealth() error {
+	return nil
+}
+
 func (s *MemoryRoomStore) CreateRoom(uid string) bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -28,6 +38,14 @@ func (s *MemoryRoomStore) CreateRoom(uid string) bool {
 	return s.ensureRoom(uid)
 }
 
+func (s *MemoryRoomStore) RoomExists(uid string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.rooms[uid]
+	return ok
+}
+
 func (s *MemoryRoomStore) GetRoom(uid string) *Room {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
@@ -35,6 +53,31 @@ func (s *MemoryRoomStore) GetRoom(uid string) *Room {
 	return s.rooms[uid]
 }
 
+// ListRooms returns summaries of all rooms, ordered by UID.
+func (s *MemoryRoomStore) ListRooms() []RoomInfo {
+	s.mutex.RLock()
+	rooms := make([]RoomInfo, 0, len(s.rooms))
+	for uid, r := range s.rooms {
+		rooms = append(rooms, RoomInfo{UID: uid, Peers: r.PeersCount()})
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].UID < rooms[j].UID })
+	return rooms
+}
+
+// DeleteRoom removes the room with all its peers, so that they can't join it anymore.
+func (s *MemoryRoomStore) DeleteRoom(uid string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.rooms[uid]; !ok {
+		return false
+	}
+	delete(s.rooms, uid)
+	return true
+}
+
 func (s *MemoryRoomStore) RoomsCount() int {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
@@ -42,7 +85,7 @@ func (s *MemoryRoomStore) RoomsCount() int {
 	return len(s.rooms)
 }
 
-func (s *MemoryRoomStore) RegisterPeer(room string, p Peer) bool {
+func (s *MemoryRoomStore) RegisterPeer(room string, p Peer) (bool, error) {
 	s.mutex.Lock()
 	s.ensureRoom(room)
 	r := s.rooms[room]
@@ -50,6 +93,82 @@ func (s *MemoryRoomStore) RegisterPeer(room string, p Peer) bool {
 	return r.RegisterPeer(p)
 }
 
+func (s *MemoryRoomStore) GetPeer(room string, uid string) (Peer, bool) {
+	s.mutex.RLock()
+	r := s.rooms[room]
+	s.mutex.RUnlock()
+	if r == nil {
+		return Peer{}, false
+	}
+	return r.GetPeer(uid)
+}
+
+func (s *MemoryRoomStore) RemovePeer(room string, uid string) bool {
+	s.mutex.RLock()
+	r := s.rooms[room]
+	s.mutex.RUnlock()
+	if r == nil {
+		return false
+	}
+	return r.RemovePeer(uid)
+}
+
+// PublicKeys returns public keys of peers registered in the room, by UID.
+func (s *MemoryRoomStore) PublicKeys(room string) map[string]string {
+	s.mutex.RLock()
+	r := s.rooms[room]
+	s.mutex.RUnlock()
+	if r == nil {
+		return map[string]string{}
+	}
+	return r.PublicKeys()
+}
+
+func (s *MemoryRoomStore) RotateSecret(room string, uid string, secret string, expiresAt time.Time) (bool, error) {
+	s.mutex.RLock()
+	r := s.rooms[room]
+	s.mutex.RUnlock()
+	if r == nil {
+		return false, nil
+	}
+	return r.RotateSecret(uid, secret, expiresAt)
+}
+
+func (s *MemoryRoomStore) RevokeSecret(room string, uid string) bool {
+	s.mutex.RLock()
+	r := s.rooms[room]
+	s.mutex.RUnlock()
+	if r == nil {
+		return false
+	}
+	return r.RevokeSecret(uid)
+}
+
+// SetConnectionOverrides keeps the overrides with the room and reports whether
+// the room exists.
+func (s *MemoryRoomStore) SetConnectionOverrides(room string, o ConnectionOverrides) bool {
+	s.mutex.RLock()
+	r := s.rooms[room]
+	s.mutex.RUnlock()
+	if r == nil {
+		return false
+	}
+	r.SetConnectionOverrides(o)
+	return true
+}
+
+// ConnectionOverrides returns the overrides kept with the room, which are zero
+// when there are none.
+func (s *MemoryRoomStore) ConnectionOverrides(room string) ConnectionOverrides {
+	s.mutex.RLock()
+	r := s.rooms[room]
+	s.mutex.RUnlock()
+	if r == nil {
+		return ConnectionOverrides{}
+	}
+	return r.ConnectionOverrides()
+}
+
 func (s *MemoryRoomStore) JoinRoom(room string, secret string) (Peer, error) {
 	s.mutex.RLock()
 	r := s.rooms[room]
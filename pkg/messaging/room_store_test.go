@@ -41,8 +41,8 @@ func TestRegisterPeerInRoom(t *testing.T) {
 	room := createEmptyRoom(t, store)
 	p := messaging.Peer{}
 
-	if !store.RegisterPeer(myRoom, p) {
-		t.Errorf("did not return true when registering peer %+v", p)
+	if created, err := store.RegisterPeer(myRoom, p); err != nil || !created {
+		t.Errorf("got %v and err %v when registering peer %+v, but want true", created, err, p)
 	}
 
 	assertPeer(t, room, p)
@@ -54,8 +54,8 @@ func TestCreateRoomWhenRegisteringPeer(t *testing.T) {
 
 	assertNoRoom(t, store, myRoom)
 
-	if !store.RegisterPeer(myRoom, p) {
-		t.Errorf("did not return true when registering peer %+v", p)
+	if created, err := store.RegisterPeer(myRoom, p); err != nil || !created {
+		t.Errorf("got %v and err %v when registering peer %+v, but want true", created, err, p)
 	}
 
 	r := store.GetRoom(myRoom)
@@ -121,6 +121,48 @@ func TestJoinRoom(t *testing.T) {
 	}
 }
 
+func TestGetPeer(t *testing.T) {
+	store := messaging.NewRoomStore()
+	store.RegisterPeer(myRoom, myPeer)
+
+	if p, ok := store.GetPeer(myRoom, myPeer.UID); !ok || p != myPeer {
+		t.Errorf("got peer %+v, want %+v", p, myPeer)
+	}
+	if _, ok := store.GetPeer(myRoom, "invalid"); ok {
+		t.Errorf("found peer which is not registered")
+	}
+	if _, ok := store.GetPeer("invalid", myPeer.UID); ok {
+		t.Errorf("found peer in a room which does not exist")
+	}
+}
+
+func TestListAndDeleteRooms(t *testing.T) {
+	store := messaging.NewRoomStore()
+	store.CreateRoom("room-b")
+	store.RegisterPeer(myRoom, myPeer)
+
+	want := []messaging.RoomInfo{{UID: myRoom, Peers: 1}, {UID: "room-b"}}
+	if got := store.ListRooms(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rooms %v, want %v", got, want)
+	}
+
+	if !store.DeleteRoom(myRoom) {
+		t.Errorf("existing room not deleted")
+	}
+	if store.DeleteRoom(myRoom) {
+		t.Errorf("deleted room which does not exist")
+	}
+	if store.GetRoom(myRoom) != nil || store.RoomExists(myRoom) {
+		t.Errorf("deleted room is still in the store")
+	}
+	if !store.RoomExists("room-b") {
+		t.Errorf("room not deleted is missing")
+	}
+	if _, err := store.JoinRoom(myRoom, myPeer.Secret); err != messaging.ErrRoomNotFound {
+		t.Errorf("got err %v joining deleted room, want %v", err, messaging.ErrRoomNotFound)
+	}
+}
+
 func assertNoRoom(t *testing.T, s *messaging.MemoryRoomStore, uid string) {
 	t.Helper()
 	r := s.GetRoom(uid)
@@ -160,7 +202,7 @@ func createEmptyRoom(t *testing.T, s *messaging.MemoryRoomStore) *messaging.Room
 func createRoomWithPeer(t *testing.T, s *messaging.MemoryRoomStore) *messaging.Room {
 	t.Helper()
 	r := createEmptyRoom(t, s)
-	if !r.RegisterPeer(messaging.Peer{}) {
+	if created, err := r.RegisterPeer(messaging.Peer{}); err != nil || !created {
 		t.Fatalf("could not register peer in room")
 	}
 	return r
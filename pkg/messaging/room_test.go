@@ -1,7 +1,9 @@
 package messaging_test
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/montrosesoftware/tarpon/pkg/messaging"
 )
@@ -12,8 +14,8 @@ func TestRegisterNewPeer(t *testing.T) {
 
 	assertNoPeer(t, room, peer)
 
-	if !room.RegisterPeer(peer) {
-		t.Errorf("did not return true when registering peer %+v", peer)
+	if created, err := room.RegisterPeer(peer); err != nil || !created {
+		t.Errorf("got %v and err %v when registering peer %+v, but want true", created, err, peer)
 	}
 
 	assertPeer(t, room, peer)
@@ -27,13 +29,85 @@ func TestUpdateAlreadyRegisteredPeer(t *testing.T) {
 	assertPeer(t, room, peer)
 
 	peer.Secret = "newsecret"
-	if room.RegisterPeer(peer) {
-		t.Errorf("did not return false when updating peer %+v", peer)
+	if created, err := room.RegisterPeer(peer); err != nil || created {
+		t.Errorf("got %v and err %v when updating peer %+v, but want false", created, err, peer)
 	}
 
 	assertPeer(t, room, peer)
 }
 
+func TestRemovePeer(t *testing.T) {
+	room := &messaging.Room{}
+	peer := messaging.Peer{UID: "peer-123", Secret: "secret"}
+	room.RegisterPeer(peer)
+
+	if !room.RemovePeer(peer.UID) {
+		t.Errorf("did not return true when removing peer %+v", peer)
+	}
+	if room.RemovePeer(peer.UID) {
+		t.Errorf("did not return false when removing peer %+v again", peer)
+	}
+
+	assertNoPeer(t, room, peer)
+	if _, err := room.Join(peer.Secret); err != messaging.ErrUnauthorized {
+		t.Errorf("got error %v when joining as removed peer, but want %v", err, messaging.ErrUnauthorized)
+	}
+}
+
+func TestRotateAndRevokeSecret(t *testing.T) {
+	room := &messaging.Room{}
+	peer := messaging.Peer{UID: "peer-123", Secret: "secret"}
+	room.RegisterPeer(peer)
+
+	if ok, err := room.RotateSecret(peer.UID, "newsecret", time.Time{}); err != nil || !ok {
+		t.Fatalf("did not return true when rotating secret of peer %+v", peer)
+	}
+	if ok, _ := room.RotateSecret("unknown", "another", time.Time{}); ok {
+		t.Errorf("did not return false when rotating secret of unknown peer")
+	}
+	assertJoin(t, room, "secret", false)
+	assertJoin(t, room, "newsecret", true)
+
+	if !room.RevokeSecret(peer.UID) {
+		t.Fatalf("did not return true when revoking secret of peer %+v", peer)
+	}
+	assertJoin(t, room, "newsecret", false)
+	assertJoin(t, room, "", false)
+	if _, ok := room.GetPeer(peer.UID); !ok {
+		t.Errorf("peer with revoked secret should stay registered")
+	}
+}
+
+func TestRejectSecretOfAnotherPeer(t *testing.T) {
+	room := &messaging.Room{}
+	peer := messaging.Peer{UID: "peer-123", Secret: "secret"}
+	room.RegisterPeer(peer)
+	room.RegisterPeer(messaging.Peer{UID: "peer-456", Secret: "another"})
+
+	if _, err := room.RegisterPeer(messaging.Peer{UID: "peer-789", Secret: "secret"}); err != messaging.ErrSecretInUse {
+		t.Errorf("got err %v registering peer with secret of another, want %v", err, messaging.ErrSecretInUse)
+	}
+	if _, err := room.RotateSecret("peer-456", "secret", time.Time{}); err != messaging.ErrSecretInUse {
+		t.Errorf("got err %v rotating to secret of another peer, want %v", err, messaging.ErrSecretInUse)
+	}
+	if _, ok := room.GetPeer("peer-789"); ok {
+		t.Errorf("registered peer with secret of another")
+	}
+	if p, err := room.Join("secret"); err != nil || p != peer {
+		t.Errorf("got peer %+v and err %v, want %+v", p, err, peer)
+	}
+	assertJoin(t, room, "another", true)
+}
+
+func TestJoinWithExpiredSecret(t *testing.T) {
+	room := &messaging.Room{}
+	room.RegisterPeer(messaging.Peer{UID: "expired", Secret: "expired", ExpiresAt: time.Now().Add(-time.Second)})
+	room.RegisterPeer(messaging.Peer{UID: "valid", Secret: "valid", ExpiresAt: time.Now().Add(time.Hour)})
+
+	assertJoin(t, room, "expired", false)
+	assertJoin(t, room, "valid", true)
+}
+
 func TestRegisterConcurrently(t *testing.T) {
 	room := &messaging.Room{}
 	for i := 0; i < 2; i++ {
@@ -48,6 +122,78 @@ func TestRegisterConcurrently(t *testing.T) {
 	}
 }
 
+func TestJoinWithRotatedSecret(t *testing.T) {
+	room := &messaging.Room{}
+	peer := messaging.Peer{UID: "peer-123", Secret: "secret"}
+	room.RegisterPeer(peer)
+	room.RegisterPeer(messaging.Peer{UID: "peer-456", Secret: "another"})
+
+	peer.Secret = "newsecret"
+	room.RegisterPeer(peer)
+
+	if _, err := room.Join("secret"); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v when joining with old secret, want %v", err, messaging.ErrUnauthorized)
+	}
+	if p, err := room.Join("newsecret"); err != nil || p != peer {
+		t.Errorf("got peer %+v and err %v when joining with new secret, want %+v", p, err, peer)
+	}
+	if p, err := room.Join("another"); err != nil || p.UID != "peer-456" {
+		t.Errorf("got peer %+v and err %v when joining as another peer", p, err)
+	}
+}
+
+func BenchmarkJoinLargeRoom(b *testing.B) {
+	room := newLargeRoom(10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := room.Join(benchSecret(i % 10000)); err != nil {
+				b.Errorf("could not join room: %v", err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkGetPeerLargeRoom(b *testing.B) {
+	room := newLargeRoom(10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, ok := room.GetPeer(benchUID(i % 10000)); !ok {
+				b.Errorf("could not find peer")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkRegisterPeerLargeRoom(b *testing.B) {
+	room := newLargeRoom(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		room.RegisterPeer(messaging.Peer{UID: benchUID(i % 20000), Secret: benchSecret(i)})
+	}
+}
+
+func newLargeRoom(peers int) *messaging.Room {
+	room := &messaging.Room{}
+	for i := 0; i < peers; i++ {
+		room.RegisterPeer(messaging.Peer{UID: benchUID(i), Secret: benchSecret(i)})
+	}
+	return room
+}
+
+func benchUID(i int) string {
+	return "peer-" + strconv.Itoa(i)
+}
+
+func benchSecret(i int) string {
+	return "0123456789-0123456789-" + strconv.Itoa(i)
+}
+
 func assertNoPeer(t *testing.T, r *messaging.Room, p messaging.Peer) {
 	t.Helper()
 	if _, ok := r.GetPeer(p.UID); ok {
@@ -71,3 +217,14 @@ func assertPeer(t *testing.T, r *messaging.Room, want messaging.Peer) {
 		t.Errorf("room should contain 1 peer, but has %d peers", r.PeersCount())
 	}
 }
+
+func assertJoin(t *testing.T, r *messaging.Room, secret string, want bool) {
+	t.Helper()
+	_, err := r.Join(secret)
+	if want && err != nil {
+		t.Errorf("got error %v when joining with secret %q, but want none", err, secret)
+	}
+	if !want && err != messaging.ErrUnauthorized {
+		t.Errorf("got error %v when joining with secret %q, but want %v", err, secret, messaging.ErrUnauthorized)
+	}
+}
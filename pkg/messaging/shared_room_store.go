@@ -0,0 +1,425 @@
+package messaging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/kv"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+)
+
+// SharedRoomStore keeps rooms and peers in a key-value store shared by instances
+// of the server, so that a peer registered through one instance can join the room
+// through any of them. Creating rooms and registering peers are single atomic
+// operations of the store, so concurrent creations of a room through different
+// instances succeed only once.
+//
+// Peers are kept with hashes of their secrets only, so that the store doesn't
+// reveal them. Errors of the store are logged, the store reports them like missing
+// rooms and peers, except for joins, registrations and rotations of secrets which
+// fail with the error.
+type SharedRoomStore struct {
+	kv     kv.Store
+	prefix string
+	logger logging.Logger
+}
+
+// peerRecord is a peer as it's kept in the store, with the hash of its secret.
+// The hash is empty when the secret is revoked.
+type peerRecord struct {
+	UID        string    `json:"uid"`
+	SecretHash string    `json:"secret_hash,omitempty"`
+	Role       string    `json:"role,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	PublicKey  string    `json:"public_key,omitempty"`
+}
+
+func newPeerRecord(p Peer) peerRecord {
+	r := peerRecord{UID: p.UID, Role: p.Role, ExpiresAt: p.ExpiresAt, PublicKey: p.PublicKey}
+	if p.Secret != "" {
+		r.SecretHash = secretIndexKey(p.Secret)
+	}
+	return r
+}
+
+// peer returns the peer without its secret, which isn't kept
+func (r peerRecord) peer() Peer {
+	return Peer{UID: r.UID, Role: r.Role, ExpiresAt: r.ExpiresAt, PublicKey: r.PublicKey}
+}
+
+// NewSharedRoomStore creates a store keeping rooms under keys with the prefix.
+func NewSharedRoomStore(s kv.Store, prefix string, l logging.Logger) *SharedRoomStore {
+	return &SharedRoomStore{kv: s, prefix: prefix, logger: l}
+}
+
+func (s *SharedRoomStore) CheckHealth() error {
+	return s.kv.CheckHealth()
+}
+
+func (s *SharedRoomStore) CreateRoom(uid string) bool {
+	created, err := s.kv.SAdd(s.roomsKey(), uid)
+	if err != nil {
+		s.logError("failed to create room", uid, err)
+		return false
+	}
+	if created {
+		// peers registered and overrides set while a previous room with the UID
+		// was deleted are stale
+		if err := s.kv.Del(s.peersKey(uid), s.secretsKey(uid)); err != nil {
+			s.logError("failed to remove stale peers", uid, err)
+		}
+		if _, err := s.kv.HDel(s.connectionsKey(), uid); err != nil {
+			s.logError("failed to remove stale connection overrides", uid, err)
+		}
+	}
+	return created
+}
+
+func (s *SharedRoomStore) RoomExists(uid string) bool {
+	exists, err := s.kv.SIsMember(s.roomsKey(), uid)
+	if err != nil {
+		s.logError("failed to check room", uid, err)
+	}
+	return exists
+}
+
+// ListRooms returns summaries of all rooms, ordered by UID.
+func (s *SharedRoomStore) ListRooms() []RoomInfo {
+	uids, err := s.kv.SMembers(s.roomsKey())
+	if err != nil {
+		s.logError("failed to list rooms", "", err)
+		return []RoomInfo{}
+	}
+	rooms := make([]RoomInfo, 0, len(uids))
+	for _, uid := range uids {
+		n, err := s.kv.HLen(s.peersKey(uid))
+		if err != nil {
+			s.logError("failed to count peers", uid, err)
+		}
+		rooms = append(rooms, RoomInfo{UID: uid, Peers: n})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].UID < rooms[j].UID })
+	return rooms
+}
+
+// DeleteRoom removes the room with all its peers, so that they can't join it anymore.
+func (s *SharedRoomStore) DeleteRoom(uid string) bool {
+	removed, err := s.kv.SRem(s.roomsKey(), uid)
+	if err != nil {
+		s.logError("failed to delete room", uid, err)
+		return false
+	}
+	if !removed {
+		return false
+	}
+	if err := s.kv.Del(s.peersKey(uid), s.secretsKey(uid)); err != nil {
+		s.logError("failed to delete peers of room", uid, err)
+	}
+	if _, err := s.kv.HDel(s.connectionsKey(), uid); err != nil {
+		s.logError("failed to delete connection overrides of room", uid, err)
+	}
+	return true
+}
+
+func (s *SharedRoomStore) RoomsCount() int {
+	uids, err := s.kv.SMembers(s.roomsKey())
+	if err != nil {
+		s.logError("failed to count rooms", "", err)
+	}
+	return len(uids)
+}
+
+// RegisterPeer creates the room, unless it exists, and registers the peer in it.
+// It reports whether the peer wasn't registered before and fails with
+// ErrSecretInUse when another peer of the room has the same secret, or with
+// ErrRoomNotFound when the room is deleted while the peer is registered.
+func (s *SharedRoomStore) RegisterPeer(room string, p Peer) (bool, error) {
+	if _, err := s.kv.SAdd(s.roomsKey(), room); err != nil {
+		return false, err
+	}
+	if err := s.checkSecret(room, p.UID, p.Secret); err != nil {
+		return false, err
+	}
+	created, err := s.putPeer(room, p)
+	if err != nil {
+		return created, err
+	}
+	// the room may have been deleted through another instance after it was
+	// checked, its peers were removed before this one was stored
+	exists, err := s.kv.SIsMember(s.roomsKey(), room)
+	if err != nil || exists {
+		return created, err
+	}
+	s.RemovePeer(room, p.UID)
+	return false, ErrRoomNotFound
+}
+
+// GetPeer returns the registered peer without its secret, which isn't kept.
+func (s *SharedRoomStore) GetPeer(room string, uid string) (Peer, bool) {
+	r, _, ok, err := s.getPeer(room, uid)
+	if err != nil {
+		s.logError("failed to get peer", room, err)
+	}
+	return r.peer(), ok
+}
+
+// RemovePeer unregisters the peer, so that it can't join the room anymore.
+func (s *SharedRoomStore) RemovePeer(room string, uid string) bool {
+	removed, err := s.kv.HDel(s.peersKey(room), uid)
+	if err != nil {
+		s.logError("failed to remove peer", room, err)
+		return false
+	}
+	return removed
+}
+
+// PublicKeys returns public keys of peers registered in the room, by UID.
+func (s *SharedRoomStore) PublicKeys(room string) map[string]string {
+	keys := make(map[string]string)
+	records, err := s.kv.HGetAll(s.peersKey(room))
+	if err != nil {
+		s.logError("failed to get public keys", room, err)
+		return keys
+	}
+	for uid, data := range records {
+		var r peerRecord
+		if err := json.Unmarshal([]byte(data), &r); err == nil && r.PublicKey != "" {
+			keys[uid] = r.PublicKey
+		}
+	}
+	return keys
+}
+
+// RotateSecret replaces the secret of the registered peer, so that the old one
+// can't be used to join the room anymore. It reports whether the peer is registered
+// and fails with ErrSecretInUse when another peer of the room has the secret.
+func (s *SharedRoomStore) RotateSecret(room string, uid string, secret string, expiresAt time.Time) (bool, error) {
+	if _, _, ok, err := s.getPeer(room, uid); err != nil || !ok {
+		return false, err
+	}
+	if err := s.checkSecret(room, uid, secret); err != nil {
+		return true, err
+	}
+	return s.updatePeer(room, uid, func(r *peerRecord) {
+		r.SecretHash = secretIndexKey(secret)
+		r.ExpiresAt = expiresAt
+	})
+}
+
+// RevokeSecret keeps the peer registered, but it can't join the room until its
+// secret is rotated.
+func (s *SharedRoomStore) RevokeSecret(room string, uid string) bool {
+	revoked, err := s.updatePeer(room, uid, func(r *peerRecord) {
+		r.SecretHash = ""
+		r.ExpiresAt = time.Time{}
+	})
+	if err != nil {
+		s.logError("failed to revoke secret", room, err)
+	}
+	return revoked
+}
+
+// SetConnectionOverrides keeps the overrides with the room, so that connections
+// in the room have the same options on every instance. It reports whether the room
+// exists.
+func (s *SharedRoomStore) SetConnectionOverrides(room string, o ConnectionOverrides) bool {
+	exists, err := s.kv.SIsMember(s.roomsKey(), room)
+	if err != nil || !exists {
+		if err != nil {
+			s.logError("failed to check room", room, err)
+		}
+		return false
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		s.logError("failed to encode connection overrides", room, err)
+		return false
+	}
+	if _, err := s.kv.HSet(s.connectionsKey(), room, string(data)); err != nil {
+		s.logError("failed to set connection overrides", room, err)
+		return false
+	}
+	return true
+}
+
+// ConnectionOverrides returns the overrides kept with the room, which are zero
+// when there are none or they can't be read.
+func (s *SharedRoomStore) ConnectionOverrides(room string) ConnectionOverrides {
+	var o ConnectionOverrides
+	data, ok, err := s.kv.HGet(s.connectionsKey(), room)
+	if err != nil {
+		s.logError("failed to get connection overrides", room, err)
+	}
+	if !ok {
+		return o
+	}
+	if err := json.Unmarshal([]byte(data), &o); err != nil {
+		s.logError("failed to decode connection overrides", room, err)
+		return ConnectionOverrides{}
+	}
+	return o
+}
+
+// JoinRoom returns the peer with the secret, unless the secret is revoked or expired.
+func (s *SharedRoomStore) JoinRoom(room string, secret string) (Peer, error) {
+	exists, err := s.kv.SIsMember(s.roomsKey(), room)
+	if err != nil {
+		return Peer{}, err
+	}
+	if !exists {
+		return Peer{}, ErrRoomNotFound
+	}
+	key := secretIndexKey(secret)
+	uid, ok, err := s.kv.HGet(s.secretsKey(room), key)
+	if err != nil {
+		return Peer{}, err
+	}
+	if !ok {
+		return Peer{}, ErrUnauthorized
+	}
+	r, _, ok, err := s.getPeer(room, uid)
+	if err != nil {
+		return Peer{}, err
+	}
+	if !ok || r.SecretHash != key {
+		// the index isn't updated together with peers, so it may point at peers
+		// which were removed or whose secrets changed
+		if _, err := s.kv.HDel(s.secretsKey(room), key); err != nil {
+			s.logError("failed to remove stale secret", room, err)
+		}
+		return Peer{}, ErrUnauthorized
+	}
+	p := r.peer()
+	p.Secret = secret
+	if p.Expired(time.Now()) {
+		return Peer{}, ErrUnauthorized
+	}
+	return p, nil
+}
+
+// checkSecret fails with ErrSecretInUse when a peer other than uid has the secret.
+// Registrations with the same secret through different instances at once aren't
+// isolated.
+func (s *SharedRoomStore) checkSecret(room string, uid string, secret string) error {
+	if secret == "" {
+		return nil
+	}
+	key := secretIndexKey(secret)
+	owner, ok, err := s.kv.HGet(s.secretsKey(room), key)
+	if err != nil || !ok || owner == uid {
+		return err
+	}
+	// the index may point at peers which were removed or whose secrets changed
+	r, _, ok, err := s.getPeer(room, owner)
+	if err != nil {
+		return err
+	}
+	if ok && r.SecretHash == key {
+		return ErrSecretInUse
+	}
+	return nil
+}
+
+// putPeer stores the peer and indexes its secret. The peer is stored first, so
+// that joins by the index never find a peer which isn't stored.
+func (s *SharedRoomStore) putPeer(room string, p Peer) (bool, error) {
+	r := newPeerRecord(p)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	created, err := s.kv.HSet(s.peersKey(room), p.UID, string(data))
+	if err != nil {
+		return false, err
+	}
+	if err := s.index(room, r); err != nil {
+		return created, err
+	}
+	return created, nil
+}
+
+// getPeer returns the record of the peer with its data as it's stored
+func (s *SharedRoomStore) getPeer(room string, uid string) (peerRecord, string, bool, error) {
+	data, ok, err := s.kv.HGet(s.peersKey(room), uid)
+	if err != nil || !ok {
+		return peerRecord{}, "", false, err
+	}
+	var r peerRecord
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return peerRecord{}, "", false, err
+	}
+	return r, data, true, nil
+}
+
+// updatePeer changes the registered peer and reports whether it's registered.
+// The record is replaced only if it's unchanged since it was read, otherwise
+// it's read and changed again, so that peers removed meanwhile aren't stored again
+// and concurrent updates aren't lost.
+func (s *SharedRoomStore) updatePeer(room string, uid string, update func(r *peerRecord)) (bool, error) {
+	for {
+		r, old, ok, err := s.getPeer(room, uid)
+		if err != nil || !ok {
+			return false, err
+		}
+		oldHash := r.SecretHash
+		update(&r)
+		data, err := json.Marshal(r)
+		if err != nil {
+			return false, err
+		}
+		set, err := s.kv.HCompareAndSet(s.peersKey(room), uid, old, string(data))
+		if err != nil {
+			return false, err
+		}
+		if !set {
+			continue
+		}
+		if err := s.index(room, r); err != nil {
+			return true, err
+		}
+		if oldHash != "" && oldHash != r.SecretHash {
+			if _, err := s.kv.HDel(s.secretsKey(room), oldHash); err != nil {
+				s.logError("failed to remove old secret", room, err)
+			}
+		}
+		return true, nil
+	}
+}
+
+// index points the hash of the peer's secret at the peer, unless it's revoked
+func (s *SharedRoomStore) index(room string, r peerRecord) error {
+	if r.SecretHash == "" {
+		return nil
+	}
+	_, err := s.kv.HSet(s.secretsKey(room), r.SecretHash, r.UID)
+	return err
+}
+
+func (s *SharedRoomStore) logError(msg string, room string, err error) {
+	s.logger.Error(msg, logging.Fields{"room": room, "error": err})
+}
+
+func (s *SharedRoomStore) roomsKey() string {
+	return s.prefix + "rooms"
+}
+
+func (s *SharedRoomStore) connectionsKey() string {
+	return s.prefix + "connections"
+}
+
+func (s *SharedRoomStore) peersKey(room string) string {
+	return s.prefix + "room:" + room + ":peers"
+}
+
+func (s *SharedRoomStore) secretsKey(room string) string {
+	return s.prefix + "room:" + room + ":secrets"
+}
+
+// secretIndexKey hashes the secret, so that the index doesn't keep secrets as keys
+func secretIndexKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,327 @@
+package messaging_test
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/kv"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+// newSharedStores creates stores of two instances of the server sharing a backend
+func newSharedStores() (*messaging.SharedRoomStore, *messaging.SharedRoomStore) {
+	backend := kv.NewMemoryStore()
+	return messaging.NewSharedRoomStore(backend, "tarpon:", logging.NoopLogger{}),
+		messaging.NewSharedRoomStore(backend, "tarpon:", logging.NoopLogger{})
+}
+
+func TestSharedRoomStoreJoinThroughAnotherInstance(t *testing.T) {
+	a, b := newSharedStores()
+
+	if _, err := b.JoinRoom(myRoom, myPeer.Secret); err != messaging.ErrRoomNotFound {
+		t.Errorf("got err %v joining missing room, want %v", err, messaging.ErrRoomNotFound)
+	}
+	if created, err := a.RegisterPeer(myRoom, myPeer); err != nil || !created {
+		t.Fatalf("got %v and err %v when registering peer %+v, want true", created, err, myPeer)
+	}
+	if created, err := a.RegisterPeer(myRoom, myPeer); err != nil || created {
+		t.Errorf("got %v and err %v when registering peer again, want false", created, err)
+	}
+
+	if p, err := b.JoinRoom(myRoom, myPeer.Secret); err != nil || p != myPeer {
+		t.Errorf("got peer %+v and err %v, want %+v", p, err, myPeer)
+	}
+	if _, err := b.JoinRoom(myRoom, "invalid"); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v, want %v", err, messaging.ErrUnauthorized)
+	}
+	if p, ok := b.GetPeer(myRoom, myPeer.UID); !ok || p != (messaging.Peer{UID: myPeer.UID}) {
+		t.Errorf("got peer %+v, want %+v without the secret", p, myPeer)
+	}
+}
+
+func TestSharedRoomStoreKeepsHashesOfSecrets(t *testing.T) {
+	backend := kv.NewMemoryStore()
+	store := messaging.NewSharedRoomStore(backend, "", logging.NoopLogger{})
+	store.RegisterPeer(myRoom, messaging.Peer{UID: myPeer.UID, Secret: "peer-secret"})
+	store.RegisterPeer(myRoom, messaging.Peer{UID: "rotated", Secret: "old-secret"})
+	store.RotateSecret(myRoom, "rotated", "rotated-secret", time.Time{})
+
+	for _, key := range []string{"room:" + myRoom + ":peers", "room:" + myRoom + ":secrets"} {
+		hash, _ := backend.HGetAll(key)
+		for field, value := range hash {
+			for _, secret := range []string{"peer-secret", "old-secret", "rotated-secret"} {
+				if strings.Contains(field, secret) || strings.Contains(value, secret) {
+					t.Errorf("found secret %q in %s: %s=%s", secret, key, field, value)
+				}
+			}
+		}
+	}
+	if _, err := store.JoinRoom(myRoom, "rotated-secret"); err != nil {
+		t.Errorf("got err %v joining with rotated secret", err)
+	}
+}
+
+// RemovingStore removes the peer right before it's replaced, like a concurrent
+// removal through another instance
+type RemovingStore struct {
+	*kv.MemoryStore
+}
+
+func (s RemovingStore) HCompareAndSet(key string, field string, old string, value string) (bool, error) {
+	s.HDel(key, field)
+	return s.MemoryStore.HCompareAndSet(key, field, old, value)
+}
+
+func TestSharedRoomStoreDoesNotRestoreRemovedPeers(t *testing.T) {
+	store := messaging.NewSharedRoomStore(RemovingStore{kv.NewMemoryStore()}, "", logging.NoopLogger{})
+	store.RegisterPeer(myRoom, myPeer)
+
+	if ok, err := store.RotateSecret(myRoom, myPeer.UID, "rotated", time.Time{}); err != nil || ok {
+		t.Errorf("got %v and err %v rotating secret of peer removed meanwhile, want false", ok, err)
+	}
+	if _, ok := store.GetPeer(myRoom, myPeer.UID); ok {
+		t.Errorf("peer removed while its secret was rotated is registered again")
+	}
+	if _, err := store.JoinRoom(myRoom, "rotated"); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v joining as removed peer, want %v", err, messaging.ErrUnauthorized)
+	}
+}
+
+// DeletingStore deletes the room right before a peer is stored in it, like a
+// concurrent deletion through another instance
+type DeletingStore struct {
+	*kv.MemoryStore
+	store *messaging.SharedRoomStore
+}
+
+func (s *DeletingStore) HSet(key string, field string, value string) (bool, error) {
+	if strings.HasSuffix(key, ":peers") {
+		s.store.DeleteRoom(myRoom)
+	}
+	return s.MemoryStore.HSet(key, field, value)
+}
+
+func TestSharedRoomStoreDoesNotKeepPeersOfDeletedRooms(t *testing.T) {
+	backend := kv.NewMemoryStore()
+	deleting := messaging.NewSharedRoomStore(&DeletingStore{MemoryStore: backend, store: messaging.NewSharedRoomStore(backend, "", logging.NoopLogger{})}, "", logging.NoopLogger{})
+	store := messaging.NewSharedRoomStore(backend, "", logging.NoopLogger{})
+
+	if _, err := deleting.RegisterPeer(myRoom, myPeer); err != messaging.ErrRoomNotFound {
+		t.Errorf("got err %v registering peer in deleted room, want %v", err, messaging.ErrRoomNotFound)
+	}
+	if !store.CreateRoom(myRoom) {
+		t.Fatalf("room not created again")
+	}
+	if _, ok := store.GetPeer(myRoom, myPeer.UID); ok {
+		t.Errorf("peer of the deleted room registered in the new one")
+	}
+	if _, err := store.JoinRoom(myRoom, myPeer.Secret); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v joining with secret of the deleted room, want %v", err, messaging.ErrUnauthorized)
+	}
+
+	// peers left by registrations which didn't finish are removed when the room is created
+	backend.HSet("room:"+myRoom+":peers", myPeer.UID, `{"uid":"`+myPeer.UID+`"}`)
+	store.DeleteRoom(myRoom)
+	backend.HSet("room:"+myRoom+":peers", myPeer.UID, `{"uid":"`+myPeer.UID+`"}`)
+	if !store.CreateRoom(myRoom) {
+		t.Fatalf("room not created again")
+	}
+	if _, ok := store.GetPeer(myRoom, myPeer.UID); ok {
+		t.Errorf("stale peer found in the new room")
+	}
+}
+
+func TestSharedRoomStoreCreatesRoomOnce(t *testing.T) {
+	a, b := newSharedStores()
+	created := 0
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(s *messaging.SharedRoomStore) {
+			defer wg.Done()
+			if s.CreateRoom(myRoom) {
+				mutex.Lock()
+				created++
+				mutex.Unlock()
+			}
+		}([]*messaging.SharedRoomStore{a, b}[i%2])
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Errorf("room created %d times, want once", created)
+	}
+	if n := b.RoomsCount(); n != 1 {
+		t.Errorf("got %d rooms, want 1", n)
+	}
+}
+
+func TestSharedRoomStoreConnectionOverrides(t *testing.T) {
+	a, b := newSharedStores()
+	overrides := messaging.ConnectionOverrides{PongWait: 10, PingPeriod: 5}
+	if a.SetConnectionOverrides(myRoom, overrides) {
+		t.Errorf("set overrides of a room which does not exist")
+	}
+
+	a.CreateRoom(myRoom)
+	if !a.SetConnectionOverrides(myRoom, overrides) {
+		t.Fatalf("could not set overrides")
+	}
+	if got := b.ConnectionOverrides(myRoom); got != overrides {
+		t.Errorf("got overrides %+v through another store, want %+v", got, overrides)
+	}
+
+	b.DeleteRoom(myRoom)
+	a.CreateRoom(myRoom)
+	if got := a.ConnectionOverrides(myRoom); got != (messaging.ConnectionOverrides{}) {
+		t.Errorf("got overrides %+v of a room created again, want none", got)
+	}
+}
+
+func TestSharedRoomStoreSecrets(t *testing.T) {
+	a, b := newSharedStores()
+	a.RegisterPeer(myRoom, myPeer)
+
+	if ok, err := a.RotateSecret(myRoom, myPeer.UID, "rotated", time.Time{}); err != nil || !ok {
+		t.Fatalf("secret of registered peer not rotated")
+	}
+	if _, err := b.JoinRoom(myRoom, myPeer.Secret); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v joining with old secret, want %v", err, messaging.ErrUnauthorized)
+	}
+	if p, err := b.JoinRoom(myRoom, "rotated"); err != nil || p.UID != myPeer.UID {
+		t.Errorf("got peer %+v and err %v joining with rotated secret", p, err)
+	}
+
+	// re-registering leaves the old secret in the index, which must not let peers in
+	a.RegisterPeer(myRoom, messaging.Peer{UID: myPeer.UID, Secret: "registered"})
+	if _, err := b.JoinRoom(myRoom, "rotated"); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v joining with replaced secret, want %v", err, messaging.ErrUnauthorized)
+	}
+
+	if !a.RevokeSecret(myRoom, myPeer.UID) {
+		t.Fatalf("secret of registered peer not revoked")
+	}
+	if _, err := b.JoinRoom(myRoom, "registered"); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v joining with revoked secret, want %v", err, messaging.ErrUnauthorized)
+	}
+	if ok, _ := a.RotateSecret(myRoom, "invalid", "rotated", time.Time{}); ok || a.RevokeSecret("invalid", myPeer.UID) {
+		t.Errorf("changed secret of peer which is not registered")
+	}
+
+	expired := messaging.Peer{UID: "expired", Secret: "expired-secret", ExpiresAt: time.Now().Add(-time.Minute)}
+	a.RegisterPeer(myRoom, expired)
+	if _, err := b.JoinRoom(myRoom, expired.Secret); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v joining with expired secret, want %v", err, messaging.ErrUnauthorized)
+	}
+}
+
+func TestSharedRoomStoreRejectsSecretOfAnotherPeer(t *testing.T) {
+	a, b := newSharedStores()
+	a.RegisterPeer(myRoom, myPeer)
+	a.RegisterPeer(myRoom, messaging.Peer{UID: "another", Secret: "another-secret"})
+
+	if _, err := b.RegisterPeer(myRoom, messaging.Peer{UID: "duplicate", Secret: myPeer.Secret}); err != messaging.ErrSecretInUse {
+		t.Errorf("got err %v registering peer with secret of another, want %v", err, messaging.ErrSecretInUse)
+	}
+	if ok, err := b.RotateSecret(myRoom, "another", myPeer.Secret, time.Time{}); !ok || err != messaging.ErrSecretInUse {
+		t.Errorf("got %v and err %v rotating to secret of another peer, want true and %v", ok, err, messaging.ErrSecretInUse)
+	}
+	if p, err := a.JoinRoom(myRoom, myPeer.Secret); err != nil || p != myPeer {
+		t.Errorf("got peer %+v and err %v, want %+v", p, err, myPeer)
+	}
+	if _, err := a.JoinRoom(myRoom, "another-secret"); err != nil {
+		t.Errorf("got err %v joining as another peer", err)
+	}
+
+	// secrets of removed peers can be used again
+	b.RemovePeer(myRoom, myPeer.UID)
+	if _, err := b.RegisterPeer(myRoom, messaging.Peer{UID: "duplicate", Secret: myPeer.Secret}); err != nil {
+		t.Errorf("got err %v registering peer with secret of removed peer", err)
+	}
+}
+
+func TestSharedRoomStoreListAndDeleteRooms(t *testing.T) {
+	a, b := newSharedStores()
+	a.CreateRoom("room-b")
+	a.RegisterPeer(myRoom, myPeer)
+	a.RegisterPeer(myRoom, messaging.Peer{UID: "with-key", Secret: "key-secret", PublicKey: "key"})
+
+	want := []messaging.RoomInfo{{UID: myRoom, Peers: 2}, {UID: "room-b"}}
+	if got := b.ListRooms(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rooms %v, want %v", got, want)
+	}
+	if got := b.PublicKeys(myRoom); !reflect.DeepEqual(got, map[string]string{"with-key": "key"}) {
+		t.Errorf("got public keys %v, want the key of with-key", got)
+	}
+
+	if !b.RemovePeer(myRoom, "with-key") || b.RemovePeer(myRoom, "with-key") {
+		t.Errorf("registered peer not removed exactly once")
+	}
+	if _, err := a.JoinRoom(myRoom, "key-secret"); err != messaging.ErrUnauthorized {
+		t.Errorf("got err %v joining as removed peer, want %v", err, messaging.ErrUnauthorized)
+	}
+
+	if !a.RoomExists(myRoom) {
+		t.Errorf("room created through another store is missing")
+	}
+	if !b.DeleteRoom(myRoom) || b.DeleteRoom(myRoom) {
+		t.Errorf("existing room not deleted exactly once")
+	}
+	if a.RoomExists(myRoom) {
+		t.Errorf("room deleted through another store still exists")
+	}
+	if _, err := a.JoinRoom(myRoom, myPeer.Secret); err != messaging.ErrRoomNotFound {
+		t.Errorf("got err %v joining deleted room, want %v", err, messaging.ErrRoomNotFound)
+	}
+	if _, ok := a.GetPeer(myRoom, myPeer.UID); ok {
+		t.Errorf("found peer of deleted room")
+	}
+}
+
+// FailingStore fails operations used to create and join rooms
+type FailingStore struct {
+	kv.Store
+}
+
+var errUnreachable = errors.New("unreachable")
+
+func (FailingStore) SAdd(key string, member string) (bool, error)      { return false, errUnreachable }
+func (FailingStore) SIsMember(key string, member string) (bool, error) { return false, errUnreachable }
+func (FailingStore) CheckHealth() error                                { return errUnreachable }
+
+func TestSharedRoomStoreReportsBackendErrors(t *testing.T) {
+	store := messaging.NewSharedRoomStore(FailingStore{}, "", logging.NoopLogger{})
+
+	if store.CreateRoom(myRoom) {
+		t.Errorf("created room in unreachable store")
+	}
+	if _, err := store.RegisterPeer(myRoom, myPeer); err != errUnreachable {
+		t.Errorf("got err %v registering peer, want %v", err, errUnreachable)
+	}
+	if _, err := store.JoinRoom(myRoom, myPeer.Secret); err != errUnreachable {
+		t.Errorf("got err %v, want %v", err, errUnreachable)
+	}
+	if err := store.CheckHealth(); err != errUnreachable {
+		t.Errorf("got health %v, want %v", err, errUnreachable)
+	}
+}
+
+func BenchmarkSharedRoomStoreJoin(b *testing.B) {
+	store := messaging.NewSharedRoomStore(kv.NewMemoryStore(), "", logging.NoopLogger{})
+	for i := 0; i < 1000; i++ {
+		store.RegisterPeer(myRoom, messaging.Peer{UID: strconv.Itoa(i), Secret: "secret-" + strconv.Itoa(i)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.JoinRoom(myRoom, "secret-500"); err != nil {
+			b.Fatalf("join failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package moderation
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+// Error codes sent to peers whose messages or commands are rejected.
+const (
+	ErrCodeMuted          = "muted"
+	ErrCodeForbidden      = "forbidden"
+	ErrCodeInvalidCommand = "invalid_command"
+)
+
+// Commands hosts send in-band, in the payload of a message addressed to the server.
+const (
+	CommandKick   = "kick"
+	CommandMute   = "mute"
+	CommandUnmute = "unmute"
+	CommandBan    = "ban"
+)
+
+// PeerStore looks up and removes peers registered in rooms.
+type PeerStore interface {
+	GetPeer(room string, uid string) (messaging.Peer, bool)
+	RemovePeer(room string, uid string) bool
+}
+
+// Closer is implemented by subscribers which can be disconnected from the room.
+type Closer interface {
+	Close()
+}
+
+// GoingAwayCloser is implemented by subscribers which tell their peers when they
+// are disconnected because the server is shutting down.
+type GoingAwayCloser interface {
+	CloseGoingAway()
+}
+
+type command struct {
+	Type string `json:"type"`
+	Peer string `json:"peer"`
+}
+
+type roomState struct {
+	sessions map[string][]broker.Subscriber
+	muted    map[string]bool
+	banned   map[string]bool
+}
+
+// Moderator removes misbehaving peers from rooms. It's a broker keeping track of
+// peers' sessions, so that they can be closed, and dropping broadcasts of muted
+// peers. Hosts moderate the room by sending commands to the server, e.g.
+// {"to": "tarpon", "payload": {"type": "kick", "peer": "peer-abc"}}.
+type Moderator struct {
+	broker.Broker
+	peers  PeerStore
+	rooms  map[string]*roomState
+	closed bool
+	audit  audit.Sink
+	mutex  sync.Mutex
+	logger logging.Logger
+}
+
+// NewModerator creates a moderator recording commands of hosts in the audit sink.
+func NewModerator(b broker.Broker, s PeerStore, a audit.Sink, l logging.Logger) *Moderator {
+	return &Moderator{Broker: b, peers: s, rooms: make(map[string]*roomState), audit: a, logger: l}
+}
+
+func (m *Moderator) Send(room string, message messaging.Message) error {
+	if messaging.IsServerUID(message.From) {
+		return m.Broker.Send(room, message)
+	}
+	if message.To == messaging.ServerUID {
+		return m.handleCommand(room, message)
+	}
+	if message.IsBroadcast() && m.IsMuted(room, message.From) {
+		return &messaging.Rejection{Code: ErrCodeMuted, Reason: "you are muted in the room"}
+	}
+	return m.Broker.Send(room, message)
+}
+
+func (m *Moderator) Register(room string, s broker.Subscriber) {
+	m.mutex.Lock()
+	r := m.room(room)
+	r.sessions[s.ID()] = append(r.sessions[s.ID()], s)
+	closed := m.closed
+	m.mutex.Unlock()
+
+	m.Broker.Register(room, s)
+	if closed {
+		m.goAway(room, []broker.Subscriber{s})
+	}
+}
+
+func (m *Moderator) Unregister(room string, s broker.Subscriber) bool {
+	m.mutex.Lock()
+	if r := m.rooms[room]; r != nil {
+		sessions := r.sessions[s.ID()]
+		for i, session := range sessions {
+			if session == s {
+				sessions = append(sessions[:i:i], sessions[i+1:]...)
+				break
+			}
+		}
+		if len(sessions) == 0 {
+			delete(r.sessions, s.ID())
+		} else {
+			r.sessions[s.ID()] = sessions
+		}
+		m.cleanup(room, r)
+	}
+	m.mutex.Unlock()
+
+	return m.Broker.Unregister(room, s)
+}
+
+// Kick disconnects all sessions of the peer and announces it to the room. The
+// peer may join the room again.
+func (m *Moderator) Kick(room string, uid string) {
+	m.Disconnect(room, uid)
+	m.notify(room, uid, messaging.NewPeerKicked)
+}
+
+// Disconnect closes all sessions of the peer without announcing it, e.g. when
+// credentials they were authenticated with are no longer valid.
+func (m *Moderator) Disconnect(room string, uid string) {
+	m.mutex.Lock()
+	var sessions []broker.Subscriber
+	if r := m.rooms[room]; r != nil {
+		sessions = r.sessions[uid]
+	}
+	m.mutex.Unlock()
+
+	m.close(room, sessions)
+}
+
+// CloseRoom closes sessions of all peers in the room and forgets who was muted
+// or banned in it, e.g. when the room is deleted.
+func (m *Moderator) CloseRoom(room string) {
+	m.mutex.Lock()
+	var sessions []broker.Subscriber
+	if r := m.rooms[room]; r != nil {
+		for _, s := range r.sessions {
+			sessions = append(sessions, s...)
+		}
+		r.muted = make(map[string]bool)
+		r.banned = make(map[string]bool)
+		m.cleanup(room, r)
+	}
+	m.mutex.Unlock()
+
+	m.close(room, sessions)
+}
+
+// CloseAll closes sessions of all peers, telling them that the server is going
+// away, when the server shuts down. Sessions registered later are closed at once.
+func (m *Moderator) CloseAll() {
+	m.mutex.Lock()
+	m.closed = true
+	sessions := make(map[string][]broker.Subscriber)
+	for room, r := range m.rooms {
+		for _, s := range r.sessions {
+			sessions[room] = append(sessions[room], s...)
+		}
+	}
+	m.mutex.Unlock()
+
+	for room, s := range sessions {
+		m.goAway(room, s)
+	}
+}
+
+// Mute makes the server drop broadcasts the peer sends until it's unmuted.
+func (m *Moderator) Mute(room string, uid string, muted bool) {
+	m.mutex.Lock()
+	r := m.room(room)
+	if muted {
+		r.muted[uid] = true
+	} else {
+		delete(r.muted, uid)
+		m.cleanup(room, r)
+	}
+	m.mutex.Unlock()
+
+	if muted {
+		m.notify(room, uid, messaging.NewPeerMuted)
+	} else {
+		m.notify(room, uid, messaging.NewPeerUnmuted)
+	}
+}
+
+// Ban revokes the peer's registration, disconnects its sessions and prevents it
+// from being registered in the room again.
+func (m *Moderator) Ban(room string, uid string) {
+	m.mutex.Lock()
+	r := m.room(room)
+	r.banned[uid] = true
+	sessions := r.sessions[uid]
+	m.mutex.Unlock()
+
+	m.peers.RemovePeer(room, uid)
+	m.close(room, sessions)
+	m.notify(room, uid, messaging.NewPeerBanned)
+}
+
+func (m *Moderator) IsMuted(room string, uid string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.rooms[room]
+	return r != nil && r.muted[uid]
+}
+
+func (m *Moderator) IsBanned(room string, uid string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.rooms[room]
+	return r != nil && r.banned[uid]
+}
+
+// handleCommand executes a command sent by a host of the room.
+func (m *Moderator) handleCommand(room string, message messaging.Message) error {
+	sender, ok := m.peers.GetPeer(room, message.From)
+	if !ok || !sender.IsHost() {
+		return &messaging.Rejection{Code: ErrCodeForbidden, Reason: "only hosts can moderate the room"}
+	}
+
+	var cmd command
+	if err := json.Unmarshal(message.Payload, &cmd); err != nil {
+		return &messaging.Rejection{Code: ErrCodeInvalidCommand, Reason: "command is not valid JSON"}
+	}
+	target, ok := m.peers.GetPeer(room, cmd.Peer)
+	if !ok {
+		return &messaging.Rejection{Code: messaging.ErrCodeUnknownRecipient, Reason: "peer is not registered in the room"}
+	}
+	if target.IsHost() {
+		return &messaging.Rejection{Code: ErrCodeForbidden, Reason: "hosts can't be moderated"}
+	}
+
+	var eventType string
+	switch cmd.Type {
+	case CommandKick:
+		m.Kick(room, cmd.Peer)
+		eventType = audit.PeerKicked
+	case CommandMute:
+		m.Mute(room, cmd.Peer, true)
+		eventType = audit.PeerMuted
+	case CommandUnmute:
+		m.Mute(room, cmd.Peer, false)
+		eventType = audit.PeerUnmuted
+	case CommandBan:
+		m.Ban(room, cmd.Peer)
+		eventType = audit.PeerBanned
+	default:
+		return &messaging.Rejection{Code: ErrCodeInvalidCommand, Reason: "unknown command"}
+	}
+	e := audit.New(eventType, room, cmd.Peer, message.Source)
+	e.Actor = sender.UID
+	m.audit.Record(e)
+	m.logger.Info("peer moderated by host", logging.Fields{"room": room, "peer": cmd.Peer, "host": sender.UID, "command": cmd.Type})
+	return nil
+}
+
+// close disconnects the sessions, or stops delivering messages to those which
+// can't be disconnected.
+func (m *Moderator) close(room string, sessions []broker.Subscriber) {
+	for _, s := range sessions {
+		if c, ok := s.(Closer); ok {
+			c.Close()
+		} else {
+			m.Unregister(room, s)
+		}
+	}
+}
+
+func (m *Moderator) goAway(room string, sessions []broker.Subscriber) {
+	for _, s := range sessions {
+		if c, ok := s.(GoingAwayCloser); ok {
+			c.CloseGoingAway()
+		} else {
+			m.close(room, []broker.Subscriber{s})
+		}
+	}
+}
+
+func (m *Moderator) notify(room string, uid string, msgFactory func(a string) (*messaging.Message, error)) {
+	msg, err := msgFactory(uid)
+	if err != nil {
+		m.logger.Error("failed to create control message", logging.Fields{"room": room, "peer": uid, "error": err})
+	} else if err := m.Broker.Send(room, *msg); err != nil {
+		m.logger.Error("failed to send control message", logging.Fields{"room": room, "peer": uid, "error": err})
+	}
+}
+
+// room assumes the lock is held
+func (m *Moderator) room(room string) *roomState {
+	r := m.rooms[room]
+	if r == nil {
+		r = &roomState{
+			sessions: make(map[string][]broker.Subscriber),
+			muted:    make(map[string]bool),
+			banned:   make(map[string]bool),
+		}
+		m.rooms[room] = r
+	}
+	return r
+}
+
+// cleanup forgets the room when there's nothing to remember about it and assumes the lock is held
+func (m *Moderator) cleanup(room string, r *roomState) {
+	if len(r.sessions) == 0 && len(r.muted) == 0 && len(r.banned) == 0 {
+		delete(m.rooms, room)
+	}
+}
@@ -0,0 +1,268 @@
+package moderation_test
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/moderation"
+)
+
+var (
+	myRoom    = "room-123"
+	myHost    = "host-abc"
+	myPeer    = "peer-abc"
+	otherPeer = "another-peer"
+)
+
+type StubPeerStore struct {
+	removed []string
+}
+
+func (s *StubPeerStore) GetPeer(room string, uid string) (messaging.Peer, bool) {
+	switch {
+	case room != myRoom:
+		return messaging.Peer{}, false
+	case uid == myHost:
+		return messaging.Peer{UID: uid, Role: messaging.RoleHost}, true
+	case uid == myPeer || uid == otherPeer:
+		return messaging.Peer{UID: uid}, true
+	}
+	return messaging.Peer{}, false
+}
+
+func (s *StubPeerStore) RemovePeer(room string, uid string) bool {
+	s.removed = append(s.removed, uid)
+	return true
+}
+
+type SpySubscriber struct {
+	id       string
+	messages []messaging.Message
+	closed   bool
+	mutex    sync.Mutex
+}
+
+func (s *SpySubscriber) ID() string {
+	return s.id
+}
+
+func (s *SpySubscriber) Write(m messaging.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages = append(s.messages, m)
+}
+
+func (s *SpySubscriber) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+}
+
+func newModerator(t *testing.T) (*moderation.Moderator, *StubPeerStore, *SpySubscriber, *SpySubscriber) {
+	t.Helper()
+	store := &StubPeerStore{}
+	m := moderation.NewModerator(broker.NewBroker(logging.NoopLogger{}), store, audit.NoopSink{}, logging.NoopLogger{})
+	peer := &SpySubscriber{id: myPeer}
+	other := &SpySubscriber{id: otherPeer}
+	m.Register(myRoom, peer)
+	m.Register(myRoom, other)
+	return m, store, peer, other
+}
+
+func TestMutedPeersCantBroadcast(t *testing.T) {
+	m, _, _, other := newModerator(t)
+
+	m.Mute(myRoom, myPeer, true)
+	assertRejection(t, m.Send(myRoom, newMessage(myPeer, "")), moderation.ErrCodeMuted)
+	if err := m.Send(myRoom, newMessage(myPeer, otherPeer)); err != nil {
+		t.Errorf("got error %v, but muted peers can send direct messages", err)
+	}
+	m.Mute(myRoom, myPeer, false)
+	if err := m.Send(myRoom, newMessage(myPeer, "")); err != nil {
+		t.Errorf("got error %v, but peer is unmuted", err)
+	}
+
+	assertControlTypes(t, other.messages, "peer_muted", "", "peer_unmuted", "")
+}
+
+func TestHostKicksPeer(t *testing.T) {
+	m, store, peer, other := newModerator(t)
+
+	if err := m.Send(myRoom, newCommand(myHost, moderation.CommandKick, myPeer)); err != nil {
+		t.Fatalf("got error %v, but host can kick peers", err)
+	}
+
+	if !peer.closed {
+		t.Errorf("kicked peer was not disconnected")
+	}
+	if other.closed {
+		t.Errorf("other peer was disconnected")
+	}
+	if len(store.removed) != 0 {
+		t.Errorf("kicked peer was removed from the room")
+	}
+	assertControlTypes(t, other.messages, "peer_kicked")
+}
+
+// SpyAudit records audit events
+type SpyAudit struct {
+	events []audit.Event
+}
+
+func (a *SpyAudit) Record(e audit.Event) {
+	a.events = append(a.events, e)
+}
+
+func TestHostCommandsAreAuditedWithTheirSource(t *testing.T) {
+	spy := &SpyAudit{}
+	m := moderation.NewModerator(broker.NewBroker(logging.NoopLogger{}), &StubPeerStore{}, spy, logging.NoopLogger{})
+	src := audit.Source{RemoteIP: "192.0.2.1", UserAgent: "Mozilla/5.0", RequestID: "request-1"}
+
+	cmd := newCommand(myHost, moderation.CommandMute, myPeer)
+	cmd.Source = src
+	if err := m.Send(myRoom, cmd); err != nil {
+		t.Fatalf("got error %v, but host can mute peers", err)
+	}
+
+	if len(spy.events) != 1 {
+		t.Fatalf("got audit events %+v, want one", spy.events)
+	}
+	e := spy.events[0]
+	if e.Type != audit.PeerMuted || e.Actor != myHost || e.RemoteIP != src.RemoteIP || e.UserAgent != src.UserAgent || e.RequestID != src.RequestID {
+		t.Errorf("got audit event %+v, want %s by %s from %+v", e, audit.PeerMuted, myHost, src)
+	}
+}
+
+func TestHostBansPeer(t *testing.T) {
+	m, store, peer, other := newModerator(t)
+
+	if err := m.Send(myRoom, newCommand(myHost, moderation.CommandBan, myPeer)); err != nil {
+		t.Fatalf("got error %v, but host can ban peers", err)
+	}
+
+	if !peer.closed {
+		t.Errorf("banned peer was not disconnected")
+	}
+	if len(store.removed) != 1 || store.removed[0] != myPeer {
+		t.Errorf("got removed peers %v, but want %q", store.removed, myPeer)
+	}
+	if !m.IsBanned(myRoom, myPeer) || m.IsBanned(myRoom, otherPeer) {
+		t.Errorf("only %q should be banned", myPeer)
+	}
+	assertControlTypes(t, other.messages, "peer_banned")
+}
+
+func TestCloseRoom(t *testing.T) {
+	m, _, peer, other := newModerator(t)
+	m.Ban(myRoom, "banned")
+
+	m.CloseRoom(myRoom)
+
+	if !peer.closed || !other.closed {
+		t.Errorf("peers in the closed room were not disconnected")
+	}
+	if m.IsBanned(myRoom, "banned") {
+		t.Errorf("ban outlived the closed room")
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	m, _, peer, other := newModerator(t)
+
+	m.CloseAll()
+	late := &SpySubscriber{id: myHost}
+	m.Register(myRoom, late)
+
+	if !peer.closed || !other.closed {
+		t.Errorf("peers were not disconnected")
+	}
+	if !late.closed {
+		t.Errorf("peer joining after the server closed sessions was not disconnected")
+	}
+}
+
+func TestInvalidCommandsAreRejected(t *testing.T) {
+	cases := map[string]struct {
+		message  messaging.Message
+		wantCode string
+	}{
+		"when sent by a peer": {
+			message:  newCommand(otherPeer, moderation.CommandKick, myPeer),
+			wantCode: moderation.ErrCodeForbidden,
+		},
+		"when targeting a host": {
+			message:  newCommand(myHost, moderation.CommandBan, myHost),
+			wantCode: moderation.ErrCodeForbidden,
+		},
+		"when targeting unknown peer": {
+			message:  newCommand(myHost, moderation.CommandKick, "unknown"),
+			wantCode: messaging.ErrCodeUnknownRecipient,
+		},
+		"when command is unknown": {
+			message:  newCommand(myHost, "promote", myPeer),
+			wantCode: moderation.ErrCodeInvalidCommand,
+		},
+		"when command is not an object": {
+			message:  messaging.Message{From: myHost, To: messaging.ServerUID, Payload: json.RawMessage(`"kick"`)},
+			wantCode: moderation.ErrCodeInvalidCommand,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			m, _, peer, _ := newModerator(t)
+
+			assertRejection(t, m.Send(myRoom, tt.message), tt.wantCode)
+			if peer.closed {
+				t.Errorf("peer was disconnected by a rejected command")
+			}
+		})
+	}
+}
+
+func newMessage(from string, to string) messaging.Message {
+	return messaging.Message{From: from, To: to, Payload: json.RawMessage(`"hello"`)}
+}
+
+func newCommand(from string, command string, peer string) messaging.Message {
+	payload, _ := json.Marshal(map[string]string{"type": command, "peer": peer})
+	return messaging.Message{From: from, To: messaging.ServerUID, Payload: payload}
+}
+
+func assertRejection(t *testing.T, err error, code string) {
+	t.Helper()
+	var rejection *messaging.Rejection
+	if !errors.As(err, &rejection) {
+		t.Fatalf("got error %v, want rejection with code %q", err, code)
+	}
+	if rejection.Code != code {
+		t.Errorf("got rejection code %q, want %q", rejection.Code, code)
+	}
+}
+
+// assertControlTypes compares types of control messages, with an empty type
+// standing for a message sent by a peer.
+func assertControlTypes(t *testing.T, messages []messaging.Message, want ...string) {
+	t.Helper()
+	if len(messages) != len(want) {
+		t.Fatalf("got %d messages %v, want %d", len(messages), messages, len(want))
+	}
+	for i, m := range messages {
+		var payload struct {
+			Type string `json:"type"`
+		}
+		if messaging.IsServerUID(m.From) {
+			if err := json.Unmarshal(m.Payload, &payload); err != nil {
+				t.Fatalf("could not decode control message %s: %v", m.Payload, err)
+			}
+		}
+		if payload.Type != want[i] {
+			t.Errorf("at index %d got message %s, want type %q", i, m.Payload, want[i])
+		}
+	}
+}
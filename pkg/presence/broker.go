@@ -0,0 +1,171 @@
+package presence
+
+import (
+	"sync"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+// Broker publishes presence of its subscribers in the registry. It announces peers
+// connecting to the room through other nodes, or disconnecting from them, to its
+// subscribers, as agents announce peers connected to this node. Announcements are
+// checked for every Heartbeat of the registry, so they are delayed by up to the
+// heartbeat, or the lease when a node crashed.
+type Broker struct {
+	broker.Broker
+	registry *Registry
+	rooms    map[string]*roomPresence
+	mutex    sync.Mutex
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	logger   logging.Logger
+}
+
+// roomPresence counts local sessions of peers and remembers peers connected
+// through other nodes when the room was last checked
+type roomPresence struct {
+	sessions map[string]int
+	remote   map[string]bool
+}
+
+func NewBroker(b broker.Broker, r *Registry, l logging.Logger) *Broker {
+	return &Broker{
+		Broker:   b,
+		registry: r,
+		rooms:    make(map[string]*roomPresence),
+		stopChan: make(chan struct{}),
+		logger:   l,
+	}
+}
+
+// Start starts announcing peers of other nodes.
+func (b *Broker) Start() {
+	b.wg.Add(1)
+	go b.work()
+}
+
+// Stop stops announcing peers of other nodes.
+func (b *Broker) Stop() {
+	close(b.stopChan)
+	b.wg.Wait()
+}
+
+func (b *Broker) Register(room string, s broker.Subscriber) {
+	b.mutex.Lock()
+	rp := b.rooms[room]
+	if rp == nil {
+		rp = &roomPresence{sessions: make(map[string]int)}
+		b.rooms[room] = rp
+	}
+	rp.sessions[s.ID()]++
+	if rp.sessions[s.ID()] == 1 {
+		// under the lock, so that changes of the peer's presence are ordered
+		b.registry.Connected(room, s.ID())
+	}
+	b.mutex.Unlock()
+
+	b.Broker.Register(room, s)
+}
+
+func (b *Broker) Unregister(room string, s broker.Subscriber) bool {
+	if !b.Broker.Unregister(room, s) {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	rp := b.rooms[room]
+	if rp == nil {
+		return true
+	}
+	rp.sessions[s.ID()]--
+	if rp.sessions[s.ID()] <= 0 {
+		delete(rp.sessions, s.ID())
+		b.registry.Disconnected(room, s.ID())
+	}
+	if len(rp.sessions) == 0 {
+		delete(b.rooms, room)
+	}
+	return true
+}
+
+func (b *Broker) work() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.registry.options.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.announceRemote()
+		case <-b.stopChan:
+			return
+		}
+	}
+}
+
+// announceRemote compares peers connected through other nodes with those of the
+// previous check in rooms with local sessions and announces the differences,
+// except for peers which are connected to this node too.
+func (b *Broker) announceRemote() {
+	b.mutex.Lock()
+	rooms := make([]string, 0, len(b.rooms))
+	for room := range b.rooms {
+		rooms = append(rooms, room)
+	}
+	b.mutex.Unlock()
+
+	for _, room := range rooms {
+		uids, err := b.registry.Remote(room)
+		if err != nil {
+			b.logger.Error("failed to read presence", logging.Fields{"room": room, "error": err})
+			continue
+		}
+		remote := make(map[string]bool, len(uids))
+		for _, uid := range uids {
+			remote[uid] = true
+		}
+
+		var connected, disconnected []string
+		b.mutex.Lock()
+		rp := b.rooms[room]
+		if rp == nil {
+			b.mutex.Unlock()
+			continue
+		}
+		// the first check of a room only learns who is connected elsewhere
+		if rp.remote != nil {
+			for uid := range remote {
+				if !rp.remote[uid] && rp.sessions[uid] == 0 {
+					connected = append(connected, uid)
+				}
+			}
+			for uid := range rp.remote {
+				if !remote[uid] && rp.sessions[uid] == 0 {
+					disconnected = append(disconnected, uid)
+				}
+			}
+		}
+		rp.remote = remote
+		b.mutex.Unlock()
+
+		for _, uid := range connected {
+			b.announce(room, uid, messaging.NewPeerConnected)
+		}
+		for _, uid := range disconnected {
+			b.announce(room, uid, messaging.NewPeerDisconnected)
+		}
+	}
+}
+
+func (b *Broker) announce(room string, uid string, msgFactory func(a string) (*messaging.Message, error)) {
+	msg, err := msgFactory(uid)
+	if err != nil {
+		b.logger.Error("failed to create control message", logging.Fields{"room": room, "peer": uid, "error": err})
+	} else if err := b.Broker.Send(room, *msg); err != nil {
+		b.logger.Error("failed to send control message", logging.Fields{"room": room, "peer": uid, "error": err})
+	}
+}
@@ -0,0 +1,497 @@
+// Package presence tracks which peers are connected to which instances of the
+// server, the nodes of a cluster. Nodes keep their entries in a shared key-value
+// store and renew their leases with heartbeats. When a node stops renewing its
+// lease, e.g. because it crashed, other nodes remove its entries and report its
+// peers as disconnected. Rooms are reported empty when the last peer connected
+// through any node leaves them.
+//
+// Leases are compared with clocks of the nodes, so they should be much longer
+// than the clock skew between nodes.
+package presence
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/kv"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+)
+
+const opsQueueSize = 1024
+
+// Options identify the node in the cluster. The node renews its lease every
+// Heartbeat and it expires after Lease. Keys in the store are prefixed with Prefix.
+type Options struct {
+	NodeID    string
+	URL       string
+	Heartbeat time.Duration
+	Lease     time.Duration
+	Prefix    string
+}
+
+// DefaultOptions returns options of a node with the given ID.
+func DefaultOptions(nodeID string) Options {
+	return Options{
+		NodeID:    nodeID,
+		Heartbeat: 2 * time.Second,
+		Lease:     10 * time.Second,
+		Prefix:    "tarpon:",
+	}
+}
+
+// Validate returns an error describing the first invalid option.
+func (o *Options) Validate() error {
+	switch {
+	case o.NodeID == "" || strings.Contains(o.NodeID, "/"):
+		return errors.New("node_id: must not be empty or contain /")
+	case o.Heartbeat <= 0 || o.Lease <= o.Heartbeat:
+		return errors.New("heartbeat: must be positive and less than lease")
+	}
+	return nil
+}
+
+// Node is an instance of the server in the cluster, which other nodes and clients
+// reach at the URL, if it's set. Ring identifies the nodes which the node routes
+// rooms between, so that nodes can tell whether they agree about owners of rooms.
+type Node struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url,omitempty"`
+	Ring      string    `json:"ring,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// op writes presence of a local peer as it's in the registry when it's applied
+type op struct {
+	room string
+	uid  string
+}
+
+// Registry publishes presence of peers connected to this node and reads presence
+// in the whole cluster. Changes of presence are written in the background and
+// never block callers: when more of them are queued than the queue holds, the
+// whole presence of the node is written again with the next heartbeat.
+type Registry struct {
+	kv       kv.Store
+	options  Options
+	local    map[string]map[string]bool
+	resync   bool
+	ring     string
+	mutex    sync.Mutex
+	ops      chan op
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	events   events.Sink
+	logger   logging.Logger
+}
+
+// NewRegistry creates the registry of the node, reporting peers of crashed nodes
+// as disconnected and rooms left by their last peers as empty to the sink.
+func NewRegistry(s kv.Store, o Options, e events.Sink, l logging.Logger) *Registry {
+	return &Registry{
+		kv:       s,
+		options:  o,
+		local:    make(map[string]map[string]bool),
+		ops:      make(chan op, opsQueueSize),
+		stopChan: make(chan struct{}),
+		events:   e,
+		logger:   l,
+	}
+}
+
+// Start joins the cluster and starts renewing the lease.
+func (r *Registry) Start() error {
+	if err := r.options.Validate(); err != nil {
+		return err
+	}
+	// entries left by a previous run of the node which crashed are stale
+	if _, err := r.sweep(r.options.NodeID, true); err != nil {
+		return err
+	}
+	if err := r.heartbeat(); err != nil {
+		return err
+	}
+	r.wg.Add(1)
+	go r.work()
+	r.logger.Info("joined cluster", logging.Fields{"node": r.options.NodeID, "lease": r.options.Lease})
+	return nil
+}
+
+// Stop writes queued changes and leaves the cluster, withdrawing presence of
+// peers which are still connected and reporting them as disconnected.
+func (r *Registry) Stop() {
+	close(r.stopChan)
+	r.wg.Wait()
+	if _, err := r.sweep(r.options.NodeID, true); err != nil {
+		r.logger.Error("failed to leave cluster", logging.Fields{"node": r.options.NodeID, "error": err})
+	}
+}
+
+// NodeID returns the ID of this node.
+func (r *Registry) NodeID() string {
+	return r.options.NodeID
+}
+
+// Connected publishes that the peer is connected to this node. When calls of
+// Connected and Disconnected of the same peer are concurrent, the last one wins.
+func (r *Registry) Connected(room string, uid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.local[room] == nil {
+		r.local[room] = make(map[string]bool)
+	}
+	r.local[room][uid] = true
+	r.enqueue(op{room: room, uid: uid})
+}
+
+// Disconnected withdraws presence of the peer on this node.
+func (r *Registry) Disconnected(room string, uid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.local[room], uid)
+	if len(r.local[room]) == 0 {
+		delete(r.local, room)
+	}
+	r.enqueue(op{room: room, uid: uid})
+}
+
+// enqueue doesn't wait for the queue, when it's full the change is written with
+// the whole presence of the node. It assumes the lock is held.
+func (r *Registry) enqueue(o op) {
+	select {
+	case r.ops <- o:
+	default:
+		r.resync = true
+	}
+}
+
+// Online returns UIDs of peers connected to the room through any live node, sorted.
+func (r *Registry) Online(room string) ([]string, error) {
+	return r.online(room, false)
+}
+
+// Remote returns UIDs of peers connected to the room through other live nodes, sorted.
+func (r *Registry) Remote(room string) ([]string, error) {
+	return r.online(room, true)
+}
+
+func (r *Registry) online(room string, remoteOnly bool) ([]string, error) {
+	entries, err := r.kv.HGetAll(r.presenceKey(room))
+	if err != nil {
+		return nil, err
+	}
+	live, err := r.liveNodes()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	online := make([]string, 0, len(entries))
+	for field := range entries {
+		node, uid := splitField(field)
+		if remoteOnly && node == r.options.NodeID {
+			continue
+		}
+		if _, ok := live[node]; ok && !seen[uid] {
+			seen[uid] = true
+			online = append(online, uid)
+		}
+	}
+	sort.Strings(online)
+	return online, nil
+}
+
+// Nodes returns live nodes of the cluster, ordered by ID.
+func (r *Registry) Nodes() ([]Node, error) {
+	live, err := r.liveNodes()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(live))
+	for _, n := range live {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// CheckHealth reports whether the store of the cluster's state is reachable.
+func (r *Registry) CheckHealth() error {
+	return r.kv.CheckHealth()
+}
+
+func (r *Registry) work() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.options.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case o := <-r.ops:
+			r.apply(o)
+		case <-ticker.C:
+			if err := r.heartbeat(); err != nil {
+				r.logger.Error("failed to renew lease", logging.Fields{"node": r.options.NodeID, "error": err})
+				continue
+			}
+			r.resyncIfDropped()
+			r.sweepExpired()
+		case <-r.stopChan:
+			for {
+				select {
+				case o := <-r.ops:
+					r.apply(o)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// apply writes presence of the peer. Failed writes are repaired when the lease
+// is renewed after it was lost.
+func (r *Registry) apply(o op) {
+	r.mutex.Lock()
+	connected := r.local[o.room][o.uid]
+	r.mutex.Unlock()
+
+	var err error
+	if connected {
+		if _, err = r.kv.SAdd(r.roomsKey(r.options.NodeID), o.room); err == nil {
+			_, err = r.kv.HSet(r.presenceKey(o.room), r.field(o.uid), "1")
+		}
+	} else {
+		var removed bool
+		if removed, err = r.kv.HDel(r.presenceKey(o.room), r.field(o.uid)); err == nil && removed {
+			r.notifyIfEmpty(o.room)
+		}
+	}
+	if err != nil {
+		r.logger.Error("failed to update presence", logging.Fields{"room": o.room, "peer": o.uid, "error": err})
+	}
+}
+
+// notifyIfEmpty reports the room as empty when no peer is connected to it through
+// any node. When the last peers leave through different nodes at once, both may
+// report it.
+func (r *Registry) notifyIfEmpty(room string) {
+	n, err := r.kv.HLen(r.presenceKey(room))
+	if err != nil {
+		r.logger.Error("failed to read presence", logging.Fields{"room": room, "error": err})
+		return
+	}
+	if n == 0 {
+		r.events.Notify(events.New(events.RoomEmpty, room, ""))
+	}
+}
+
+// PublishRing sets the ring which this node routes rooms with, which is published
+// with the next heartbeat.
+func (r *Registry) PublishRing(ring string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ring = ring
+}
+
+// heartbeat renews the lease. When the node lost it, e.g. because it couldn't
+// reach the store for longer than the lease, and other nodes removed its entries,
+// presence of its peers is published again.
+func (r *Registry) heartbeat() error {
+	_, existed, err := r.kv.HGet(r.nodesKey(), r.options.NodeID)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	ring := r.ring
+	r.mutex.Unlock()
+	n := Node{ID: r.options.NodeID, URL: r.options.URL, Ring: ring, ExpiresAt: time.Now().Add(r.options.Lease)}
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	if _, err := r.kv.HSet(r.nodesKey(), n.ID, string(data)); err != nil {
+		return err
+	}
+	if !existed {
+		r.republish()
+	}
+	return nil
+}
+
+func (r *Registry) republish() {
+	r.mutex.Lock()
+	var ops []op
+	for room, peers := range r.local {
+		for uid := range peers {
+			ops = append(ops, op{room: room, uid: uid})
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, o := range ops {
+		r.apply(o)
+	}
+}
+
+// resyncIfDropped writes the whole presence of the node, when changes were dropped
+// because the queue was full: entries of peers which aren't connected anymore are
+// removed and those of connected peers are published again.
+func (r *Registry) resyncIfDropped() {
+	r.mutex.Lock()
+	resync := r.resync
+	r.resync = false
+	r.mutex.Unlock()
+	if !resync {
+		return
+	}
+
+	rooms, err := r.kv.SMembers(r.roomsKey(r.options.NodeID))
+	if err != nil {
+		r.logger.Error("failed to read presence", logging.Fields{"node": r.options.NodeID, "error": err})
+		r.mutex.Lock()
+		r.resync = true
+		r.mutex.Unlock()
+		return
+	}
+	for _, room := range rooms {
+		entries, err := r.kv.HGetAll(r.presenceKey(room))
+		if err != nil {
+			r.logger.Error("failed to read presence", logging.Fields{"room": room, "error": err})
+			continue
+		}
+		for field := range entries {
+			if node, uid := splitField(field); node == r.options.NodeID {
+				r.apply(op{room: room, uid: uid})
+			}
+		}
+	}
+	r.republish()
+}
+
+// sweepExpired removes entries of nodes whose leases expired
+func (r *Registry) sweepExpired() {
+	nodes, err := r.allNodes()
+	if err != nil {
+		r.logger.Error("failed to read nodes", logging.Fields{"error": err})
+		return
+	}
+	now := time.Now()
+	for _, n := range nodes {
+		if n.ID == r.options.NodeID || n.ExpiresAt.After(now) {
+			continue
+		}
+		removed, err := r.sweep(n.ID, true)
+		if err != nil {
+			r.logger.Error("failed to remove expired node", logging.Fields{"node": n.ID, "error": err})
+			continue
+		}
+		r.logger.Warn("removed expired node", logging.Fields{"node": n.ID, "peers": removed})
+	}
+}
+
+// sweep removes the node with presence of its peers, which are reported as
+// disconnected by the node which removed them when notify is set. It returns the
+// number of removed peers.
+func (r *Registry) sweep(node string, notify bool) (int, error) {
+	rooms, err := r.kv.SMembers(r.roomsKey(node))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, room := range rooms {
+		entries, err := r.kv.HGetAll(r.presenceKey(room))
+		if err != nil {
+			return removed, err
+		}
+		removedInRoom := 0
+		for field := range entries {
+			n, uid := splitField(field)
+			if n != node {
+				continue
+			}
+			ok, err := r.kv.HDel(r.presenceKey(room), field)
+			if err != nil {
+				return removed, err
+			}
+			if !ok {
+				continue
+			}
+			removedInRoom++
+			if notify {
+				r.events.Notify(events.New(events.PeerDisconnected, room, uid))
+			}
+		}
+		removed += removedInRoom
+		if notify && removedInRoom > 0 {
+			r.notifyIfEmpty(room)
+		}
+	}
+	if err := r.kv.Del(r.roomsKey(node)); err != nil {
+		return removed, err
+	}
+	_, err = r.kv.HDel(r.nodesKey(), node)
+	return removed, err
+}
+
+func (r *Registry) allNodes() ([]Node, error) {
+	entries, err := r.kv.HGetAll(r.nodesKey())
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(entries))
+	for id, data := range entries {
+		var n Node
+		if err := json.Unmarshal([]byte(data), &n); err != nil {
+			r.logger.Warn("ignoring invalid node", logging.Fields{"node": id, "error": err})
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func (r *Registry) liveNodes() (map[string]Node, error) {
+	nodes, err := r.allNodes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	live := make(map[string]Node, len(nodes))
+	for _, n := range nodes {
+		if n.ExpiresAt.After(now) {
+			live[n.ID] = n
+		}
+	}
+	return live, nil
+}
+
+func (r *Registry) nodesKey() string {
+	return r.options.Prefix + "nodes"
+}
+
+func (r *Registry) roomsKey(node string) string {
+	return r.options.Prefix + "node:" + node + ":rooms"
+}
+
+func (r *Registry) presenceKey(room string) string {
+	return r.options.Prefix + "presence:" + room
+}
+
+// field is the key of the peer's presence on this node in the room's hash
+func (r *Registry) field(uid string) string {
+	return r.options.NodeID + "/" + uid
+}
+
+func splitField(field string) (node string, uid string) {
+	i := strings.Index(field, "/")
+	if i < 0 {
+		return "", field
+	}
+	return field[:i], field[i+1:]
+}
@@ -0,0 +1,350 @@
+package presence_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/kv"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/presence"
+)
+
+const myRoom = "room-123"
+
+// FlakyStore fails all operations while it's partitioned from the node
+type FlakyStore struct {
+	kv.Store
+	partitioned bool
+	mutex       sync.Mutex
+}
+
+var errPartitioned = errors.New("partitioned")
+
+func (s *FlakyStore) partition(p bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.partitioned = p
+}
+
+func (s *FlakyStore) err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.partitioned {
+		return errPartitioned
+	}
+	return nil
+}
+
+func (s *FlakyStore) SAdd(key string, member string) (bool, error) {
+	if err := s.err(); err != nil {
+		return false, err
+	}
+	return s.Store.SAdd(key, member)
+}
+
+func (s *FlakyStore) HSet(key string, field string, value string) (bool, error) {
+	if err := s.err(); err != nil {
+		return false, err
+	}
+	return s.Store.HSet(key, field, value)
+}
+
+func (s *FlakyStore) HGet(key string, field string) (string, bool, error) {
+	if err := s.err(); err != nil {
+		return "", false, err
+	}
+	return s.Store.HGet(key, field)
+}
+
+func (s *FlakyStore) HGetAll(key string) (map[string]string, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+	return s.Store.HGetAll(key)
+}
+
+type SpySink struct {
+	events []events.Event
+	mutex  sync.Mutex
+}
+
+func (s *SpySink) Notify(e events.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, e)
+}
+
+func (s *SpySink) notified() []events.Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]events.Event(nil), s.events...)
+}
+
+func startNode(t *testing.T, s kv.Store, id string, e events.Sink) *presence.Registry {
+	t.Helper()
+	o := presence.DefaultOptions(id)
+	o.Heartbeat = 20 * time.Millisecond
+	o.Lease = 100 * time.Millisecond
+	r := presence.NewRegistry(s, o, e, logging.NoopLogger{})
+	if err := r.Start(); err != nil {
+		t.Fatalf("could not start node %s: %v", id, err)
+	}
+	return r
+}
+
+func assertOnline(t *testing.T, r *presence.Registry, want []string) {
+	t.Helper()
+	got, err := r.Online(myRoom)
+	if err != nil {
+		t.Fatalf("could not read presence: %v", err)
+	}
+	if (len(got) != 0 || len(want) != 0) && !reflect.DeepEqual(got, want) {
+		t.Errorf("got peers %v online, want %v", got, want)
+	}
+}
+
+func TestOnlineAcrossNodes(t *testing.T) {
+	store := kv.NewMemoryStore()
+	a := startNode(t, store, "node-a", events.NoopSink{})
+	sink := &SpySink{}
+	b := startNode(t, store, "node-b", sink)
+	defer a.Stop()
+
+	a.Connected(myRoom, "peer-a")
+	b.Connected(myRoom, "peer-b")
+	b.Connected(myRoom, "peer-a")
+	time.Sleep(50 * time.Millisecond)
+
+	assertOnline(t, a, []string{"peer-a", "peer-b"})
+	if got, err := a.Remote(myRoom); err != nil || !reflect.DeepEqual(got, []string{"peer-a", "peer-b"}) {
+		t.Errorf("got peers %v and error %v connected elsewhere, want peers of node-b", got, err)
+	}
+	nodes, err := a.Nodes()
+	if err != nil || len(nodes) != 2 || nodes[0].ID != "node-a" || nodes[1].ID != "node-b" {
+		t.Errorf("got nodes %+v and error %v, want node-a and node-b", nodes, err)
+	}
+
+	b.PublishRing("ring-1")
+	b.Disconnected(myRoom, "peer-b")
+	time.Sleep(50 * time.Millisecond)
+	if nodes, _ := a.Nodes(); len(nodes) != 2 || nodes[1].Ring != "ring-1" {
+		t.Errorf("got nodes %+v, want node-b with its published ring", nodes)
+	}
+	assertOnline(t, a, []string{"peer-a"})
+
+	// peers still connected through the node are disconnected when it leaves
+	b.Stop()
+	assertOnline(t, a, []string{"peer-a"})
+	if nodes, _ := a.Nodes(); len(nodes) != 1 {
+		t.Errorf("got nodes %+v, want node-b to leave", nodes)
+	}
+	got := sink.notified()
+	if len(got) != 1 || got[0].Type != events.PeerDisconnected || got[0].Room != myRoom || got[0].Peer != "peer-a" {
+		t.Errorf("got events %+v, want peer-a disconnected", got)
+	}
+}
+
+func TestCrashedNodeDisconnectsPeers(t *testing.T) {
+	store := kv.NewMemoryStore()
+	sink := &SpySink{}
+	a := startNode(t, store, "node-a", sink)
+	defer a.Stop()
+	flaky := &FlakyStore{Store: store}
+	b := startNode(t, flaky, "node-b", events.NoopSink{})
+	defer b.Stop()
+
+	b.Connected(myRoom, "peer-b")
+	time.Sleep(50 * time.Millisecond)
+	assertOnline(t, a, []string{"peer-b"})
+
+	flaky.partition(true)
+	time.Sleep(200 * time.Millisecond)
+	assertOnline(t, a, nil)
+	got := sink.notified()
+	if len(got) != 2 || got[0].Type != events.PeerDisconnected || got[0].Room != myRoom || got[0].Peer != "peer-b" || got[1].Type != events.RoomEmpty {
+		t.Errorf("got events %+v, want peer-b disconnected and the room empty", got)
+	}
+
+	// the node publishes its peers again when it can renew its lease
+	flaky.partition(false)
+	time.Sleep(50 * time.Millisecond)
+	assertOnline(t, a, []string{"peer-b"})
+}
+
+func TestRoomEmptyAcrossNodes(t *testing.T) {
+	store := kv.NewMemoryStore()
+	sink := &SpySink{}
+	a := startNode(t, store, "node-a", sink)
+	defer a.Stop()
+	b := startNode(t, store, "node-b", sink)
+	defer b.Stop()
+
+	a.Connected(myRoom, "peer-a")
+	b.Connected(myRoom, "peer-b")
+	time.Sleep(50 * time.Millisecond)
+	a.Disconnected(myRoom, "peer-a")
+	time.Sleep(50 * time.Millisecond)
+	if got := sink.notified(); len(got) != 0 {
+		t.Errorf("got events %+v while peer-b is connected through node-b", got)
+	}
+
+	b.Disconnected(myRoom, "peer-b")
+	time.Sleep(50 * time.Millisecond)
+	got := sink.notified()
+	if len(got) != 1 || got[0].Type != events.RoomEmpty || got[0].Room != myRoom {
+		t.Errorf("got events %+v, want the room empty", got)
+	}
+}
+
+// SpyBroker records messages and subscribers
+type SpyBroker struct {
+	messages    []messaging.Message
+	subscribers []broker.Subscriber
+	mutex       sync.Mutex
+}
+
+func (b *SpyBroker) Send(room string, m messaging.Message) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.messages = append(b.messages, m)
+	return nil
+}
+
+func (b *SpyBroker) Register(room string, s broker.Subscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers = append(b.subscribers, s)
+}
+
+func (b *SpyBroker) Unregister(room string, s broker.Subscriber) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, sub := range b.subscribers {
+		if sub == s {
+			b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *SpyBroker) controlMessages() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var got []string
+	for _, m := range b.messages {
+		got = append(got, string(m.Payload))
+	}
+	return got
+}
+
+type StubSubscriber struct {
+	id string
+}
+
+func (s *StubSubscriber) Write(m messaging.Message) {}
+func (s *StubSubscriber) ID() string                { return s.id }
+
+func TestBrokerPublishesPresence(t *testing.T) {
+	store := kv.NewMemoryStore()
+	a := startNode(t, store, "node-a", events.NoopSink{})
+	defer a.Stop()
+	b := startNode(t, store, "node-b", events.NoopSink{})
+	defer b.Stop()
+	br := presence.NewBroker(&SpyBroker{}, a, logging.NoopLogger{})
+
+	first, second := &StubSubscriber{id: "peer-a"}, &StubSubscriber{id: "peer-a"}
+	br.Register(myRoom, first)
+	br.Register(myRoom, second)
+	time.Sleep(50 * time.Millisecond)
+	assertOnline(t, b, []string{"peer-a"})
+
+	// the peer stays online until its last session leaves
+	if !br.Unregister(myRoom, first) || br.Unregister(myRoom, first) {
+		t.Errorf("subscriber not unregistered exactly once")
+	}
+	time.Sleep(50 * time.Millisecond)
+	assertOnline(t, b, []string{"peer-a"})
+	br.Unregister(myRoom, second)
+	time.Sleep(50 * time.Millisecond)
+	assertOnline(t, b, nil)
+}
+
+func TestBrokerAnnouncesPeersOfOtherNodes(t *testing.T) {
+	store := kv.NewMemoryStore()
+	a := startNode(t, store, "node-a", events.NoopSink{})
+	defer a.Stop()
+	b := startNode(t, store, "node-b", events.NoopSink{})
+	defer b.Stop()
+	flaky := &FlakyStore{Store: store}
+	c := startNode(t, flaky, "node-c", events.NoopSink{})
+	defer c.Stop()
+	spy := &SpyBroker{}
+	br := presence.NewBroker(spy, a, logging.NoopLogger{})
+	br.Start()
+	defer br.Stop()
+
+	local := &StubSubscriber{id: "peer-a"}
+	br.Register(myRoom, local)
+	time.Sleep(50 * time.Millisecond)
+
+	b.Connected(myRoom, "peer-b")
+	time.Sleep(50 * time.Millisecond)
+	b.Disconnected(myRoom, "peer-b")
+	// peers connected to both nodes are announced by this node only
+	b.Connected(myRoom, "peer-a")
+	time.Sleep(50 * time.Millisecond)
+
+	// peers of crashed nodes are announced when their leases expire
+	c.Connected(myRoom, "peer-c")
+	time.Sleep(50 * time.Millisecond)
+	flaky.partition(true)
+	time.Sleep(200 * time.Millisecond)
+
+	payload := func(msgFactory func(string) (*messaging.Message, error), uid string) string {
+		m, _ := msgFactory(uid)
+		return string(m.Payload)
+	}
+	want := []string{
+		payload(messaging.NewPeerConnected, "peer-b"),
+		payload(messaging.NewPeerDisconnected, "peer-b"),
+		payload(messaging.NewPeerConnected, "peer-c"),
+		payload(messaging.NewPeerDisconnected, "peer-c"),
+	}
+	if got := spy.controlMessages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+}
+
+func TestRegistryDoesNotBlockWhenQueueIsFull(t *testing.T) {
+	o := presence.DefaultOptions("node-a")
+	o.Heartbeat = 20 * time.Millisecond
+	o.Lease = 100 * time.Millisecond
+	r := presence.NewRegistry(kv.NewMemoryStore(), o, events.NoopSink{}, logging.NoopLogger{})
+
+	// changes aren't written before the registry starts, so they fill the queue
+	var want []string
+	for i := 0; i < 1100; i++ {
+		uid := fmt.Sprintf("peer-%04d", i)
+		r.Connected(myRoom, uid)
+		if i%2 == 0 {
+			r.Disconnected(myRoom, uid)
+		} else {
+			want = append(want, uid)
+		}
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("could not start node: %v", err)
+	}
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	assertOnline(t, r, want)
+}
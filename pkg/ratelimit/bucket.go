@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket rate limiter. It holds up to burst tokens and is
+// refilled with rate tokens per second. Bucket is safe for concurrent use.
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// Allow takes a single token from the bucket and reports whether it was available.
+func (b *Bucket) Allow() bool {
+	return b.AllowAt(time.Now())
+}
+
+// AllowAt is like Allow, but uses t as the current time.
+func (b *Bucket) AllowAt(t time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.last.IsZero() && t.After(b.last) {
+		b.tokens += t.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	if t.After(b.last) {
+		b.last = t
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,51 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/ratelimit"
+)
+
+func TestBucketAllowsBurst(t *testing.T) {
+	b := ratelimit.NewBucket(1, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !b.AllowAt(now) {
+			t.Fatalf("request %d rejected, but should fit in the burst", i)
+		}
+	}
+	if b.AllowAt(now) {
+		t.Errorf("request allowed, but the bucket should be empty")
+	}
+}
+
+func TestBucketRefills(t *testing.T) {
+	b := ratelimit.NewBucket(2, 2)
+	now := time.Now()
+
+	b.AllowAt(now)
+	b.AllowAt(now)
+	if b.AllowAt(now) {
+		t.Fatalf("request allowed, but the bucket should be empty")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !b.AllowAt(now) {
+		t.Errorf("request rejected, but one token should be refilled")
+	}
+	if b.AllowAt(now) {
+		t.Errorf("request allowed, but only one token should be refilled")
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.AllowAt(now) {
+			t.Errorf("request %d rejected, but the bucket should be full", i)
+		}
+	}
+	if b.AllowAt(now) {
+		t.Errorf("request allowed, but refill should be capped at burst")
+	}
+}
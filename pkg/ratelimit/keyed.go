@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Buckets holds a token bucket per key, e.g. per IP address. Buckets idle long
+// enough to be full again are forgotten. Keys are not limited when the rate is
+// not positive. Buckets is safe for concurrent use.
+type Buckets struct {
+	rate      float64
+	burst     int
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+func NewBuckets(rate float64, burst int) *Buckets {
+	return &Buckets{rate: rate, burst: burst, buckets: make(map[string]*Bucket)}
+}
+
+// SetLimit changes the rate and burst of all keys. Buckets of keys are refilled
+// when the limit changes, otherwise they are kept.
+func (b *Buckets) SetLimit(rate float64, burst int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if rate == b.rate && burst == b.burst {
+		return
+	}
+	b.rate = rate
+	b.burst = burst
+	b.buckets = make(map[string]*Bucket)
+}
+
+// Allow takes a single token from the key's bucket and reports whether it was available.
+func (b *Buckets) Allow(key string) bool {
+	return b.AllowAt(key, time.Now())
+}
+
+// AllowAt is like Allow, but uses t as the current time.
+func (b *Buckets) AllowAt(key string, t time.Time) bool {
+	b.mutex.Lock()
+	if b.rate <= 0 {
+		b.mutex.Unlock()
+		return true
+	}
+	b.sweep(t)
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = NewBucket(b.rate, b.burst)
+		b.buckets[key] = bucket
+	}
+	b.mutex.Unlock()
+
+	return bucket.AllowAt(t)
+}
+
+// sweep forgets full buckets at most once per refill time and assumes the lock is held
+func (b *Buckets) sweep(t time.Time) {
+	refill := time.Duration(float64(b.burst) / b.rate * float64(time.Second))
+	if t.Sub(b.lastSweep) < refill {
+		return
+	}
+	b.lastSweep = t
+	for key, bucket := range b.buckets {
+		bucket.mutex.Lock()
+		idle := t.Sub(bucket.last) >= refill
+		bucket.mutex.Unlock()
+		if idle {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+// ConcurrencyLimit limits the number of concurrent uses of every key, e.g. the
+// number of connections per IP address. Keys are not limited when max is not
+// positive. ConcurrencyLimit is safe for concurrent use.
+type ConcurrencyLimit struct {
+	max    int
+	counts map[string]int
+	mutex  sync.Mutex
+}
+
+func NewConcurrencyLimit(max int) *ConcurrencyLimit {
+	return &ConcurrencyLimit{max: max, counts: make(map[string]int)}
+}
+
+// Acquire reports whether the key may be used once more. Every successful Acquire
+// must be followed by Release.
+func (c *ConcurrencyLimit) Acquire(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.max > 0 && c.counts[key] >= c.max {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+// SetMax changes the limit of all keys. Keys used more times than the new limit
+// can't be acquired until they are released below it.
+func (c *ConcurrencyLimit) SetMax(max int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.max = max
+}
+
+func (c *ConcurrencyLimit) Release(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+		return
+	}
+	c.counts[key]--
+}
@@ -0,0 +1,73 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/ratelimit"
+)
+
+func TestBucketsLimitKeysSeparately(t *testing.T) {
+	b := ratelimit.NewBuckets(1, 2)
+	now := time.Now()
+
+	b.AllowAt("a", now)
+	b.AllowAt("a", now)
+	if b.AllowAt("a", now) {
+		t.Errorf("request allowed, but the bucket of a should be empty")
+	}
+	if !b.AllowAt("b", now) {
+		t.Errorf("request rejected, but the bucket of b should be full")
+	}
+	if !b.AllowAt("a", now.Add(time.Hour)) {
+		t.Errorf("request rejected, but the bucket of a should be refilled")
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	c := ratelimit.NewConcurrencyLimit(2)
+
+	if !c.Acquire("a") || !c.Acquire("a") {
+		t.Fatalf("acquire failed below the limit")
+	}
+	if c.Acquire("a") {
+		t.Errorf("acquired a above the limit")
+	}
+	if !c.Acquire("b") {
+		t.Errorf("acquire of b failed, but it's limited separately")
+	}
+	c.Release("a")
+	if !c.Acquire("a") {
+		t.Errorf("acquire failed after release")
+	}
+}
+
+func TestChangingLimits(t *testing.T) {
+	b := ratelimit.NewBuckets(0, 0)
+	c := ratelimit.NewConcurrencyLimit(0)
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		if !b.AllowAt("a", now) || !c.Acquire("a") {
+			t.Fatalf("request %d rejected, but keys are not limited", i)
+		}
+	}
+
+	b.SetLimit(1, 1)
+	c.SetMax(10)
+	if !b.AllowAt("a", now) || b.AllowAt("a", now) {
+		t.Errorf("got wrong limit of requests after changing it")
+	}
+	// e.g. reloading the config with other settings changed
+	b.SetLimit(1, 1)
+	if b.AllowAt("a", now) {
+		t.Errorf("bucket refilled, but the limit didn't change")
+	}
+	if c.Acquire("a") {
+		t.Errorf("acquired a above the new limit")
+	}
+	c.Release("a")
+	if !c.Acquire("a") {
+		t.Errorf("acquire failed below the new limit")
+	}
+}
@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	lockoutFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tarpon_lockout_failures_total",
+		Help: "Number of failed attempts counted by lockouts.",
+	}, []string{"lockout"})
+	lockoutLocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tarpon_lockout_locks_total",
+		Help: "Number of times a key was locked out after too many failed attempts.",
+	}, []string{"lockout"})
+	lockoutRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tarpon_lockout_rejections_total",
+		Help: "Number of attempts rejected because their key was locked out.",
+	}, []string{"lockout"})
+)
+
+// Lockout counts failed attempts per key, e.g. per IP address, and locks the key
+// out once they reach the threshold. Every next failure doubles the lockout,
+// starting from backoff, up to max. Failures are forgotten after window passes
+// without any. Clients may be exempted from the lockout of a key, e.g. IP addresses
+// which joined a room are exempted from the room's lockout, for a window since they
+// were exempted. Lockout is safe for concurrent use.
+type Lockout struct {
+	name      string
+	threshold int
+	backoff   time.Duration
+	max       time.Duration
+	window    time.Duration
+	entries   map[string]*lockoutEntry
+	exempted  map[string]time.Time
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+type lockoutEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// NewLockout creates a lockout reporting metrics labeled with the name.
+func NewLockout(name string, threshold int, backoff time.Duration, max time.Duration, window time.Duration) *Lockout {
+	return &Lockout{
+		name:      name,
+		threshold: threshold,
+		backoff:   backoff,
+		max:       max,
+		window:    window,
+		entries:   make(map[string]*lockoutEntry),
+		exempted:  make(map[string]time.Time),
+	}
+}
+
+// Exempt exempts the client from the lockout of the key.
+func (l *Lockout) Exempt(key string, client string) {
+	l.ExemptAt(key, client, time.Now())
+}
+
+// ExemptAt is like Exempt, but uses t as the current time.
+func (l *Lockout) ExemptAt(key string, client string, t time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.sweep(t)
+	l.exempted[exemptionKey(key, client)] = t
+}
+
+// Exempted reports whether the client is exempted from the lockout of the key.
+func (l *Lockout) Exempted(key string, client string) bool {
+	return l.ExemptedAt(key, client, time.Now())
+}
+
+// ExemptedAt is like Exempted, but uses t as the current time.
+func (l *Lockout) ExemptedAt(key string, client string, t time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	since, ok := l.exempted[exemptionKey(key, client)]
+	return ok && t.Sub(since) <= l.window
+}
+
+func exemptionKey(key string, client string) string {
+	return key + "\x00" + client
+}
+
+// RetryAfter returns how long the key is locked out for, or 0 when it's not.
+func (l *Lockout) RetryAfter(key string) time.Duration {
+	return l.RetryAfterAt(key, time.Now())
+}
+
+// RetryAfterAt is like RetryAfter, but uses t as the current time.
+func (l *Lockout) RetryAfterAt(key string, t time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e := l.entries[key]
+	if e == nil || !t.Before(e.until) {
+		return 0
+	}
+	lockoutRejections.WithLabelValues(l.name).Inc()
+	return e.until.Sub(t)
+}
+
+// Fail counts a failed attempt of the key. It returns how long the key is locked
+// out for because of it, or 0 when the threshold is not reached yet.
+func (l *Lockout) Fail(key string) time.Duration {
+	return l.FailAt(key, time.Now())
+}
+
+// FailAt is like Fail, but uses t as the current time.
+func (l *Lockout) FailAt(key string, t time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.sweep(t)
+	e := l.entries[key]
+	if e == nil || l.expired(e, t) {
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.last = t
+	lockoutFailures.WithLabelValues(l.name).Inc()
+
+	if e.failures < l.threshold {
+		return 0
+	}
+	d := l.backoff
+	for i := l.threshold; i < e.failures && d < l.max; i++ {
+		d *= 2
+	}
+	if d > l.max {
+		d = l.max
+	}
+	e.until = t.Add(d)
+	lockoutLocks.WithLabelValues(l.name).Inc()
+	return d
+}
+
+// expired assumes the lock is held
+func (l *Lockout) expired(e *lockoutEntry, t time.Time) bool {
+	return t.Sub(e.last) > l.window && !t.Before(e.until)
+}
+
+// sweep forgets expired entries at most once per window and assumes the lock is held
+func (l *Lockout) sweep(t time.Time) {
+	if t.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = t
+	for key, e := range l.entries {
+		if l.expired(e, t) {
+			delete(l.entries, key)
+		}
+	}
+	for key, since := range l.exempted {
+		if t.Sub(since) > l.window {
+			delete(l.exempted, key)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/ratelimit"
+)
+
+func TestLockoutAfterThreshold(t *testing.T) {
+	l := ratelimit.NewLockout("test", 3, time.Second, 10*time.Second, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if d := l.FailAt("key", now); d != 0 {
+			t.Fatalf("failure %d locked out for %v, but threshold is not reached", i, d)
+		}
+	}
+	if d := l.RetryAfterAt("key", now); d != 0 {
+		t.Fatalf("key locked out for %v before reaching threshold", d)
+	}
+
+	if d := l.FailAt("key", now); d != time.Second {
+		t.Errorf("got lockout %v, want 1s", d)
+	}
+	if d := l.RetryAfterAt("key", now.Add(500*time.Millisecond)); d != 500*time.Millisecond {
+		t.Errorf("got retry after %v, want 500ms", d)
+	}
+	if d := l.RetryAfterAt("key", now.Add(time.Second)); d != 0 {
+		t.Errorf("got retry after %v, but lockout is over", d)
+	}
+	if d := l.RetryAfterAt("another-key", now); d != 0 {
+		t.Errorf("another key locked out for %v", d)
+	}
+}
+
+func TestLockoutBacksOffExponentially(t *testing.T) {
+	l := ratelimit.NewLockout("test", 1, time.Second, 10*time.Second, time.Minute)
+	now := time.Now()
+
+	for _, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if d := l.FailAt("key", now); d != want*time.Second {
+			t.Errorf("got lockout %v, want %v", d, want*time.Second)
+		}
+	}
+}
+
+func TestLockoutExemptsClients(t *testing.T) {
+	l := ratelimit.NewLockout("test", 1, time.Second, 10*time.Second, time.Minute)
+	now := time.Now()
+
+	l.ExemptAt("key", "client", now)
+	if !l.ExemptedAt("key", "client", now.Add(time.Second)) {
+		t.Errorf("client not exempted")
+	}
+	if l.ExemptedAt("key", "another-client", now) || l.ExemptedAt("another-key", "client", now) {
+		t.Errorf("exempted another client or key")
+	}
+	if l.ExemptedAt("key", "client", now.Add(2*time.Minute)) {
+		t.Errorf("client still exempted after the window")
+	}
+}
+
+func TestLockoutForgetsOldFailures(t *testing.T) {
+	l := ratelimit.NewLockout("test", 2, time.Second, 10*time.Second, time.Minute)
+	now := time.Now()
+
+	l.FailAt("key", now)
+	if d := l.FailAt("key", now.Add(2*time.Minute)); d != 0 {
+		t.Errorf("got lockout %v, but the first failure should be forgotten", d)
+	}
+}
@@ -0,0 +1,61 @@
+// Package ring assigns rooms to nodes of a cluster with consistent hashing, so that
+// peers of a room can be sent to the same instance of the server. When a node joins
+// or leaves the cluster, only rooms it owns or takes over move between nodes.
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// replicas is the number of points of every node on the ring, which spread rooms
+// evenly between nodes
+const replicas = 128
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring maps keys to nodes. It's immutable, a new ring is created when nodes change.
+type Ring struct {
+	points []point
+}
+
+// New creates a ring of the nodes. Keys are mapped to the same nodes regardless of
+// their order.
+func New(nodes []string) *Ring {
+	points := make([]point, 0, len(nodes)*replicas)
+	for _, n := range nodes {
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{hash: hash(n + "#" + strconv.Itoa(i)), node: n})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].node < points[j].node
+		}
+		return points[i].hash < points[j].hash
+	})
+	return &Ring{points: points}
+}
+
+// Owner returns the node owning the key, or an empty string when the ring has no nodes.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,212 @@
+package ring_test
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/presence"
+	"github.com/montrosesoftware/tarpon/pkg/ring"
+)
+
+const keysCount = 3000
+
+func TestRingSpreadsKeysEvenly(t *testing.T) {
+	r := ring.New([]string{"node-a", "node-b", "node-c"})
+	owned := make(map[string]int)
+	for i := 0; i < keysCount; i++ {
+		owned[r.Owner("room-"+strconv.Itoa(i))]++
+	}
+
+	if len(owned) != 3 {
+		t.Fatalf("got owners %v, want 3 nodes", owned)
+	}
+	for node, n := range owned {
+		if n < keysCount/5 || n > keysCount/2 {
+			t.Errorf("node %s owns %d of %d keys", node, n, keysCount)
+		}
+	}
+	if owner := ring.New(nil).Owner("room-1"); owner != "" {
+		t.Errorf("got owner %q of empty ring", owner)
+	}
+}
+
+func TestRingMovesKeysOfChangedNodesOnly(t *testing.T) {
+	before := ring.New([]string{"node-a", "node-b", "node-c"})
+	after := ring.New([]string{"node-d", "node-c", "node-b", "node-a"})
+	reordered := ring.New([]string{"node-c", "node-a", "node-b"})
+
+	moved := 0
+	for i := 0; i < keysCount; i++ {
+		key := "room-" + strconv.Itoa(i)
+		if before.Owner(key) != reordered.Owner(key) {
+			t.Fatalf("key %s moved when nodes were reordered", key)
+		}
+		if owner := after.Owner(key); owner != before.Owner(key) {
+			moved++
+			if owner != "node-d" {
+				t.Fatalf("key %s moved from %s to %s, want node-d", key, before.Owner(key), owner)
+			}
+		}
+	}
+	if moved < keysCount/8 || moved > keysCount/2 {
+		t.Errorf("%d of %d keys moved to the new node", moved, keysCount)
+	}
+}
+
+// StubMembers returns nodes which can be changed, or an error
+type StubMembers struct {
+	nodes []presence.Node
+	err   error
+	mutex sync.Mutex
+}
+
+func (m *StubMembers) Nodes() ([]presence.Node, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.nodes, m.err
+}
+
+func (m *StubMembers) set(nodes []presence.Node, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nodes = nodes
+	m.err = err
+}
+
+// roomOf finds a room which the ring of nodes assigns to the node
+func roomOf(t *testing.T, nodes []string, node string) string {
+	t.Helper()
+	r := ring.New(nodes)
+	for i := 0; i < keysCount; i++ {
+		if room := "room-" + strconv.Itoa(i); r.Owner(room) == node {
+			return room
+		}
+	}
+	t.Fatalf("no room of node %s", node)
+	return ""
+}
+
+func TestRouter(t *testing.T) {
+	a := presence.Node{ID: "node-a", URL: "http://a.example.com"}
+	b := presence.Node{ID: "node-b", URL: "http://b.example.com"}
+	members := &StubMembers{nodes: []presence.Node{a, b, {ID: "node-c"}}}
+	router := ring.NewRouter(members, "node-a", 10*time.Millisecond, logging.NoopLogger{})
+	if err := router.Start(); err != nil {
+		t.Fatalf("could not start router: %v", err)
+	}
+	defer router.Stop()
+
+	// node-c has no URL, so it owns no rooms
+	roomOfB := roomOf(t, []string{"node-a", "node-b"}, "node-b")
+	if node, local := router.Route(roomOfB); local || node != b {
+		t.Errorf("got node %+v and local %v, want node-b", node, local)
+	}
+	roomOfA := roomOf(t, []string{"node-a", "node-b"}, "node-a")
+	if node, local := router.Route(roomOfA); !local || node != a {
+		t.Errorf("got node %+v and local %v, want this node", node, local)
+	}
+
+	// the last ring is kept while members can't be read
+	members.set(nil, errors.New("unreachable"))
+	time.Sleep(30 * time.Millisecond)
+	if _, local := router.Route(roomOfB); local {
+		t.Errorf("room of node-b routed locally after failing to read members")
+	}
+
+	members.set([]presence.Node{a}, nil)
+	time.Sleep(30 * time.Millisecond)
+	if node, local := router.Route(roomOfB); !local || node != a {
+		t.Errorf("got node %+v and local %v after node-b left, want this node", node, local)
+	}
+}
+
+func TestStaticRouter(t *testing.T) {
+	urls := []string{"http://a.example.com", "http://b.example.com"}
+	router := ring.NewRouter(ring.StaticMembers(urls), urls[1], time.Minute, logging.NoopLogger{})
+	if err := router.Start(); err != nil {
+		t.Fatalf("could not start router: %v", err)
+	}
+	defer router.Stop()
+
+	room := roomOf(t, urls, urls[0])
+	if node, local := router.Route(room); local || node.URL != urls[0] {
+		t.Errorf("got node %+v and local %v, want %s", node, local, urls[0])
+	}
+}
+
+// PublishingMembers keep the ring published by the router
+type PublishingMembers struct {
+	StubMembers
+	ring string
+}
+
+func (m *PublishingMembers) PublishRing(ring string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ring = ring
+}
+
+func (m *PublishingMembers) published() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.ring
+}
+
+func TestRouterTracksAgreementAboutRing(t *testing.T) {
+	a := presence.Node{ID: "node-a", URL: "http://a.example.com"}
+	b := presence.Node{ID: "node-b", URL: "http://b.example.com", Ring: "old"}
+	members := &PublishingMembers{StubMembers: StubMembers{nodes: []presence.Node{a, b}}}
+	router := ring.NewRouter(members, "node-a", 10*time.Millisecond, logging.NoopLogger{})
+	if err := router.Start(); err != nil {
+		t.Fatalf("could not start router: %v", err)
+	}
+	defer router.Stop()
+
+	if router.Agreed() {
+		t.Errorf("router agreed with a node publishing another ring")
+	}
+	ring := members.published()
+	if ring == "" {
+		t.Fatalf("router published no ring")
+	}
+
+	b.Ring = ring
+	members.set([]presence.Node{a, b}, nil)
+	time.Sleep(30 * time.Millisecond)
+	if !router.Agreed() {
+		t.Errorf("router disagreed with a node publishing the same ring")
+	}
+
+	// a new node changes the ring, which the others didn't publish yet
+	members.set([]presence.Node{a, b, {ID: "node-c", URL: "http://c.example.com", Ring: ring}}, nil)
+	time.Sleep(30 * time.Millisecond)
+	if router.Agreed() {
+		t.Errorf("router agreed with nodes publishing the ring without the new node")
+	}
+	if members.published() == ring {
+		t.Errorf("router published the same ring after the new node joined")
+	}
+}
+
+func TestRouterFailsToStartWithoutMembers(t *testing.T) {
+	members := &StubMembers{err: errors.New("unreachable")}
+	if err := ring.NewRouter(members, "node-a", time.Minute, logging.NoopLogger{}).Start(); err == nil {
+		t.Errorf("router started without reading members")
+	}
+}
+
+func BenchmarkRingOwner(b *testing.B) {
+	nodes := make([]string, 16)
+	for i := range nodes {
+		nodes[i] = "node-" + strconv.Itoa(i)
+	}
+	r := ring.New(nodes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Owner("room-" + strconv.Itoa(i))
+	}
+}
@@ -0,0 +1,186 @@
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/presence"
+)
+
+// Members lists nodes of the cluster, e.g. the presence registry lists live nodes.
+type Members interface {
+	Nodes() ([]presence.Node, error)
+}
+
+// RingPublisher is implemented by members which tell other nodes which ring this
+// node routes rooms with, e.g. the presence registry publishes it with the node.
+type RingPublisher interface {
+	PublishRing(ring string)
+}
+
+// StaticMembers are nodes given by their URLs, which are also their IDs.
+type StaticMembers []string
+
+func (m StaticMembers) Nodes() ([]presence.Node, error) {
+	nodes := make([]presence.Node, 0, len(m))
+	for _, u := range m {
+		nodes = append(nodes, presence.Node{ID: u, URL: u})
+	}
+	return nodes, nil
+}
+
+// Router assigns rooms to nodes on a ring of the members, which is rebuilt when
+// they change. Members without URLs can't be reached by clients and don't own rooms.
+//
+// When members publish their rings, the router also tracks whether all of them
+// route rooms with the same ring. Static members are listed the same by every
+// node, so they always agree.
+type Router struct {
+	members  Members
+	self     string
+	refresh  time.Duration
+	ring     *Ring
+	nodes    map[string]presence.Node
+	agreed   bool
+	mutex    sync.RWMutex
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	logger   logging.Logger
+}
+
+// NewRouter creates the router of the node with the ID self, which reads members
+// every refresh period.
+func NewRouter(m Members, self string, refresh time.Duration, l logging.Logger) *Router {
+	return &Router{
+		members:  m,
+		self:     self,
+		refresh:  refresh,
+		ring:     New(nil),
+		agreed:   true,
+		stopChan: make(chan struct{}),
+		logger:   l,
+	}
+}
+
+// Start reads members and starts following their changes.
+func (r *Router) Start() error {
+	if err := r.update(); err != nil {
+		return err
+	}
+	r.wg.Add(1)
+	go r.work()
+	return nil
+}
+
+// Stop stops following changes of members.
+func (r *Router) Stop() {
+	close(r.stopChan)
+	r.wg.Wait()
+}
+
+// Route returns the node owning the room and whether it's this node. Rooms are
+// local when the ring is empty, e.g. before this node joined the cluster.
+func (r *Router) Route(room string) (presence.Node, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	owner := r.ring.Owner(room)
+	if owner == "" || owner == r.self {
+		return r.nodes[r.self], true
+	}
+	return r.nodes[owner], false
+}
+
+// Agreed reports whether other nodes routed rooms with the same ring as this node
+// when members were last read.
+func (r *Router) Agreed() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.agreed
+}
+
+func (r *Router) work() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.update(); err != nil {
+				r.logger.Error("failed to read cluster nodes", logging.Fields{"error": err})
+			}
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// update rebuilds the ring when members changed and checks whether they agree
+// about it
+func (r *Router) update() error {
+	members, err := r.members.Nodes()
+	if err != nil {
+		return err
+	}
+	nodes := make(map[string]presence.Node, len(members))
+	ids := make([]string, 0, len(members))
+	for _, n := range members {
+		if n.URL == "" {
+			continue
+		}
+		nodes[n.ID] = n
+		ids = append(ids, n.ID)
+	}
+	sort.Strings(ids)
+
+	agreed := true
+	if p, ok := r.members.(RingPublisher); ok {
+		id := ringID(ids, nodes)
+		p.PublishRing(id)
+		// this node's own entry shows the ring published with its last heartbeat
+		for _, n := range nodes {
+			agreed = agreed && (n.ID == r.self || n.Ring == id)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if agreed != r.agreed {
+		r.logger.Info("cluster ring agreement changed", logging.Fields{"agreed": agreed})
+		r.agreed = agreed
+	}
+	if sameNodes(r.nodes, nodes) {
+		return nil
+	}
+	r.ring = New(ids)
+	r.nodes = nodes
+	r.logger.Info("cluster ring changed", logging.Fields{"nodes": strings.Join(ids, ",")})
+	return nil
+}
+
+// ringID identifies the ring of the nodes by a hash of their IDs and URLs
+func ringID(ids []string, nodes map[string]presence.Node) string {
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write([]byte(id + "=" + nodes[id].URL + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// sameNodes compares IDs and URLs of nodes, ignoring their leases
+func sameNodes(a map[string]presence.Node, b map[string]presence.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, n := range a {
+		if m, ok := b[id]; !ok || m.URL != n.URL {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+)
+
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Statuses reported by health endpoints.
+const (
+	StatusOK       = "ok"
+	StatusReady    = "ready"
+	StatusNotReady = "not_ready"
+	StatusDraining = "draining"
+)
+
+// HealthChecker reports whether a backend the server depends on, e.g. the room
+// store or the broker's backplane, is reachable.
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// BuildInfo identifies the running build.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// HealthRes is the response of health endpoints. Checks maps names of checked
+// backends to "ok" or the error they reported.
+type HealthRes struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+	Build  BuildInfo         `json:"build"`
+}
+
+var errAlreadyShutdown = errors.New("server is already shutting down")
+
+type healthCheck struct {
+	name    string
+	checker HealthChecker
+}
+
+// SetBuildInfo sets the build reported by health endpoints.
+func (s *RoomServer) SetBuildInfo(b BuildInfo) {
+	s.build = b
+}
+
+// AddHealthCheck makes the server not ready when the checker reports an error.
+func (s *RoomServer) AddHealthCheck(name string, c HealthChecker) {
+	s.healthChecks = append(s.healthChecks, healthCheck{name: name, checker: c})
+}
+
+// Healthz reports the server is alive. It doesn't check backends, so that the
+// server isn't restarted when they are down.
+func (s *RoomServer) Healthz(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, http.StatusOK, HealthRes{Status: StatusOK, Build: s.build})
+}
+
+// Readyz reports whether the server can serve peers. It's not ready while backends
+// are failing or during shutdown, so that load balancers stop routing to it.
+func (s *RoomServer) Readyz(w http.ResponseWriter, r *http.Request) {
+	res := HealthRes{Status: StatusReady, Checks: make(map[string]string), Build: s.build}
+	for _, c := range s.healthChecks {
+		if err := c.checker.CheckHealth(); err != nil {
+			s.logger.Warn("health check failed", logging.Fields{"check": c.name, "error": err})
+			res.Checks[c.name] = err.Error()
+			res.Status = StatusNotReady
+		} else {
+			res.Checks[c.name] = StatusOK
+		}
+	}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		res.Status = StatusDraining
+	}
+
+	code := http.StatusOK
+	if res.Status != StatusReady {
+		code = http.StatusServiceUnavailable
+	}
+	s.writeHealth(w, code, res)
+}
+
+func (s *RoomServer) writeHealth(w http.ResponseWriter, code int, res HealthRes) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		s.logger.Error("response write failed", logging.Fields{"error": err})
+	}
+}
+
+// Shutdown marks the server as draining, so that it's reported not ready, and
+// keeps serving for the drain period to let load balancers notice it. Then it
+// closes websockets and event streams with the moderator, stops accepting
+// connections and waits for the sessions and pending requests until the context
+// is done.
+// The server doesn't start listening after it was shut down. Shutdown can be
+// called only once.
+func (s *RoomServer) Shutdown(ctx context.Context, drain time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return errAlreadyShutdown
+	}
+	s.logger.Info("server is draining", logging.Fields{"drain": drain})
+	defer close(s.stopped)
+
+	select {
+	case <-time.After(drain):
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	httpServer := s.httpServer
+	s.closed = true
+	s.mutex.Unlock()
+	if httpServer == nil {
+		return nil
+	}
+	s.logger.Info("server is shutting down")
+	// the HTTP server doesn't close hijacked connections and waits for event
+	// streams, peers joining later are closed by the moderator as they register
+	s.closeSessions()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		return err
+	}
+	return s.waitForWebsockets(ctx)
+}
+
+// closeSessions closes websockets and event streams of peers
+func (s *RoomServer) closeSessions() {
+	if s.moderator != nil {
+		s.moderator.CloseAll()
+	}
+}
+
+// waitForWebsockets polls until sessions of peers connected through websockets
+// end, as the HTTP server does for pending requests
+func (s *RoomServer) waitForWebsockets(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&s.websockets) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -1,34 +1,171 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/e2e"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/history"
 	"github.com/montrosesoftware/tarpon/pkg/logging"
 	"github.com/montrosesoftware/tarpon/pkg/messaging"
 	"github.com/montrosesoftware/tarpon/pkg/msv"
+	"github.com/montrosesoftware/tarpon/pkg/presence"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
 )
 
 type RoomStore interface {
 	CreateRoom(uid string) bool
-	RegisterPeer(room string, peer messaging.Peer) bool
+	RoomExists(uid string) bool
+	ListRooms() []messaging.RoomInfo
+	DeleteRoom(uid string) bool
+	RegisterPeer(room string, peer messaging.Peer) (bool, error)
 	JoinRoom(room string, secret string) (messaging.Peer, error)
+	GetPeer(room string, uid string) (messaging.Peer, bool)
+	RotateSecret(room string, uid string, secret string, expiresAt time.Time) (bool, error)
+	RevokeSecret(room string, uid string) bool
 }
 
-type PeerHandlerFunc func(p messaging.Peer, room string, conn *websocket.Conn)
+// MessageSender sends messages to peers of a room, usually it's the broker.
+type MessageSender interface {
+	Send(room string, message messaging.Message) error
+}
+
+// ConnectionSettings keeps timeouts and limits of peers' connections in rooms.
+// Overrides are kept with rooms, so they're removed together with them.
+type ConnectionSettings interface {
+	CheckOverrides(req ConnectionReq) error
+	SetOverrides(room string, req ConnectionReq)
+}
+
+type MessageHistory interface {
+	SetLimits(room string, limits history.Limits)
+	Messages(room string, after uint64, limit int) ([]history.Entry, bool)
+	Delete(room string)
+}
+
+// FailureLimiter locks keys out after too many failed attempts.
+type FailureLimiter interface {
+	// RetryAfter returns how long the key is locked out for, or 0 when it's not.
+	RetryAfter(key string) time.Duration
+	// Fail counts a failed attempt and returns how long the key is locked out for because of it.
+	Fail(key string) time.Duration
+}
+
+// RoomLimiter locks rooms out after too many failed attempts to join them. Clients
+// which joined a room are exempted from its lockout, so that guessing secrets of a
+// room doesn't lock its peers out when they reconnect.
+type RoomLimiter interface {
+	FailureLimiter
+	Exempt(room string, client string)
+	Exempted(room string, client string) bool
+}
+
+// ClientIPResolver finds the IP address of the client which sent the request.
+type ClientIPResolver interface {
+	ClientIP(r *http.Request) string
+}
+
+// RequestLimiter limits the rate of requests per client IP address.
+type RequestLimiter interface {
+	Allow(key string) bool
+}
+
+// ConnectionLimiter limits the number of concurrent requests per client IP
+// address, including long-lived websockets and event streams.
+type ConnectionLimiter interface {
+	Acquire(key string) bool
+	Release(key string)
+}
+
+// PeerModerator removes misbehaving peers from rooms.
+type PeerModerator interface {
+	Kick(room string, uid string)
+	Disconnect(room string, uid string)
+	Mute(room string, uid string, muted bool)
+	Ban(room string, uid string)
+	IsBanned(room string, uid string) bool
+	CloseRoom(room string)
+	CloseAll()
+}
+
+// Presence reports peers connected to rooms through any instance of the server.
+type Presence interface {
+	Online(room string) ([]string, error)
+}
+
+// RoomRouter assigns rooms to instances of the server, so that peers of a room
+// connect to the same instance.
+type RoomRouter interface {
+	// Route returns the node owning the room and whether it's this one.
+	Route(room string) (presence.Node, bool)
+	// Agreed reports whether all nodes route rooms with the same ring, so that
+	// the owner which a peer is redirected to doesn't redirect it elsewhere.
+	Agreed() bool
+}
+
+// PeerHandlerFunc handles the websocket of the peer which joined the room with
+// the request until the websocket is closed.
+type PeerHandlerFunc func(p messaging.Peer, room string, conn *websocket.Conn, r *http.Request)
+
+// StreamHandlerFunc streams messages to the peer until the request is done.
+type StreamHandlerFunc func(p messaging.Peer, room string, w http.ResponseWriter, r *http.Request)
+
+// MessageHandlerFunc delivers a message the peer sent over HTTP. It returns a
+// rejection when the message was not delivered.
+type MessageHandlerFunc func(p messaging.Peer, room string, r *http.Request) *messaging.Rejection
 
 type RoomServer struct {
 	store          RoomStore
 	peerHandler    PeerHandlerFunc
 	logger         logging.Logger
 	metricsHandler http.Handler
+	events         events.Sink
+	history        MessageHistory
+	streamHandler  StreamHandlerFunc
+	messageHandler MessageHandlerFunc
+	adminToken     string
+	sender         MessageSender
+	senderName     string
+	moderator      PeerModerator
+	presence       Presence
+	router         RoomRouter
+	redirect       bool
+	audit          audit.Sink
+	ipLimiter      FailureLimiter
+	roomLimiter    RoomLimiter
+	ipResolver     ClientIPResolver
+	requestLimiter RequestLimiter
+	connLimiter    ConnectionLimiter
+	tracer         tracing.Tracer
+	connections    ConnectionSettings
+	upgrader       websocket.Upgrader
+	origins        []string
+	build          BuildInfo
+	healthChecks   []healthCheck
+	draining       int32
+	websockets     int32
+	httpServer     *http.Server
+	closed         bool
+	stopped        chan struct{}
+	mutex          sync.Mutex
 }
 
 func NewRoomServer(store RoomStore, ph PeerHandlerFunc, l logging.Logger) *RoomServer {
-	return &RoomServer{store, ph, l, nil}
+	s := &RoomServer{store: store, peerHandler: ph, logger: l, events: events.NoopSink{}, audit: audit.NoopSink{}, tracer: tracing.NoopTracer{}, stopped: make(chan struct{})}
+	s.upgrader = s.newUpgrader(defaultBufferSize, defaultBufferSize)
+	return s
 }
 
 func (s *RoomServer) EnableMetrics(handler http.Handler) {
@@ -36,43 +173,272 @@ func (s *RoomServer) EnableMetrics(handler http.Handler) {
 	s.metricsHandler = handler
 }
 
+// EnableEvents makes the server notify the sink about rooms created and peers registered.
+func (s *RoomServer) EnableEvents(sink events.Sink) {
+	s.logger.Info("room events enabled")
+	s.events = sink
+}
+
+// EnableHistory allows setting history limits of created rooms and reading rooms' history.
+func (s *RoomServer) EnableHistory(h MessageHistory) {
+	s.logger.Info("message history enabled")
+	s.history = h
+}
+
+// EnableHTTPTransport allows peers to receive messages with Server-Sent Events and
+// send them with HTTP requests, when websockets are not available.
+func (s *RoomServer) EnableHTTPTransport(sh StreamHandlerFunc, mh MessageHandlerFunc) {
+	s.logger.Info("http transport enabled")
+	s.streamHandler = sh
+	s.messageHandler = mh
+}
+
+// EnableAdminAuth requires the token as a bearer token of requests creating rooms,
+// registering peers and sending server messages.
+func (s *RoomServer) EnableAdminAuth(token string) {
+	s.logger.Info("admin authorization enabled")
+	s.adminToken = token
+}
+
+// EnableServerMessages allows the backend to send messages to rooms on behalf of
+// the server. Messages come from the named server identity, unless the request
+// names another one. It requires admin authorization to be enabled.
+func (s *RoomServer) EnableServerMessages(sender MessageSender, name string) {
+	s.logger.Info("server messages enabled", logging.Fields{"from": messaging.ServerIdentity(name)})
+	s.sender = sender
+	s.senderName = name
+}
+
+// EnableModeration allows kicking, muting and banning peers and prevents banned
+// peers from being registered again.
+func (s *RoomServer) EnableModeration(m PeerModerator) {
+	s.logger.Info("moderation enabled")
+	s.moderator = m
+}
+
+// EnablePresence makes the server report which peers are connected to rooms.
+func (s *RoomServer) EnablePresence(p Presence) {
+	s.logger.Info("presence enabled")
+	s.presence = p
+}
+
+// EnableRouting allows clients to find the instance owning a room. With redirect
+// set, peers joining rooms owned by other instances are redirected to them.
+func (s *RoomServer) EnableRouting(r RoomRouter, redirect bool) {
+	s.logger.Info("room routing enabled", logging.Fields{"redirect": redirect})
+	s.router = r
+	s.redirect = redirect
+}
+
+// EnableAudit makes the server record security-relevant events in the sink.
+func (s *RoomServer) EnableAudit(sink audit.Sink) {
+	s.logger.Info("audit log enabled")
+	s.audit = sink
+}
+
+// EnableJoinProtection locks out IP addresses and rooms after too many failed
+// attempts to join rooms, so that secrets can't be guessed. Either limiter may be nil.
+func (s *RoomServer) EnableJoinProtection(perIP FailureLimiter, perRoom RoomLimiter) {
+	s.logger.Info("join protection enabled", logging.Fields{"per_ip": perIP != nil, "per_room": perRoom != nil})
+	s.ipLimiter = perIP
+	s.roomLimiter = perRoom
+}
+
+// EnableClientIPResolver makes the server identify clients by the resolver, e.g.
+// to trust forwarding headers set by proxies, instead of the remote address.
+func (s *RoomServer) EnableClientIPResolver(r ClientIPResolver) {
+	s.logger.Info("client ip resolver enabled")
+	s.ipResolver = r
+}
+
+// EnableClientLimits limits the rate of requests and the number of concurrent
+// connections of every client IP address. Either limiter may be nil.
+func (s *RoomServer) EnableClientLimits(requests RequestLimiter, connections ConnectionLimiter) {
+	s.logger.Info("client limits enabled", logging.Fields{"requests": requests != nil, "connections": connections != nil})
+	s.requestLimiter = requests
+	s.connLimiter = connections
+}
+
+// EnableConnectionOverrides allows overriding timeouts and limits of peers'
+// connections when rooms are created.
+func (s *RoomServer) EnableConnectionOverrides(c ConnectionSettings) {
+	s.logger.Info("connection overrides enabled")
+	s.connections = c
+}
+
+// SetWebsocketBuffers sets sizes of read and write buffers of websocket connections in bytes.
+func (s *RoomServer) SetWebsocketBuffers(read int, write int) {
+	s.upgrader = s.newUpgrader(read, write)
+}
+
+// SetAllowedOrigins allows opening websockets only from pages of the origins, e.g.
+// "https://example.com". Requests without the Origin header, which browsers
+// always send, are allowed. All origins are allowed when the list is empty.
+// It can be called while the server is running.
+func (s *RoomServer) SetAllowedOrigins(origins []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.origins = origins
+}
+
+// EnableTracing makes the server record spans of peers joining rooms. Spans continue
+// traces of requests with the traceparent and tracestate headers.
+func (s *RoomServer) EnableTracing(t tracing.Tracer) {
+	s.logger.Info("tracing enabled")
+	s.tracer = t
+}
+
+// Listen serves requests until the server fails or is shut down. After Shutdown
+// it returns once the shutdown completes.
 func (s *RoomServer) Listen(host string, port string) {
 	s.logger.Info("server starts listening...", logging.Fields{"host": host, "port": port})
-	if err := http.ListenAndServe(host+":"+port, s); err != nil {
-		s.logger.Error("can't listen", logging.Fields{"host": host, "port": port, "error": err})
+	httpServer := &http.Server{Addr: host + ":" + port, Handler: s}
+	s.mutex.Lock()
+	closed := s.closed
+	s.httpServer = httpServer
+	s.mutex.Unlock()
+	if closed {
+		s.logger.Info("server stopped before listening")
+		return
+	}
+
+	err := httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-s.stopped
+		s.logger.Info("server stopped")
+		return
 	}
+	s.logger.Error("can't listen", logging.Fields{"host": host, "port": port, "error": err})
 }
 
 func (s *RoomServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	src := audit.NewSource(r)
+	if s.ipResolver != nil {
+		src.RemoteIP = s.ipResolver.ClientIP(r)
+	}
+	w.Header().Set(audit.RequestIDHeader, src.RequestID)
+	r = r.WithContext(audit.WithSource(r.Context(), src))
+
 	head, tail := msv.ShiftPath(r.URL.Path)
 
 	if head == "metrics" && s.metricsHandler != nil {
 		s.metricsHandler.ServeHTTP(w, r)
 		return
 	}
+	// probes are not limited, so that orchestrators can always reach them
+	if (head == "healthz" || head == "readyz") && tail == "/" {
+		if checkMethod(w, r, http.MethodGet) {
+			if head == "healthz" {
+				s.Healthz(w, r)
+			} else {
+				s.Readyz(w, r)
+			}
+		}
+		return
+	}
+
+	// admin requests are not limited, so that backends sharing an address with
+	// clients, or managing many rooms, aren't throttled
+	limited := !s.isAdmin(r)
+	if limited && s.requestLimiter != nil && !s.requestLimiter.Allow(src.RemoteIP) {
+		s.logger.Warn("request rate limit exceeded", logging.Fields{"ip": src.RemoteIP})
+		setRetryAfter(w, time.Second)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	if limited && s.connLimiter != nil {
+		if !s.connLimiter.Acquire(src.RemoteIP) {
+			s.logger.Warn("concurrent connections limit exceeded", logging.Fields{"ip": src.RemoteIP})
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		defer s.connLimiter.Release(src.RemoteIP)
+	}
 
 	if head == "rooms" {
 		head, tail := msv.ShiftPath(tail)
 		if head == "" {
-			if checkMethod(w, r, http.MethodPost) {
+			switch r.Method {
+			case http.MethodPost:
 				s.CreateRoom(w, r)
+			case http.MethodGet:
+				s.ListRooms(w, r)
+			default:
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			}
 			return
 		}
 		{
 			head, _ := msv.ShiftPath(tail)
+			if head == "" {
+				if checkMethod(w, r, http.MethodDelete) {
+					s.DeleteRoom(w, r)
+				}
+				return
+			}
 			if head == "ws" {
-				if checkMethod(w, r, http.MethodGet) {
+				if checkMethod(w, r, http.MethodGet) && !s.redirectToOwner(w, r) {
 					s.JoinRoom(w, r)
 				}
 				return
 			}
+			if head == "node" && s.router != nil {
+				if checkMethod(w, r, http.MethodGet) {
+					s.GetNode(w, r)
+				}
+				return
+			}
 			if head == "peers" {
+				_, tail := msv.ShiftPathN(r.URL.Path, 4)
+				if tail == "/secret" {
+					switch r.Method {
+					case http.MethodPost:
+						s.RotateSecret(w, r)
+					case http.MethodDelete:
+						s.RevokeSecret(w, r)
+					default:
+						http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+					}
+					return
+				}
+				if tail != "/" && s.moderator != nil {
+					if checkMethod(w, r, http.MethodPost) {
+						s.ModeratePeer(w, r)
+					}
+					return
+				}
 				if checkMethod(w, r, http.MethodPost) {
 					s.RegisterPeer(w, r)
 				}
 				return
 			}
+			if head == "messages" && (s.history != nil || s.messageHandler != nil || s.sender != nil) {
+				switch {
+				case r.Method == http.MethodGet && s.history != nil:
+					s.GetMessages(w, r)
+				case r.Method == http.MethodPost && s.sender != nil && (s.isAdmin(r) || s.messageHandler == nil):
+					s.SendServerMessage(w, r)
+				case r.Method == http.MethodPost && s.messageHandler != nil:
+					if !s.redirectToOwner(w, r) {
+						s.SendMessage(w, r)
+					}
+				default:
+					http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			}
+			if head == "presence" && s.presence != nil {
+				if checkMethod(w, r, http.MethodGet) {
+					s.GetPresence(w, r)
+				}
+				return
+			}
+			if head == "events" && s.streamHandler != nil {
+				if checkMethod(w, r, http.MethodGet) && !s.redirectToOwner(w, r) {
+					s.StreamEvents(w, r)
+				}
+				return
+			}
 		}
 	}
 
@@ -80,10 +446,35 @@ func (s *RoomServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type CreateRoomReq struct {
-	UID string `json:"uid"`
+	UID        string            `json:"uid"`
+	History    *HistoryLimitsReq `json:"history,omitempty"`
+	Connection *ConnectionReq    `json:"connection,omitempty"`
+}
+
+// HistoryLimitsReq overrides default history limits of a room. MaxAge is in seconds.
+type HistoryLimitsReq struct {
+	MaxCount int `json:"max_count"`
+	MaxAge   int `json:"max_age"`
+}
+
+// ConnectionReq overrides timeouts and limits of peers' connections in a room.
+// Timeouts are in seconds, fields left zero keep their defaults.
+type ConnectionReq struct {
+	WriteWait       int `json:"write_wait,omitempty"`
+	PongWait        int `json:"pong_wait,omitempty"`
+	PingPeriod      int `json:"ping_period,omitempty"`
+	MaxMessageSize  int `json:"max_message_size,omitempty"`
+	MessagesBufSize int `json:"messages_buf_size,omitempty"`
+	MessageRate     int `json:"message_rate,omitempty"`
+	MessageBurst    int `json:"message_burst,omitempty"`
+	MaxRateStrikes  int `json:"max_rate_strikes,omitempty"`
 }
 
 func (s *RoomServer) CreateRoom(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
 	var req CreateRoomReq
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -95,8 +486,33 @@ func (s *RoomServer) CreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.History != nil {
+		if s.history == nil {
+			http.Error(w, "history: not enabled", http.StatusBadRequest)
+			return
+		}
+		if !checkRange(w, req.History.MaxCount, 0, maxHistoryCount, "history.max_count") ||
+			!checkRange(w, req.History.MaxAge, 0, maxHistoryAge, "history.max_age") {
+			return
+		}
+	}
+	if req.Connection != nil && !s.checkConnection(w, req.Connection) {
+		return
+	}
+
 	created := s.store.CreateRoom(req.UID)
 	if created {
+		if req.History != nil {
+			s.history.SetLimits(req.UID, history.Limits{
+				MaxCount: req.History.MaxCount,
+				MaxAge:   time.Duration(req.History.MaxAge) * time.Second,
+			})
+		}
+		if req.Connection != nil {
+			s.connections.SetOverrides(req.UID, *req.Connection)
+		}
+		s.events.Notify(events.New(events.RoomCreated, req.UID, ""))
+		s.record(r, audit.RoomCreated, req.UID, "", "")
 		w.WriteHeader(http.StatusCreated)
 		s.withLogging(w.Write([]byte("Created\n")))
 	} else {
@@ -104,9 +520,157 @@ func (s *RoomServer) CreateRoom(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type ListRoomsRes struct {
+	Rooms []messaging.RoomInfo `json:"rooms"`
+}
+
+func (s *RoomServer) ListRooms(w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	rooms := s.store.ListRooms()
+	if s.presence != nil {
+		for i := range rooms {
+			online, err := s.presence.Online(rooms[i].UID)
+			if err != nil {
+				s.logger.Error("failed to read presence", logging.Fields{"room": rooms[i].UID, "error": err})
+				continue
+			}
+			rooms[i].Online = len(online)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ListRoomsRes{Rooms: rooms}); err != nil {
+		s.logger.Error("response write failed", logging.Fields{"error": err})
+	}
+}
+
+type PresenceRes struct {
+	Peers []string `json:"peers"`
+}
+
+// GetPresence lists peers connected to the room given in the path.
+func (s *RoomServer) GetPresence(w http.ResponseWriter, r *http.Request) {
+	room, _ := msv.ShiftPathN(r.URL.Path, 2)
+
+	if !checkLength(w, room, 1, 40, "room uid") {
+		return
+	}
+
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	online, err := s.presence.Online(room)
+	if err != nil {
+		s.logger.Error("failed to read presence", logging.Fields{"room": room, "error": err})
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(PresenceRes{Peers: online}); err != nil {
+		s.logger.Error("response write failed", logging.Fields{"error": err})
+	}
+}
+
+// NodeRes is the instance of the server owning a room, which clients reach at the URL.
+type NodeRes struct {
+	Node string `json:"node"`
+	URL  string `json:"url"`
+}
+
+// GetNode returns the instance owning the room given in the path, where peers
+// should join the room.
+func (s *RoomServer) GetNode(w http.ResponseWriter, r *http.Request) {
+	room, tail := msv.ShiftPathN(r.URL.Path, 2)
+
+	if !checkLength(w, room, 1, 40, "room uid") {
+		return
+	}
+
+	if tail != "/node" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	node, _ := s.router.Route(room)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(NodeRes{Node: node.ID, URL: node.URL}); err != nil {
+		s.logger.Error("response write failed", logging.Fields{"error": err})
+	}
+}
+
+// routingRetryAfter is how long peers wait while nodes disagree about owners of
+// rooms, nodes agree again after about a heartbeat of the cluster.
+const routingRetryAfter = 2 * time.Second
+
+// redirectToOwner redirects peers' requests of rooms owned by other instances to
+// them, keeping the method and the body. While nodes disagree about owners, e.g.
+// because one joined or left the cluster, peers are asked to retry instead, so
+// that peers of a room aren't sent to different owners. It returns true when it
+// answered the request.
+func (s *RoomServer) redirectToOwner(w http.ResponseWriter, r *http.Request) bool {
+	if s.router == nil || !s.redirect {
+		return false
+	}
+	room, _ := msv.ShiftPathN(r.URL.Path, 2)
+	node, local := s.router.Route(room)
+	if local {
+		return false
+	}
+	if !s.router.Agreed() {
+		s.logger.Debug("not redirecting, nodes disagree about owners", logging.Fields{"room": room, "node": node.ID})
+		setRetryAfter(w, routingRetryAfter)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return true
+	}
+	location := strings.TrimSuffix(node.URL, "/") + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	s.logger.Debug("redirecting to owner of room", logging.Fields{"room": room, "node": node.ID})
+	http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+	return true
+}
+
+// DeleteRoom removes the room given in the path with its peers and disconnects
+// those which are connected.
+func (s *RoomServer) DeleteRoom(w http.ResponseWriter, r *http.Request) {
+	room, _ := msv.ShiftPathN(r.URL.Path, 2)
+
+	if !checkLength(w, room, 1, 40, "room uid") {
+		return
+	}
+
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	if !s.store.DeleteRoom(room) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if s.moderator != nil {
+		s.moderator.CloseRoom(room)
+	}
+	if s.history != nil {
+		s.history.Delete(room)
+	}
+	s.events.Notify(events.New(events.RoomDeleted, room, ""))
+	s.record(r, audit.RoomDeleted, room, "", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterPeerReq registers a peer. Its secret doesn't expire when ExpiresAt is zero.
+// PublicKey is the peer's X25519 key for end-to-end encryption in base64, if any.
 type RegisterPeerReq struct {
-	UID    string `json:"uid"`
-	Secret string `json:"secret"`
+	UID       string    `json:"uid"`
+	Secret    string    `json:"secret"`
+	Role      string    `json:"role,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	PublicKey string    `json:"public_key,omitempty"`
 }
 
 func (s *RoomServer) RegisterPeer(w http.ResponseWriter, r *http.Request) {
@@ -121,6 +685,10 @@ func (s *RoomServer) RegisterPeer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
 	var req RegisterPeerReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "decoding json failed", http.StatusBadRequest)
@@ -135,12 +703,40 @@ func (s *RoomServer) RegisterPeer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !checkLength(w, req.Secret, 24, 100, "secret") {
+	if !checkLength(w, req.Secret, minSecretLength, maxSecretLength, "secret") {
+		return
+	}
+
+	if !checkExpiry(w, req.ExpiresAt) {
+		return
+	}
+
+	if req.PublicKey != "" {
+		if _, err := e2e.ParsePublicKey(req.PublicKey); err != nil {
+			http.Error(w, "public_key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Role != "" && req.Role != messaging.RoleHost {
+		http.Error(w, fmt.Sprint("role: must be empty or '", messaging.RoleHost, "'"), http.StatusBadRequest)
+		return
+	}
+
+	if s.moderator != nil && s.moderator.IsBanned(room, req.UID) {
+		http.Error(w, "uid: banned from the room", http.StatusForbidden)
 		return
 	}
 
 	p := messaging.Peer(req)
-	if s.store.RegisterPeer(room, p) {
+	created, err := s.store.RegisterPeer(room, p)
+	if err != nil {
+		s.secretFailed(w, room, err)
+		return
+	}
+	s.record(r, audit.PeerRegistered, room, p.UID, "")
+	if created {
+		s.events.Notify(events.New(events.PeerRegistered, room, p.UID))
 		w.WriteHeader(http.StatusCreated)
 		s.withLogging((w.Write([]byte("Created\n"))))
 	} else {
@@ -149,13 +745,369 @@ func (s *RoomServer) RegisterPeer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  4096,
-	WriteBufferSize: 4096,
-	CheckOrigin: func(r *http.Request) bool {
+// ModeratePeer kicks, mutes, unmutes or bans the peer given in the path,
+// e.g. /rooms/{id}/peers/{uid}/kick.
+func (s *RoomServer) ModeratePeer(w http.ResponseWriter, r *http.Request) {
+	room, uid := peerPath(r)
+	_, action := msv.ShiftPathN(r.URL.Path, 4)
+
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	if _, ok := s.store.GetPeer(room, uid); !ok {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "/kick":
+		s.moderator.Kick(room, uid)
+		s.record(r, audit.PeerKicked, room, uid, "")
+	case "/mute":
+		s.moderator.Mute(room, uid, true)
+		s.record(r, audit.PeerMuted, room, uid, "")
+	case "/unmute":
+		s.moderator.Mute(room, uid, false)
+		s.record(r, audit.PeerUnmuted, room, uid, "")
+	case "/ban":
+		s.moderator.Ban(room, uid)
+		s.record(r, audit.PeerBanned, room, uid, "")
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	s.logger.Info("peer moderated", logging.Fields{"room": room, "peer": uid, "action": strings.TrimPrefix(action, "/")})
+	w.WriteHeader(http.StatusOK)
+	s.withLogging(w.Write([]byte("OK\n")))
+}
+
+// RotateSecretReq replaces the peer's secret. When TerminateSessions is set, the
+// peer is disconnected and has to join again with the new secret.
+type RotateSecretReq struct {
+	Secret            string    `json:"secret"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	TerminateSessions bool      `json:"terminate_sessions"`
+}
+
+// RotateSecret replaces the secret of the peer given in the path,
+// e.g. /rooms/{id}/peers/{uid}/secret.
+func (s *RoomServer) RotateSecret(w http.ResponseWriter, r *http.Request) {
+	room, uid := peerPath(r)
+
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	var req RotateSecretReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "decoding json failed", http.StatusBadRequest)
+		return
+	}
+
+	if !checkLength(w, req.Secret, minSecretLength, maxSecretLength, "secret") || !checkExpiry(w, req.ExpiresAt) {
+		return
+	}
+
+	if !s.checkTermination(w, req.TerminateSessions) {
+		return
+	}
+
+	found, err := s.store.RotateSecret(room, uid, req.Secret, req.ExpiresAt)
+	if err != nil {
+		s.secretFailed(w, room, err)
+		return
+	}
+	if !found {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	if req.TerminateSessions {
+		s.moderator.Disconnect(room, uid)
+	}
+	s.record(r, audit.SecretRotated, room, uid, "")
+
+	s.logger.Info("peer secret rotated", logging.Fields{"room": room, "peer": uid, "terminate_sessions": req.TerminateSessions})
+	w.WriteHeader(http.StatusOK)
+	s.withLogging(w.Write([]byte("OK\n")))
+}
+
+// RevokeSecret revokes the secret of the peer given in the path, so that it can't
+// join the room until the secret is rotated. Existing sessions are terminated
+// when the terminate_sessions query parameter is true.
+func (s *RoomServer) RevokeSecret(w http.ResponseWriter, r *http.Request) {
+	room, uid := peerPath(r)
+
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	terminate := false
+	if v := r.URL.Query().Get("terminate_sessions"); v != "" {
+		var err error
+		if terminate, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "terminate_sessions: must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !s.checkTermination(w, terminate) {
+		return
+	}
+
+	if !s.store.RevokeSecret(room, uid) {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+	if terminate {
+		s.moderator.Disconnect(room, uid)
+	}
+	s.record(r, audit.SecretRevoked, room, uid, "")
+
+	s.logger.Info("peer secret revoked", logging.Fields{"room": room, "peer": uid, "terminate_sessions": terminate})
+	w.WriteHeader(http.StatusOK)
+	s.withLogging(w.Write([]byte("OK\n")))
+}
+
+// checkTermination writes an error response and returns false when sessions should
+// be terminated, but the server doesn't track them.
+func (s *RoomServer) checkTermination(w http.ResponseWriter, terminate bool) bool {
+	if terminate && s.moderator == nil {
+		http.Error(w, "terminate_sessions: not enabled", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+const (
+	minSecretLength     = 24
+	maxSecretLength     = 100
+	maxHistoryCount     = 10000
+	maxHistoryAge       = 7 * 24 * 60 * 60
+	defaultMessagesPage = 50
+	maxMessagesPage     = 100
+	maxConnectionWait   = 60 * 60
+	maxMessageSize      = 1 << 20
+	maxMessagesBufSize  = 4096
+	maxMessageRate      = 10000
+	maxRateStrikes      = 10000
+	defaultBufferSize   = 4096
+)
+
+type MessagesRes struct {
+	Messages []history.Entry `json:"messages"`
+	Next     string          `json:"next,omitempty"`
+}
+
+// GetMessages returns a page of the room's history to its peers. The page starts
+// after the message given by the after cursor.
+func (s *RoomServer) GetMessages(w http.ResponseWriter, r *http.Request) {
+	room, tail := msv.ShiftPathN(r.URL.Path, 2)
+
+	if tail != "/messages" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if _, ok := s.authorizePeer(w, r, room); !ok {
+		return
+	}
+
+	var after uint64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "after: invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultMessagesPage
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "limit: must be a number", http.StatusBadRequest)
+			return
+		}
+		if !checkRange(w, limit, 1, maxMessagesPage, "limit") {
+			return
+		}
+	}
+
+	entries, more := s.history.Messages(room, after, limit)
+	res := MessagesRes{Messages: entries}
+	if res.Messages == nil {
+		res.Messages = []history.Entry{}
+	}
+	if more {
+		res.Next = strconv.FormatUint(entries[len(entries)-1].Seq, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		s.logger.Error("response write failed", logging.Fields{"error": err})
+	}
+}
+
+// SendMessage delivers a message sent by the peer over HTTP. Rejected messages
+// are answered with the same error message as on the websocket.
+func (s *RoomServer) SendMessage(w http.ResponseWriter, r *http.Request) {
+	room, tail := msv.ShiftPathN(r.URL.Path, 2)
+
+	if tail != "/messages" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	peer, ok := s.authorizePeer(w, r, room)
+	if !ok {
+		return
+	}
+
+	rejection := s.messageHandler(peer, room, r)
+	if rejection == nil {
+		w.WriteHeader(http.StatusAccepted)
+		s.withLogging(w.Write([]byte("Accepted\n")))
+		return
+	}
+
+	msg, err := messaging.NewError(peer.UID, rejection.ID, rejection.Code, rejection.Reason)
+	if err != nil {
+		s.logger.Error("failed to create error message", logging.Fields{"room": room, "peer": peer.UID, "error": err})
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rejectionStatus(rejection.Code))
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		s.logger.Error("response write failed", logging.Fields{"error": err})
+	}
+}
+
+type ServerMessageReq struct {
+	ID      string          `json:"id,omitempty"`
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// SendServerMessage sends a broadcast or direct message to the room on behalf of the server.
+func (s *RoomServer) SendServerMessage(w http.ResponseWriter, r *http.Request) {
+	room, tail := msv.ShiftPathN(r.URL.Path, 2)
+
+	if tail != "/messages" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if !s.isAdmin(r) {
+		s.record(r, audit.AdminAuthFailed, room, "", "invalid admin token")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ServerMessageReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "decoding json failed", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Payload) == 0 || string(req.Payload) == "null" {
+		http.Error(w, "payload: is required", http.StatusBadRequest)
+		return
+	}
+
+	name := s.senderName
+	if req.From != "" {
+		if !checkLength(w, req.From, 1, 40, "from") {
+			return
+		}
+		name = req.From
+	}
+
+	if !s.store.RoomExists(room) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	if req.To != "" {
+		if _, ok := s.store.GetPeer(room, req.To); !ok {
+			http.Error(w, "to: peer not registered in the room", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	err := s.sender.Send(room, messaging.Message{
+		ID:      req.ID,
+		From:    messaging.ServerIdentity(name),
+		To:      req.To,
+		Payload: req.Payload,
+	})
+	if errors.Is(err, broker.ErrRecipientOffline) {
+		s.logger.Info("server message not delivered", logging.Fields{"room": room, "to": req.To, "error": err})
+		http.Error(w, "to: peer not connected", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.logger.Error("server message failed", logging.Fields{"room": room, "to": req.To, "error": err})
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	s.withLogging(w.Write([]byte("Accepted\n")))
+}
+
+// StreamEvents streams messages to the peer with Server-Sent Events. Because
+// browsers can't set headers of EventSource requests, the secret may also be
+// given in the access_token query parameter.
+func (s *RoomServer) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	room, tail := msv.ShiftPathN(r.URL.Path, 2)
+
+	if tail != "/events" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	secret := getSecret(r)
+	if secret == "" {
+		secret = r.URL.Query().Get("access_token")
+	}
+	peer, ok := s.authorizePeerWithSecret(w, r, room, secret)
+	if !ok {
+		return
+	}
+	s.record(r, audit.PeerJoined, room, peer.UID, "")
+
+	s.streamHandler(peer, room, w, r)
+}
+
+// errJoinRejected marks spans of joins rejected before upgrading to websocket
+var errJoinRejected = errors.New("join rejected")
+
+func (s *RoomServer) newUpgrader(read int, write int) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  read,
+		WriteBufferSize: write,
+		CheckOrigin:     s.checkOrigin,
+		Subprotocols:    []string{"tarpon"},
+	}
+}
+
+func (s *RoomServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if origin == "" || len(s.origins) == 0 {
 		return true
-	},
-	Subprotocols: []string{"tarpon"},
+	}
+	for _, o := range s.origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	s.logger.Warn("websocket origin not allowed", logging.Fields{"origin": origin})
+	return false
 }
 
 func (s *RoomServer) JoinRoom(w http.ResponseWriter, r *http.Request) {
@@ -166,29 +1118,159 @@ func (s *RoomServer) JoinRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	secret := getSecret(r)
+	parent, _ := tracing.ParseTraceContext(r.Header.Get(tracing.TraceparentHeader), r.Header.Get(tracing.TracestateHeader))
+	span := s.tracer.StartSpan(parent, "RoomServer.JoinRoom")
+	span.SetAttribute("room", room)
+
+	peer, ok := s.authorizePeer(w, r, room)
+	if !ok {
+		span.SetError(errJoinRejected)
+		span.End()
+		return
+	}
+	span.SetAttribute("peer", peer.UID)
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Error("cant upgrade to websocket", logging.Fields{"room": room, "peer": peer.UID, "error": err})
+		span.SetError(err)
+		span.End()
+		return
+	}
+	s.record(r, audit.PeerJoined, room, peer.UID, "")
+	// the span covers joining only, not the whole session
+	span.End()
+
+	atomic.AddInt32(&s.websockets, 1)
+	defer atomic.AddInt32(&s.websockets, -1)
+	s.peerHandler(peer, room, conn, r)
+}
+
+// authorizePeer finds the peer of the room by the secret sent with the request.
+// It writes an error response and returns false when there's no such peer.
+func (s *RoomServer) authorizePeer(w http.ResponseWriter, r *http.Request, room string) (messaging.Peer, bool) {
+	return s.authorizePeerWithSecret(w, r, room, getSecret(r))
+}
+
+func (s *RoomServer) authorizePeerWithSecret(w http.ResponseWriter, r *http.Request, room string, secret string) (messaging.Peer, bool) {
+	ip := audit.SourceFrom(r.Context()).RemoteIP
+	if s.ipLimiter != nil {
+		if retry := s.ipLimiter.RetryAfter(ip); retry > 0 {
+			s.lockedOut(w, r, room, retry)
+			return messaging.Peer{}, false
+		}
+	}
+
+	// the room's lockout rejects every attempt before the secret is checked, so
+	// that responses don't tell whether guessed secrets are right, except attempts
+	// of clients which joined the room before
+	if s.roomLimiter != nil && !s.roomLimiter.Exempted(room, ip) {
+		if retry := s.roomLimiter.RetryAfter(room); retry > 0 {
+			if d := s.countFailure(ip, room); d > retry {
+				retry = d
+			}
+			s.lockedOut(w, r, room, retry)
+			return messaging.Peer{}, false
+		}
+	}
+
 	peer, err := s.store.JoinRoom(room, secret)
 
 	if err != nil {
 		switch err {
 		case messaging.ErrRoomNotFound:
+			s.record(r, audit.JoinFailed, room, "", "room not found")
+			s.joinFailed(w, ip, "")
 			http.Error(w, "Room not found", http.StatusNotFound)
 		case messaging.ErrUnauthorized:
+			s.record(r, audit.JoinFailed, room, "", "invalid secret")
+			s.joinFailed(w, ip, room)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		default:
 			s.logger.Error("unknown error when joining room", logging.Fields{"room": room, "error": err})
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
-		return
+		return messaging.Peer{}, false
+	}
+	if s.roomLimiter != nil {
+		s.roomLimiter.Exempt(room, ip)
 	}
+	return peer, true
+}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		s.logger.Error("cant upgrade to websocket", logging.Fields{"room": room, "peer": peer.UID, "error": err})
+// secretFailed responds to a failed registration or rotation of a secret.
+func (s *RoomServer) secretFailed(w http.ResponseWriter, room string, err error) {
+	if errors.Is(err, messaging.ErrSecretInUse) {
+		http.Error(w, "secret: used by another peer", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, messaging.ErrRoomNotFound) {
+		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
+	s.logger.Error("failed to store secret", logging.Fields{"room": room, "error": err})
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// lockedOut rejects the attempt to join the room, which is locked out.
+func (s *RoomServer) lockedOut(w http.ResponseWriter, r *http.Request, room string, retry time.Duration) {
+	s.record(r, audit.JoinFailed, room, "", "locked out")
+	setRetryAfter(w, retry)
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// joinFailed counts a failed attempt to join the room from the IP. Attempts to
+// join rooms which don't exist are counted only per IP. When the attempt causes
+// a lockout, the response tells the client when to retry.
+func (s *RoomServer) joinFailed(w http.ResponseWriter, ip string, room string) {
+	if retry := s.countFailure(ip, room); retry > 0 {
+		setRetryAfter(w, retry)
+	}
+}
+
+// countFailure counts a failed attempt to join the room from the IP and returns
+// how long joining is locked out for because of it.
+func (s *RoomServer) countFailure(ip string, room string) time.Duration {
+	var retry time.Duration
+	if s.ipLimiter != nil {
+		retry = s.ipLimiter.Fail(ip)
+	}
+	if s.roomLimiter != nil && room != "" {
+		if d := s.roomLimiter.Fail(room); d > retry {
+			retry = d
+		}
+	}
+	if retry > 0 {
+		s.logger.Warn("joining locked out after failed attempts", logging.Fields{"room": room, "ip": ip, "retry_after": retry})
+	}
+	return retry
+}
+
+// isAdmin reports whether the request is authorized with the admin token.
+func (s *RoomServer) isAdmin(r *http.Request) bool {
+	return s.adminToken != "" && subtle.ConstantTimeCompare([]byte(getSecret(r)), []byte(s.adminToken)) == 1
+}
+
+// checkAdmin writes an error response and returns false when admin authorization
+// is enabled, but the request is not authorized with the admin token.
+func (s *RoomServer) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.adminToken != "" && !s.isAdmin(r) {
+		s.record(r, audit.AdminAuthFailed, "", "", "invalid admin token")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
 
-	s.peerHandler(peer, room, conn)
+// record records the audit event caused by the request. Events caused by requests
+// authorized with the admin token are attributed to the admin.
+func (s *RoomServer) record(r *http.Request, t string, room string, peer string, reason string) {
+	e := audit.New(t, room, peer, audit.SourceFrom(r.Context()))
+	e.Reason = reason
+	if s.isAdmin(r) {
+		e.Actor = "admin"
+	}
+	s.audit.Record(e)
 }
 
 func (s *RoomServer) withLogging(n int, err error) {
@@ -205,14 +1287,79 @@ func checkLength(w http.ResponseWriter, val string, lower int, upper int, name s
 	return true
 }
 
+func checkRange(w http.ResponseWriter, val int, lower int, upper int, name string) bool {
+	if val < lower || val > upper {
+		http.Error(w, fmt.Sprint(name, ": must be between ", lower, " and ", upper), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// checkConnection writes an error response and returns false when the request
+// can't override connection options
+func (s *RoomServer) checkConnection(w http.ResponseWriter, req *ConnectionReq) bool {
+	if s.connections == nil {
+		http.Error(w, "connection: overrides not enabled", http.StatusBadRequest)
+		return false
+	}
+	if !checkRange(w, req.WriteWait, 0, maxConnectionWait, "connection.write_wait") ||
+		!checkRange(w, req.PongWait, 0, maxConnectionWait, "connection.pong_wait") ||
+		!checkRange(w, req.PingPeriod, 0, maxConnectionWait, "connection.ping_period") ||
+		!checkRange(w, req.MaxMessageSize, 0, maxMessageSize, "connection.max_message_size") ||
+		!checkRange(w, req.MessagesBufSize, 0, maxMessagesBufSize, "connection.messages_buf_size") ||
+		!checkRange(w, req.MessageRate, 0, maxMessageRate, "connection.message_rate") ||
+		!checkRange(w, req.MessageBurst, 0, maxMessageRate, "connection.message_burst") ||
+		!checkRange(w, req.MaxRateStrikes, 0, maxRateStrikes, "connection.max_rate_strikes") {
+		return false
+	}
+	if err := s.connections.CheckOverrides(*req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func checkExpiry(w http.ResponseWriter, val time.Time) bool {
+	if !val.IsZero() && !val.After(time.Now()) {
+		http.Error(w, "expires_at: must be in the future", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// peerPath returns the room and the peer given in paths like /rooms/{id}/peers/{uid}/...
+func peerPath(r *http.Request) (room string, uid string) {
+	room, tail := msv.ShiftPathN(r.URL.Path, 2)
+	uid, _ = msv.ShiftPathN(tail, 2)
+	return room, uid
+}
+
 func checkUID(w http.ResponseWriter, val string) bool {
-	if val == "tarpon" {
-		http.Error(w, fmt.Sprint("Your UID cannot be '", messaging.ServerUID, "' you filthy hacker."), http.StatusBadRequest)
+	if messaging.IsServerUID(val) {
+		http.Error(w, fmt.Sprint("Your UID cannot be '", messaging.ServerUID, "' or start with '", messaging.ServerUID, ":' you filthy hacker."), http.StatusBadRequest)
 		return false
 	}
 	return true
 }
 
+func rejectionStatus(code string) int {
+	switch code {
+	case messaging.ErrCodeDecode, messaging.ErrCodeEmptyPayload:
+		return http.StatusBadRequest
+	case messaging.ErrCodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case messaging.ErrCodeRateLimited:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+}
+
 func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
 	if r.Method != method {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
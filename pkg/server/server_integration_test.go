@@ -1,25 +1,33 @@
 package server_test
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/montrosesoftware/tarpon/pkg/agent"
+	"github.com/montrosesoftware/tarpon/pkg/audit"
 	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/events"
 	"github.com/montrosesoftware/tarpon/pkg/logging"
 	"github.com/montrosesoftware/tarpon/pkg/messaging"
 	"github.com/montrosesoftware/tarpon/pkg/server"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
 )
 
 func TestSendingMessagesBetweenPeers(t *testing.T) {
 	store := messaging.NewRoomStore()
 	broker := broker.NewBroker(logging.NoopLogger{})
-	httpServer := httptest.NewServer(server.NewRoomServer(store, agent.PeerHandler(broker, logging.NoopLogger{}), logging.NoopLogger{}))
+	httpServer := httptest.NewServer(server.NewRoomServer(store, agent.PeerHandler(broker, store, events.NoopSink{}, audit.NoopSink{}, tracing.NoopTracer{}, agent.NewRoomOptions(agent.DefaultOptions(), store), logging.NoopLogger{}), logging.NoopLogger{}))
 	defer httpServer.Close()
 
 	room := "aaa3ff11-9ff3-44b8-ab95-b2f339fb9765"
@@ -50,6 +58,130 @@ func TestSendingMessagesBetweenPeers(t *testing.T) {
 	assertSameMessages(t, peer2, m2, recv2)
 }
 
+func TestSendingMessagesBetweenWebsocketAndHTTPPeers(t *testing.T) {
+	store := messaging.NewRoomStore()
+	broker := broker.NewBroker(logging.NoopLogger{})
+	options := agent.NewRoomOptions(agent.DefaultOptions(), store)
+	roomServer := server.NewRoomServer(store, agent.PeerHandler(broker, store, events.NoopSink{}, audit.NoopSink{}, tracing.NoopTracer{}, options, logging.NoopLogger{}), logging.NoopLogger{})
+	roomServer.EnableHTTPTransport(agent.StreamHandler(broker, store, events.NoopSink{}, options, logging.NoopLogger{}), agent.MessageHandler(broker, store, tracing.NoopTracer{}, options, logging.NoopLogger{}))
+	httpServer := httptest.NewServer(roomServer)
+	defer httpServer.Close()
+
+	room := "aaa3ff11-9ff3-44b8-ab95-b2f339fb9765"
+	peer1 := "p1-74cbdcda-bdc3-4fe3-8602-fbaac01689cc"
+	peerSecret1 := "4FAAA42E3DEB4C4F0AD20CC9A2A441F400B0A3DD0E57C7FB33EA73D7BFA966BB"
+	peer2 := "p2-af868c84-ab5a-4835-8503-93f295068f98"
+	peerSecret2 := "88BDA59097E5840A25C2E7B442E88C7790C508F4C759E82047F9637DA6ACB2C5"
+
+	registerPeer(t, httpServer, server.RegisterPeerReq{UID: peer1, Secret: peerSecret1}, room)
+	registerPeer(t, httpServer, server.RegisterPeerReq{UID: peer2, Secret: peerSecret2}, room)
+
+	ws1 := peerJoinsRoom(t, httpServer, room, peerSecret1)
+	defer ws1.Close()
+	stream := peerOpensStream(t, httpServer, room, peerSecret2)
+	defer stream.Close()
+
+	_ = readMessage(t, ws1) // skip 'peer_connected'
+	// wait for the server to register the stream
+	time.Sleep(time.Millisecond * 100)
+
+	m1 := agent.ClientMessage{To: peer2, Payload: json.RawMessage(`"ping"`)}
+	sendMessage(t, ws1, m1)
+	recv1 := readEvent(t, bufio.NewReader(stream))
+	assertSameMessages(t, peer1, m1, recv1)
+
+	m2 := agent.ClientMessage{To: peer1, Payload: json.RawMessage(`"pong"`)}
+	postMessage(t, httpServer, room, peerSecret2, m2)
+	recv2 := readMessage(t, ws1)
+	assertSameMessages(t, peer2, m2, recv2)
+}
+
+func TestStreamReceivesKeyDirectory(t *testing.T) {
+	store := messaging.NewRoomStore()
+	broker := broker.NewBroker(logging.NoopLogger{})
+	options := agent.NewRoomOptions(agent.DefaultOptions(), store)
+	roomServer := server.NewRoomServer(store, agent.PeerHandler(broker, store, events.NoopSink{}, audit.NoopSink{}, tracing.NoopTracer{}, options, logging.NoopLogger{}), logging.NoopLogger{})
+	roomServer.EnableHTTPTransport(agent.StreamHandler(broker, store, events.NoopSink{}, options, logging.NoopLogger{}), agent.MessageHandler(broker, store, tracing.NoopTracer{}, options, logging.NoopLogger{}))
+	httpServer := httptest.NewServer(roomServer)
+	defer httpServer.Close()
+
+	room := "aaa3ff11-9ff3-44b8-ab95-b2f339fb9765"
+	peer1 := "p1-74cbdcda-bdc3-4fe3-8602-fbaac01689cc"
+	key1 := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	peer2 := "p2-af868c84-ab5a-4835-8503-93f295068f98"
+	peerSecret2 := "88BDA59097E5840A25C2E7B442E88C7790C508F4C759E82047F9637DA6ACB2C5"
+
+	registerPeer(t, httpServer, server.RegisterPeerReq{UID: peer1, Secret: "4FAAA42E3DEB4C4F0AD20CC9A2A441F400B0A3DD0E57C7FB33EA73D7BFA966BB", PublicKey: key1}, room)
+	registerPeer(t, httpServer, server.RegisterPeerReq{UID: peer2, Secret: peerSecret2}, room)
+
+	stream := peerOpensStream(t, httpServer, room, peerSecret2)
+	defer stream.Close()
+
+	m := readEvent(t, bufio.NewReader(stream))
+	var payload struct {
+		Type string            `json:"type"`
+		Keys map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(m.Payload, &payload); err != nil {
+		t.Fatalf("can't decode payload %s: %v", m.Payload, err)
+	}
+	if payload.Type != "key_directory" || payload.Keys[peer1] != key1 {
+		t.Errorf("got %s, want key directory with key of %s", m.Payload, peer1)
+	}
+}
+
+func peerOpensStream(t *testing.T, s *httptest.Server, room string, secret string) io.ReadCloser {
+	t.Helper()
+	res, err := s.Client().Get(s.URL + "/rooms/" + room + "/events?access_token=" + secret)
+	if err != nil {
+		t.Fatalf("could not open event stream: %v", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("event stream returned %q status, but wanted 200", res.Status)
+	}
+	return res.Body
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) messaging.Message {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("can't read event: %v", err)
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var m messaging.Message
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m); err != nil {
+			t.Fatalf("can't decode event %q: %v", line, err)
+		}
+		return m
+	}
+}
+
+func postMessage(t *testing.T, s *httptest.Server, room string, secret string, m agent.ClientMessage) {
+	t.Helper()
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("could not marshal message: %v", err)
+	}
+	req, err := http.NewRequest("POST", s.URL+"/rooms/"+room+"/messages", bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatalf("could not instantiate send message request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	res, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("send message request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 202 {
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("send message returned %q status and %q body, but wanted 202", res.Status, string(bodyBytes))
+	}
+}
+
 func peerJoinsRoom(t *testing.T, s *httptest.Server, room string, secret string) *websocket.Conn {
 	ws, _, err := joinRoom(s, room, secret, false)
 	if err != nil {
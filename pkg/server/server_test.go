@@ -2,16 +2,26 @@ package server_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/montrosesoftware/tarpon/pkg/audit"
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/history"
 	"github.com/montrosesoftware/tarpon/pkg/logging"
 	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/presence"
+	"github.com/montrosesoftware/tarpon/pkg/ratelimit"
 	"github.com/montrosesoftware/tarpon/pkg/server"
 )
 
@@ -22,6 +32,7 @@ var (
 	myRoomUID     = "room-123"
 	mySecret      = "0123456789-0123456789-0123456789"
 	myPeer        = "peer-abc"
+	usedSecret    = "used-0123456789-0123456789"
 )
 
 type SpyRoomStore struct {
@@ -40,19 +51,40 @@ func (s *SpyRoomStore) CreateRoom(uid string) bool {
 	return true
 }
 
-func (s *SpyRoomStore) RegisterPeer(room string, peer messaging.Peer) bool {
+func (s *SpyRoomStore) RegisterPeer(room string, peer messaging.Peer) (bool, error) {
 	if room != myRoomUID {
 		s.t.Errorf("unexpected room %q passed to register peer", room)
-		return false
+		return false, nil
+	}
+	if peer.Secret == usedSecret {
+		return false, messaging.ErrSecretInUse
 	}
 	if peer.UID == "duplicate" {
-		return false
+		return false, nil
 	}
 	s.peers = append(s.peers, peer)
-	return true
+	return true, nil
 }
 
-func dummyPeerHandler(messaging.Peer, string, *websocket.Conn) {}
+func (s *SpyRoomStore) ListRooms() []messaging.RoomInfo {
+	rooms := make([]messaging.RoomInfo, len(s.rooms))
+	for i, uid := range s.rooms {
+		rooms[i] = messaging.RoomInfo{UID: uid}
+	}
+	return rooms
+}
+
+func (s *SpyRoomStore) DeleteRoom(uid string) bool {
+	for i, room := range s.rooms {
+		if room == uid {
+			s.rooms = append(s.rooms[:i], s.rooms[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func dummyPeerHandler(messaging.Peer, string, *websocket.Conn, *http.Request) {}
 
 func TestCreateRoomRequest(t *testing.T) {
 	cases := map[string]struct {
@@ -132,6 +164,42 @@ func TestRegisterPeerRequest(t *testing.T) {
 			wantStatus: 400,
 			wantPeer:   false,
 		},
+		"returns error when peer UID is spoofed as server identity": {
+			peer:       &messaging.Peer{UID: tarponUID + ":recorder", Secret: mySecret},
+			room:       myRoomUID,
+			wantStatus: 400,
+			wantPeer:   false,
+		},
+		"creates given host": {
+			peer:       &messaging.Peer{UID: myPeer, Secret: mySecret, Role: messaging.RoleHost},
+			room:       myRoomUID,
+			wantStatus: 201,
+			wantPeer:   true,
+		},
+		"returns error when secret expired": {
+			peer:       &messaging.Peer{UID: myPeer, Secret: mySecret, ExpiresAt: time.Now().Add(-time.Minute)},
+			room:       myRoomUID,
+			wantStatus: 400,
+			wantPeer:   false,
+		},
+		"returns error when role unknown": {
+			peer:       &messaging.Peer{UID: myPeer, Secret: mySecret, Role: "admin"},
+			room:       myRoomUID,
+			wantStatus: 400,
+			wantPeer:   false,
+		},
+		"creates given peer with public key": {
+			peer:       &messaging.Peer{UID: myPeer, Secret: mySecret, PublicKey: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+			room:       myRoomUID,
+			wantStatus: 201,
+			wantPeer:   true,
+		},
+		"returns error when public key invalid": {
+			peer:       &messaging.Peer{UID: myPeer, Secret: mySecret, PublicKey: "not-a-key"},
+			room:       myRoomUID,
+			wantStatus: 400,
+			wantPeer:   false,
+		},
 		"returns error when peer secret too long": {
 			peer:       &messaging.Peer{UID: myPeer, Secret: tooLongSecret},
 			room:       myRoomUID,
@@ -148,6 +216,12 @@ func TestRegisterPeerRequest(t *testing.T) {
 			wantStatus:  200,
 			wantPeer:    false,
 			wantMessage: "OK\n",
+		}, "returns error when secret used by another peer": {
+			peer:        &messaging.Peer{UID: myPeer, Secret: usedSecret},
+			room:        myRoomUID,
+			wantStatus:  409,
+			wantPeer:    false,
+			wantMessage: "secret: used by another peer\n",
 		},
 	}
 	for name, tt := range cases {
@@ -169,6 +243,1113 @@ func TestRegisterPeerRequest(t *testing.T) {
 	}
 }
 
+type SpySink struct {
+	events []events.Event
+}
+
+func (s *SpySink) Notify(e events.Event) {
+	s.events = append(s.events, e)
+}
+
+func TestNotifyRoomEvents(t *testing.T) {
+	store := &SpyRoomStore{t: t}
+	sink := &SpySink{}
+	server := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+	server.EnableEvents(sink)
+
+	server.ServeHTTP(httptest.NewRecorder(), newCreateRoomRequest(t, myRoomUID))
+	server.ServeHTTP(httptest.NewRecorder(), newCreateRoomRequest(t, "duplicate"))
+	server.ServeHTTP(httptest.NewRecorder(), newRegisterPeerRequest(t, myRoomUID, &messaging.Peer{UID: myPeer, Secret: mySecret}))
+	server.ServeHTTP(httptest.NewRecorder(), newRegisterPeerRequest(t, myRoomUID, &messaging.Peer{UID: "duplicate", Secret: mySecret}))
+
+	want := []events.Event{
+		{Type: events.RoomCreated, Room: myRoomUID},
+		{Type: events.PeerRegistered, Room: myRoomUID, Peer: myPeer},
+	}
+	if len(sink.events) != len(want) {
+		t.Fatalf("got events %v, but want %v", sink.events, want)
+	}
+	for i, e := range sink.events {
+		if e.Type != want[i].Type || e.Room != want[i].Room || e.Peer != want[i].Peer {
+			t.Errorf("at index %d got event %+v, but want %+v", i, e, want[i])
+		}
+	}
+}
+
+func TestListRooms(t *testing.T) {
+	store := &SpyRoomStore{rooms: []string{"room-1", "room-2"}}
+	server := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+	server.EnableAdminAuth("admin-token")
+
+	request, err := http.NewRequest("GET", "/rooms", nil)
+	if err != nil {
+		t.Fatalf("could not instantiate list rooms request: %v", err)
+	}
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertStatus(t, response, 401)
+
+	request.Header.Set("Authorization", "Bearer admin-token")
+	response = httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertStatus(t, response, 200)
+
+	var res struct {
+		Rooms []messaging.RoomInfo `json:"rooms"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	want := []messaging.RoomInfo{{UID: "room-1"}, {UID: "room-2"}}
+	if !reflect.DeepEqual(res.Rooms, want) {
+		t.Errorf("got rooms %v, want %v", res.Rooms, want)
+	}
+}
+
+type StubPresence struct {
+	err error
+}
+
+func (p StubPresence) Online(room string) ([]string, error) {
+	if room == "room-1" {
+		return []string{myPeer, "other-peer"}, p.err
+	}
+	return []string{}, p.err
+}
+
+func TestPresence(t *testing.T) {
+	cases := map[string]struct {
+		url        string
+		err        error
+		wantStatus int
+		wantBody   string
+	}{
+		"lists room's peers": {
+			url:        "/rooms/room-1/presence",
+			wantStatus: 200,
+			wantBody:   `{"peers":["` + myPeer + `","other-peer"]}` + "\n",
+		},
+		"lists peers of empty room": {
+			url:        "/rooms/room-2/presence",
+			wantStatus: 200,
+			wantBody:   `{"peers":[]}` + "\n",
+		},
+		"counts online peers of rooms": {
+			url:        "/rooms",
+			wantStatus: 200,
+			wantBody:   `{"rooms":[{"uid":"room-1","peers":0,"online":2},{"uid":"room-2","peers":0}]}` + "\n",
+		},
+		"returns error when presence unavailable": {
+			url:        "/rooms/room-1/presence",
+			err:        errors.New("unreachable"),
+			wantStatus: 500,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			store := &SpyRoomStore{rooms: []string{"room-1", "room-2"}}
+			server := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableAdminAuth("admin-token")
+			server.EnablePresence(StubPresence{err: tt.err})
+
+			request, err := http.NewRequest("GET", tt.url, nil)
+			if err != nil {
+				t.Fatalf("could not instantiate presence request: %v", err)
+			}
+			request.Header.Set("Authorization", "Bearer admin-token")
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			if tt.wantBody != "" && response.Body.String() != tt.wantBody {
+				t.Errorf("got body %q, want %q", response.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// StubRouter assigns remote-room to node-b and other rooms to this node. Nodes
+// disagree about owners when split is set.
+type StubRouter struct {
+	split bool
+}
+
+func (StubRouter) Route(room string) (presence.Node, bool) {
+	if room == "remote-room" {
+		return presence.Node{ID: "node-b", URL: "https://b.example.com/"}, false
+	}
+	return presence.Node{ID: "node-a", URL: "https://a.example.com"}, true
+}
+
+func (r StubRouter) Agreed() bool {
+	return !r.split
+}
+
+func TestRouting(t *testing.T) {
+	cases := map[string]struct {
+		url          string
+		redirect     bool
+		split        bool
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+	}{
+		"returns node of remote room": {
+			url:        "/rooms/remote-room/node",
+			wantStatus: 200,
+			wantBody:   `{"node":"node-b","url":"https://b.example.com/"}` + "\n",
+		},
+		"returns this node": {
+			url:        "/rooms/local-room/node",
+			wantStatus: 200,
+			wantBody:   `{"node":"node-a","url":"https://a.example.com"}` + "\n",
+		},
+		"redirects peer to owner": {
+			url:          "/rooms/remote-room/ws?access_token=secret",
+			redirect:     true,
+			wantStatus:   307,
+			wantLocation: "https://b.example.com/rooms/remote-room/ws?access_token=secret",
+		},
+		"asks peer to retry while nodes disagree": {
+			url:        "/rooms/remote-room/ws",
+			redirect:   true,
+			split:      true,
+			wantStatus: 503,
+		},
+		"joins local room while nodes disagree": {
+			url:        "/rooms/local-room/ws",
+			redirect:   true,
+			split:      true,
+			wantStatus: 404,
+		},
+		"joins local room": {
+			url:        "/rooms/local-room/ws",
+			redirect:   true,
+			wantStatus: 404,
+		},
+		"joins remote room without redirects": {
+			url:        "/rooms/remote-room/ws",
+			wantStatus: 404,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			server := server.NewRoomServer(&StubRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableRouting(StubRouter{split: tt.split}, tt.redirect)
+
+			request, err := http.NewRequest("GET", tt.url, nil)
+			if err != nil {
+				t.Fatalf("could not instantiate routing request: %v", err)
+			}
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			if tt.wantBody != "" && response.Body.String() != tt.wantBody {
+				t.Errorf("got body %q, want %q", response.Body.String(), tt.wantBody)
+			}
+			if got := response.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("got location %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	cases := map[string]struct {
+		room        string
+		token       string
+		wantStatus  int
+		wantActions []string
+		wantEvents  int
+	}{
+		"deletes room and closes its sessions": {
+			room:        myRoomUID,
+			token:       "admin-token",
+			wantStatus:  204,
+			wantActions: []string{"close " + myRoomUID},
+			wantEvents:  1,
+		},
+		"returns error when room unknown": {
+			room:       "unknown",
+			token:      "admin-token",
+			wantStatus: 404,
+		},
+		"returns error without admin token": {
+			room:       myRoomUID,
+			token:      mySecret,
+			wantStatus: 401,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			store := &SpyRoomStore{rooms: []string{myRoomUID}}
+			moderator := &SpyModerator{}
+			sink := &SpySink{}
+			server := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableAdminAuth("admin-token")
+			server.EnableModeration(moderator)
+			server.EnableEvents(sink)
+			messages := history.NewStore(history.Limits{MaxCount: 10})
+			server.EnableHistory(messages)
+			b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), messages, 0)
+			if err := b.Send(myRoomUID, messaging.Message{From: myPeer, Payload: json.RawMessage(`"hi"`)}); err != nil {
+				t.Fatalf("could not send message: %v", err)
+			}
+
+			request, err := http.NewRequest("DELETE", "/rooms/"+tt.room, nil)
+			if err != nil {
+				t.Fatalf("could not instantiate delete room request: %v", err)
+			}
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			if !reflect.DeepEqual(moderator.actions, tt.wantActions) {
+				t.Errorf("got actions %v, but want %v", moderator.actions, tt.wantActions)
+			}
+			if len(sink.events) != tt.wantEvents {
+				t.Errorf("got events %v, want %d", sink.events, tt.wantEvents)
+			}
+			if deleted := len(store.rooms) == 0; deleted != (tt.wantStatus == 204) {
+				t.Errorf("got rooms %v after status %d", store.rooms, tt.wantStatus)
+			}
+			if entries, _ := messages.Messages(myRoomUID, 0, 10); (len(entries) == 0) != (tt.wantStatus == 204) {
+				t.Errorf("got %d messages in history after status %d", len(entries), tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCreateRoomWithHistoryLimits(t *testing.T) {
+	messages := history.NewStore(history.Limits{})
+	server := server.NewRoomServer(&SpyRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+	server.EnableHistory(messages)
+
+	body := bytes.NewBufferString(`{"uid":"` + myRoomUID + `","history":{"max_count":2,"max_age":60}}`)
+	request, err := http.NewRequest("POST", "/rooms", body)
+	if err != nil {
+		t.Fatalf("could not instantiate create room request: %v", err)
+	}
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertStatus(t, response, 201)
+
+	b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), messages, 0)
+	for i := 0; i < 3; i++ {
+		if err := b.Send(myRoomUID, messaging.Message{From: myPeer, Payload: json.RawMessage(`"hi"`)}); err != nil {
+			t.Fatalf("could not send message: %v", err)
+		}
+	}
+	if entries, _ := messages.Messages(myRoomUID, 0, 10); len(entries) != 2 {
+		t.Errorf("got %d messages in history, want 2", len(entries))
+	}
+
+	body = bytes.NewBufferString(`{"uid":"another","history":{"max_count":-1}}`)
+	request, err = http.NewRequest("POST", "/rooms", body)
+	if err != nil {
+		t.Fatalf("could not instantiate create room request: %v", err)
+	}
+	response = httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertStatus(t, response, 400)
+}
+
+type SpyConnectionSettings struct {
+	overrides map[string]server.ConnectionReq
+}
+
+func (c *SpyConnectionSettings) CheckOverrides(req server.ConnectionReq) error {
+	if req.PingPeriod >= req.PongWait && req.PongWait > 0 {
+		return errors.New("connection.ping_period: must be less than pong_wait")
+	}
+	return nil
+}
+
+func (c *SpyConnectionSettings) SetOverrides(room string, req server.ConnectionReq) {
+	c.overrides[room] = req
+}
+
+func TestCreateRoomWithConnectionOverrides(t *testing.T) {
+	cases := map[string]struct {
+		body     string
+		enabled  bool
+		status   int
+		override bool
+	}{
+		"overrides connection options":       {body: `{"uid":"room-123","connection":{"pong_wait":10,"ping_period":5,"max_message_size":1024}}`, enabled: true, status: 201, override: true},
+		"overrides message rate":             {body: `{"uid":"room-123","connection":{"message_rate":10,"message_burst":20,"max_rate_strikes":5}}`, enabled: true, status: 201, override: true},
+		"rejects message rate out of range":  {body: `{"uid":"room-123","connection":{"message_rate":20000}}`, enabled: true, status: 400},
+		"keeps defaults without overrides":   {body: `{"uid":"room-123"}`, enabled: true, status: 201},
+		"rejects overrides out of range":     {body: `{"uid":"room-123","connection":{"max_message_size":2000000}}`, enabled: true, status: 400},
+		"rejects invalid overrides":          {body: `{"uid":"room-123","connection":{"pong_wait":5,"ping_period":5}}`, enabled: true, status: 400},
+		"rejects overrides when not enabled": {body: `{"uid":"room-123","connection":{"pong_wait":10}}`, status: 400},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			store := &SpyRoomStore{}
+			settings := &SpyConnectionSettings{overrides: make(map[string]server.ConnectionReq)}
+			s := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+			if c.enabled {
+				s.EnableConnectionOverrides(settings)
+			}
+
+			request, err := http.NewRequest("POST", "/rooms", bytes.NewBufferString(c.body))
+			if err != nil {
+				t.Fatalf("could not instantiate create room request: %v", err)
+			}
+			response := httptest.NewRecorder()
+			s.ServeHTTP(response, request)
+
+			assertStatus(t, response, c.status)
+			assertRoomCreated(t, store, c.status == 201, myRoomUID)
+			if _, ok := settings.overrides[myRoomUID]; ok != c.override {
+				t.Errorf("got overrides %v, want overridden %v", settings.overrides, c.override)
+			}
+		})
+	}
+}
+
+func TestGetMessagesRequest(t *testing.T) {
+	messages := history.NewStore(history.Limits{MaxCount: 10})
+	b := history.NewBroker(broker.NewBroker(logging.NoopLogger{}), messages, 0)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := b.Send(myRoomUID, messaging.Message{ID: id, From: myPeer, Payload: json.RawMessage(`"hi"`)}); err != nil {
+			t.Fatalf("could not send message: %v", err)
+		}
+	}
+	server := server.NewRoomServer(&StubRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+	server.EnableHistory(messages)
+
+	res := getMessages(t, server, "/rooms/"+myRoomUID+"/messages?limit=2", mySecret, 200)
+	assertMessagesPage(t, res, []string{"a", "b"}, "2")
+
+	res = getMessages(t, server, "/rooms/"+myRoomUID+"/messages?after="+res.Next, mySecret, 200)
+	assertMessagesPage(t, res, []string{"c"}, "")
+
+	getMessages(t, server, "/rooms/"+myRoomUID+"/messages", "bad", 401)
+	getMessages(t, server, "/rooms/"+myRoomUID+"/messages?after=x", mySecret, 400)
+	getMessages(t, server, "/rooms/"+myRoomUID+"/messages?limit=1000", mySecret, 400)
+}
+
+func getMessages(t *testing.T, s *server.RoomServer, url string, secret string, wantStatus int) server.MessagesRes {
+	t.Helper()
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("could not instantiate get messages request: %v", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+secret)
+	response := httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+	assertStatus(t, response, wantStatus)
+
+	var res server.MessagesRes
+	if wantStatus == 200 {
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("could not decode messages response: %v", err)
+		}
+	}
+	return res
+}
+
+func assertMessagesPage(t *testing.T, got server.MessagesRes, wantIDs []string, wantNext string) {
+	t.Helper()
+	if len(got.Messages) != len(wantIDs) {
+		t.Fatalf("got %d messages, want %d", len(got.Messages), len(wantIDs))
+	}
+	for i, id := range wantIDs {
+		if got.Messages[i].Message.ID != id {
+			t.Errorf("at index %d got message %v, want id %q", i, got.Messages[i].Message, id)
+		}
+	}
+	if got.Next != wantNext {
+		t.Errorf("got next cursor %q, want %q", got.Next, wantNext)
+	}
+}
+
+func TestSendMessageRequest(t *testing.T) {
+	cases := map[string]struct {
+		secret      string
+		rejection   *messaging.Rejection
+		wantStatus  int
+		wantMessage string
+	}{
+		"accepts delivered message": {
+			secret:      mySecret,
+			wantStatus:  202,
+			wantMessage: "Accepted\n",
+		},
+		"returns error when bad secret": {
+			secret:      "bad",
+			wantStatus:  401,
+			wantMessage: "Unauthorized\n",
+		},
+		"returns error message when rejected": {
+			secret:      mySecret,
+			rejection:   &messaging.Rejection{ID: "msg-1", Code: messaging.ErrCodeTooLarge, Reason: "too large"},
+			wantStatus:  413,
+			wantMessage: `{"id":"msg-1","from":"tarpon","to":"peer-abc","payload":{"type":"error","code":"too_large","message":"too large"}}` + "\n",
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			handled := 0
+			mh := func(p messaging.Peer, room string, r *http.Request) *messaging.Rejection {
+				handled++
+				return tt.rejection
+			}
+			server := server.NewRoomServer(&StubRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableHTTPTransport(nil, mh)
+
+			request, err := http.NewRequest("POST", "/rooms/"+myRoomUID+"/messages", bytes.NewBufferString(`{"payload":"hi"}`))
+			if err != nil {
+				t.Fatalf("could not instantiate send message request: %v", err)
+			}
+			request.Header.Set("Authorization", "Bearer "+tt.secret)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			assertMessage(t, response, tt.wantMessage)
+			if tt.wantStatus != 401 && handled != 1 {
+				t.Errorf("message handled %d times, want 1", handled)
+			}
+		})
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	cases := map[string]struct {
+		token      string
+		wantStatus int
+	}{
+		"creates room with admin token":          {token: "admin-token", wantStatus: 201},
+		"returns error without admin token":      {token: "", wantStatus: 401},
+		"returns error with invalid admin token": {token: mySecret, wantStatus: 401},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			store := &SpyRoomStore{}
+			server := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableAdminAuth("admin-token")
+
+			request := newCreateRoomRequest(t, myRoomUID)
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			assertRoomCreated(t, store, tt.wantStatus == 201, myRoomUID)
+		})
+	}
+}
+
+type SpySender struct {
+	rooms    []string
+	messages []messaging.Message
+}
+
+func (s *SpySender) Send(room string, m messaging.Message) error {
+	if m.To == "offline" {
+		return broker.ErrRecipientOffline
+	}
+	if m.To == "failing" {
+		return errors.New("broker failed")
+	}
+	s.rooms = append(s.rooms, room)
+	s.messages = append(s.messages, m)
+	return nil
+}
+
+type PeersRoomStore struct {
+	server.RoomStore
+}
+
+func (PeersRoomStore) RoomExists(uid string) bool {
+	return uid == myRoomUID
+}
+
+func (PeersRoomStore) GetPeer(room string, uid string) (messaging.Peer, bool) {
+	return messaging.Peer{UID: uid}, room == myRoomUID && (uid == myPeer || uid == "offline" || uid == "failing")
+}
+
+func TestSendServerMessageRequest(t *testing.T) {
+	cases := map[string]struct {
+		room       string
+		token      string
+		body       string
+		wantStatus int
+		wantSent   *messaging.Message
+	}{
+		"sends broadcast from default identity": {
+			token:      "admin-token",
+			body:       `{"payload":"recording started"}`,
+			wantStatus: 202,
+			wantSent:   &messaging.Message{From: "tarpon:backend", Payload: json.RawMessage(`"recording started"`)},
+		},
+		"sends direct message from given identity": {
+			token:      "admin-token",
+			body:       `{"id":"1","from":"recorder","to":"` + myPeer + `","payload":"hi"}`,
+			wantStatus: 202,
+			wantSent:   &messaging.Message{ID: "1", From: "tarpon:recorder", To: myPeer, Payload: json.RawMessage(`"hi"`)},
+		},
+		"returns error without admin token": {
+			token:      mySecret,
+			body:       `{"payload":"hi"}`,
+			wantStatus: 401,
+		},
+		"returns error without payload": {
+			token:      "admin-token",
+			body:       `{"to":"` + myPeer + `"}`,
+			wantStatus: 400,
+		},
+		"returns error when recipient unknown": {
+			token:      "admin-token",
+			body:       `{"to":"unknown","payload":"hi"}`,
+			wantStatus: 422,
+		},
+		"returns error when recipient offline": {
+			token:      "admin-token",
+			body:       `{"to":"offline","payload":"hi"}`,
+			wantStatus: 409,
+		},
+		"returns error when sending fails": {
+			token:      "admin-token",
+			body:       `{"to":"failing","payload":"hi"}`,
+			wantStatus: 500,
+		},
+		"returns error when room unknown": {
+			room:       "unknown",
+			token:      "admin-token",
+			body:       `{"payload":"hi"}`,
+			wantStatus: 404,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			if tt.room == "" {
+				tt.room = myRoomUID
+			}
+			sender := &SpySender{}
+			server := server.NewRoomServer(PeersRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableAdminAuth("admin-token")
+			server.EnableServerMessages(sender, "backend")
+
+			request, err := http.NewRequest("POST", "/rooms/"+tt.room+"/messages", bytes.NewBufferString(tt.body))
+			if err != nil {
+				t.Fatalf("could not instantiate server message request: %v", err)
+			}
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			if tt.wantSent == nil {
+				if len(sender.messages) != 0 {
+					t.Errorf("sent messages %v, but want none", sender.messages)
+				}
+				return
+			}
+			if len(sender.messages) != 1 || sender.rooms[0] != myRoomUID {
+				t.Fatalf("sent messages %v to rooms %v, but want one to %q", sender.messages, sender.rooms, myRoomUID)
+			}
+			if !reflect.DeepEqual(sender.messages[0], *tt.wantSent) {
+				t.Errorf("sent message %+v, but want %+v", sender.messages[0], *tt.wantSent)
+			}
+		})
+	}
+}
+
+type SpyModerator struct {
+	actions []string
+}
+
+func (m *SpyModerator) Kick(room string, uid string) {
+	m.actions = append(m.actions, "kick "+room+"/"+uid)
+}
+
+func (m *SpyModerator) Disconnect(room string, uid string) {
+	m.actions = append(m.actions, "disconnect "+room+"/"+uid)
+}
+
+func (m *SpyModerator) Mute(room string, uid string, muted bool) {
+	if muted {
+		m.actions = append(m.actions, "mute "+room+"/"+uid)
+	} else {
+		m.actions = append(m.actions, "unmute "+room+"/"+uid)
+	}
+}
+
+func (m *SpyModerator) Ban(room string, uid string) {
+	m.actions = append(m.actions, "ban "+room+"/"+uid)
+}
+
+func (m *SpyModerator) IsBanned(room string, uid string) bool {
+	return uid == "banned"
+}
+
+func (m *SpyModerator) CloseRoom(room string) {
+	m.actions = append(m.actions, "close "+room)
+}
+
+func (m *SpyModerator) CloseAll() {
+	m.actions = append(m.actions, "close all")
+}
+
+func TestModeratePeerRequest(t *testing.T) {
+	cases := map[string]struct {
+		url        string
+		token      string
+		wantStatus int
+		wantAction string
+	}{
+		"kicks peer": {
+			url:        "/rooms/" + myRoomUID + "/peers/" + myPeer + "/kick",
+			token:      "admin-token",
+			wantStatus: 200,
+			wantAction: "kick " + myRoomUID + "/" + myPeer,
+		},
+		"mutes peer": {
+			url:        "/rooms/" + myRoomUID + "/peers/" + myPeer + "/mute",
+			token:      "admin-token",
+			wantStatus: 200,
+			wantAction: "mute " + myRoomUID + "/" + myPeer,
+		},
+		"unmutes peer": {
+			url:        "/rooms/" + myRoomUID + "/peers/" + myPeer + "/unmute",
+			token:      "admin-token",
+			wantStatus: 200,
+			wantAction: "unmute " + myRoomUID + "/" + myPeer,
+		},
+		"bans peer": {
+			url:        "/rooms/" + myRoomUID + "/peers/" + myPeer + "/ban",
+			token:      "admin-token",
+			wantStatus: 200,
+			wantAction: "ban " + myRoomUID + "/" + myPeer,
+		},
+		"returns error without admin token": {
+			url:        "/rooms/" + myRoomUID + "/peers/" + myPeer + "/kick",
+			token:      mySecret,
+			wantStatus: 401,
+		},
+		"returns error when peer unknown": {
+			url:        "/rooms/" + myRoomUID + "/peers/unknown/kick",
+			token:      "admin-token",
+			wantStatus: 404,
+		},
+		"returns error when action unknown": {
+			url:        "/rooms/" + myRoomUID + "/peers/" + myPeer + "/promote",
+			token:      "admin-token",
+			wantStatus: 404,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			moderator := &SpyModerator{}
+			server := server.NewRoomServer(PeersRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableAdminAuth("admin-token")
+			server.EnableModeration(moderator)
+
+			request, err := http.NewRequest("POST", tt.url, nil)
+			if err != nil {
+				t.Fatalf("could not instantiate moderate peer request: %v", err)
+			}
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			var wantActions []string
+			if tt.wantAction != "" {
+				wantActions = []string{tt.wantAction}
+			}
+			if !reflect.DeepEqual(moderator.actions, wantActions) {
+				t.Errorf("got actions %v, but want %v", moderator.actions, wantActions)
+			}
+		})
+	}
+}
+
+func TestRegisterBannedPeer(t *testing.T) {
+	store := &SpyRoomStore{t: t}
+	server := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+	server.EnableModeration(&SpyModerator{})
+
+	peer := &messaging.Peer{UID: "banned", Secret: mySecret}
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, newRegisterPeerRequest(t, myRoomUID, peer))
+
+	assertStatus(t, response, 403)
+	assertPeerRegistered(t, store, false, peer)
+}
+
+type SpySecretStore struct {
+	PeersRoomStore
+	rotated []messaging.Peer
+	revoked []string
+}
+
+func (s *SpySecretStore) RotateSecret(room string, uid string, secret string, expiresAt time.Time) (bool, error) {
+	if _, ok := s.GetPeer(room, uid); !ok {
+		return false, nil
+	}
+	if secret == usedSecret {
+		return true, messaging.ErrSecretInUse
+	}
+	s.rotated = append(s.rotated, messaging.Peer{UID: uid, Secret: secret, ExpiresAt: expiresAt})
+	return true, nil
+}
+
+func (s *SpySecretStore) RevokeSecret(room string, uid string) bool {
+	if _, ok := s.GetPeer(room, uid); !ok {
+		return false
+	}
+	s.revoked = append(s.revoked, uid)
+	return true
+}
+
+func TestRotateSecretRequest(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	cases := map[string]struct {
+		peer        string
+		body        string
+		wantStatus  int
+		wantRotated []messaging.Peer
+		wantActions []string
+	}{
+		"rotates secret": {
+			peer:        myPeer,
+			body:        `{"secret":"` + mySecret + `"}`,
+			wantStatus:  200,
+			wantRotated: []messaging.Peer{{UID: myPeer, Secret: mySecret}},
+		},
+		"rotates secret with expiry and terminates sessions": {
+			peer:        myPeer,
+			body:        `{"secret":"` + mySecret + `","expires_at":"` + expiresAt.Format(time.RFC3339) + `","terminate_sessions":true}`,
+			wantStatus:  200,
+			wantRotated: []messaging.Peer{{UID: myPeer, Secret: mySecret, ExpiresAt: expiresAt}},
+			wantActions: []string{"disconnect " + myRoomUID + "/" + myPeer},
+		},
+		"returns error when secret too short": {
+			peer:       myPeer,
+			body:       `{"secret":"short"}`,
+			wantStatus: 400,
+		},
+		"returns error when expiry in the past": {
+			peer:       myPeer,
+			body:       `{"secret":"` + mySecret + `","expires_at":"2000-01-01T00:00:00Z"}`,
+			wantStatus: 400,
+		},
+		"returns error when peer unknown": {
+			peer:       "unknown",
+			body:       `{"secret":"` + mySecret + `","terminate_sessions":true}`,
+			wantStatus: 404,
+		},
+		"returns error when secret used by another peer": {
+			peer:       myPeer,
+			body:       `{"secret":"` + usedSecret + `","terminate_sessions":true}`,
+			wantStatus: 409,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			store := &SpySecretStore{}
+			moderator := &SpyModerator{}
+			server := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableModeration(moderator)
+
+			request, err := http.NewRequest("POST", "/rooms/"+myRoomUID+"/peers/"+tt.peer+"/secret", bytes.NewBufferString(tt.body))
+			if err != nil {
+				t.Fatalf("could not instantiate rotate secret request: %v", err)
+			}
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			if !reflect.DeepEqual(store.rotated, tt.wantRotated) {
+				t.Errorf("got rotated peers %v, but want %v", store.rotated, tt.wantRotated)
+			}
+			if !reflect.DeepEqual(moderator.actions, tt.wantActions) {
+				t.Errorf("got actions %v, but want %v", moderator.actions, tt.wantActions)
+			}
+		})
+	}
+}
+
+func TestRevokeSecretRequest(t *testing.T) {
+	cases := map[string]struct {
+		url         string
+		wantStatus  int
+		wantRevoked []string
+		wantActions []string
+	}{
+		"revokes secret": {
+			url:         "/rooms/" + myRoomUID + "/peers/" + myPeer + "/secret",
+			wantStatus:  200,
+			wantRevoked: []string{myPeer},
+		},
+		"revokes secret and terminates sessions": {
+			url:         "/rooms/" + myRoomUID + "/peers/" + myPeer + "/secret?terminate_sessions=true",
+			wantStatus:  200,
+			wantRevoked: []string{myPeer},
+			wantActions: []string{"disconnect " + myRoomUID + "/" + myPeer},
+		},
+		"returns error when terminate_sessions invalid": {
+			url:        "/rooms/" + myRoomUID + "/peers/" + myPeer + "/secret?terminate_sessions=maybe",
+			wantStatus: 400,
+		},
+		"returns error when peer unknown": {
+			url:        "/rooms/" + myRoomUID + "/peers/unknown/secret",
+			wantStatus: 404,
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			store := &SpySecretStore{}
+			moderator := &SpyModerator{}
+			server := server.NewRoomServer(store, dummyPeerHandler, logging.NoopLogger{})
+			server.EnableModeration(moderator)
+
+			request, err := http.NewRequest("DELETE", tt.url, nil)
+			if err != nil {
+				t.Fatalf("could not instantiate revoke secret request: %v", err)
+			}
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+
+			assertStatus(t, response, tt.wantStatus)
+			if !reflect.DeepEqual(store.revoked, tt.wantRevoked) {
+				t.Errorf("got revoked peers %v, but want %v", store.revoked, tt.wantRevoked)
+			}
+			if !reflect.DeepEqual(moderator.actions, tt.wantActions) {
+				t.Errorf("got actions %v, but want %v", moderator.actions, tt.wantActions)
+			}
+		})
+	}
+}
+
+type SpyAudit struct {
+	events []audit.Event
+}
+
+func (a *SpyAudit) Record(e audit.Event) {
+	a.events = append(a.events, e)
+}
+
+func TestRecordAuditEvents(t *testing.T) {
+	spy := &SpyAudit{}
+	server := server.NewRoomServer(&StubRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+	server.EnableAdminAuth("admin-token")
+	server.EnableAudit(spy)
+
+	request := newCreateRoomRequest(t, myRoomUID)
+	request.RemoteAddr = "192.0.2.1:1234"
+	request.Header.Set(audit.RequestIDHeader, "req-1")
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	assertStatus(t, response, 401)
+	if got := response.Header().Get(audit.RequestIDHeader); got != "req-1" {
+		t.Errorf("got request id header %q, want %q", got, "req-1")
+	}
+
+	request, err := http.NewRequest("GET", "/rooms/"+myRoomUID+"/ws", nil)
+	if err != nil {
+		t.Fatalf("could not instantiate join request: %v", err)
+	}
+	request.Header.Set("Authorization", "Bearer wrong-secret")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	if len(spy.events) != 2 {
+		t.Fatalf("got %d audit events %v, want 2", len(spy.events), spy.events)
+	}
+	first, second := spy.events[0], spy.events[1]
+	if first.Type != audit.AdminAuthFailed || first.RemoteIP != "192.0.2.1" || first.RequestID != "req-1" {
+		t.Errorf("got event %+v, want failed admin authorization from 192.0.2.1", first)
+	}
+	if second.Type != audit.JoinFailed || second.Room != myRoomUID || second.RequestID == "" {
+		t.Errorf("got event %+v, want failed join of %q", second, myRoomUID)
+	}
+}
+
+type StubClientIPResolver struct{}
+
+func (StubClientIPResolver) ClientIP(r *http.Request) string {
+	return r.Header.Get("X-Client-IP")
+}
+
+type StubConnectionLimiter struct {
+	acquired map[string]int
+}
+
+func (l *StubConnectionLimiter) Acquire(key string) bool {
+	if l.acquired[key] > 0 {
+		return false
+	}
+	l.acquired[key]++
+	return true
+}
+
+func (l *StubConnectionLimiter) Release(key string) {
+	l.acquired[key]--
+}
+
+func TestClientLimits(t *testing.T) {
+	connections := &StubConnectionLimiter{acquired: map[string]int{"198.51.100.1": 1}}
+	server := server.NewRoomServer(&SpyRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+	server.EnableClientIPResolver(StubClientIPResolver{})
+	server.EnableClientLimits(ratelimit.NewBuckets(1, 2), connections)
+
+	createRoom := func(ip string) *httptest.ResponseRecorder {
+		request := newCreateRoomRequest(t, myRoomUID)
+		request.Header.Set("X-Client-IP", ip)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	assertStatus(t, createRoom("192.0.2.1"), 201)
+	assertStatus(t, createRoom("192.0.2.1"), 201)
+	response := createRoom("192.0.2.1")
+	assertStatus(t, response, 429)
+	if got := response.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want %q", got, "1")
+	}
+	assertStatus(t, createRoom("198.51.100.1"), 429)
+	assertStatus(t, createRoom("203.0.113.1"), 201)
+	if connections.acquired["192.0.2.1"] != 0 || connections.acquired["203.0.113.1"] != 0 {
+		t.Errorf("connections were not released, got %v", connections.acquired)
+	}
+}
+
+func TestAdminRequestsAreNotLimited(t *testing.T) {
+	connections := &StubConnectionLimiter{acquired: map[string]int{"192.0.2.1": 1}}
+	server := server.NewRoomServer(&SpyRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+	server.EnableClientIPResolver(StubClientIPResolver{})
+	server.EnableClientLimits(ratelimit.NewBuckets(1, 1), connections)
+	server.EnableAdminAuth("admin-token")
+
+	createRoom := func(token string) *httptest.ResponseRecorder {
+		request := newCreateRoomRequest(t, myRoomUID)
+		request.Header.Set("X-Client-IP", "192.0.2.1")
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		return response
+	}
+
+	for i := 0; i < 3; i++ {
+		assertStatus(t, createRoom("admin-token"), 201)
+	}
+	assertStatus(t, createRoom("invalid-token"), 429)
+	if connections.acquired["192.0.2.1"] != 1 {
+		t.Errorf("admin requests acquired connections, got %v", connections.acquired)
+	}
+}
+
+type StubHealthChecker struct {
+	err error
+}
+
+func (c *StubHealthChecker) CheckHealth() error {
+	return c.err
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	broker := &StubHealthChecker{}
+	s := server.NewRoomServer(&SpyRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+	s.SetBuildInfo(server.BuildInfo{Version: "1.2.3", GoVersion: "go1.15"})
+	s.AddHealthCheck("store", &StubHealthChecker{})
+	s.AddHealthCheck("broker", broker)
+	// client limits don't apply to probes
+	s.EnableClientLimits(ratelimit.NewBuckets(1, 1), nil)
+
+	probe := func(url string, wantStatus int) server.HealthRes {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatalf("could not instantiate request: %v", err)
+		}
+		response := httptest.NewRecorder()
+		s.ServeHTTP(response, request)
+		assertStatus(t, response, wantStatus)
+		var res server.HealthRes
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("could not decode response: %v", err)
+		}
+		return res
+	}
+
+	if res := probe("/healthz", 200); res.Status != server.StatusOK || res.Build.Version != "1.2.3" {
+		t.Errorf("got %+v, want ok status with build info", res)
+	}
+	if res := probe("/readyz", 200); res.Status != server.StatusReady || res.Checks["broker"] != server.StatusOK {
+		t.Errorf("got %+v, want ready", res)
+	}
+
+	broker.err = errors.New("backplane unreachable")
+	res := probe("/readyz", 503)
+	if res.Status != server.StatusNotReady || res.Checks["broker"] != "backplane unreachable" || res.Checks["store"] != server.StatusOK {
+		t.Errorf("got %+v, want not ready because of the broker", res)
+	}
+	probe("/healthz", 200)
+
+	broker.err = nil
+	if err := s.Shutdown(context.Background(), 0); err != nil {
+		t.Fatalf("could not shut down: %v", err)
+	}
+	if res := probe("/readyz", 503); res.Status != server.StatusDraining {
+		t.Errorf("got %+v, want draining", res)
+	}
+	if err := s.Shutdown(context.Background(), 0); err == nil {
+		t.Errorf("second shutdown should fail")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	listen := func(s *server.RoomServer) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			s.Listen("127.0.0.1", "0")
+			close(done)
+		}()
+		return done
+	}
+	assertStopped := func(done chan struct{}) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("server is still listening")
+		}
+	}
+
+	t.Run("closes sessions of peers", func(t *testing.T) {
+		s := server.NewRoomServer(&SpyRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+		moderator := &SpyModerator{}
+		s.EnableModeration(moderator)
+		done := listen(s)
+		time.Sleep(50 * time.Millisecond)
+
+		if err := s.Shutdown(context.Background(), 0); err != nil {
+			t.Fatalf("could not shut down: %v", err)
+		}
+		assertStopped(done)
+		if !reflect.DeepEqual(moderator.actions, []string{"close all"}) {
+			t.Errorf("got moderator actions %v, want sessions closed", moderator.actions)
+		}
+	})
+
+	t.Run("before listening", func(t *testing.T) {
+		s := server.NewRoomServer(&SpyRoomStore{}, dummyPeerHandler, logging.NoopLogger{})
+		if err := s.Shutdown(context.Background(), 0); err != nil {
+			t.Fatalf("could not shut down: %v", err)
+		}
+		assertStopped(listen(s))
+	})
+}
+
 func TestInvalidRequests(t *testing.T) {
 	cases := []struct {
 		url    string
@@ -177,12 +1358,16 @@ func TestInvalidRequests(t *testing.T) {
 	}{
 		{"/", "GET", 404},
 		{"/abc", "GET", 404},
-		{"/rooms", "GET", 405},
+		{"/rooms", "PUT", 405},
+		{"/rooms/abc", "POST", 405},
 		{"/rooms/abc/test", "POST", 404},
 		{"/rooms/abc/peers", "GET", 405},
 		{"/rooms/abc/peers/abc", "POST", 404},
+		{"/rooms/abc/peers/abc/secret", "GET", 405},
 		{"/rooms/abc/ws", "POST", 405},
 		{"/rooms/abc/ws/aaa", "GET", 404},
+		{"/healthz", "POST", 405},
+		{"/readyz/abc", "GET", 404},
 	}
 	for _, tt := range cases {
 		t.Run("check "+tt.url, func(t *testing.T) {
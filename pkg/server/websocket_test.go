@@ -6,10 +6,12 @@ import (
 	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/montrosesoftware/tarpon/pkg/logging"
 	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/ratelimit"
 	"github.com/montrosesoftware/tarpon/pkg/server"
 )
 
@@ -37,7 +39,7 @@ type SpyPeerHandler struct {
 	mutex sync.Mutex
 }
 
-func (s *SpyPeerHandler) handlePeer(p messaging.Peer, room string, conn *websocket.Conn) {
+func (s *SpyPeerHandler) handlePeer(p messaging.Peer, room string, conn *websocket.Conn, r *http.Request) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.handled = append(s.handled, struct {
@@ -135,6 +137,106 @@ func TestJoinRoomRequest(t *testing.T) {
 	}
 }
 
+func TestJoinLockout(t *testing.T) {
+	cases := map[string]struct {
+		perIP          server.FailureLimiter
+		perRoom        server.RoomLimiter
+		joinFirst      bool
+		wantJoinStatus int
+		wantRetryAfter string
+	}{
+		"locks out IP address": {
+			perIP:          ratelimit.NewLockout("test_ip", 2, time.Minute, time.Hour, time.Hour),
+			wantJoinStatus: 429,
+			wantRetryAfter: "60",
+		},
+		// attempts during the room's lockout count as failures, whatever their secrets
+		"locks out room": {
+			perRoom:        ratelimit.NewLockout("test_room", 2, time.Minute, time.Hour, time.Hour),
+			wantJoinStatus: 429,
+			wantRetryAfter: "240",
+		},
+		"exempts IP address which joined the room": {
+			perRoom:        ratelimit.NewLockout("test_room", 2, time.Minute, time.Hour, time.Hour),
+			joinFirst:      true,
+			wantJoinStatus: 101,
+			wantRetryAfter: "120",
+		},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			ph := &SpyPeerHandler{}
+			roomServer := server.NewRoomServer(&StubRoomStore{}, ph.handlePeer, logging.NoopLogger{})
+			roomServer.EnableJoinProtection(tt.perIP, tt.perRoom)
+			server := httptest.NewServer(roomServer)
+			defer server.Close()
+
+			if tt.joinFirst {
+				ws, response, err := joinRoom(server, myRoomUID, mySecret, false)
+				if err == nil {
+					ws.Close()
+				}
+				assertResponseStatus(t, response, 101)
+			}
+
+			_, response, _ := joinRoom(server, myRoomUID, "bad", false)
+			assertResponseStatus(t, response, 401)
+			_, response, _ = joinRoom(server, myRoomUID, "bad", false)
+			assertResponseStatus(t, response, 401)
+			if got := response.Header.Get("Retry-After"); got != "60" {
+				t.Errorf("got Retry-After %q, want %q", got, "60")
+			}
+
+			ws, response, err := joinRoom(server, myRoomUID, mySecret, false)
+			if err == nil {
+				ws.Close()
+			}
+			assertResponseStatus(t, response, tt.wantJoinStatus)
+
+			_, response, _ = joinRoom(server, myRoomUID, "bad", false)
+			if tt.joinFirst {
+				// the exempted IP address gets answers to its attempts
+				assertResponseStatus(t, response, 401)
+			} else {
+				assertResponseStatus(t, response, 429)
+			}
+			if got := response.Header.Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("got Retry-After %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	cases := map[string]struct {
+		origin     string
+		wantStatus int
+	}{
+		"allows listed origin":          {origin: "https://example.com", wantStatus: 101},
+		"allows request without origin": {origin: "", wantStatus: 101},
+		"rejects other origin":          {origin: "https://evil.example.com", wantStatus: 403},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			ph := &SpyPeerHandler{}
+			roomServer := server.NewRoomServer(&StubRoomStore{}, ph.handlePeer, logging.NoopLogger{})
+			roomServer.SetAllowedOrigins([]string{"https://example.com"})
+			server := httptest.NewServer(roomServer)
+			defer server.Close()
+
+			header := http.Header{"Authorization": {"Bearer " + mySecret}}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			ws, response, err := websocket.DefaultDialer.Dial("ws://"+server.Listener.Addr().String()+"/rooms/"+myRoomUID+"/ws", header)
+			if err == nil {
+				ws.Close()
+			}
+			assertResponseStatus(t, response, tt.wantStatus)
+		})
+	}
+}
+
 func joinRoom(server *httptest.Server, room string, secret string, useSubprotocol bool) (*websocket.Conn, *http.Response, error) {
 	wsURL := "ws://" + server.Listener.Addr().String() + "/rooms/" + room + "/ws"
 
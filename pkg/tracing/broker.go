@@ -0,0 +1,35 @@
+package tracing
+
+import (
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+)
+
+// Broker records a span of every message sent through the underlying broker.
+// The span is a child of the message's trace and replaces it, so that spans of
+// delivering the message to subscribers are its children.
+type Broker struct {
+	broker.Broker
+	tracer Tracer
+}
+
+func NewBroker(b broker.Broker, t Tracer) *Broker {
+	return &Broker{Broker: b, tracer: t}
+}
+
+func (b *Broker) Send(room string, message messaging.Message) error {
+	parent, _ := ParseTraceContext(message.Trace, message.TraceState)
+	span := b.tracer.StartSpan(parent, "Broker.Send")
+	defer span.End()
+	span.SetAttribute("room", room)
+	span.SetAttribute("from", message.From)
+	if message.To != "" {
+		span.SetAttribute("to", message.To)
+	}
+
+	message.Trace = span.Context().Traceparent()
+	message.TraceState = span.Context().TraceState
+	err := b.Broker.Send(room, message)
+	span.SetError(err)
+	return err
+}
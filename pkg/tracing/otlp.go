@@ -0,0 +1,183 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OTLP span kinds and status codes.
+const (
+	otlpKindInternal = 1
+	otlpStatusError  = 2
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP over HTTP,
+// using the JSON encoding. The endpoint is the collector's traces URL, e.g.
+// http://localhost:4318/v1/traces. Spans are exported as spans of the resource,
+// which are attributes describing the server, see NewResource.
+type OTLPExporter struct {
+	endpoint string
+	resource map[string]string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string, resource map[string]string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{endpoint: endpoint, resource: resource, client: &http.Client{Timeout: timeout}}
+}
+
+// SetHeaders sets headers sent with every export request, e.g. to authenticate
+// with the collector.
+func (e *OTLPExporter) SetHeaders(headers map[string]string) {
+	e.headers = headers
+}
+
+// NewResource returns resource attributes of the service, following semantic
+// conventions of OpenTelemetry. Attributes given by users, e.g. with
+// OTEL_RESOURCE_ATTRIBUTES, take precedence over detected ones, except for the
+// service name, which is always the given one.
+func NewResource(service string, version string, instance string, attrs map[string]string) map[string]string {
+	resource := map[string]string{
+		"service.name":            service,
+		"service.version":         version,
+		"service.instance.id":     instance,
+		"telemetry.sdk.name":      "tarpon",
+		"telemetry.sdk.language":  "go",
+		"process.pid":             strconv.Itoa(os.Getpid()),
+		"process.runtime.name":    "go",
+		"process.runtime.version": runtime.Version(),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		resource["host.name"] = hostname
+	}
+	for k, v := range attrs {
+		resource[k] = v
+	}
+	resource["service.name"] = service
+	for k, v := range resource {
+		if v == "" {
+			delete(resource, k)
+		}
+	}
+	return resource
+}
+
+func (e *OTLPExporter) Export(spans []SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", res.Status)
+	}
+	return nil
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	TraceState        string          `json:"traceState,omitempty"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *OTLPExporter) request(spans []SpanData) otlpRequest {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, d := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(d.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(d.Context.SpanID[:]),
+			TraceState:        d.Context.TraceState,
+			Name:              d.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(d.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(d.End.UnixNano(), 10),
+			Attributes:        attributes(d.Attributes),
+		}
+		if d.Parent != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(d.Parent[:])
+		}
+		if d.Error != "" {
+			s.Status = &otlpStatus{Code: otlpStatusError, Message: d.Error}
+		}
+		converted = append(converted, s)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: attributes(e.resource)},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "tarpon"}, Spans: converted}},
+	}}}
+}
+
+// attributes converts the map to attributes sorted by key
+func attributes(m map[string]string) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(m))
+	for k, v := range m {
+		attrs = append(attrs, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
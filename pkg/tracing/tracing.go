@@ -0,0 +1,386 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+)
+
+// Headers carrying the trace context of HTTP requests, as defined by W3C Trace
+// Context.
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+const (
+	defaultBatchSize     = 512
+	defaultQueueSize     = 2048
+	defaultFlushInterval = 5 * time.Second
+
+	maxTracestateMembers = 32
+	maxTracestateLength  = 512
+)
+
+// SpanContext identifies a span and the trace it belongs to. It's propagated
+// between spans in the traceparent format, e.g. in the trace field of messages.
+// TraceState is the vendor specific state of the trace in the tracestate format,
+// which the tracer doesn't use, but passes on to children of the span.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+// IsValid reports whether the context identifies a span.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// Traceparent returns the context in the traceparent format, or an empty string
+// when it's not valid.
+func (c SpanContext) Traceparent() string {
+	if !c.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(c.TraceID[:]), hex.EncodeToString(c.SpanID[:]), flags)
+}
+
+// ParseTraceparent reads a context in the traceparent format. It returns false
+// when the value is not a valid version 00 traceparent.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var c SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return c, false
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c, c.IsValid()
+}
+
+// ParseTraceContext reads a context in the traceparent format along with its
+// state in the tracestate format. The state is dropped when it's not valid, as
+// W3C Trace Context requires, without making the context invalid.
+func ParseTraceContext(traceparent string, tracestate string) (SpanContext, bool) {
+	c, ok := ParseTraceparent(traceparent)
+	if !ok {
+		return c, false
+	}
+	c.TraceState = parseTracestate(tracestate)
+	return c, true
+}
+
+// parseTracestate returns the list of key=value members without empty ones, or an
+// empty string when the list is not valid
+func parseTracestate(s string) string {
+	if len(s) > maxTracestateLength {
+		return ""
+	}
+	members := make([]string, 0, 4)
+	keys := make(map[string]bool)
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		i := strings.IndexByte(m, '=')
+		if i < 0 || !validTracestateKey(m[:i]) || !validTracestateValue(m[i+1:]) || keys[m[:i]] {
+			return ""
+		}
+		keys[m[:i]] = true
+		members = append(members, m)
+	}
+	if len(members) > maxTracestateMembers {
+		return ""
+	}
+	return strings.Join(members, ",")
+}
+
+// validTracestateKey reports whether the key is a simple key or a multi-tenant
+// key with a tenant ID, e.g. rojo or tenant@vendor
+func validTracestateKey(k string) bool {
+	tenant, system := "", k
+	if i := strings.IndexByte(k, '@'); i >= 0 {
+		tenant, system = k[:i], k[i+1:]
+		if tenant == "" || len(tenant) > 241 || len(system) > 14 {
+			return false
+		}
+	}
+	if system == "" || len(k) > 256 || system[0] < 'a' || system[0] > 'z' {
+		return false
+	}
+	for _, r := range tenant + system {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-', r == '*', r == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validTracestateValue reports whether the value has printable ASCII characters
+// other than comma and equals sign and doesn't end with a space
+func validTracestateValue(v string) bool {
+	if v == "" || len(v) > 256 || v[len(v)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e || v[i] == ',' || v[i] == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// Span is an operation of a trace. Spans must be ended, unfinished spans are
+// never exported.
+type Span interface {
+	Context() SpanContext
+	SetAttribute(key string, value string)
+	SetError(err error)
+	End()
+}
+
+// Tracer starts spans. Spans are children of the parent, or roots of new traces
+// when the parent is not valid.
+type Tracer interface {
+	StartSpan(parent SpanContext, name string) Span
+}
+
+// NoopTracer starts spans which are not recorded. Their context is empty, so that
+// trace context sent by clients isn't passed on to other peers when tracing is off.
+type NoopTracer struct{}
+
+func (NoopTracer) StartSpan(parent SpanContext, name string) Span {
+	return noopSpan{}
+}
+
+type noopSpan struct {
+	ctx SpanContext
+}
+
+func (s noopSpan) Context() SpanContext      { return s.ctx }
+func (noopSpan) SetAttribute(string, string) {}
+func (noopSpan) SetError(error)              {}
+func (noopSpan) End()                        {}
+
+// SpanData is a finished span.
+type SpanData struct {
+	Name       string
+	Context    SpanContext
+	Parent     [8]byte
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// Provider records spans and hands them to the exporter in batches. Spans are
+// queued in a bounded queue and dropped when it's full, so that tracing never
+// slows down messaging.
+//
+// New traces are sampled with the sample ratio, by their trace ID like the
+// TraceIDRatioBased sampler of OpenTelemetry, and children follow their parents.
+type Provider struct {
+	exporter      Exporter
+	batchSize     int
+	flushInterval time.Duration
+	sampleBound   uint64
+	queue         chan SpanData
+	stopChan      chan struct{}
+	wg            sync.WaitGroup
+	logger        logging.Logger
+}
+
+// NewProvider creates a provider sampling the ratio of new traces, which is between
+// 0 and 1.
+func NewProvider(e Exporter, flushInterval time.Duration, sampleRatio float64, l logging.Logger) *Provider {
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+	return &Provider{
+		exporter:      e,
+		batchSize:     defaultBatchSize,
+		flushInterval: flushInterval,
+		sampleBound:   sampleBound(sampleRatio),
+		queue:         make(chan SpanData, defaultQueueSize),
+		stopChan:      make(chan struct{}),
+		logger:        l,
+	}
+}
+
+// Start starts exporting spans.
+func (p *Provider) Start() {
+	p.wg.Add(1)
+	go p.work()
+	p.logger.Info("tracing enabled", logging.Fields{"flush_interval": p.flushInterval, "sample_ratio": float64(p.sampleBound) / (1 << 63)})
+}
+
+// Stop exports queued spans and stops exporting.
+func (p *Provider) Stop() {
+	close(p.stopChan)
+	p.wg.Wait()
+}
+
+// StartSpan starts a span, which is recorded only when the parent is sampled or,
+// when there's no parent, the new trace is sampled. The span keeps the state of
+// its parent's trace.
+func (p *Provider) StartSpan(parent SpanContext, name string) Span {
+	if !parent.IsValid() {
+		id := newTraceID()
+		parent = SpanContext{TraceID: id, Sampled: p.sampled(id)}
+	}
+	ctx := SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Sampled: parent.Sampled, TraceState: parent.TraceState}
+	if !ctx.Sampled {
+		return noopSpan{ctx: ctx}
+	}
+	return &span{
+		provider: p,
+		data: SpanData{
+			Name:       name,
+			Context:    ctx,
+			Parent:     parent.SpanID,
+			Start:      time.Now(),
+			Attributes: make(map[string]string),
+		},
+	}
+}
+
+// sampled reports whether a new trace is sampled, comparing the lower half of its
+// ID with the bound
+func (p *Provider) sampled(id [16]byte) bool {
+	return binary.BigEndian.Uint64(id[8:])>>1 < p.sampleBound
+}
+
+// sampleBound returns the bound of 63 bit numbers sampled with the ratio
+func sampleBound(ratio float64) uint64 {
+	switch {
+	case ratio >= 1:
+		return 1 << 63
+	case ratio <= 0:
+		return 0
+	}
+	return uint64(ratio * (1 << 63))
+}
+
+// enqueue never blocks, spans are dropped when the queue is full
+func (p *Provider) enqueue(d SpanData) {
+	select {
+	case p.queue <- d:
+	default:
+		p.logger.Warn("span dropped, queue is full", logging.Fields{"span": d.Name, "queue_length": len(p.queue)})
+	}
+}
+
+func (p *Provider) work() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, p.batchSize)
+	for {
+		select {
+		case d := <-p.queue:
+			batch = append(batch, d)
+			if len(batch) >= p.batchSize {
+				batch = p.export(batch)
+			}
+		case <-ticker.C:
+			batch = p.export(batch)
+		case <-p.stopChan:
+			for {
+				select {
+				case d := <-p.queue:
+					batch = append(batch, d)
+				default:
+					p.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends the batch and returns an empty one. Failed batches are dropped.
+func (p *Provider) export(batch []SpanData) []SpanData {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := p.exporter.Export(batch); err != nil {
+		p.logger.Error("span export failed", logging.Fields{"spans": len(batch), "error": err})
+	}
+	return make([]SpanData, 0, p.batchSize)
+}
+
+type span struct {
+	provider *Provider
+	data     SpanData
+	once     sync.Once
+	mutex    sync.Mutex
+}
+
+func (s *span) Context() SpanContext {
+	return s.data.Context
+}
+
+func (s *span) SetAttribute(key string, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Attributes[key] = value
+}
+
+func (s *span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Error = err.Error()
+}
+
+func (s *span) End() {
+	s.once.Do(func() {
+		s.mutex.Lock()
+		s.data.End = time.Now()
+		d := s.data
+		s.mutex.Unlock()
+		s.provider.enqueue(d)
+	})
+}
+
+func newTraceID() (id [16]byte) {
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+func newSpanID() (id [8]byte) {
+	_, _ = rand.Read(id[:])
+	return id
+}
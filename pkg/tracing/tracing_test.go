@@ -0,0 +1,262 @@
+package tracing_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/broker"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/messaging"
+	"github.com/montrosesoftware/tarpon/pkg/tracing"
+)
+
+const clientTrace = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	TraceState   string `json:"traceState"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Status       *struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type collectedAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// StubCollector stands in for an OpenTelemetry collector receiving OTLP/HTTP JSON.
+type StubCollector struct {
+	spans    []collectedSpan
+	resource map[string]string
+	headers  http.Header
+	mutex    sync.Mutex
+	t        *testing.T
+}
+
+func (c *StubCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		c.t.Errorf("got request to %q with content type %q", r.URL.Path, r.Header.Get("Content-Type"))
+	}
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []collectedAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []collectedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		c.t.Errorf("could not decode export request: %v", err)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.headers = r.Header
+	for _, rs := range req.ResourceSpans {
+		c.resource = make(map[string]string)
+		for _, a := range rs.Resource.Attributes {
+			c.resource[a.Key] = a.Value.StringValue
+		}
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *StubCollector) get() []collectedSpan {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]collectedSpan(nil), c.spans...)
+}
+
+type SpySubscriber struct {
+	messages []messaging.Message
+	mutex    sync.Mutex
+}
+
+func (s *SpySubscriber) ID() string {
+	return "peer-2"
+}
+
+func (s *SpySubscriber) Write(m messaging.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages = append(s.messages, m)
+}
+
+func TestTraceparent(t *testing.T) {
+	cases := map[string]struct {
+		value string
+		valid bool
+	}{
+		"sampled":             {value: clientTrace, valid: true},
+		"not sampled":         {value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", valid: true},
+		"empty":               {value: "", valid: false},
+		"unsupported version": {value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: false},
+		"zero trace id":       {value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", valid: false},
+		"not hex":             {value: "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", valid: false},
+		"too short":           {value: "00-4bf92f3577b34da6-00f067aa0ba902b7-01", valid: false},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			sc, ok := tracing.ParseTraceparent(c.value)
+			if ok != c.valid {
+				t.Fatalf("got valid %v, want %v", ok, c.valid)
+			}
+			if ok && sc.Traceparent() != c.value {
+				t.Errorf("got traceparent %q, want %q", sc.Traceparent(), c.value)
+			}
+		})
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	cases := map[string]struct {
+		tracestate string
+		want       string
+	}{
+		"none":                 {tracestate: "", want: ""},
+		"members":              {tracestate: "rojo=00f067aa0ba902b7, congo=t61rcWkgMzE", want: "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE"},
+		"multi-tenant key":     {tracestate: "tenant@vendor=value", want: "tenant@vendor=value"},
+		"empty members":        {tracestate: "rojo=1,,congo=2,", want: "rojo=1,congo=2"},
+		"uppercase key":        {tracestate: "Rojo=1", want: ""},
+		"duplicate key":        {tracestate: "rojo=1,rojo=2", want: ""},
+		"missing value":        {tracestate: "rojo=1,congo", want: ""},
+		"equals sign in value": {tracestate: "rojo=a=b", want: ""},
+		"too many members":     {tracestate: strings.Repeat("k=v,", 33), want: ""},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			sc, ok := tracing.ParseTraceContext(clientTrace, c.tracestate)
+			if !ok {
+				t.Fatalf("got invalid context")
+			}
+			if sc.TraceState != c.want {
+				t.Errorf("got tracestate %q, want %q", sc.TraceState, c.want)
+			}
+		})
+	}
+
+	if _, ok := tracing.ParseTraceContext("", "rojo=1"); ok {
+		t.Errorf("got valid context without traceparent")
+	}
+}
+
+func TestNoopTracerDropsParent(t *testing.T) {
+	parent, _ := tracing.ParseTraceparent(clientTrace)
+	span := tracing.NoopTracer{}.StartSpan(parent, "test")
+	if got := span.Context().Traceparent(); got != "" {
+		t.Errorf("got trace %q, want none", got)
+	}
+}
+
+func TestProviderSamplesRatioOfNewTraces(t *testing.T) {
+	cases := map[string]struct {
+		ratio    float64
+		min, max int
+	}{
+		"all":  {ratio: 1, min: 1000, max: 1000},
+		"none": {ratio: 0, min: 0, max: 0},
+		"some": {ratio: 0.25, min: 150, max: 350},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			provider := tracing.NewProvider(&StubExporter{}, time.Hour, c.ratio, logging.NoopLogger{})
+			sampled := 0
+			for i := 0; i < 1000; i++ {
+				if provider.StartSpan(tracing.SpanContext{}, "test").Context().Sampled {
+					sampled++
+				}
+			}
+			if sampled < c.min || sampled > c.max {
+				t.Errorf("sampled %d of 1000 traces, want between %d and %d", sampled, c.min, c.max)
+			}
+		})
+	}
+
+	// children follow their parents regardless of the ratio
+	provider := tracing.NewProvider(&StubExporter{}, time.Hour, 0, logging.NoopLogger{})
+	parent, _ := tracing.ParseTraceparent(clientTrace)
+	if !provider.StartSpan(parent, "test").Context().Sampled {
+		t.Errorf("child of a sampled parent not sampled")
+	}
+}
+
+type StubExporter struct{}
+
+func (*StubExporter) Export([]tracing.SpanData) error {
+	return nil
+}
+
+func TestBrokerExportsSpans(t *testing.T) {
+	collector := &StubCollector{t: t}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	resource := tracing.NewResource("tarpon", "1.2.3", "node-1", map[string]string{"deployment.environment": "test", "service.name": "other"})
+	exporter := tracing.NewOTLPExporter(server.URL+"/v1/traces", resource, time.Second)
+	exporter.SetHeaders(map[string]string{"Authorization": "Bearer secret"})
+	provider := tracing.NewProvider(exporter, time.Hour, 1, logging.NoopLogger{})
+	provider.Start()
+	b := tracing.NewBroker(broker.NewBroker(logging.NoopLogger{}), provider)
+	subscriber := &SpySubscriber{}
+	b.Register("room-123", subscriber)
+
+	err := b.Send("room-123", messaging.Message{From: "peer-1", Payload: []byte(`"hello"`), Trace: clientTrace, TraceState: "rojo=00f067aa0ba902b7"})
+	if err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+	err = b.Send("room-123", messaging.Message{From: "peer-1", To: "peer-3", Payload: []byte(`"hello"`)})
+	if err != broker.ErrRecipientOffline {
+		t.Fatalf("got error %v, want recipient offline", err)
+	}
+	// stopping the provider exports queued spans
+	provider.Stop()
+
+	spans := collector.get()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	sent := spans[0]
+	if sent.Name != "Broker.Send" || sent.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || sent.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("got span %+v, want a child of the message's trace", sent)
+	}
+	if want := "00-" + sent.TraceID + "-" + sent.SpanID + "-01"; subscriber.messages[0].Trace != want {
+		t.Errorf("got delivered trace %q, want %q", subscriber.messages[0].Trace, want)
+	}
+	if sent.TraceState != "rojo=00f067aa0ba902b7" || subscriber.messages[0].TraceState != sent.TraceState {
+		t.Errorf("got tracestate %q, delivered %q, want the message's", sent.TraceState, subscriber.messages[0].TraceState)
+	}
+	failed := spans[1]
+	if failed.ParentSpanID != "" || failed.TraceID == sent.TraceID {
+		t.Errorf("got span %+v, want a root of a new trace", failed)
+	}
+	if failed.Status == nil || failed.Status.Code != 2 {
+		t.Errorf("got status %+v, want error", failed.Status)
+	}
+
+	for k, v := range map[string]string{"service.name": "tarpon", "service.version": "1.2.3", "service.instance.id": "node-1", "deployment.environment": "test", "telemetry.sdk.language": "go"} {
+		if collector.resource[k] != v {
+			t.Errorf("got resource attribute %s %q, want %q", k, collector.resource[k], v)
+		}
+	}
+	if got := collector.headers.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("got authorization %q, want the configured header", got)
+	}
+}
@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/config"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+)
+
+const (
+	SignatureHeader = "X-Tarpon-Signature"
+	EventHeader     = "X-Tarpon-Event"
+	maxBackoff      = 30 * time.Second
+)
+
+type delivery struct {
+	url  string
+	body []byte
+	typ  events.Type
+}
+
+// Dispatcher delivers lifecycle events to configured URLs as signed HTTP POST
+// requests. Events are queued in a bounded queue and delivered by a pool of
+// workers, failed deliveries are retried with exponential backoff.
+type Dispatcher struct {
+	urls       []string
+	secret     []byte
+	targets    sync.RWMutex
+	workers    int
+	maxRetries int
+	backoff    time.Duration
+	client     *http.Client
+	queue      chan delivery
+	stopChan   chan struct{}
+	wg         sync.WaitGroup
+	logger     logging.Logger
+}
+
+func NewDispatcher(cfg *config.Webhooks, l logging.Logger) *Dispatcher {
+	return &Dispatcher{
+		urls:       cfg.URLs,
+		secret:     []byte(cfg.Secret),
+		workers:    cfg.Workers,
+		maxRetries: cfg.MaxRetries,
+		backoff:    cfg.RetryBackoff,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		queue:      make(chan delivery, cfg.QueueSize),
+		stopChan:   make(chan struct{}),
+		logger:     l,
+	}
+}
+
+// Start starts delivery workers.
+func (d *Dispatcher) Start() {
+	workers := d.workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	d.logger.Info("webhooks enabled", logging.Fields{"urls": d.urls, "workers": workers})
+}
+
+// SetTargets changes the URLs events are delivered to and the key they are signed
+// with. Queued webhooks are delivered to the URLs they were queued for.
+func (d *Dispatcher) SetTargets(urls []string, secret string) {
+	d.targets.Lock()
+	defer d.targets.Unlock()
+	d.urls = urls
+	d.secret = []byte(secret)
+	d.logger.Info("webhook targets changed", logging.Fields{"urls": urls})
+}
+
+// Stop stops delivery workers. Queued webhooks are discarded and pending retries are abandoned.
+func (d *Dispatcher) Stop() {
+	close(d.stopChan)
+	d.wg.Wait()
+}
+
+// Notify queues the event for delivery to every URL. It never blocks, events
+// are dropped when the queue is full.
+func (d *Dispatcher) Notify(e events.Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		d.logger.Error("can't marshal webhook event", logging.Fields{"event": e, "error": err})
+		return
+	}
+	d.targets.RLock()
+	urls := d.urls
+	d.targets.RUnlock()
+	for _, url := range urls {
+		select {
+		case d.queue <- delivery{url: url, body: body, typ: e.Type}:
+		default:
+			d.logger.Warn("webhook dropped, queue is full", logging.Fields{"url": url, "event": e.Type, "room": e.Room, "queue_length": len(d.queue)})
+		}
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case w := <-d.queue:
+			d.deliver(w)
+		case <-d.stopChan:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(w delivery) {
+	backoff := d.backoff
+	for attempt := 0; ; attempt++ {
+		err := d.post(w)
+		if err == nil {
+			d.logger.Debug("webhook delivered", logging.Fields{"url": w.url, "event": w.typ, "attempt": attempt})
+			return
+		}
+		if attempt >= d.maxRetries {
+			d.logger.Error("webhook delivery failed, giving up", logging.Fields{"url": w.url, "event": w.typ, "attempt": attempt, "error": err})
+			return
+		}
+		d.logger.Warn("webhook delivery failed, retrying", logging.Fields{"url": w.url, "event": w.typ, "attempt": attempt, "backoff": backoff, "error": err})
+
+		select {
+		case <-time.After(backoff):
+		case <-d.stopChan:
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (d *Dispatcher) post(w delivery) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(w.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(w.typ))
+	d.targets.RLock()
+	secret := d.secret
+	d.targets.RUnlock()
+	req.Header.Set(SignatureHeader, Sign(secret, w.body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", res.Status)
+	}
+	return nil
+}
+
+// Sign returns the value of the signature header for the given body. Receivers
+// should compute it with the shared secret and compare with the received one.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,175 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montrosesoftware/tarpon/pkg/config"
+	"github.com/montrosesoftware/tarpon/pkg/events"
+	"github.com/montrosesoftware/tarpon/pkg/logging"
+	"github.com/montrosesoftware/tarpon/pkg/webhook"
+)
+
+var (
+	myRoom   = "room-123"
+	myPeer   = "peer-abc"
+	mySecret = "webhook-secret"
+)
+
+type SpyReceiver struct {
+	events   []events.Event
+	failures int
+	mutex    sync.Mutex
+	t        *testing.T
+}
+
+func (s *SpyReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.t.Errorf("could not read webhook body: %v", err)
+		return
+	}
+	if got, want := r.Header.Get(webhook.SignatureHeader), webhook.Sign([]byte(mySecret), body); got != want {
+		s.t.Errorf("got signature %q, want %q", got, want)
+	}
+	var e events.Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		s.t.Errorf("could not decode webhook body: %v", err)
+		return
+	}
+	if got := r.Header.Get(webhook.EventHeader); got != string(e.Type) {
+		s.t.Errorf("got event header %q, want %q", got, e.Type)
+	}
+	s.events = append(s.events, e)
+}
+
+func (s *SpyReceiver) waitForEvents(t *testing.T, want []events.Type) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		n := len(s.events)
+		s.mutex.Unlock()
+		if n >= len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.events) != len(want) {
+		t.Fatalf("got %d events %v, but want %v", len(s.events), s.events, want)
+	}
+	for i, e := range s.events {
+		if e.Type != want[i] || e.Room != myRoom {
+			t.Errorf("at index %d got event %+v, but want %q in room %q", i, e, want[i], myRoom)
+		}
+	}
+}
+
+func newConfig(url string) *config.Webhooks {
+	return &config.Webhooks{
+		URLs:         []string{url},
+		Secret:       mySecret,
+		QueueSize:    16,
+		Workers:      1,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+		Timeout:      time.Second,
+	}
+}
+
+func TestDeliverSignedEvents(t *testing.T) {
+	receiver := &SpyReceiver{t: t}
+	s := httptest.NewServer(receiver)
+	defer s.Close()
+
+	d := webhook.NewDispatcher(newConfig(s.URL), logging.NoopLogger{})
+	d.Start()
+	defer d.Stop()
+
+	d.Notify(events.New(events.PeerConnected, myRoom, myPeer))
+	d.Notify(events.New(events.PeerConnected, myRoom, "another-peer"))
+	d.Notify(events.New(events.PeerDisconnected, myRoom, myPeer))
+	d.Notify(events.New(events.PeerDisconnected, myRoom, "another-peer"))
+
+	receiver.waitForEvents(t, []events.Type{
+		events.PeerConnected,
+		events.PeerConnected,
+		events.PeerDisconnected,
+		events.PeerDisconnected,
+	})
+}
+
+func TestChangeTargets(t *testing.T) {
+	receiver := &SpyReceiver{t: t}
+	s := httptest.NewServer(receiver)
+	defer s.Close()
+
+	cfg := newConfig(s.URL)
+	cfg.URLs = nil
+	cfg.Secret = ""
+	d := webhook.NewDispatcher(cfg, logging.NoopLogger{})
+	d.Start()
+	defer d.Stop()
+
+	d.Notify(events.New(events.PeerConnected, myRoom, myPeer))
+	d.SetTargets([]string{s.URL}, mySecret)
+	d.Notify(events.New(events.RoomCreated, myRoom, ""))
+
+	receiver.waitForEvents(t, []events.Type{events.RoomCreated})
+}
+
+func TestRetryFailedDeliveries(t *testing.T) {
+	receiver := &SpyReceiver{t: t, failures: 2}
+	s := httptest.NewServer(receiver)
+	defer s.Close()
+
+	d := webhook.NewDispatcher(newConfig(s.URL), logging.NoopLogger{})
+	d.Start()
+	defer d.Stop()
+
+	d.Notify(events.New(events.RoomCreated, myRoom, ""))
+
+	receiver.waitForEvents(t, []events.Type{events.RoomCreated})
+}
+
+func TestGiveUpAfterMaxRetries(t *testing.T) {
+	receiver := &SpyReceiver{t: t, failures: 4}
+	s := httptest.NewServer(receiver)
+	defer s.Close()
+
+	d := webhook.NewDispatcher(newConfig(s.URL), logging.NoopLogger{})
+	d.Start()
+	defer d.Stop()
+
+	d.Notify(events.New(events.RoomCreated, myRoom, ""))
+	d.Notify(events.New(events.PeerRegistered, myRoom, myPeer))
+
+	receiver.waitForEvents(t, []events.Type{events.PeerRegistered})
+}
+
+// this test times out when notifying blocks
+func TestNotifyNeverBlocks(t *testing.T) {
+	// the dispatcher is not started, so the queue gets full
+	d := webhook.NewDispatcher(newConfig("http://127.0.0.1:1"), logging.NoopLogger{})
+
+	for i := 0; i < 1000; i++ {
+		d.Notify(events.New(events.PeerRegistered, myRoom, myPeer))
+	}
+}